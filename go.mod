@@ -13,6 +13,7 @@ require (
 	github.com/hashicorp/consul/api v1.1.0 // indirect
 	github.com/hashicorp/go-hclog v0.9.2
 	github.com/hashicorp/go-immutable-radix v1.1.0 // indirect
+	github.com/hashicorp/go-multierror v1.0.0
 	github.com/hashicorp/go-uuid v1.0.1
 	github.com/hashicorp/go-version v1.2.0 // indirect
 	github.com/hashicorp/nomad v0.9.3
@@ -22,7 +23,7 @@ require (
 	github.com/mitchellh/hashstructure v1.0.0 // indirect
 	github.com/shirou/gopsutil v2.18.12+incompatible // indirect
 	github.com/shirou/w32 v0.0.0-20160930032740-bb4de0191aa4 // indirect
-	github.com/ugorji/go v0.0.0-20170620060102-0053ebfd9d0e // indirect
+	github.com/ugorji/go v0.0.0-20170620060102-0053ebfd9d0e
 	github.com/zclconf/go-cty v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20190611184440-5c40567a22f8 // indirect
 	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980 // indirect
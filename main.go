@@ -1,6 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/plugins"
 
@@ -8,6 +14,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(render(os.Args[2:]))
+	}
+
+	validate := flag.String("validate", "", "validate the task config in the JSON `file` and print the generated files, without starting anything")
+	flag.Parse()
+
+	if *validate != "" {
+		os.Exit(validateTaskConfig(*validate))
+	}
+
 	// Serve the plugin
 	plugins.Serve(factory)
 }
@@ -16,3 +33,75 @@ func main() {
 func factory(log log.Logger) interface{} {
 	return systemd.NewSystemdNSpawnDriver(log)
 }
+
+// renderTaskConfig decodes, validates and renders the task config in the
+// file, which is the Config of a task as in `nomad job run -output`. Errors
+// are printed.
+func renderTaskConfig(path, machineName string) (*systemd.Rendered, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	c, err := systemd.DecodeTaskConfig(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return nil, false
+	}
+	r, err := systemd.Render(c, machineName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid driver config: %v\n", path, err)
+		return nil, false
+	}
+	return r, true
+}
+
+// validateTaskConfig validates the task config in the file and prints the
+// generated files. It returns the exit code.
+func validateTaskConfig(path string) int {
+	r, ok := renderTaskConfig(path, "nomad-task")
+	if !ok {
+		return 1
+	}
+
+	fmt.Printf("%s: valid\n", path)
+	if len(r.Args) > 0 {
+		fmt.Printf("\n%s\n", strings.Join(r.Args, " \\\n  "))
+		return 0
+	}
+	fmt.Printf("\n%s", r.NSpawnFile)
+	if r.DropIn != "" {
+		fmt.Printf("\n%s", r.DropIn)
+	}
+	return 0
+}
+
+// render implements the render command, which prints the nspawn file and
+// the unit properties generated for a task config. It returns the exit code.
+func render(args []string) int {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	config := flags.String("config", "", "the task config in the JSON `file`")
+	machineName := flags.String("machine", "nomad-task", "the `name` of the machine")
+	flags.Parse(args)
+	if *config == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: nomad-driver-systemd-nspawn render -config task.json [-machine name]")
+		return 2
+	}
+
+	r, ok := renderTaskConfig(*config, *machineName)
+	if !ok {
+		return 1
+	}
+	if len(r.Properties) > 0 {
+		fmt.Printf("# transient unit %s\n", r.Unit)
+		for _, p := range r.Properties {
+			fmt.Println(p)
+		}
+		return 0
+	}
+	fmt.Printf("# %s.nspawn\n%s", *machineName, r.NSpawnFile)
+	if r.DropIn != "" {
+		fmt.Printf("\n# drop-in of %s\n%s", r.Unit, r.DropIn)
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// addressPollInterval is the interval between polls of the machine's
+// addresses.
+//
+// machined doesn't signal address changes, they are only known by asking for
+// them.
+var addressPollInterval = 10 * time.Second
+
+// watchAddresses polls the addresses of the machine and emits a task event
+// whenever they change, e.g. after DHCP renewals or interface flaps.
+//
+// Nomad doesn't allow drivers to update the DriverNetwork of a running task,
+// so services keep being registered with the address from the start of the
+// task; the event tells operators why they may be stale.
+func (h *taskHandle) watchAddresses(ctx context.Context) {
+	ticker := time.NewTicker(addressPollInterval)
+	defer ticker.Stop()
+
+	var last []string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.doneCh:
+			return
+		case <-ticker.C:
+		}
+
+		ips, err := h.driver.GetMachineAddresses(h.machineName)
+		if err != nil {
+			h.logger.Debug("failed to get machine addresses", "error", err)
+			continue
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		sort.Strings(addrs)
+
+		if last != nil {
+			added, removed := diffAddresses(last, addrs)
+			if len(added) > 0 || len(removed) > 0 {
+				h.emitAddressEvent(added, removed)
+			}
+		}
+		last = addrs
+	}
+}
+
+// emitAddressEvent emits a task event about changed addresses.
+func (h *taskHandle) emitAddressEvent(added, removed []string) {
+	var changes []string
+	if len(added) > 0 {
+		changes = append(changes, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "removed "+strings.Join(removed, ", "))
+	}
+
+	h.logger.Info("machine addresses changed", "added", added, "removed", removed)
+	h.driver.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    h.taskConfig.ID,
+		TaskName:  h.taskConfig.Name,
+		AllocID:   h.taskConfig.AllocID,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("machine addresses changed: %s", strings.Join(changes, "; ")),
+		Annotations: map[string]string{
+			"added":   strings.Join(added, ","),
+			"removed": strings.Join(removed, ","),
+		},
+	})
+}
+
+// diffAddresses returns the addresses only in new and only in old.
+func diffAddresses(old, new []string) (added, removed []string) {
+	seen := make(map[string]bool, len(old))
+	for _, a := range old {
+		seen[a] = true
+	}
+	for _, a := range new {
+		if !seen[a] {
+			added = append(added, a)
+		}
+		delete(seen, a)
+	}
+	for _, a := range old {
+		if seen[a] {
+			removed = append(removed, a)
+			delete(seen, a)
+		}
+	}
+	return
+}
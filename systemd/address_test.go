@@ -0,0 +1,25 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffAddresses(t *testing.T) {
+	cases := []struct {
+		old, new       []string
+		added, removed []string
+	}{
+		{[]string{"10.0.0.2"}, []string{"10.0.0.2"}, nil, nil},
+		{[]string{"10.0.0.2"}, []string{"10.0.0.3"}, []string{"10.0.0.3"}, []string{"10.0.0.2"}},
+		{[]string{"10.0.0.2"}, []string{"10.0.0.2", "fe80::1"}, []string{"fe80::1"}, nil},
+		{[]string{"10.0.0.2", "fe80::1"}, []string{}, nil, []string{"10.0.0.2", "fe80::1"}},
+		{[]string{"10.0.0.2", "10.0.0.2"}, []string{}, nil, []string{"10.0.0.2"}},
+	}
+	for _, c := range cases {
+		added, removed := diffAddresses(c.old, c.new)
+		if !reflect.DeepEqual(added, c.added) || !reflect.DeepEqual(removed, c.removed) {
+			t.Errorf("%v -> %v: expected +%v -%v, got +%v -%v", c.old, c.new, c.added, c.removed, added, removed)
+		}
+	}
+}
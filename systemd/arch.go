@@ -0,0 +1,122 @@
+package systemd
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// hostMachine returns the machine hardware name of the host as printed by
+// uname -m, e.g. "x86_64" or "aarch64".
+var hostMachine = func() string {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range u.Machine {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String()
+}
+
+// machinePersonalities maps machine hardware names to the personalities
+// nspawn supports on them, native first.
+var machinePersonalities = map[string][]string{
+	"x86_64":  {"x86-64", "x86"},
+	"i386":    {"x86"},
+	"i486":    {"x86"},
+	"i586":    {"x86"},
+	"i686":    {"x86"},
+	"aarch64": {"arm64", "arm"},
+	"s390x":   {"s390x", "s390"},
+	"ppc64":   {"ppc64", "ppc"},
+	"ppc64le": {"ppc64-le"},
+}
+
+// supportedPersonalities returns the personalities supported on the host.
+func supportedPersonalities() []string {
+	return machinePersonalities[hostMachine()]
+}
+
+// validatePersonality checks Personality against the host's architecture, so
+// e.g. x86 containers are refused on arm64 hosts instead of failing to exec
+// their init. Nothing is checked on unknown architectures.
+func (c *TaskConfig) validatePersonality() error {
+	if c.Personality == "" {
+		return nil
+	}
+	machine := hostMachine()
+	personalities, ok := machinePersonalities[machine]
+	if !ok {
+		return nil
+	}
+	for _, p := range personalities {
+		if p == c.Personality {
+			return nil
+		}
+	}
+	return fmt.Errorf("personality %q is not supported on %s hosts, supported: %s",
+		c.Personality, machine, strings.Join(personalities, ", "))
+}
+
+// archMachines maps architecture names as used by Go and OCI registries to
+// the machine hardware names printed by uname -m.
+var archMachines = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i686",
+	"arm64":   "aarch64",
+	"arm":     "armv7l",
+	"s390x":   "s390x",
+	"ppc64":   "ppc64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+}
+
+// hostArch returns the architecture name of the host, which falls back to
+// the architecture of the driver's binary if uname -m is unknown.
+func hostArch() string {
+	machine := hostMachine()
+	if len(machine) == 4 && machine[0] == 'i' && strings.HasSuffix(machine, "86") {
+		return "386"
+	}
+	for arch, m := range archMachines {
+		if m == machine {
+			return arch
+		}
+	}
+	return runtime.GOARCH
+}
+
+// validateArch applies Arch to the image, whose URL may contain "{arch}"
+// (e.g. "arm64") and "{machine}" (e.g. "aarch64"), and picks the digest of
+// the architecture from ImageDigests.
+func (c *TaskConfig) validateArch() error {
+	arch := c.Arch
+	if arch == "" {
+		arch = hostArch()
+	} else if _, ok := archMachines[arch]; !ok {
+		return fmt.Errorf("invalid arch %q", arch)
+	}
+
+	if len(c.ImageDigests) > 0 {
+		if c.Image == "" {
+			return fmt.Errorf("image_digests requires image to be set")
+		}
+		if strings.Contains(c.Image, "@sha256:") {
+			return fmt.Errorf("image must not be pinned by digest if image_digests is set")
+		}
+		digest, ok := c.ImageDigests[arch]
+		if !ok {
+			return fmt.Errorf("image_digests has no digest for arch %q", arch)
+		}
+		c.Image += "@" + digest
+	}
+
+	c.Image = strings.NewReplacer("{arch}", arch, "{machine}", archMachines[arch]).Replace(c.Image)
+	return nil
+}
@@ -0,0 +1,102 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePersonality(t *testing.T) {
+	defer func(f func() string) { hostMachine = f }(hostMachine)
+
+	cases := []struct {
+		machine     string
+		personality string
+		valid       bool
+	}{
+		{"x86_64", "", true},
+		{"x86_64", "x86", true},
+		{"x86_64", "x86-64", true},
+		{"i686", "x86", true},
+		{"i686", "x86-64", false},
+		{"aarch64", "x86", false},
+		{"aarch64", "x86-64", false},
+		{"aarch64", "arm64", true},
+		{"riscv64", "x86", true},
+	}
+	for _, c := range cases {
+		hostMachine = func() string { return c.machine }
+		cfg := TaskConfig{Personality: c.personality}
+		if err := cfg.validatePersonality(); (err == nil) != c.valid {
+			t.Errorf("%s on %s: expected valid %v, got %v", c.personality, c.machine, c.valid, err)
+		}
+	}
+}
+
+func TestHostMachine(t *testing.T) {
+	if m := hostMachine(); m == "" {
+		t.Error("expected host machine name")
+	}
+}
+
+func TestHostArch(t *testing.T) {
+	defer func(f func() string) { hostMachine = f }(hostMachine)
+
+	for machine, arch := range map[string]string{
+		"x86_64":  "amd64",
+		"i586":    "386",
+		"aarch64": "arm64",
+		"ppc64le": "ppc64le",
+	} {
+		hostMachine = func() string { return machine }
+		if got := hostArch(); got != arch {
+			t.Errorf("%s: expected %s, got %s", machine, arch, got)
+		}
+	}
+}
+
+func TestValidateArch(t *testing.T) {
+	defer func(f func() string) { hostMachine = f }(hostMachine)
+	hostMachine = func() string { return "aarch64" }
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := []struct {
+		config TaskConfig
+		image  string
+	}{
+		{
+			TaskConfig{Image: "https://example.com/web-{arch}.raw"},
+			"https://example.com/web-arm64.raw",
+		},
+		{
+			TaskConfig{Image: "https://example.com/{machine}/web.raw", Arch: "amd64"},
+			"https://example.com/x86_64/web.raw",
+		},
+		{
+			TaskConfig{
+				Image:        "https://example.com/web-{arch}.raw",
+				ImageDigests: map[string]string{"amd64": "sha256:other", "arm64": digest},
+			},
+			"https://example.com/web-arm64.raw@" + digest,
+		},
+	}
+	for _, c := range cases {
+		if err := c.config.validateArch(); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.image, err)
+			continue
+		}
+		if c.config.Image != c.image {
+			t.Errorf("expected %s, got %s", c.image, c.config.Image)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{Image: "https://example.com/web.raw", Arch: "x86_64"},
+		{Image: "https://example.com/web.raw", ImageDigests: map[string]string{"amd64": digest}},
+		{Image: "https://example.com/web.raw@" + digest, ImageDigests: map[string]string{"arm64": digest}},
+		{DiskImage: "/srv/web.raw", ImageDigests: map[string]string{"arm64": digest}},
+	} {
+		if err := c.validateArch(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
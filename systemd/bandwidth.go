@@ -0,0 +1,98 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// NetworkBandwidth limits the bandwidth of the container with tc on the
+// host-side veth interface, so a single container can't saturate the
+// node's uplink.
+//
+// The queueing disciplines are removed together with the interface.
+type NetworkBandwidth struct {
+	// IngressMbps is the bandwidth of traffic to the container in Mbit/s,
+	// which is shaped. Unlimited if 0.
+	IngressMbps int `codec:"ingress_mbps"`
+	// EgressMbps is the bandwidth of traffic from the container in Mbit/s,
+	// which is policed, i.e. exceeding packets are dropped. Unlimited if 0.
+	EgressMbps int `codec:"egress_mbps"`
+}
+
+// enabled returns whether the bandwidth is limited.
+func (b NetworkBandwidth) enabled() bool {
+	return b.IngressMbps > 0 || b.EgressMbps > 0
+}
+
+func (b NetworkBandwidth) validate(c *TaskConfig) error {
+	if b.IngressMbps < 0 || b.EgressMbps < 0 {
+		return fmt.Errorf("network_bandwidth must not be negative")
+	}
+	if !b.enabled() {
+		return nil
+	}
+	if !c.VirtualEthernet && c.Bridge == "" && c.Zone == "" {
+		return fmt.Errorf("network_bandwidth requires virtual_ethernet, bridge or zone")
+	}
+	if !c.Register {
+		return fmt.Errorf("network_bandwidth requires the machine to be registered")
+	}
+	return nil
+}
+
+// bandwidthBurst returns the burst of the limit in bytes, which is the
+// traffic of 10ms but at least 32KiB so full sized packets always fit.
+func bandwidthBurst(mbps int) int {
+	burst := mbps * 1000 * 1000 / 8 / 100
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return burst
+}
+
+// bandwidthCommands returns the tc commands limiting the bandwidth on the
+// host-side interface, whose egress is the container's ingress and vice
+// versa.
+func bandwidthCommands(iface string, b NetworkBandwidth) [][]string {
+	var cmds [][]string
+	if b.IngressMbps > 0 {
+		cmds = append(cmds, []string{"tc", "qdisc", "replace", "dev", iface, "root", "tbf",
+			"rate", fmt.Sprintf("%dmbit", b.IngressMbps),
+			"burst", fmt.Sprintf("%d", bandwidthBurst(b.IngressMbps)),
+			"latency", "50ms"})
+	}
+	if b.EgressMbps > 0 {
+		cmds = append(cmds,
+			[]string{"tc", "qdisc", "replace", "dev", iface, "handle", "ffff:", "ingress"},
+			[]string{"tc", "filter", "replace", "dev", iface, "parent", "ffff:", "matchall",
+				"action", "police",
+				"rate", fmt.Sprintf("%dmbit", b.EgressMbps),
+				"burst", fmt.Sprintf("%d", bandwidthBurst(b.EgressMbps)),
+				"conform-exceed", "drop"})
+	}
+	return cmds
+}
+
+// setupBandwidth limits the bandwidth of the machine's host-side veth
+// interface if network_bandwidth is set.
+func (d *Driver) setupBandwidth(m *Machine, b NetworkBandwidth) error {
+	if !b.enabled() {
+		return nil
+	}
+	if len(m.NetworkInterfaces) == 0 {
+		return fmt.Errorf("machine %s has no network interface", m.Name)
+	}
+
+	iface, err := net.InterfaceByIndex(m.NetworkInterfaces[0])
+	if err != nil {
+		return err
+	}
+	for _, cmd := range bandwidthCommands(iface.Name, b) {
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("tc: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
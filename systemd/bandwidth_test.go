@@ -0,0 +1,44 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateNetworkBandwidth(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{VirtualEthernet: true, Register: true, NetworkBandwidth: NetworkBandwidth{IngressMbps: 100}},
+		{Zone: "web", Register: true, NetworkBandwidth: NetworkBandwidth{EgressMbps: 10}},
+	} {
+		if err := c.NetworkBandwidth.validate(&c); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{VirtualEthernet: true, Register: true, NetworkBandwidth: NetworkBandwidth{IngressMbps: -1}},
+		{Register: true, NetworkBandwidth: NetworkBandwidth{IngressMbps: 100}},
+		{VirtualEthernet: true, NetworkBandwidth: NetworkBandwidth{EgressMbps: 100}},
+	} {
+		if err := c.NetworkBandwidth.validate(&c); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestBandwidthCommands(t *testing.T) {
+	cmds := bandwidthCommands("ve-web", NetworkBandwidth{IngressMbps: 100, EgressMbps: 1})
+	expected := [][]string{
+		{"tc", "qdisc", "replace", "dev", "ve-web", "root", "tbf", "rate", "100mbit", "burst", "125000", "latency", "50ms"},
+		{"tc", "qdisc", "replace", "dev", "ve-web", "handle", "ffff:", "ingress"},
+		{"tc", "filter", "replace", "dev", "ve-web", "parent", "ffff:", "matchall",
+			"action", "police", "rate", "1mbit", "burst", "32768", "conform-exceed", "drop"},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v, got %v", expected, cmds)
+	}
+
+	if cmds := bandwidthCommands("ve-web", NetworkBandwidth{}); len(cmds) != 0 {
+		t.Errorf("unexpected commands %v", cmds)
+	}
+}
@@ -0,0 +1,157 @@
+package systemd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultBootstrapTimeout is the time a bootstrap may run if it has no
+// timeout.
+const defaultBootstrapTimeout = 30 * time.Minute
+
+// bootstrapTools are the tools on the host which bootstrap the distros.
+var bootstrapTools = map[string]string{
+	"debian": "debootstrap",
+	"ubuntu": "debootstrap",
+	"fedora": "dnf",
+	"arch":   "pacstrap",
+}
+
+// bootstrapNameRegexp matches valid releases and package names, which must
+// not be mistaken for options of the tools.
+var bootstrapNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_:-]*$`)
+
+// Bootstrap creates the image of the machine with the distro's bootstrap tool
+// on the host, e.g. debootstrap, so simple jobs need no image hosting.
+//
+// The result is cached by the hash of the options, so it's bootstrapped once
+// per node for all machines using the same options.
+type Bootstrap struct {
+	// Distro is one of "debian", "ubuntu", "fedora" and "arch".
+	Distro string `codec:"distro"`
+	// Release is the release of the distro, e.g. "bookworm" or "40". Arch
+	// has no releases.
+	Release string `codec:"release"`
+	// Packages are installed in addition to the distro's base system.
+	Packages []string `codec:"packages"`
+	// Timeout is the time the bootstrap may run before it fails, defaults
+	// to 30m.
+	Timeout string `codec:"timeout"`
+}
+
+func (c *TaskConfig) validateBootstrap() error {
+	b := c.Bootstrap
+	if b.Distro == "" {
+		if b.Release != "" || len(b.Packages) > 0 || b.Timeout != "" {
+			return fmt.Errorf("bootstrap requires distro")
+		}
+		return nil
+	}
+
+	if _, ok := bootstrapTools[b.Distro]; !ok {
+		return fmt.Errorf("invalid bootstrap distro %q", b.Distro)
+	}
+	if b.Distro == "arch" {
+		if b.Release != "" {
+			return fmt.Errorf("bootstrap distro %q has no releases", b.Distro)
+		}
+	} else if !bootstrapNameRegexp.MatchString(b.Release) {
+		return fmt.Errorf("invalid bootstrap release %q", b.Release)
+	}
+	for _, p := range b.Packages {
+		if !bootstrapNameRegexp.MatchString(p) {
+			return fmt.Errorf("invalid bootstrap package %q", p)
+		}
+	}
+	if b.Timeout != "" {
+		t, err := time.ParseDuration(b.Timeout)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid bootstrap timeout %q", b.Timeout)
+		}
+	}
+	if c.RootLocation == rootLocationAlloc {
+		return fmt.Errorf("bootstrap is not supported with root_location %q", rootLocationAlloc)
+	}
+	return nil
+}
+
+// timeout returns the time the bootstrap may run.
+func (b Bootstrap) timeout() time.Duration {
+	if t, err := time.ParseDuration(b.Timeout); err == nil && t > 0 {
+		return t
+	}
+	return defaultBootstrapTimeout
+}
+
+// cacheName returns the local name of the bootstrapped image, which doesn't
+// depend on the order of packages.
+func (b Bootstrap) cacheName() string {
+	packages := append([]string(nil), b.Packages...)
+	sort.Strings(packages)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "bootstrap\x00%s\x00%s\x00", b.Distro, b.Release)
+	for _, p := range packages {
+		fmt.Fprintf(h, "%s\x00", p)
+	}
+	// Image names are limited to 64 characters.
+	return imageBuildPrefix + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// bootstrapCommand returns the command line bootstrapping the distro into
+// the directory.
+func bootstrapCommand(b Bootstrap, dir string) []string {
+	tool := bootstrapTools[b.Distro]
+	switch tool {
+	case "debootstrap":
+		args := []string{tool}
+		if len(b.Packages) > 0 {
+			args = append(args, "--include="+strings.Join(b.Packages, ","))
+		}
+		return append(args, b.Release, dir)
+	case "dnf":
+		args := []string{tool, "--assumeyes", "--releasever=" + b.Release, "--installroot=" + dir,
+			"--setopt=install_weak_deps=False", "install", "fedora-release", "systemd", "passwd", "dnf"}
+		return append(args, b.Packages...)
+	default:
+		args := []string{tool, "-c", dir, "base"}
+		return append(args, b.Packages...)
+	}
+}
+
+// prepareBootstrapImage makes the bootstrapped image the image of machine,
+// bootstrapping it unless it's cached already.
+func (d *Driver) prepareBootstrapImage(b Bootstrap, machineName string) error {
+	name := b.cacheName()
+	err := d.buildCachedImage(name, func(tmp string) error {
+		if err := d.checkFreeSpace(0); err != nil {
+			return err
+		}
+		dir := filepath.Join(machinesPool, tmp)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		d.logger.Info("bootstrapping image", "distro", b.Distro, "release", b.Release, "name", name)
+		hook := Hook{Command: bootstrapCommand(b, dir), Timeout: b.timeout().String()}
+		if err := runHook(d.ctx, hook, os.Environ()); err != nil {
+			return fmt.Errorf("bootstrap failed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.checkFreeSpace(0); err != nil {
+		return err
+	}
+	return cloneImage(d.ctx, name, machineName)
+}
@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateBootstrap(t *testing.T) {
+	cases := []struct {
+		c     TaskConfig
+		valid bool
+	}{
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "bookworm"}}, true},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "ubuntu", Release: "noble", Packages: []string{"nginx", "libstdc++6"}}}, true},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "fedora", Release: "40", Timeout: "1h"}}, true},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "arch", Packages: []string{"nginx"}}}, true},
+		{TaskConfig{Bootstrap: Bootstrap{Release: "bookworm"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "gentoo", Release: "latest"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "--foreign"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "arch", Release: "2024.01.01"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "bookworm", Packages: []string{"a,b"}}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "bookworm", Timeout: "soon"}}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "bookworm"}, RootLocation: rootLocationAlloc}, false},
+		{TaskConfig{Bootstrap: Bootstrap{Distro: "debian", Release: "bookworm"}, Image: "https://example.com/web.raw"}, false},
+	}
+	for _, c := range cases {
+		err := c.c.validateImage()
+		if err == nil {
+			err = c.c.validateBootstrap()
+		}
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.c.Bootstrap, c.valid, err)
+		}
+	}
+}
+
+func TestBootstrapCacheName(t *testing.T) {
+	b := Bootstrap{Distro: "debian", Release: "bookworm", Packages: []string{"nginx", "curl"}}
+	name := b.cacheName()
+	if !strings.HasPrefix(name, imageBuildPrefix) || len(name) > 64 {
+		t.Errorf("invalid name %q", name)
+	}
+	if (Bootstrap{Distro: "debian", Release: "bookworm", Packages: []string{"curl", "nginx"}, Timeout: "1h"}).cacheName() != name {
+		t.Error("expected the order of packages and the timeout not to change the name")
+	}
+	if (Bootstrap{Distro: "debian", Release: "trixie", Packages: b.Packages}).cacheName() == name {
+		t.Error("expected a different release to change the name")
+	}
+	if b.Packages[0] != "nginx" {
+		t.Error("expected packages not to be sorted in place")
+	}
+}
+
+func TestBootstrapCommand(t *testing.T) {
+	cases := []struct {
+		b        Bootstrap
+		expected []string
+	}{
+		{
+			Bootstrap{Distro: "debian", Release: "bookworm"},
+			[]string{"debootstrap", "bookworm", "/var/lib/machines/tmp"},
+		},
+		{
+			Bootstrap{Distro: "ubuntu", Release: "noble", Packages: []string{"nginx", "curl"}},
+			[]string{"debootstrap", "--include=nginx,curl", "noble", "/var/lib/machines/tmp"},
+		},
+		{
+			Bootstrap{Distro: "fedora", Release: "40", Packages: []string{"nginx"}},
+			[]string{"dnf", "--assumeyes", "--releasever=40", "--installroot=/var/lib/machines/tmp",
+				"--setopt=install_weak_deps=False", "install", "fedora-release", "systemd", "passwd", "dnf", "nginx"},
+		},
+		{
+			Bootstrap{Distro: "arch", Packages: []string{"nginx"}},
+			[]string{"pacstrap", "-c", "/var/lib/machines/tmp", "base", "nginx"},
+		},
+	}
+	for _, c := range cases {
+		if args := bootstrapCommand(c.b, "/var/lib/machines/tmp"); !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("%+v: expected %q, got %q", c.b, c.expected, args)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package systemd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// defaultImageBuildTimeout is the time a build command may run if the build
+// has no timeout.
+const defaultImageBuildTimeout = 10 * time.Minute
+
+// Tools of image builds.
+const (
+	imageBuildNSpawn = "nspawn"
+	imageBuildMkosi  = "mkosi"
+)
+
+// imageBuildPrefix is the prefix of images built from recipes, which are
+// shared by all machines using the same recipe.
+const imageBuildPrefix = "nomad-build-"
+
+// ImageBuild builds the image of the machine on the node, either by running
+// commands in a clone of Image, e.g. to install a few packages without an
+// external build pipeline, or with mkosi from a config in the task dir.
+//
+// The result is cached by the hash of the recipe, so it's built once per
+// node for all machines using the same recipe.
+type ImageBuild struct {
+	// Tool is "nspawn" (default) to run Commands in Image, or "mkosi" to
+	// build the image from Config instead of Image.
+	Tool string `codec:"tool"`
+	// Commands are run in order with /bin/sh -c in the image, which is not
+	// booted.
+	Commands []string `codec:"commands"`
+	// Config is the path of the mkosi.conf, or the directory containing
+	// it, in the task dir.
+	Config string `codec:"config"`
+	// Timeout is the time each command may run before the build fails,
+	// defaults to 10m.
+	Timeout string `codec:"timeout"`
+}
+
+func (c *TaskConfig) validateImageBuild() error {
+	b := c.ImageBuild
+	if b.Timeout != "" {
+		t, err := time.ParseDuration(b.Timeout)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid image_build timeout %q", b.Timeout)
+		}
+	}
+	if b.enabled() && c.RootLocation == rootLocationAlloc {
+		return fmt.Errorf("image_build is not supported with root_location %q", rootLocationAlloc)
+	}
+
+	switch b.Tool {
+	case "", imageBuildNSpawn:
+	case imageBuildMkosi:
+		return c.validateMkosiBuild()
+	default:
+		return fmt.Errorf("invalid image_build tool %q", b.Tool)
+	}
+
+	if b.Config != "" {
+		return fmt.Errorf("image_build config requires tool %q", imageBuildMkosi)
+	}
+	if len(b.Commands) == 0 {
+		if b.Tool != "" || b.Timeout != "" {
+			return fmt.Errorf("image_build requires commands")
+		}
+		return nil
+	}
+
+	ref, err := parseImageRef(c.Image)
+	if err != nil {
+		return fmt.Errorf("image_build requires image: %v", err)
+	}
+	// The cached build must not depend on when the image was pulled.
+	if ref.Digest == "" {
+		return fmt.Errorf("image_build requires image to be pinned by digest")
+	}
+	for _, cmd := range b.Commands {
+		if cmd == "" {
+			return fmt.Errorf("invalid image_build command %q", cmd)
+		}
+	}
+	return nil
+}
+
+// enabled returns whether the image of the machine is built.
+func (b ImageBuild) enabled() bool {
+	return len(b.Commands) > 0 || b.Tool == imageBuildMkosi
+}
+
+// timeout returns the time each command may run.
+func (b ImageBuild) timeout() time.Duration {
+	if t, err := time.ParseDuration(b.Timeout); err == nil && t > 0 {
+		return t
+	}
+	return defaultImageBuildTimeout
+}
+
+// cacheName returns the local name of the image built from the base image
+// by the commands.
+func (b ImageBuild) cacheName(ref *imageRef) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", ref.URL, ref.Digest)
+	for _, cmd := range b.Commands {
+		fmt.Fprintf(h, "%s\x00", cmd)
+	}
+	// Image names are limited to 64 characters.
+	return imageBuildPrefix + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// buildCommand returns the command line of nspawn running the build command
+// in the image, which is looked up by its name in the machines pool.
+func buildCommand(image, cmd string) []string {
+	return []string{nspawnBinary, "--quiet", "--register=no", "--machine=" + image, "--", "/bin/sh", "-c", cmd}
+}
+
+// prepareBuiltImage makes the image built from the task's recipe the image
+// of machine, building it unless it's cached already.
+func (d *Driver) prepareBuiltImage(cfg *drivers.TaskConfig, taskConfig TaskConfig, machineName string) error {
+	var name string
+	if taskConfig.ImageBuild.Tool == imageBuildMkosi {
+		dir, err := mkosiConfigDir(filepath.Join(cfg.TaskDir().Dir, taskConfig.ImageBuild.Config))
+		if err != nil {
+			return err
+		}
+		if name, err = d.buildMkosiImage(dir, taskConfig.ImageBuild); err != nil {
+			return err
+		}
+	} else {
+		ref, err := parseImageRef(taskConfig.Image)
+		if err != nil {
+			return err
+		}
+		if name, err = d.buildImage(ref, taskConfig.ImageBuild); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkFreeSpace(0); err != nil {
+		return err
+	}
+	return cloneImage(d.ctx, name, machineName)
+}
+
+// buildImage builds the image unless it's cached already, and returns its
+// local name.
+func (d *Driver) buildImage(ref *imageRef, build ImageBuild) (string, error) {
+	base, err := d.cacheImage(ref)
+	if err != nil {
+		return "", err
+	}
+	name := build.cacheName(ref)
+
+	return name, d.buildCachedImage(name, func(tmp string) error {
+		if err := cloneImage(d.ctx, base, tmp); err != nil {
+			return err
+		}
+		d.logger.Info("building image", "base", base, "name", name, "commands", len(build.Commands))
+		for i, cmd := range build.Commands {
+			hook := Hook{Command: buildCommand(tmp, cmd), Timeout: build.timeout().String()}
+			if err := runHook(d.ctx, hook, os.Environ()); err != nil {
+				return fmt.Errorf("image_build command %d failed: %v", i+1, err)
+			}
+		}
+		return nil
+	})
+}
+
+// buildCachedImage builds the image unless it's cached already.
+//
+// build creates the image under the given temporary name, which is renamed
+// to name once it succeeded, so failed or interrupted builds are never used.
+func (d *Driver) buildCachedImage(name string, build func(tmp string) error) error {
+	d.imageLock.Lock()
+	defer d.imageLock.Unlock()
+
+	ok, err := imageExists(d.ctx, name)
+	if err != nil || ok {
+		return err
+	}
+
+	tmp := name + "-tmp"
+	if err := removeImage(d.ctx, tmp); err != nil {
+		return fmt.Errorf("failed to remove stale build %s: %v", tmp, err)
+	}
+	if err := build(tmp); err != nil {
+		if err := removeImage(d.ctx, tmp); err != nil {
+			d.logger.Warn("failed to remove failed build", "name", tmp, "error", err)
+		}
+		return err
+	}
+	return renameImage(d.ctx, tmp, name)
+}
@@ -0,0 +1,75 @@
+package systemd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateImageBuild(t *testing.T) {
+	pinned := "https://example.com/web.raw@sha256:" + strings.Repeat("0123456789abcdef", 4)
+	cases := []struct {
+		c     TaskConfig
+		valid bool
+	}{
+		{TaskConfig{Image: "https://example.com/web.raw"}, true},
+		{TaskConfig{Image: pinned, ImageBuild: ImageBuild{Commands: []string{"apt-get install -y nginx"}}}, true},
+		{TaskConfig{Image: pinned, ImageBuild: ImageBuild{Commands: []string{"true"}, Timeout: "30m"}}, true},
+		{TaskConfig{Image: pinned, ImageBuild: ImageBuild{Timeout: "30m"}}, false},
+		{TaskConfig{Image: "https://example.com/web.raw", ImageBuild: ImageBuild{Commands: []string{"true"}}}, false},
+		{TaskConfig{DiskImage: "/srv/web.raw", ImageBuild: ImageBuild{Commands: []string{"true"}}}, false},
+		{TaskConfig{Image: pinned, RootLocation: rootLocationAlloc, ImageBuild: ImageBuild{Commands: []string{"true"}}}, false},
+		{TaskConfig{Image: pinned, ImageBuild: ImageBuild{Commands: []string{""}}}, false},
+		{TaskConfig{Image: pinned, ImageBuild: ImageBuild{Commands: []string{"true"}, Timeout: "-1s"}}, false},
+	}
+	for _, c := range cases {
+		if err := c.c.validateImageBuild(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.c, c.valid, err)
+		}
+	}
+}
+
+func TestImageBuildCacheName(t *testing.T) {
+	ref, err := parseImageRef("https://example.com/web.raw@sha256:" + strings.Repeat("0123456789abcdef", 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := ImageBuild{Commands: []string{"apt-get update", "apt-get install -y nginx"}}
+
+	name := b.cacheName(ref)
+	if !strings.HasPrefix(name, imageBuildPrefix) || len(name) > 64 {
+		t.Errorf("invalid name %q", name)
+	}
+	if b.cacheName(ref) != name {
+		t.Error("expected the same name for the same recipe")
+	}
+	if (ImageBuild{Commands: b.Commands, Timeout: "1h"}).cacheName(ref) != name {
+		t.Error("expected the timeout not to change the name")
+	}
+
+	other := ImageBuild{Commands: []string{"apt-get update apt-get", "install -y nginx"}}
+	if other.cacheName(ref) == name {
+		t.Error("expected different commands to change the name")
+	}
+	ref.Digest = "sha256:" + strings.Repeat("fedcba9876543210", 4)
+	if b.cacheName(ref) == name {
+		t.Error("expected a different image to change the name")
+	}
+}
+
+func TestImageBuildTimeout(t *testing.T) {
+	if d := (ImageBuild{}).timeout(); d != defaultImageBuildTimeout {
+		t.Errorf("expected default timeout, got %s", d)
+	}
+	if d := (ImageBuild{Timeout: "30m"}).timeout(); d != 30*time.Minute {
+		t.Errorf("expected 30m, got %s", d)
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	expected := []string{nspawnBinary, "--quiet", "--register=no", "--machine=nomad-build-1", "--", "/bin/sh", "-c", "echo a && echo b"}
+	if args := buildCommand("nomad-build-1", "echo a && echo b"); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
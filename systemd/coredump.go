@@ -0,0 +1,226 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// Modes of coredumps.
+const (
+	coredumpsOff   = "off"
+	coredumpsEvent = "event"
+	coredumpsCopy  = "copy"
+)
+
+// coredumpMessageID is the MESSAGE_ID of journal entries logged by
+// systemd-coredump for every process dumping core.
+const coredumpMessageID = "fc2e22bc6ee647b6b90729ab34a250b1"
+
+// defaultCoredumpMaxSize is the default size limit of copied core dumps.
+const defaultCoredumpMaxSize = 100 << 20
+
+// coredumpPollInterval is the interval between polls of the journal for new
+// core dumps.
+var coredumpPollInterval = 30 * time.Second
+
+func (c *TaskConfig) validateCoredumps() error {
+	switch c.Coredumps {
+	case "", coredumpsOff, coredumpsEvent, coredumpsCopy:
+	default:
+		return fmt.Errorf("invalid coredumps %q", c.Coredumps)
+	}
+
+	c.coredumpMaxSize = defaultCoredumpMaxSize
+	if c.CoredumpMaxSize != "" {
+		size, err := parseBytes(c.CoredumpMaxSize)
+		if err != nil || size == 0 {
+			return fmt.Errorf("invalid coredump_max_size %q", c.CoredumpMaxSize)
+		}
+		c.coredumpMaxSize = size
+	}
+	return nil
+}
+
+// coredump is a core dump of a process of the machine recorded by
+// systemd-coredump.
+type coredump struct {
+	Cursor string
+	PID    string
+	Comm   string
+	Signal string
+	// Filename is the dump in /var/lib/systemd/coredump, empty if it's not
+	// stored externally.
+	Filename string
+}
+
+// parseCoredumps parses the journal entries of core dumps in json output.
+func parseCoredumps(r io.Reader) ([]coredump, error) {
+	var dumps []coredump
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		// Skip hints like "-- No entries --".
+		if !bytes.HasPrefix(s.Bytes(), []byte("{")) {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &fields); err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			v, _ := fields[name].(string)
+			return v
+		}
+		dumps = append(dumps, coredump{
+			Cursor:   field("__CURSOR"),
+			PID:      field("COREDUMP_PID"),
+			Comm:     field("COREDUMP_COMM"),
+			Signal:   field("COREDUMP_SIGNAL_NAME"),
+			Filename: field("COREDUMP_FILENAME"),
+		})
+	}
+	return dumps, s.Err()
+}
+
+// coredumpArgs returns the arguments of journalctl to list the core dumps of
+// the unit after the cursor, or since the given time without one.
+func coredumpArgs(unit, cursor string, since time.Time) []string {
+	args := []string{
+		"MESSAGE_ID=" + coredumpMessageID,
+		"COREDUMP_UNIT=" + unit,
+		"--output", "json",
+		"--no-pager",
+	}
+	if cursor != "" {
+		return append(args, "--after-cursor", cursor)
+	}
+	return append(args, "--since", fmt.Sprintf("@%d", since.Unix()))
+}
+
+// findCoredumps returns the core dumps of the unit after the cursor.
+func findCoredumps(ctx context.Context, unit, cursor string, since time.Time) ([]coredump, error) {
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "journalctl", coredumpArgs(unit, cursor, since)...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("journalctl: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseCoredumps(&stdout)
+}
+
+// watchCoredumps polls the journal for core dumps of processes of the
+// machine, and emits a task event for each of them.
+//
+// The journal is checked a last time once the machine exits, to catch the
+// dump of a crashed init.
+func (h *taskHandle) watchCoredumps(ctx context.Context) {
+	ticker := time.NewTicker(coredumpPollInterval)
+	defer ticker.Stop()
+
+	var cursor string
+	for {
+		exited := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.doneCh:
+			exited = true
+		case <-ticker.C:
+		}
+
+		dumps, err := findCoredumps(ctx, h.unitName, cursor, h.startedAt)
+		if err != nil {
+			h.logger.Warn("failed to find core dumps", "error", err)
+		}
+		for _, dump := range dumps {
+			h.handleCoredump(dump)
+			cursor = dump.Cursor
+		}
+		if exited {
+			return
+		}
+	}
+}
+
+// handleCoredump emits the event of the core dump, and copies it into the
+// alloc's log dir if enabled.
+func (h *taskHandle) handleCoredump(dump coredump) {
+	msg := fmt.Sprintf("process %s (%s) dumped core", dump.PID, dump.Comm)
+	if dump.Signal != "" {
+		msg += " on " + dump.Signal
+	}
+
+	path := dump.Filename
+	if h.coredumps == coredumpsCopy && path != "" {
+		copied, err := h.copyCoredump(path)
+		switch {
+		case err != nil:
+			h.logger.Warn("failed to copy core dump", "path", path, "error", err)
+		case copied != "":
+			path = copied
+		}
+	}
+	if path != "" {
+		msg += ": " + path
+	}
+
+	h.logger.Info("machine process dumped core", "pid", dump.PID, "comm", dump.Comm, "path", path)
+	h.driver.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    h.taskConfig.ID,
+		TaskName:  h.taskConfig.Name,
+		AllocID:   h.taskConfig.AllocID,
+		Timestamp: time.Now(),
+		Message:   msg,
+		Annotations: map[string]string{
+			"pid":    dump.PID,
+			"comm":   dump.Comm,
+			"signal": dump.Signal,
+			"path":   path,
+		},
+	})
+}
+
+// copyCoredump copies the dump into the alloc's log dir, and returns the path
+// of the copy. Dumps larger than coredump_max_size are not copied, in which
+// case an empty path is returned.
+func (h *taskHandle) copyCoredump(src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	if uint64(fi.Size()) > h.coredumpMaxSize {
+		h.logger.Warn("core dump exceeds coredump_max_size, not copying", "path", src, "size", fi.Size())
+		return "", nil
+	}
+
+	dst := filepath.Join(h.taskConfig.TaskDir().LogDir, h.taskConfig.Name+"."+filepath.Base(src))
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, out.Close()
+}
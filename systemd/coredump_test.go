@@ -0,0 +1,119 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateCoredumps(t *testing.T) {
+	c := TaskConfig{Coredumps: "copy"}
+	if err := c.validateCoredumps(); err != nil {
+		t.Fatal(err)
+	}
+	if c.coredumpMaxSize != defaultCoredumpMaxSize {
+		t.Errorf("expected %d, got %d", defaultCoredumpMaxSize, c.coredumpMaxSize)
+	}
+
+	c = TaskConfig{Coredumps: "copy", CoredumpMaxSize: "1G"}
+	if err := c.validateCoredumps(); err != nil {
+		t.Fatal(err)
+	}
+	if c.coredumpMaxSize != 1<<30 {
+		t.Errorf("expected %d, got %d", 1<<30, c.coredumpMaxSize)
+	}
+
+	for _, c := range []TaskConfig{
+		{Coredumps: "save"},
+		{Coredumps: "copy", CoredumpMaxSize: "0"},
+		{Coredumps: "copy", CoredumpMaxSize: "lots"},
+	} {
+		if err := c.validateCoredumps(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestCoredumpArgs(t *testing.T) {
+	unit := "systemd-nspawn@nomad-web-1234.service"
+	expected := []string{
+		"MESSAGE_ID=fc2e22bc6ee647b6b90729ab34a250b1",
+		"COREDUMP_UNIT=" + unit,
+		"--output", "json",
+		"--no-pager",
+		"--since", "@1560000000",
+	}
+	if args := coredumpArgs(unit, "", time.Unix(1560000000, 0)); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	expected = append(expected[:len(expected)-2], "--after-cursor", "s=1;i=2")
+	if args := coredumpArgs(unit, "s=1;i=2", time.Unix(1560000000, 0)); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
+
+func TestParseCoredumps(t *testing.T) {
+	out := `{"__CURSOR":"s=1;i=2","COREDUMP_PID":"42","COREDUMP_COMM":"nginx","COREDUMP_SIGNAL_NAME":"SIGSEGV","COREDUMP_FILENAME":"/var/lib/systemd/coredump/core.nginx.0.1.42.1560000000000000.zst","COREDUMP":[1,2,3]}
+{"__CURSOR":"s=1;i=3","COREDUMP_PID":"43","COREDUMP_COMM":"sh"}
+-- No entries --
+`
+	dumps, err := parseCoredumps(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []coredump{
+		{
+			Cursor:   "s=1;i=2",
+			PID:      "42",
+			Comm:     "nginx",
+			Signal:   "SIGSEGV",
+			Filename: "/var/lib/systemd/coredump/core.nginx.0.1.42.1560000000000000.zst",
+		},
+		{Cursor: "s=1;i=3", PID: "43", Comm: "sh"},
+	}
+	if !reflect.DeepEqual(dumps, expected) {
+		t.Errorf("expected %+v, got %+v", expected, dumps)
+	}
+}
+
+func TestCopyCoredump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	if err := os.MkdirAll(cfg.TaskDir().LogDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "core.nginx.0.1.42.1560000000000000.zst")
+	if err := ioutil.WriteFile(src, []byte("core"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &taskHandle{logger: log.NewNullLogger(), taskConfig: cfg, coredumpMaxSize: 4}
+	dst, err := h.copyCoredump(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(cfg.TaskDir().LogDir, "web.core.nginx.0.1.42.1560000000000000.zst"); dst != expected {
+		t.Errorf("expected %s, got %s", expected, dst)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "core" {
+		t.Errorf("unexpected copy %q: %v", b, err)
+	}
+
+	h.coredumpMaxSize = 3
+	if dst, err := h.copyCoredump(src); err != nil || dst != "" {
+		t.Errorf("expected dump not to be copied, got %q: %v", dst, err)
+	}
+}
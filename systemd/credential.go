@@ -0,0 +1,91 @@
+package systemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// Credential is a systemd credential passed into the container.
+type Credential struct {
+	// Name is the name of the credential.
+	Name string `codec:"name"`
+	// Value is the content of the credential, which is written into a file
+	// instead of the unit, so it may span multiple lines.
+	Value string `codec:"value" ini:"-"`
+	// File is the path of a file on the host to read the credential from.
+	File string `codec:"file"`
+}
+
+// credentialNameRegexp matches valid credential names.
+var credentialNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// credentialsDir is the directory which contains the credentials given by
+// value, placed under /run so they never hit the disk.
+var credentialsDir = "/run/nomad-driver-systemd-nspawn/credentials"
+
+// credentialsPath returns the directory of the machine's credentials.
+func credentialsPath(machineName string) string {
+	return filepath.Join(credentialsDir, machineName)
+}
+
+// validateCredentials checks that credentials are named uniquely and have
+// exactly one of value and file.
+func (c *TaskConfig) validateCredentials() error {
+	names := map[string]bool{}
+	for _, cred := range c.Credential {
+		if !credentialNameRegexp.MatchString(cred.Name) || cred.Name == "." || cred.Name == ".." {
+			return fmt.Errorf("invalid credential name %q", cred.Name)
+		}
+		if names[cred.Name] {
+			return fmt.Errorf("duplicate credential %q", cred.Name)
+		}
+		names[cred.Name] = true
+
+		if (cred.Value == "") == (cred.File == "") {
+			return fmt.Errorf("credential %q must have exactly one of value and file", cred.Name)
+		}
+		if cred.File != "" {
+			if err := validatePathArg("credential file", cred.File); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setupCredentials writes credentials given by value into files readable
+// only by root, and loads them from there.
+//
+// Values are never passed with --set-credential, which would expose them in
+// the unit's drop-in and the process list.
+func setupCredentials(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	var dir string
+	for i, cred := range taskConfig.Credential {
+		if cred.Value == "" {
+			continue
+		}
+		if dir == "" {
+			dir = credentialsPath(machineName(cfg))
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+
+		path := filepath.Join(dir, cred.Name)
+		if err := ioutil.WriteFile(path, []byte(cred.Value), 0600); err != nil {
+			return err
+		}
+		taskConfig.Credential[i] = Credential{Name: cred.Name, File: path}
+	}
+	return nil
+}
+
+// removeCredentials removes the credentials of the machine.
+func removeCredentials(machineName string) error {
+	return os.RemoveAll(credentialsPath(machineName))
+}
@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	valid := TaskConfig{Credential: []Credential{
+		{Name: "db.password", Value: "secret"},
+		{Name: "tls-key", File: "/etc/ssl/private/web.key"},
+	}}
+	if err := valid.validateCredentials(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, creds := range [][]Credential{
+		{{Name: "a/b", Value: "secret"}},
+		{{Name: "..", Value: "secret"}},
+		{{Name: "token"}},
+		{{Name: "token", Value: "secret", File: "/etc/token"}},
+		{{Name: "token", File: "token"}},
+		{{Name: "token", Value: "a"}, {Name: "token", Value: "b"}},
+	} {
+		c := TaskConfig{Credential: creds}
+		if err := c.validateCredentials(); err == nil {
+			t.Errorf("%+v: expected error", creds)
+		}
+	}
+}
+
+func TestSetupCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := credentialsDir
+	defer func() { credentialsDir = old }()
+	credentialsDir = dir
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocID: "1234"}
+	taskConfig := TaskConfig{Credential: []Credential{
+		{Name: "db.password", Value: "secret"},
+		{Name: "tls-key", File: "/etc/ssl/private/web.key"},
+	}}
+	if err := setupCredentials(cfg, &taskConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(credentialsPath(machineName(cfg)), "db.password")
+	if c := taskConfig.Credential[0]; c.Value != "" || c.File != path {
+		t.Errorf("unexpected credential %+v", c)
+	}
+	if c := taskConfig.Credential[1]; c.File != "/etc/ssl/private/web.key" {
+		t.Errorf("unexpected credential %+v", c)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "secret" {
+		t.Errorf("unexpected content %q", b)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+
+	if err := removeCredentials(machineName(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(credentialsPath(machineName(cfg))); !os.IsNotExist(err) {
+		t.Errorf("credentials not removed: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// CRIU support is experimental: the container's init is dumped with CRIU
+// into the alloc dir when the task is stopped, and restored from it in a
+// transient unit instead of booting the image when the task is started
+// again, on a restart or after the alloc dir is migrated.
+//
+// Restored containers are not registered with machined, and containers with
+// private networking are not supported since their links can't be restored.
+
+const (
+	// checkpointDirName is the directory in the shared alloc dir which holds
+	// the checkpoints of tasks.
+	checkpointDirName = "checkpoint"
+	// criuInventory is the file CRIU writes for every dump.
+	criuInventory = "inventory.img"
+)
+
+// checkpointPath returns the directory of the task's checkpoint.
+func checkpointPath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().SharedAllocDir, checkpointDirName, cfg.Name)
+}
+
+// restoredUnitName returns the transient unit of a restored machine.
+func restoredUnitName(machineName string) string {
+	return machineName + "-restored.service"
+}
+
+// validateCheckpoint checks the checkpoint option.
+func (c *TaskConfig) validateCheckpoint() error {
+	if c.Checkpoint && c.privateNetwork() {
+		return fmt.Errorf("checkpoint doesn't support private networking")
+	}
+	return nil
+}
+
+// dumpArgs returns the arguments of criu to dump the process tree of pid.
+func dumpArgs(pid int, dir string) []string {
+	return []string{
+		"dump", "--tree", strconv.Itoa(pid), "--images-dir", dir,
+		"--manage-cgroups", "--file-locks", "--tcp-established", "--ext-unix-sk",
+		"--external", "mnt[]",
+	}
+}
+
+// restoreArgs returns the arguments of criu to restore the checkpoint in dir
+// with root as the container's root.
+func restoreArgs(dir, root string) []string {
+	return []string{
+		"criu", "restore", "--images-dir", dir, "--root", root,
+		"--manage-cgroups", "--file-locks", "--tcp-established", "--ext-unix-sk",
+		"--external", "mnt[]",
+	}
+}
+
+// dumpCheckpoint dumps the machine into the alloc dir, which also kills it.
+func (h *taskHandle) dumpCheckpoint() error {
+	m, err := h.driver.GetMachine(h.machineName)
+	if err != nil {
+		return err
+	}
+
+	dir := checkpointPath(h.taskConfig)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir + ".restoring"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	out, err := exec.Command("criu", dumpArgs(m.Leader, dir)...).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("criu dump: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreMachine restores the task's checkpoint if there is one, and returns
+// nil if the machine should be booted instead.
+func (d *Driver) restoreMachine(cfg *drivers.TaskConfig) (*Machine, error) {
+	dir := checkpointPath(cfg)
+	if _, err := os.Stat(filepath.Join(dir, criuInventory)); err != nil {
+		return nil, nil
+	}
+
+	name := machineName(cfg)
+	root := filepath.Join(machinesPool, name)
+	if _, err := os.Stat(root); err != nil {
+		d.logger.Warn("checkpoint found but machine image is missing, booting instead", "machine", name)
+		return nil, nil
+	}
+
+	// Move the checkpoint away, so it's not restored again if the restored
+	// machine fails.
+	restoring := dir + ".restoring"
+	if err := os.RemoveAll(restoring); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dir, restoring); err != nil {
+		return nil, err
+	}
+
+	unit := restoredUnitName(name)
+	props := []dbus.Property{
+		dbus.PropDescription("Restored container " + name),
+		dbus.PropExecStart(restoreArgs(restoring, root), true),
+		{Name: "CollectMode", Value: godbus.MakeVariant("inactive-or-failed")},
+	}
+
+	ch := make(chan string, 1)
+	err := callDBus(d.ctx, "StartTransientUnit", func(c *systemdConn) error {
+		_, err := c.systemd.StartTransientUnit(unit, "fail", props, ch)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return nil, fmt.Errorf("restore unit %s: %s", unit, result)
+		}
+	case <-time.After(defaultBootTimeout):
+		return nil, fmt.Errorf("restore unit %s: timeout", unit)
+	}
+
+	return &Machine{
+		Name:  name,
+		Unit:  unit,
+		Class: MachineClassContainer,
+		State: MachineStateRunning,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package systemd
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestCheckpointPath(t *testing.T) {
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: "/var/lib/nomad/alloc/1234"}
+	if p := checkpointPath(cfg); p != "/var/lib/nomad/alloc/1234/alloc/checkpoint/web" {
+		t.Errorf("unexpected checkpoint path %q", p)
+	}
+}
+
+func TestValidateCheckpoint(t *testing.T) {
+	if err := (&TaskConfig{Checkpoint: true}).validateCheckpoint(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (&TaskConfig{Checkpoint: true, VirtualEthernet: true}).validateCheckpoint(); err == nil {
+		t.Errorf("expected error for private networking")
+	}
+}
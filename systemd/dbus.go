@@ -0,0 +1,306 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	"github.com/coreos/go-systemd/import1"
+	"github.com/coreos/go-systemd/machine1"
+	godbus "github.com/godbus/dbus"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+var (
+	// dbusCallTimeout is the maximum time a call to systemd may take, calls
+	// hanging longer are considered lost, for example because systemd
+	// restarted.
+	dbusCallTimeout = 30 * time.Second
+	// dbusRetryInterval is the interval between retries of failed calls.
+	dbusRetryInterval = time.Second
+)
+
+// dbusRetries is the number of times a call is retried after reconnecting.
+const dbusRetries = 2
+
+// errNotConnected is returned if connecting to systemd failed.
+var errNotConnected = errors.New("systemd is not connected")
+
+// systemdConn holds the connections to systemd, systemd-machined and
+// systemd-importd.
+//
+// bus is a private connection to the system bus for calls go-systemd doesn't
+// support, the shared one of godbus can't be replaced once it's closed.
+type systemdConn struct {
+	systemd  *dbus.Conn
+	machined *machine1.Conn
+	importd  *import1.Conn
+	bus      *godbus.Conn
+
+	closeOnce sync.Once
+}
+
+// connect connects to systemd, systemd-machined and systemd-importd.
+func connect() (*systemdConn, error) {
+	c := &systemdConn{}
+
+	var err error
+	if c.systemd, err = dbus.New(); err != nil {
+		return nil, fmt.Errorf("systemd: %v", err)
+	}
+	if c.machined, err = machine1.New(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("machined: %v", err)
+	}
+	if c.importd, err = import1.New(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("importd: %v", err)
+	}
+	if c.bus, err = godbus.SystemBusPrivate(); err == nil {
+		if err = c.bus.Auth(nil); err == nil {
+			err = c.bus.Hello()
+		}
+	}
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("system bus: %v", err)
+	}
+	return c, nil
+}
+
+// close closes all connections.
+//
+// machine1 and import1 don't expose their connections, they are released
+// once collected.
+func (c *systemdConn) close() {
+	c.closeOnce.Do(func() {
+		if c.systemd != nil {
+			c.systemd.Close()
+		}
+		if c.bus != nil {
+			c.bus.Close()
+		}
+	})
+}
+
+// machinedManager returns the manager object of systemd-machined.
+func (c *systemdConn) machinedManager() godbus.BusObject {
+	return c.bus.Object("org.freedesktop.machine1", "/org/freedesktop/machine1")
+}
+
+// systemdManager returns the manager object of systemd.
+func (c *systemdConn) systemdManager() godbus.BusObject {
+	return c.bus.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+}
+
+var (
+	// connLock syncs access to conn
+	connLock sync.RWMutex
+	conn     *systemdConn
+)
+
+// getConn returns the current connection, and connects if there is none.
+func getConn() (*systemdConn, error) {
+	connLock.RLock()
+	c := conn
+	connLock.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	return reconnect(nil)
+}
+
+// reconnect replaces the broken connection with a new one.
+//
+// Callers which saw the same broken connection share the new one. The broken
+// connection is closed even if connecting fails, so calls on it fail fast
+// instead of hanging until they time out.
+func reconnect(broken *systemdConn) (*systemdConn, error) {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	if conn != broken {
+		return conn, nil
+	}
+
+	if broken != nil {
+		broken.close()
+	}
+	c, err := connect()
+	if err != nil {
+		return nil, errNotConnected
+	}
+	if broken != nil {
+		dbusMetrics.reconnected()
+	}
+	conn = c
+	return c, nil
+}
+
+// callDBus calls systemd with fn, which honors ctx cancellation and a
+// timeout of dbusCallTimeout.
+//
+// Calls failing because the connection is lost are retried after
+// reconnecting, so the driver survives restarts of systemd and dbus.
+func callDBus(ctx context.Context, op string, fn func(c *systemdConn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := getConn()
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err = callOnce(ctx, c, fn)
+		dbusMetrics.record(op, time.Since(start), err)
+		if err == nil || ctx.Err() != nil || !isConnectionError(err) || attempt >= dbusRetries {
+			return err
+		}
+
+		// The next attempt reconnects again if this fails.
+		reconnect(c)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dbusRetryInterval):
+		}
+	}
+}
+
+// callOnce calls fn, and gives up once ctx is done or the call times out.
+//
+// go-systemd doesn't support contexts, so the call is left running in the
+// background until dbus replies or the connection is closed.
+func callOnce(ctx context.Context, c *systemdConn, fn func(c *systemdConn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, dbusCallTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn(c)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isConnectionError returns whether the call failed because the connection
+// was lost, rather than being rejected by systemd.
+func isConnectionError(err error) bool {
+	switch err {
+	case godbus.ErrClosed, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded:
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	if e, ok := err.(godbus.Error); ok {
+		switch e.Name {
+		case "org.freedesktop.DBus.Error.Disconnected",
+			"org.freedesktop.DBus.Error.NoReply",
+			"org.freedesktop.DBus.Error.ServiceUnknown",
+			"org.freedesktop.DBus.Error.NameHasNoOwner":
+			return true
+		}
+	}
+	return false
+}
+
+// dbusMetrics records the calls to systemd made by the driver.
+var dbusMetrics = newDBusStats()
+
+// dbusOpStats are the metrics of a single dbus operation.
+type dbusOpStats struct {
+	Calls   uint64
+	Errors  uint64
+	Latency time.Duration
+	Max     time.Duration
+}
+
+// dbusStats are the latency and error metrics of calls to systemd.
+type dbusStats struct {
+	lock       sync.Mutex
+	ops        map[string]*dbusOpStats
+	reconnects uint64
+}
+
+func newDBusStats() *dbusStats {
+	return &dbusStats{ops: map[string]*dbusOpStats{}}
+}
+
+// record records a call of op which took d.
+func (s *dbusStats) record(op string, d time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, ok := s.ops[op]
+	if !ok {
+		o = &dbusOpStats{}
+		s.ops[op] = o
+	}
+	o.Calls++
+	o.Latency += d
+	if d > o.Max {
+		o.Max = d
+	}
+	if err != nil {
+		o.Errors++
+	}
+}
+
+func (s *dbusStats) reconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reconnects++
+}
+
+// Snapshot returns a copy of the metrics of all operations, and the number
+// of reconnects.
+func (s *dbusStats) Snapshot() (map[string]dbusOpStats, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ops := make(map[string]dbusOpStats, len(s.ops))
+	for op, o := range s.ops {
+		ops[op] = *o
+	}
+	return ops, s.reconnects
+}
+
+// dbusAttributes returns node attributes of the calls to systemd, latencies
+// are in microseconds.
+func dbusAttributes() map[string]*pstructs.Attribute {
+	ops, reconnects := dbusMetrics.Snapshot()
+
+	var calls, errs uint64
+	var latency, max time.Duration
+	for _, o := range ops {
+		calls += o.Calls
+		errs += o.Errors
+		latency += o.Latency
+		if o.Max > max {
+			max = o.Max
+		}
+	}
+	var mean time.Duration
+	if calls > 0 {
+		mean = latency / time.Duration(calls)
+	}
+
+	return map[string]*pstructs.Attribute{
+		"driver.systemd-nspawn.dbus_calls":          pstructs.NewIntAttribute(int64(calls), ""),
+		"driver.systemd-nspawn.dbus_errors":         pstructs.NewIntAttribute(int64(errs), ""),
+		"driver.systemd-nspawn.dbus_reconnects":     pstructs.NewIntAttribute(int64(reconnects), ""),
+		"driver.systemd-nspawn.dbus_latency_us":     pstructs.NewIntAttribute(int64(mean/time.Microsecond), ""),
+		"driver.systemd-nspawn.dbus_latency_max_us": pstructs.NewIntAttribute(int64(max/time.Microsecond), ""),
+	}
+}
@@ -0,0 +1,120 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	godbus "github.com/godbus/dbus"
+)
+
+// withFakeConn replaces the connection to systemd, and returns a function
+// restoring it.
+func withFakeConn() func() {
+	connLock.Lock()
+	saved := conn
+	conn = &systemdConn{}
+	connLock.Unlock()
+
+	interval := dbusRetryInterval
+	dbusRetryInterval = 10 * time.Millisecond
+
+	return func() {
+		connLock.Lock()
+		conn = saved
+		connLock.Unlock()
+		dbusRetryInterval = interval
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{godbus.ErrClosed, true},
+		{io.EOF, true},
+		{context.DeadlineExceeded, true},
+		{godbus.Error{Name: "org.freedesktop.DBus.Error.NoReply"}, true},
+		{godbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}, true},
+		{godbus.Error{Name: "org.freedesktop.machine1.NoSuchMachine"}, false},
+		{context.Canceled, false},
+		{errors.New("unit not found"), false},
+	}
+	for _, c := range cases {
+		if got := isConnectionError(c.err); got != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.err, c.expected, got)
+		}
+	}
+}
+
+func TestCallDBusRetry(t *testing.T) {
+	defer withFakeConn()()
+
+	calls := 0
+	err := callDBus(context.Background(), "test", func(*systemdConn) error {
+		calls++
+		return godbus.ErrClosed
+	})
+	if err != godbus.ErrClosed {
+		t.Errorf("expected %v, got %v", godbus.ErrClosed, err)
+	}
+	if calls != dbusRetries+1 {
+		t.Errorf("expected %d calls, got %d", dbusRetries+1, calls)
+	}
+
+	// Errors returned by systemd are not retried.
+	calls = 0
+	notFound := godbus.Error{Name: "org.freedesktop.machine1.NoSuchMachine"}
+	err = callDBus(context.Background(), "test", func(*systemdConn) error {
+		calls++
+		return notFound
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected 1 failed call, got %d: %v", calls, err)
+	}
+}
+
+func TestCallDBusContext(t *testing.T) {
+	defer withFakeConn()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- callDBus(ctx, "test", func(*systemdConn) error {
+			<-release
+			return nil
+		})
+	}()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call didn't return after cancel")
+	}
+}
+
+func TestDBusStats(t *testing.T) {
+	s := newDBusStats()
+	s.record("StartUnit", 2*time.Millisecond, nil)
+	s.record("StartUnit", 4*time.Millisecond, errors.New("failed"))
+	s.reconnected()
+
+	ops, reconnects := s.Snapshot()
+	expected := dbusOpStats{Calls: 2, Errors: 1, Latency: 6 * time.Millisecond, Max: 4 * time.Millisecond}
+	if ops["StartUnit"] != expected {
+		t.Errorf("expected %+v, got %+v", expected, ops["StartUnit"])
+	}
+	if reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %d", reconnects)
+	}
+}
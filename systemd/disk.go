@@ -0,0 +1,251 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	godbus "github.com/godbus/dbus"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// poolSpace returns the bytes available to unprivileged users and the total
+// size of the file system of dir.
+func poolSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// checkFreeSpace checks that min_free_space is left in the machines pool
+// after adding need bytes to it.
+func (d *Driver) checkFreeSpace(need uint64) error {
+	config := d.loadConfig()
+	if config.minFreeSpace == 0 {
+		return nil
+	}
+	free, _, err := poolSpace(machinesPool)
+	if err != nil {
+		return fmt.Errorf("failed to check free space of %s: %v", machinesPool, err)
+	}
+	if free < need || free-need < config.minFreeSpace {
+		return fmt.Errorf("insufficient disk space in %s: %d bytes free, %d bytes needed and min_free_space is %s",
+			machinesPool, free, need, config.MinFreeSpace)
+	}
+	return nil
+}
+
+// poolAttributes returns the free and total space of the machines pool, so
+// image heavy jobs can be constrained to nodes with enough space.
+func (d *Driver) poolAttributes() map[string]*pstructs.Attribute {
+	free, total, err := poolSpace(machinesPool)
+	if err != nil {
+		d.logger.Warn("failed to get machines pool space", "path", machinesPool, "error", err)
+		return nil
+	}
+	return map[string]*pstructs.Attribute{
+		"driver.systemd-nspawn.pool_free":  pstructs.NewIntAttribute(int64(free>>20), pstructs.UnitMiB),
+		"driver.systemd-nspawn.pool_total": pstructs.NewIntAttribute(int64(total>>20), pstructs.UnitMiB),
+	}
+}
+
+// validateDiskLimit parses disk_limit, which requires the machine's image to
+// be managed by machined.
+func (c *TaskConfig) validateDiskLimit() error {
+	if c.DiskLimit == "" {
+		return nil
+	}
+	if c.DiskImage != "" {
+		return fmt.Errorf("disk_limit is not supported with disk_image")
+	}
+
+	limit, err := parseBytes(c.DiskLimit)
+	if err != nil || limit == 0 || limit == math.MaxUint64 {
+		return fmt.Errorf("invalid disk_limit %q", c.DiskLimit)
+	}
+	c.diskLimit = limit
+	return nil
+}
+
+// Locations of the machine's root.
+const (
+	rootLocationMachines = "machines"
+	rootLocationAlloc    = "alloc"
+)
+
+// allocRootName is the name of the machine's root in the task's local dir,
+// with the ".raw" suffix for raw images.
+const allocRootName = ".machine"
+
+// validateRootLocation checks root_location, roots in the alloc dir are not
+// managed by machined, and disk images are booted in place.
+func (c *TaskConfig) validateRootLocation() error {
+	switch c.RootLocation {
+	case "", rootLocationMachines:
+		return nil
+	case rootLocationAlloc:
+	default:
+		return fmt.Errorf("invalid root_location %q", c.RootLocation)
+	}
+	if c.DiskImage != "" {
+		return fmt.Errorf("root_location %q is not supported with disk_image", c.RootLocation)
+	}
+	if c.DiskLimit != "" {
+		return fmt.Errorf("root_location %q is not supported with disk_limit", c.RootLocation)
+	}
+	return nil
+}
+
+// RootDirectory returns the root directory of the machine placed in the
+// alloc dir, which is rendered into the drop-in.
+func (c TaskConfig) RootDirectory() string {
+	return c.rootDirectory
+}
+
+// prepareAllocRoot places the machine's root in the task's local dir, which
+// is reused if it's kept by a sticky or migrated ephemeral_disk. Otherwise
+// the image is pulled as usual and moved out of /var/lib/machines.
+func (d *Driver) prepareAllocRoot(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	dir := filepath.Join(cfg.TaskDir().LocalDir, allocRootName)
+	if _, err := os.Stat(dir + ".raw"); err == nil {
+		taskConfig.DiskImage = dir + ".raw"
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		taskConfig.rootDirectory = dir
+		return nil
+	}
+
+	name := machineName(cfg)
+	if err := d.prepareImage(taskConfig.Image, name); err != nil {
+		return err
+	}
+	u, err := getImageUsage(d.ctx, name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(u.Path, ".raw") {
+		if err := moveImage(u.Path, dir+".raw"); err != nil {
+			return err
+		}
+		taskConfig.DiskImage = dir + ".raw"
+		return nil
+	}
+	if err := moveImage(u.Path, dir); err != nil {
+		return err
+	}
+	taskConfig.rootDirectory = dir
+	return nil
+}
+
+// moveImage moves the image, which is copied if the alloc dir is on another
+// file system.
+func moveImage(src, dst string) error {
+	err := os.Rename(src, dst)
+	if e, ok := err.(*os.LinkError); !ok || e.Err != syscall.EXDEV {
+		return err
+	}
+
+	if out, err := exec.Command("cp", "-a", "--reflink=auto", src, dst).CombinedOutput(); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("copy image: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.RemoveAll(src)
+}
+
+// setImageLimit limits the size of the image via systemd-machined, which
+// sets a btrfs quota on subvolumes, and grows raw images to the size.
+func setImageLimit(ctx context.Context, name string, limit uint64) error {
+	return callDBus(ctx, "SetImageLimit", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.SetImageLimit", 0, name, limit).Err
+	})
+}
+
+// imageUsage is the disk usage of a machine image.
+type imageUsage struct {
+	// Path is the path of the image.
+	Path string
+	// Usage is the size of the image, including data shared with other
+	// images.
+	Usage uint64
+	// UsageExclusive is the size of data only used by this image.
+	UsageExclusive uint64
+	// Limit is the size limit of the image.
+	Limit uint64
+}
+
+// unknownSize is reported by machined for sizes it can't determine, like
+// the usage of directories without quota.
+const unknownSize = math.MaxUint64
+
+// getImageUsage returns the disk usage of the image via systemd-machined.
+func getImageUsage(ctx context.Context, name string) (*imageUsage, error) {
+	var props map[string]godbus.Variant
+	err := callDBus(ctx, "GetImage", func(c *systemdConn) error {
+		var path godbus.ObjectPath
+		err := c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.GetImage", 0, name).Store(&path)
+		if err != nil {
+			return err
+		}
+		return c.bus.Object("org.freedesktop.machine1", path).
+			Call("org.freedesktop.DBus.Properties.GetAll", 0, "org.freedesktop.machine1.Image").Store(&props)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := &imageUsage{Usage: unknownSize, UsageExclusive: unknownSize, Limit: unknownSize}
+	u.Path, _ = props["Path"].Value().(string)
+	if v, ok := props["Usage"].Value().(uint64); ok {
+		u.Usage = v
+	}
+	if v, ok := props["UsageExclusive"].Value().(uint64); ok {
+		u.UsageExclusive = v
+	}
+	if v, ok := props["Limit"].Value().(uint64); ok {
+		u.Limit = v
+	}
+	return u, nil
+}
+
+// dirUsage returns the disk space allocated by files in the directory, like
+// du does, without following symlinks or counting hard links twice.
+func dirUsage(root string) (uint64, error) {
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]bool{}
+
+	var usage uint64
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Files could be removed by the container while walking.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if st.Nlink > 1 {
+			k := inode{uint64(st.Dev), st.Ino}
+			if seen[k] {
+				return nil
+			}
+			seen[k] = true
+		}
+		usage += uint64(st.Blocks) * 512
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,183 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateDiskLimit(t *testing.T) {
+	c := TaskConfig{Image: "https://example.com/web.raw", DiskLimit: "10G"}
+	if err := c.validateDiskLimit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.diskLimit != 10<<30 {
+		t.Errorf("expected 10G, got %d", c.diskLimit)
+	}
+
+	for _, c := range []TaskConfig{
+		{Image: "https://example.com/web.raw", DiskLimit: "ten"},
+		{Image: "https://example.com/web.raw", DiskLimit: "0"},
+		{Image: "https://example.com/web.raw", DiskLimit: "infinity"},
+		{DiskImage: "/srv/images/web.raw", DiskLimit: "10G"},
+	} {
+		if err := c.validateDiskLimit(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestPoolSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	free, total, err := poolSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("unexpected space %d/%d", free, total)
+	}
+
+	if _, _, err := poolSpace(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing dir")
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { machinesPool = p }(machinesPool)
+	machinesPool = dir
+
+	free, _, err := poolSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{config: &Config{}}
+	if err := d.checkFreeSpace(free * 2); err != nil {
+		t.Errorf("expected no check without min_free_space, got %v", err)
+	}
+
+	d.config = &Config{MinFreeSpace: "1M", minFreeSpace: 1 << 20}
+	if err := d.checkFreeSpace(0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := d.checkFreeSpace(free); err == nil {
+		t.Error("expected error if the pull leaves less than min_free_space")
+	}
+	if err := d.checkFreeSpace(free * 2); err == nil {
+		t.Error("expected error if the pull doesn't fit")
+	}
+}
+
+func TestDirUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty, err := dirUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := dirUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hard links must be counted once.
+	if usage-empty < 1<<20 || usage-empty >= 2<<20 {
+		t.Errorf("expected about 1MiB, got %d", usage-empty)
+	}
+}
+
+func TestValidateRootLocation(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{Image: "https://example.com/web.raw"},
+		{Image: "https://example.com/web.raw", RootLocation: "machines", DiskLimit: "10G"},
+		{Image: "https://example.com/web.raw", RootLocation: "alloc"},
+	} {
+		if err := c.validateRootLocation(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{Image: "https://example.com/web.raw", RootLocation: "tmp"},
+		{DiskImage: "/srv/images/web.raw", RootLocation: "alloc"},
+		{Image: "https://example.com/web.raw", RootLocation: "alloc", DiskLimit: "10G"},
+	} {
+		if err := c.validateRootLocation(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestPrepareAllocRootReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	root := filepath.Join(cfg.TaskDir().LocalDir, allocRootName)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Driver{}
+	taskConfig := TaskConfig{Image: "https://example.com/web.tar.xz", RootLocation: "alloc"}
+	if err := d.prepareAllocRoot(cfg, &taskConfig); err != nil {
+		t.Fatal(err)
+	}
+	if taskConfig.RootDirectory() != root || taskConfig.DiskImage != "" {
+		t.Errorf("expected root %s to be reused, got %+v", root, taskConfig)
+	}
+	if !taskConfig.needsDropIn() {
+		t.Error("expected drop-in for root directory")
+	}
+}
+
+func TestMoveImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "web.raw")
+	if err := ioutil.WriteFile(src, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, allocRootName+".raw")
+	if err := moveImage(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be moved", src)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "image" {
+		t.Errorf("unexpected content %q: %v", b, err)
+	}
+}
@@ -0,0 +1,88 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// containerResolvConfPath is the path of resolv.conf inside the container.
+const containerResolvConfPath = "/etc/resolv.conf"
+
+// resolvConfTemplate is the resolv.conf of the container.
+const resolvConfTemplate = nspawnFileMarker + `
+{{- range $_, $v := .Servers }}
+nameserver {{$v}}
+{{- end }}
+{{- if .Searches }}
+search {{join .Searches " "}}
+{{- end }}
+{{- if .Options }}
+options {{join .Options " "}}
+{{- end }}
+`
+
+var resolvConfTmpl = template.Must(template.New("resolv.conf").Funcs(funcMaps).Parse(resolvConfTemplate))
+
+// DNS is the DNS configuration of the container, which will be written into
+// its resolv.conf.
+type DNS struct {
+	// Servers takes a list of name server addresses.
+	Servers []string `codec:"servers"`
+	// Searches takes a list of search domains.
+	Searches []string `codec:"searches"`
+	// Options takes a list of resolver options, like "ndots:2".
+	Options []string `codec:"options"`
+}
+
+// enabled returns whether resolv.conf should be generated.
+func (n DNS) enabled() bool {
+	return len(n.Servers) > 0 || len(n.Searches) > 0 || len(n.Options) > 0
+}
+
+// validate checks the dns config.
+func (n DNS) validate(c *TaskConfig) error {
+	if !n.enabled() {
+		return nil
+	}
+	for _, v := range n.Servers {
+		if net.ParseIP(v) == nil {
+			return fmt.Errorf("invalid dns server %q", v)
+		}
+	}
+	if c.ResolvConf != "" && c.ResolvConf != "off" {
+		return fmt.Errorf("dns conflicts with resolv_conf %q", c.ResolvConf)
+	}
+	return nil
+}
+
+// setupDNS writes the resolv.conf into the task dir, and binds it into the
+// container instead of letting nspawn manage it.
+func (d *Driver) setupDNS(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	if !taskConfig.DNS.enabled() {
+		return nil
+	}
+
+	path := filepath.Join(cfg.TaskDir().Dir, "resolv.conf")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := resolvConfTmpl.Execute(f, taskConfig.DNS); err != nil {
+		return err
+	}
+
+	taskConfig.ResolvConf = "off"
+	taskConfig.Bind = append(taskConfig.Bind, BindMount{
+		Source:   path,
+		Target:   containerResolvConfPath,
+		ReadOnly: true,
+	})
+	return nil
+}
@@ -0,0 +1,41 @@
+package systemd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResolvConfTemplate(t *testing.T) {
+	dns := DNS{
+		Servers:  []string{"10.0.0.1", "fd00::1"},
+		Searches: []string{"service.consul", "example.com"},
+		Options:  []string{"ndots:2", "edns0"},
+	}
+
+	expected := nspawnFileMarker + `
+nameserver 10.0.0.1
+nameserver fd00::1
+search service.consul example.com
+options ndots:2 edns0
+`
+
+	var buf bytes.Buffer
+	if err := resolvConfTmpl.Execute(&buf, dns); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestDNSValidate(t *testing.T) {
+	if err := (DNS{Servers: []string{"consul"}}).validate(&TaskConfig{}); err == nil {
+		t.Error("expected error for invalid server")
+	}
+	if err := (DNS{Servers: []string{"10.0.0.1"}}).validate(&TaskConfig{ResolvConf: "bind-host"}); err == nil {
+		t.Error("expected error for conflicting resolv_conf")
+	}
+	if err := (DNS{Servers: []string{"10.0.0.1"}}).validate(&TaskConfig{ResolvConf: "off"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -2,6 +2,11 @@ package systemd
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
@@ -9,11 +14,23 @@ import (
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
 )
 
 const (
 	// pluginName is the name of the plugin
 	pluginName = "systemd-nspawn"
+
+	// defaultFingerprintInterval is the default interval at which the driver
+	// will send fingerprint responses
+	defaultFingerprintInterval = 30 * time.Second
+
+	// taskHandleVersion is the version of task handle which this driver sets
+	// and understands how to decode driver state
+	taskHandleVersion = 1
+
+	// defaultBootTimeout is the time to wait for a machine to become ready
+	defaultBootTimeout = 5 * time.Minute
 )
 
 var (
@@ -31,18 +48,293 @@ var (
 			hclspec.NewAttr("enabled", "bool", false),
 			hclspec.NewLiteral("true"),
 		),
+		"zone_isolation": hclspec.NewDefault(
+			hclspec.NewAttr("zone_isolation", "bool", false),
+			hclspec.NewLiteral("false"),
+		),
+		"criu": hclspec.NewDefault(
+			hclspec.NewAttr("criu", "bool", false),
+			hclspec.NewLiteral("false"),
+		),
+		"strict_options": hclspec.NewDefault(
+			hclspec.NewAttr("strict_options", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"scrape_journal": hclspec.NewDefault(
+			hclspec.NewAttr("scrape_journal", "bool", false),
+			hclspec.NewLiteral("false"),
+		),
+		"runtime_nspawn_files": hclspec.NewDefault(
+			hclspec.NewAttr("runtime_nspawn_files", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"prepull_images": hclspec.NewAttr("prepull_images", "list(string)", false),
+		"max_concurrent_pulls": hclspec.NewDefault(
+			hclspec.NewAttr("max_concurrent_pulls", "number", false),
+			hclspec.NewLiteral("0"),
+		),
+		"max_concurrent_starts": hclspec.NewDefault(
+			hclspec.NewAttr("max_concurrent_starts", "number", false),
+			hclspec.NewLiteral("0"),
+		),
+		"default_pids_limit": hclspec.NewDefault(
+			hclspec.NewAttr("default_pids_limit", "number", false),
+			hclspec.NewLiteral("16384"),
+		),
+		"min_free_space":      hclspec.NewAttr("min_free_space", "string", false),
+		"log_generated_files": hclspec.NewAttr("log_generated_files", "bool", false),
+		"image_commands":      hclspec.NewAttr("image_commands", "bool", false),
+		// garbage collection options
+		// default needed for both if the gc {...} block is not set and
+		// if the default fields are missing
+		"gc": hclspec.NewDefault(hclspec.NewBlock("gc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"dangling_machines": hclspec.NewDefault(
+				hclspec.NewAttr("dangling_machines", "bool", false),
+				hclspec.NewLiteral("true"),
+			),
+			"dangling_nspawn_files": hclspec.NewDefault(
+				hclspec.NewAttr("dangling_nspawn_files", "bool", false),
+				hclspec.NewLiteral("true"),
+			),
+			"dry_run": hclspec.NewDefault(
+				hclspec.NewAttr("dry_run", "bool", false),
+				hclspec.NewLiteral("false"),
+			),
+			"interval": hclspec.NewDefault(
+				hclspec.NewAttr("interval", "string", false),
+				hclspec.NewLiteral(`"5m"`),
+			),
+			"creation_grace": hclspec.NewDefault(
+				hclspec.NewAttr("creation_grace", "string", false),
+				hclspec.NewLiteral(`"5m"`),
+			),
+		})), hclspec.NewLiteral(`{
+			dangling_machines = true
+			dangling_nspawn_files = true
+			dry_run = false
+			interval = "5m"
+			creation_grace = "5m"
+		}`)),
+		"peer_cache": hclspec.NewBlock("peer_cache", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"listen": hclspec.NewAttr("listen", "string", false),
+			"token":  hclspec.NewAttr("token", "string", false),
+			"peers":  hclspec.NewAttr("peers", "list(string)", false),
+		})),
+		"pre_start_hook":    hookSpec("pre_start_hook"),
+		"post_stop_hook":    hookSpec("post_stop_hook"),
+		"liveness_interval": hclspec.NewAttr("liveness_interval", "string", false),
+		"fingerprint_interval": hclspec.NewDefault(
+			hclspec.NewAttr("fingerprint_interval", "string", false),
+			hclspec.NewLiteral(`"30s"`),
+		),
 	})
 
 	// taskConfigSpec is the hcl specification for the driver config section of
 	// a task within a job. It is returned in the TaskConfigSchema RPC
 	taskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
-		"template": hclspec.NewAttr("template", "string", true),
+		"image":         hclspec.NewAttr("image", "string", false),
+		"disk_image":    hclspec.NewAttr("disk_image", "string", false),
+		"arch":          hclspec.NewAttr("arch", "string", false),
+		"image_digests": hclspec.NewAttr("image_digests", "map(string)", false),
+		"image_build": hclspec.NewBlock("image_build", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"tool":     hclspec.NewAttr("tool", "string", false),
+			"commands": hclspec.NewAttr("commands", "list(string)", false),
+			"config":   hclspec.NewAttr("config", "string", false),
+			"timeout":  hclspec.NewAttr("timeout", "string", false),
+		})),
+		"bootstrap": hclspec.NewBlock("bootstrap", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"distro":   hclspec.NewAttr("distro", "string", true),
+			"release":  hclspec.NewAttr("release", "string", false),
+			"packages": hclspec.NewAttr("packages", "list(string)", false),
+			"timeout":  hclspec.NewAttr("timeout", "string", false),
+		})),
+		"root_hash":              hclspec.NewAttr("root_hash", "string", false),
+		"verity":                 hclspec.NewAttr("verity", "string", false),
+		"root_hash_signature":    hclspec.NewAttr("root_hash_signature", "string", false),
+		"extension_images":       hclspec.NewAttr("extension_images", "list(string)", false),
+		"boot":                   hclspec.NewAttr("boot", "bool", false),
+		"ephemeral":              hclspec.NewAttr("ephemeral", "bool", false),
+		"process_two":            hclspec.NewAttr("process_two", "bool", false),
+		"parameters":             hclspec.NewAttr("parameters", "list(string)", false),
+		"environment":            hclspec.NewAttr("environment", "map(string)", false),
+		"env_file":               hclspec.NewAttr("env_file", "list(string)", false),
+		"nspawn_settings_file":   hclspec.NewAttr("nspawn_settings_file", "string", false),
+		"respect_image_settings": hclspec.NewAttr("respect_image_settings", "bool", false),
+		"user":                   hclspec.NewAttr("user", "string", false),
+		"working_directory":      hclspec.NewAttr("working_directory", "string", false),
+		"pivot_root":             hclspec.NewAttr("pivot_root", "string", false),
+		"capability":             hclspec.NewAttr("capability", "list(string)", false),
+		"drop_capability":        hclspec.NewAttr("drop_capability", "list(string)", false),
+		"no_new_privileges":      hclspec.NewAttr("no_new_privileges", "bool", false),
+		"kill_signal":            hclspec.NewAttr("kill_signal", "string", false),
+		"personality":            hclspec.NewAttr("personality", "string", false),
+		"machine_id":             hclspec.NewAttr("machine_id", "string", false),
+		"private_users":          hclspec.NewAttr("private_users", "string", false),
+		"notify_ready":           hclspec.NewAttr("notify_ready", "bool", false),
+		"system_call_filter":     hclspec.NewAttr("system_call_filter", "list(string)", false),
+		"limit_cpu":              hclspec.NewAttr("limit_cpu", "string", false),
+		"limit_fsize":            hclspec.NewAttr("limit_fsize", "string", false),
+		"limit_data":             hclspec.NewAttr("limit_data", "string", false),
+		"limit_stack":            hclspec.NewAttr("limit_stack", "string", false),
+		"limit_core":             hclspec.NewAttr("limit_core", "string", false),
+		"limit_rss":              hclspec.NewAttr("limit_rss", "string", false),
+		"limit_nofile":           hclspec.NewAttr("limit_nofile", "string", false),
+		"limit_as":               hclspec.NewAttr("limit_as", "string", false),
+		"limit_nproc":            hclspec.NewAttr("limit_nproc", "string", false),
+		"limit_memlock":          hclspec.NewAttr("limit_memlock", "string", false),
+		"limit_locks":            hclspec.NewAttr("limit_locks", "string", false),
+		"limit_sigpending":       hclspec.NewAttr("limit_sigpending", "string", false),
+		"limit_msgqueue":         hclspec.NewAttr("limit_msgqueue", "string", false),
+		"limit_nice":             hclspec.NewAttr("limit_nice", "string", false),
+		"limit_rtprio":           hclspec.NewAttr("limit_rtprio", "string", false),
+		"limit_rttime":           hclspec.NewAttr("limit_rttime", "string", false),
+		"oom_score_adjust":       hclspec.NewAttr("oom_score_adjust", "number", false),
+		"cpu_affinity":           hclspec.NewAttr("cpu_affinity", "list(string)", false),
+		"hostname":               hclspec.NewAttr("hostname", "string", false),
+		"resolv_conf":            hclspec.NewAttr("resolv_conf", "string", false),
+		"timezone":               hclspec.NewAttr("timezone", "string", false),
+		"link_journal":           hclspec.NewAttr("link_journal", "string", false),
+		"suppress_sync":          hclspec.NewAttr("suppress_sync", "bool", false),
+		"read_only":              hclspec.NewAttr("read_only", "bool", false),
+		"volatile":               hclspec.NewAttr("volatile", "string", false),
+		"ephemeral_root":         hclspec.NewAttr("ephemeral_root", "bool", false),
+		"bind": hclspec.NewBlockList("bind", hclspec.NewObject(map[string]*hclspec.Spec{
+			"source":    hclspec.NewAttr("source", "string", true),
+			"target":    hclspec.NewAttr("target", "string", false),
+			"options":   hclspec.NewAttr("options", "list(string)", false),
+			"read_only": hclspec.NewAttr("read_only", "bool", false),
+		})),
+		"temporary_file_system":   hclspec.NewAttr("temporary_file_system", "list(string)", false),
+		"inaccessible":            hclspec.NewAttr("inaccessible", "list(string)", false),
+		"overlay":                 hclspec.NewAttr("overlay", "list(list(string))", false),
+		"overlay_read_only":       hclspec.NewAttr("overlay_read_only", "list(list(string))", false),
+		"bind_user":               hclspec.NewAttr("bind_user", "list(string)", false),
+		"private_users_chown":     hclspec.NewAttr("private_users_chown", "bool", false),
+		"private_users_ownership": hclspec.NewAttr("private_users_ownership", "string", false),
+		"credential": hclspec.NewBlockList("credential", hclspec.NewObject(map[string]*hclspec.Spec{
+			"name":  hclspec.NewAttr("name", "string", true),
+			"value": hclspec.NewAttr("value", "string", false),
+			"file":  hclspec.NewAttr("file", "string", false),
+		})),
+		"private":                hclspec.NewAttr("private", "bool", false),
+		"virtual_ethernet":       hclspec.NewAttr("virtual_ethernet", "bool", false),
+		"virtual_ethernet_extra": hclspec.NewAttr("virtual_ethernet_extra", "list(string)", false),
+		"interface":              hclspec.NewAttr("interface", "list(string)", false),
+		"macvlan":                hclspec.NewAttr("macvlan", "list(string)", false),
+		"ipvlan":                 hclspec.NewAttr("ipvlan", "list(string)", false),
+		"pin_mac":                hclspec.NewAttr("pin_mac", "bool", false),
+		"network_interface": hclspec.NewBlockList("network_interface", hclspec.NewObject(map[string]*hclspec.Spec{
+			"type":           hclspec.NewAttr("type", "string", true),
+			"host_interface": hclspec.NewAttr("host_interface", "string", true),
+			"name":           hclspec.NewAttr("name", "string", false),
+			"mac":            hclspec.NewAttr("mac", "string", false),
+		})),
+		"bridge": hclspec.NewAttr("bridge", "string", false),
+		"zone":   hclspec.NewAttr("zone", "string", false),
+		"port": hclspec.NewBlockList("port", hclspec.NewObject(map[string]*hclspec.Spec{
+			"protocol":       hclspec.NewAttr("protocol", "string", false),
+			"host":           hclspec.NewAttr("host", "string", true),
+			"container":      hclspec.NewAttr("container", "string", false),
+			"host_interface": hclspec.NewAttr("host_interface", "string", false),
+		})),
+		"port_backend": hclspec.NewAttr("port_backend", "string", false),
+		"firewall": hclspec.NewBlock("firewall", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"allow": hclspec.NewAttr("allow", "list(string)", false),
+		})),
+		"address": hclspec.NewAttr("address", "list(string)", false),
+		"gateway": hclspec.NewAttr("gateway", "string", false),
+		"host_network": hclspec.NewBlock("host_network", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address":     hclspec.NewAttr("address", "list(string)", false),
+			"masquerade":  hclspec.NewAttr("masquerade", "bool", false),
+			"dhcp_server": hclspec.NewAttr("dhcp_server", "bool", false),
+			"ipv6_prefix": hclspec.NewAttr("ipv6_prefix", "string", false),
+		})),
+		"network_bandwidth": hclspec.NewBlock("network_bandwidth", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"ingress_mbps": hclspec.NewAttr("ingress_mbps", "number", false),
+			"egress_mbps":  hclspec.NewAttr("egress_mbps", "number", false),
+		})),
+		"dns": hclspec.NewBlock("dns", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"servers":  hclspec.NewAttr("servers", "list(string)", false),
+			"searches": hclspec.NewAttr("searches", "list(string)", false),
+			"options":  hclspec.NewAttr("options", "list(string)", false),
+		})),
+		"slice":            hclspec.NewAttr("slice", "string", false),
+		"cgroup_delegate":  hclspec.NewAttr("cgroup_delegate", "bool", false),
+		"nesting":          hclspec.NewAttr("nesting", "bool", false),
+		"ip_accounting":    hclspec.NewAttr("ip_accounting", "bool", false),
+		"ip_address_allow": hclspec.NewAttr("ip_address_allow", "list(string)", false),
+		"ip_address_deny":  hclspec.NewAttr("ip_address_deny", "list(string)", false),
+		"numa_node":        hclspec.NewAttr("numa_node", "string", false),
+		"pids_limit":       hclspec.NewAttr("pids_limit", "number", false),
+		"io_limit": hclspec.NewBlockList("io_limit", hclspec.NewObject(map[string]*hclspec.Spec{
+			"device":     hclspec.NewAttr("device", "string", true),
+			"read_bps":   hclspec.NewAttr("read_bps", "string", false),
+			"write_bps":  hclspec.NewAttr("write_bps", "string", false),
+			"read_iops":  hclspec.NewAttr("read_iops", "number", false),
+			"write_iops": hclspec.NewAttr("write_iops", "number", false),
+		})),
+		"memory": hclspec.NewBlock("memory", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"swap_max":  hclspec.NewAttr("swap_max", "string", false),
+			"zswap_max": hclspec.NewAttr("zswap_max", "string", false),
+			"hugetlb":   hclspec.NewAttr("hugetlb", "map(string)", false),
+		})),
+		"register": hclspec.NewDefault(
+			hclspec.NewAttr("register", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"keep_unit": hclspec.NewDefault(
+			hclspec.NewAttr("keep_unit", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"exec_user": hclspec.NewAttr("exec_user", "string", false),
+		"mount_task_dirs": hclspec.NewDefault(
+			hclspec.NewAttr("mount_task_dirs", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"expose_rootfs": hclspec.NewAttr("expose_rootfs", "bool", false),
+		"checkpoint":    hclspec.NewAttr("checkpoint", "bool", false),
+		"boot_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("boot_timeout", "string", false),
+			hclspec.NewLiteral(`"5m"`),
+		),
+		"wait_for_ports": hclspec.NewAttr("wait_for_ports", "string", false),
+		"disk_limit":     hclspec.NewAttr("disk_limit", "string", false),
+		"transient_unit": hclspec.NewAttr("transient_unit", "bool", false),
+		"extra_args":     hclspec.NewAttr("extra_args", "list(string)", false),
+		"class": hclspec.NewDefault(
+			hclspec.NewAttr("class", "string", false),
+			hclspec.NewLiteral(`"container"`),
+		),
+		"vm": hclspec.NewBlock("vm", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"cpus":   hclspec.NewAttr("cpus", "number", false),
+			"ram":    hclspec.NewAttr("ram", "string", false),
+			"linux":  hclspec.NewAttr("linux", "string", false),
+			"initrd": hclspec.NewAttr("initrd", "string", false),
+		})),
+		"root_location": hclspec.NewDefault(
+			hclspec.NewAttr("root_location", "string", false),
+			hclspec.NewLiteral(`"machines"`),
+		),
+		"export_journal": hclspec.NewAttr("export_journal", "bool", false),
+		"pre_start_hook": hookSpec("pre_start_hook"),
+		"post_stop_hook": hookSpec("post_stop_hook"),
+		"coredumps": hclspec.NewDefault(
+			hclspec.NewAttr("coredumps", "string", false),
+			hclspec.NewLiteral(`"off"`),
+		),
+		"coredump_max_size": hclspec.NewAttr("coredump_max_size", "string", false),
+		"stop_mode": hclspec.NewDefault(
+			hclspec.NewAttr("stop_mode", "string", false),
+			hclspec.NewLiteral(`"terminate"`),
+		),
 	})
 
 	// capabilities is returned by the Capabilities RPC and indicates what
 	// optional features this driver supports
 	capabilities = &drivers.Capabilities{
-		Exec: false,
+		SendSignals: true,
+		Exec:        true,
+		FSIsolation: drivers.FSIsolationImage,
 	}
 )
 
@@ -52,8 +344,10 @@ type Driver struct {
 	// event can be broadcast to all callers
 	eventer *eventer.Eventer
 
-	// config is the driver configuration set by the SetConfig RPC
-	config *Config
+	// config is the driver configuration set by the SetConfig RPC, which
+	// is read via loadConfig
+	config     *Config
+	configLock sync.RWMutex
 
 	// nomadConfig is the client config from nomad
 	nomadConfig *base.ClientDriverConfig
@@ -66,6 +360,54 @@ type Driver struct {
 	// ctx passed to any subsystems
 	signalShutdown context.CancelFunc
 
+	// tasks is the in memory datastore mapping taskIDs to taskHandles
+	tasks *taskStore
+
+	// zones tracks the number of tasks in every network zone
+	zones *zoneStore
+
+	// ports tracks the host ports reserved by tasks
+	ports *portStore
+
+	// version is the major version of the host's systemd detected during
+	// fingerprinting, 0 if unknown
+	version     int
+	versionLock sync.RWMutex
+
+	// imageLock serializes pulls of images shared by machines
+	imageLock sync.Mutex
+
+	// transfers tracks the image pulls started by the driver
+	transfers *transferStore
+
+	// subsystems tracks all goroutines started by the driver, which are
+	// stopped with ctx and waited for on Shutdown
+	subsystems *subsystemRegistry
+
+	// reloader coalesces reloads of systemd
+	reloader *reloader
+
+	// startSlots holds a token for every machine being started, nil if
+	// max_concurrent_starts is unlimited
+	startSlots chan struct{}
+
+	// starting holds the names of machines whose tasks are being started,
+	// which aren't tracked yet but must not be taken as dangling
+	starting     map[string]struct{}
+	startingLock sync.Mutex
+
+	// reconcilerOnce makes sure the dangling reconciler is started only once
+	reconcilerOnce sync.Once
+
+	// prepullOnce makes sure images are prepulled only once
+	prepullOnce sync.Once
+
+	// livenessOnce makes sure the liveness prober is started only once
+	livenessOnce sync.Once
+
+	// peerCacheOnce makes sure the image cache is served to peers only once
+	peerCacheOnce sync.Once
+
 	// logger will log to the Nomad agent
 	logger log.Logger
 }
@@ -74,14 +416,125 @@ type Driver struct {
 type Config struct {
 	// Enabled is set to true to enable the systemd driver
 	Enabled bool `codec:"enabled"`
+
+	// ZoneIsolation is set to true to drop traffic between network zones
+	// via nftables.
+	ZoneIsolation bool `codec:"zone_isolation"`
+	// CRIU is set to true to allow tasks to checkpoint and restore
+	// containers with CRIU, which is experimental.
+	CRIU bool `codec:"criu"`
+	// StrictOptions is set to true to fail tasks using options not supported
+	// by the host's systemd, otherwise they are dropped with a task event.
+	StrictOptions bool `codec:"strict_options"`
+	// ScrapeJournal is set to true to scan the machine's journal for errors
+	// when it failed to start, and attach the first one to the failure.
+	ScrapeJournal bool `codec:"scrape_journal"`
+	// GC is the garbage collection configuration.
+	GC GCConfig `codec:"gc"`
+	// RuntimeNSpawnFiles is set to true to write nspawn files to
+	// /run/systemd/nspawn instead of /etc/systemd/nspawn, so they vanish on
+	// reboot. Files of recovered tasks are moved on recovery.
+	RuntimeNSpawnFiles bool `codec:"runtime_nspawn_files"`
+	// PrepullImages are images pulled into the cache when the driver starts,
+	// which must be pinned by digest.
+	PrepullImages []string `codec:"prepull_images"`
+	// MaxConcurrentPulls limits the number of images pulled at the same
+	// time, further pulls are queued. 0 means unlimited.
+	MaxConcurrentPulls int `codec:"max_concurrent_pulls"`
+	// MaxConcurrentStarts limits the number of machines started at the same
+	// time, further tasks wait for a start slot. 0 means unlimited.
+	MaxConcurrentStarts int `codec:"max_concurrent_starts"`
+	// DefaultPidsLimit is the max number of tasks in machines without
+	// pids_limit, which defaults to 16384 like systemd-nspawn@.service, so
+	// fork bombs can't exhaust the host's PIDs. 0 means unlimited.
+	DefaultPidsLimit int `codec:"default_pids_limit"`
+	// MinFreeSpace is the space, e.g. "10G", which must stay free in the
+	// machines pool. Pulls and clones which would leave less fail instead of
+	// filling up the file system. Disabled if empty.
+	MinFreeSpace string `codec:"min_free_space"`
+	// LogGeneratedFiles is set to true to log the nspawn file, drop-in or
+	// transient unit command line of every machine, with environment and
+	// credential values masked.
+	LogGeneratedFiles bool `codec:"log_generated_files"`
+	// ImageCommands is set to true to allow the nspawn:image-export and
+	// nspawn:image-import commands of ExecTask, which let anyone allowed to exec into tasks read
+	// and seed the image cache of the node.
+	ImageCommands bool `codec:"image_commands"`
+	// PeerCache shares the image cache with other nodes.
+	PeerCache PeerCacheConfig `codec:"peer_cache"`
+	// PreStartHook is run on the host before every machine is started,
+	// before the task's own hook.
+	PreStartHook Hook `codec:"pre_start_hook"`
+	// PostStopHook is run on the host after every machine is destroyed,
+	// after the task's own hook.
+	PostStopHook Hook `codec:"post_stop_hook"`
+	// LivenessInterval is the interval between liveness probes of running
+	// machines, which fail tasks whose machine vanished without its unit
+	// being noticed to exit. Disabled if empty.
+	LivenessInterval string `codec:"liveness_interval"`
+	// FingerprintInterval is the interval between fingerprints, which check
+	// the health of systemd, machined and importd.
+	FingerprintInterval string `codec:"fingerprint_interval"`
+
+	minFreeSpace        uint64
+	livenessInterval    time.Duration
+	fingerprintInterval time.Duration
+}
+
+// GCConfig is the garbage collection configuration of driver.
+type GCConfig struct {
+	// DanglingMachines is set to true to terminate and remove machines
+	// created by this driver but not tracked by any task.
+	DanglingMachines bool `codec:"dangling_machines"`
+	// DanglingNSpawnFiles is set to true to remove nspawn files generated by
+	// this driver whose machines no longer exist.
+	DanglingNSpawnFiles bool `codec:"dangling_nspawn_files"`
+	// DryRun is set to true to only log dangling resources without removing them.
+	DryRun bool `codec:"dry_run"`
+	// Interval is the interval between two garbage collections.
+	Interval string `codec:"interval"`
+	// CreationGrace is the time a machine or nspawn file could be untracked
+	// after creation, which avoids removing machines that are starting or
+	// being recovered.
+	CreationGrace string `codec:"creation_grace"`
+
+	interval      time.Duration
+	creationGrace time.Duration
 }
 
 // TaskConfig is the driver configuration of a task within a job
 type TaskConfig struct {
 	// Image section
 
-	// Image is the image name.
-	Image string
+	// Image is the image reference, which takes the form "[raw:|tar:]url[@sha256:digest]".
+	// Images pinned by digest are pulled once and cloned for each machine, others are pulled every time.
+	Image string `codec:"image"`
+	// Arch is the architecture of the image, e.g. "amd64" or "arm64", which defaults to the host's. Its
+	// name replaces "{arch}" in the URL of Image, and its uname -m name (e.g. "aarch64") "{machine}", so
+	// the same job pulls the right image on all nodes of a mixed cluster.
+	Arch string `codec:"arch" ini:"-"`
+	// ImageDigests pins Image by the digest of each architecture, e.g. {amd64 = "sha256:..."}, instead of
+	// a single digest in Image. Fails the task on nodes whose architecture has no digest.
+	ImageDigests map[string]string `codec:"image_digests" ini:"-"`
+	// ImageBuild builds the image on the node and starts the machine from the result, which is cached
+	// by the hash of the recipe: either commands run in a clone of Image, which must be pinned by digest,
+	// or the image built by mkosi from a config in the task dir, which replaces Image.
+	ImageBuild ImageBuild `codec:"image_build" ini:"-"`
+	// Bootstrap creates the image with the distro's bootstrap tool on the host, e.g. debootstrap,
+	// instead of pulling Image. The result is cached by the hash of the options.
+	Bootstrap Bootstrap `codec:"bootstrap" ini:"-"`
+	// DiskImage is the path of a raw disk image on the host to boot directly, instead of pulling Image.
+	DiskImage string `codec:"disk_image"`
+	// RootHash is the root hash of the verity protected DiskImage in hex.
+	RootHash string `codec:"root_hash"`
+	// Verity is the path of the verity data of DiskImage, nspawn looks for it next to the image by default.
+	Verity string `codec:"verity"`
+	// RootHashSignature is the PKCS#7 signature of RootHash, which takes a path or "base64:" followed by
+	// the signature. The kernel verifies it against the keys in its keyring.
+	RootHashSignature string `codec:"root_hash_signature"`
+	// ExtensionImages are paths of system extension images on the host, which are layered on top of the
+	// root in order.
+	ExtensionImages []string `codec:"extension_images"`
 
 	// Exec section
 
@@ -89,212 +542,603 @@ type TaskConfig struct {
 	// If enabled, systemd-nspawn will automatically search for an init executable and invoke it.
 	// In this case, the specified parameters using Parameters= are passed as additional arguments to the init process.
 	// This option may not be combined with ProcessTwo=yes.
-	Boot bool
+	Boot bool `codec:"boot"`
 	// Ephemeral takes a boolean argument, which defaults to off, If enabled, the container is run with a temporary
 	// snapshot of its file system that is removed immediately when the container terminates.
-	Ephemeral bool
+	Ephemeral bool `codec:"ephemeral"`
 	// ProcessTwo takes a boolean argument, which defaults to off.
 	// If enabled, the specified program is run as PID 2.
 	// A stub init process is run as PID 1.
 	// This option may not be combined with Boot=yes.
-	ProcessTwo bool
+	ProcessTwo bool `codec:"process_two"`
 	// Parameters takes a space-separated list of arguments.
 	// This is either a command line, beginning with the binary name to execute,
 	// or – if Boot= is enabled – the list of arguments to pass to the init process.
-	Parameters []string
+	Parameters []string `codec:"parameters"`
 	// Environment takes an environment variable assignment consisting of key and value.
 	// Sets an environment variable for the main process invoked in the container.
 	// This setting may be used multiple times to set multiple environment variables.
-	Environment map[string]string
+	Environment map[string]string `codec:"environment"`
+	// EnvFile are files relative to the task dir, e.g. rendered by a template stanza, whose KEY=VALUE
+	// lines are added to Environment. Variables set in Environment take precedence, later files override
+	// earlier ones.
+	EnvFile []string `codec:"env_file" ini:"-"`
+	// NspawnSettingsFile is an nspawn file relative to the task dir, e.g. rendered by a template stanza,
+	// which is used instead of the nspawn options of the task. The driver adds the settings it controls:
+	// the environment, hostname, machine ID, binds like the task dirs, and ports. Other nspawn options
+	// can't be set alongside it.
+	NspawnSettingsFile string `codec:"nspawn_settings_file" ini:"-"`
+	// RespectImageSettings merges the .nspawn file shipped with the image, e.g. pulled along with it,
+	// into the generated nspawn file. Options of the task config override the image's, and lists like
+	// binds are merged. The image's settings are trusted, so this should only be enabled for trusted
+	// images. Otherwise they are ignored with a task event.
+	RespectImageSettings bool `codec:"respect_image_settings"`
 	// User takes a UNIX user name.
 	// Specifies the user name to invoke the main process of the container as.
 	// This user must be known in the container's user database.
-	User string
+	User string `codec:"user"`
 	// WorkingDirectory selects the working directory for the process invoked in the container.
 	// Expects an absolute path in the container's file system namespace.
-	WorkingDirectory string
+	WorkingDirectory string `codec:"working_directory"`
 	// PivotRoot selects a directory to pivot to / inside the container when starting up.
 	// Takes a single path, or a pair of two paths separated by a colon.
 	// Both paths must be absolute, and are resolved in the container's file system namespace.
-	PivotRoot string
+	PivotRoot string `codec:"pivot_root"`
 	// Capability takes a list of Linux process capabilities (see capabilities(7) for details).
 	// The Capability= setting specifies additional capabilities to pass on top of the default set of capabilities.
 	// The DropCapability= setting specifies capabilities to drop from the default set.
-	Capability []string
+	Capability []string `codec:"capability"`
 	// DropCapability used like Capability.
-	DropCapability []string
+	DropCapability []string `codec:"drop_capability"`
 	// NoNewPrivileges takes a boolean argument that controls the PR_SET_NO_NEW_PRIVS flag for the container payload.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--no-new-privileges=
-	NoNewPrivileges bool
+	NoNewPrivileges bool `codec:"no_new_privileges"`
 	// KillSignal specify the process signal to send to the container's PID 1 when nspawn itself receives SIGTERM,
 	// in order to trigger an orderly shutdown of the container.
 	// Defaults to SIGRTMIN+3 if Boot= is used (on systemd-compatible init systems SIGRTMIN+3 triggers an
 	// orderly shutdown).
 	// For a list of valid signals, see signal(7).
-	KillSignal uint32
+	// Takes a signal name like "SIGTERM" or "SIGRTMIN+3", numbers are still accepted.
+	KillSignal string `codec:"kill_signal"`
 	// Personality configures the kernel personality for the container.
-	// Currently, "x86" and "x86-64" are supported.
+	// Takes e.g. "x86" or "x86-64", which must be supported by the host's architecture, see the
+	// driver.systemd-nspawn.personalities node attribute.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--personality=
-	Personality string
+	Personality string `codec:"personality"`
 	// MachineID configures the 128-bit machine ID (UUID) to pass to the container.
-	MachineID string
+	// Defaults to an ID derived from the alloc ID and task name, which is stable across restarts.
+	MachineID string `codec:"machine_id"`
 	// PrivateUsers configures support for usernamespacing.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--private-users=
-	PrivateUsers string
+	PrivateUsers string `codec:"private_users"`
 	// NotifyReady configures support for notifications from the container's init process.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--notify-ready=
-	NotifyReady bool
+	NotifyReady bool `codec:"notify_ready"`
 	// SystemCallFilter configures the system call filter applied to containers.
+	// Takes a list of system call names or groups (like "@keyring"), which could
+	// be prefixed with "~" to deny it instead of allow.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--system-call-filter=
-	SystemCallFilter []string
+	SystemCallFilter []string `codec:"system_call_filter"`
 	// Configures various types of resource limits applied to containers.
 	// Sets the specified POSIX resource limit for the container payload.
 	// Expects an assignment of the form "SOFT:HARD" or "VALUE"
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--rlimit=
-	LimitCPU        string
-	LimitFSIZE      string
-	LimitDATA       string
-	LimitSTACK      string
-	LimitCORE       string
-	LimitRSS        string
-	LimitNOFILE     string
-	LimitAS         string
-	LimitNPROC      string
-	LimitMEMLOCK    string
-	LimitLOCKS      string
-	LimitSIGPENDING string
-	LimitMSGQUEUE   string
-	LimitNICE       string
-	LimitRTPRIO     string
-	LimitRTTIME     string
+	LimitCPU        string `codec:"limit_cpu"`
+	LimitFSIZE      string `codec:"limit_fsize"`
+	LimitDATA       string `codec:"limit_data"`
+	LimitSTACK      string `codec:"limit_stack"`
+	LimitCORE       string `codec:"limit_core"`
+	LimitRSS        string `codec:"limit_rss"`
+	LimitNOFILE     string `codec:"limit_nofile"`
+	LimitAS         string `codec:"limit_as"`
+	LimitNPROC      string `codec:"limit_nproc"`
+	LimitMEMLOCK    string `codec:"limit_memlock"`
+	LimitLOCKS      string `codec:"limit_locks"`
+	LimitSIGPENDING string `codec:"limit_sigpending"`
+	LimitMSGQUEUE   string `codec:"limit_msgqueue"`
+	LimitNICE       string `codec:"limit_nice"`
+	LimitRTPRIO     string `codec:"limit_rtprio"`
+	LimitRTTIME     string `codec:"limit_rttime"`
 	// OOMScoreAdjust changes the OOM ("Out Of Memory") score adjustment value for the container payload.
 	// This controls /proc/self/oom_score_adj which influences the preference with which this container
 	// is terminated when memory becomes scarce.
 	// For details see proc(5).
 	// Takes an integer in the range -1000…1000.
-	OOMScoreAdjust int
+	OOMScoreAdjust int `codec:"oom_score_adjust"`
 	// CPUAffinity controls the CPU affinity of the container payload.
 	// Takes a comma separated list of CPU numbers or number ranges (the latter's start and end value separated by
 	// dashes).
 	// See sched_setaffinity(2) for details.
-	CPUAffinity []string
+	CPUAffinity []string `codec:"cpu_affinity"`
 	// Hostname configures the kernel hostname set for the container.
-	Hostname string
+	// Defaults to "<job>-<task>-<alloc-index>".
+	Hostname string `codec:"hostname"`
 	// ResolvConf configures how /etc/resolv.conf inside of the container (i.e. DNS configuration synchronization from
 	// host to container) shall be handled.
 	// Takes one of "off", "copy-host", "copy-static", "bind-host", "bind-static", "delete" or "auto".
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--resolv-conf=
-	ResolvConf string
+	ResolvConf string `codec:"resolv_conf"`
 	// Timezone configures how /etc/localtime inside of the container (i.e. local timezone synchronization from host
 	// to container) shall be handled.
 	// Takes one of "off", "copy", "bind", "symlink", "delete" or "auto".
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--timezone=
-	Timezone string
+	Timezone string `codec:"timezone"`
 	// LinkJournal controls whether the container's journal shall be made visible to the host system.
 	// If enabled, allows viewing the container's journal files from the host (but not vice versa).
 	// Takes one of "no", "host", "try-host", "guest", "try-guest", "auto".
-	LinkJournal string
+	LinkJournal string `codec:"link_journal"`
+	// SuppressSync turns sync(), fsync() and similar calls of the container into no-ops, which speeds up
+	// batch containers whose files don't need to survive a crash of the host. Requires systemd 250.
+	SuppressSync bool `codec:"suppress_sync"`
 
 	// Files section
 
 	// ReadOnly takes a boolean argument, which defaults to off.
 	// If specified, the container will be run with a read-only file system.
-	ReadOnly bool
-	// Volatile takes "no", "yes", or the special value "state".
+	ReadOnly bool `codec:"read_only"`
+	// Volatile takes "no", "yes", or the special values "state" and "overlay".
 	// This configures whether to run the container with volatile state and/or configuration.
 	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--volatile
-	Volatile string
-	// Bind adds a bind mount from the host into the container.
-	// Takes a single path, a pair of two paths separated by a colon, or a triplet of two paths plus an
-	// option string separated by colons.
-	Bind         []string
-	BindReadOnly []string
+	Volatile string `codec:"volatile"`
+	// EphemeralRoot runs the container with a writable root whose changes are discarded when it exits,
+	// via Volatile=overlay. It conflicts with Volatile and ReadOnly.
+	EphemeralRoot bool `codec:"ephemeral_root"`
+	// Bind adds bind mounts from the host into the container.
+	Bind []BindMount `codec:"bind"`
 	// TemporaryFileSystem adds a "tmpfs" mount to the container.
 	// Takes a path or a pair of path and option string, separated by a colon.
-	TemporaryFileSystem []string
+	// The size defaults to half of the task's memory limit if not specified.
+	TemporaryFileSystem []string `codec:"temporary_file_system"`
 	// Inaccessible masks the specified file or directly in the container, by over-mounting it with an empty file node of
 	// the same type with the most restrictive access mode.
 	// Takes a file system path as arugment.
-	Inaccessible []string
+	Inaccessible []string `codec:"inaccessible"`
 	// Overlay adds an overlay mount point.
 	// Takes a colon-separated list of paths.
-	Overlay         [][]string
-	OverlayReadOnly [][]string
+	// The upper dir of Overlay could be "auto", which is replaced by a dir inside the task's local dir.
+	Overlay         [][]string `codec:"overlay"`
+	OverlayReadOnly [][]string `codec:"overlay_read_only"`
 	// PrivateUsersChown configures whether the ownership of the files and directories in the container tree shall be adjusted
 	// to the UID/GID range used, if necessary and user namespacing is enabled.
-	PrivateUsersChown bool
+	PrivateUsersChown bool `codec:"private_users_chown"`
+	// PrivateUsersOwnership controls how the ownership of the container tree is adjusted to the UID/GID
+	// range: "off", "chown", "map" or "auto". "map" uses idmapped mounts instead of recursively chowning
+	// the tree, which makes the first start of large images much faster. Conflicts with PrivateUsersChown
+	// and requires systemd 249.
+	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--private-users-ownership=
+	PrivateUsersOwnership string `codec:"private_users_ownership"`
+	// BindUser binds a host user account into the container, including its home directory.
+	// Takes a list of user names, requires user namespacing to be enabled via PrivateUsers.
+	// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--bind-user=
+	BindUser []string `codec:"bind_user"`
+	// Credential passes systemd credentials into the container, which are read by services via
+	// $CREDENTIALS_DIRECTORY instead of environment variables.
+	// ref: https://systemd.io/CREDENTIALS/
+	Credential []Credential `codec:"credential"`
 
 	// Network section
 
 	// Private takes a boolean argument, which defaults to off.
 	// If enabled, the container will run in its own network namespace and not share network interfaces
 	// and configuration with the host.
-	Private bool
+	Private bool `codec:"private"`
 	// VirtualEthernet takes a boolean argument.
 	// Configures whether to create a virtual Ethernet connection ("veth") between host and the container.
 	// This setting implies Private=yes.
-	VirtualEthernet bool
+	VirtualEthernet bool `codec:"virtual_ethernet"`
 	// VirtualEthernetExtra takes a colon-separated pair of interface names.
 	// Configures an additional virtual Ethernet connection ("veth") between host and the container.
 	// The first specified name is the interface name on the host, the second the interface name in the container.
 	// The latter may be omitted in which case it is set to the same name as the host side interface.
 	// This setting implies Private=yes.
 	// It is independent of VirtualEthernet=. This option is privileged.
-	VirtualEthernetExtra []string
+	VirtualEthernetExtra []string `codec:"virtual_ethernet_extra"`
 	// Interface takes a space-separated list of interfaces to add to the container.
 	// This option implies Private=yes.
-	Interface []string
+	// Deprecated: use NetworkInterface, which is validated consistently and supports MAC addresses.
+	Interface []string `codec:"interface"`
 	// MACVLAN and IPVLAN takes a space-separated list of interfaces to add MACLVAN or IPVLAN interfaces to,
 	// which are then added to the container.
+	// Entries take the "interface:name" form to rename the interface inside the container.
 	// These options correspond to the --network-macvlan= and --network-ipvlan= command line switches and
 	// imply Private=yes.
 	// These options are privileged.
-	MACVLAN []string
-	IPVLAN  []string
+	// Deprecated: use NetworkInterface.
+	MACVLAN []string `codec:"macvlan"`
+	IPVLAN  []string `codec:"ipvlan"`
+	// PinMAC is set to true to pin the MAC addresses of MACVLAN interfaces, which are derived from the
+	// job, task and alloc index instead of the machine name, so DHCP reservations survive reschedules.
+	PinMAC bool `codec:"pin_mac"`
+	// NetworkInterface adds host interfaces, or MACVLAN or IPVLAN interfaces on top of them, to the
+	// container, each with its own name and MAC address. Added to Interface, MACVLAN and IPVLAN when the
+	// machine is started, so it implies Private=yes.
+	// This option is privileged.
+	NetworkInterface []NetworkInterface `codec:"network_interface"`
 	// Bridge takes an interface name.
 	// This setting implies VirtualEthernet=yes and Private=yes and has the effect that the host side of the
 	// created virtual Ethernet link is connected to the specified bridge interface.
 	// This option is privileged.
-	Bridge string
+	Bridge string `codec:"bridge"`
 	// Zone takes a network zone name.
 	// This setting implies VirtualEthernet=yes and Private=yes and has the effect that the host side of the
 	// created virtual Ethernet link is connected to an automatically managed bridge interface named after
 	// the passed argument, prefixed with "vz-".
 	// This option is privileged.
-	Zone string
-	// Port exposes a TCP or UDP port of the container on the host.
-	// If private networking is enabled, maps an IP port on the host onto an IP port on the container.
-	// Takes a protocol specifier (either "tcp" or "udp"), separated by a colon from a host port number in the
-	// range 1 to 65535, separated by a colon from a container port number in the range from 1 to 65535.
-	// The protocol specifier and its separating colon may be omitted, in which case "tcp" is assumed.
-	// The container port number and its colon may be omitted, in which case the same port as the host port is
-	// implied.
+	Zone string `codec:"zone"`
+	// Port exposes TCP or UDP ports of the container on the host.
+	// If private networking is enabled, maps IP ports on the host onto IP ports on the container.
+	// The host port takes a port number, a range or the label of a port allocated by Nomad, and
+	// the container port defaults to the host port.
 	// This option is only supported if private networking is used, such as with --network-veth,
 	// --network-zone= --network-bridge=.
 	// This option is privileged.
-	Port []string
+	Port []PortMapping `codec:"port"`
+	// PortBackend selects how Port is published, either "nspawn" (default) which uses nspawn's Port=,
+	// or "nftables" which programs DNAT rules to the container's address instead, and works with
+	// bridges and interfaces nspawn doesn't manage.
+	PortBackend string `codec:"port_backend"`
+	// Firewall restricts the traffic to and from the container to the allowed rules with a nftables
+	// table per machine, which is removed when the machine is destroyed.
+	// This option is privileged.
+	Firewall Firewall `codec:"firewall" ini:"-"`
+	// Address takes a list of static addresses in CIDR notation for the container's host0 interface,
+	// which will be configured by systemd-networkd inside the container instead of DHCP.
+	// Requires VirtualEthernet, Bridge or Zone to be set.
+	Address []string `codec:"address"`
+	// Gateway is the default gateway of the container's host0 interface, used with Address.
+	Gateway string `codec:"gateway"`
+	// HostNetwork configures the host-side veth interface via systemd-networkd on the host.
+	// Requires VirtualEthernet to be set.
+	HostNetwork HostNetwork `codec:"host_network"`
+	// NetworkBandwidth limits the bandwidth of the container with tc on the host-side veth interface.
+	// Requires VirtualEthernet, Bridge or Zone to be set.
+	NetworkBandwidth NetworkBandwidth `codec:"network_bandwidth"`
+	// DNS writes a resolv.conf into the container with the given servers, searches and options,
+	// and sets ResolvConf=off.
+	DNS DNS `codec:"dns"`
+
+	// Unit section, which will be written into the drop-in of machine's unit.
+
+	// Slice makes the machine's unit part of the specified slice, instead of machine.slice.
+	Slice string `codec:"slice"`
+	// IPAccounting counts the IP traffic of the machine's unit, which is reported in the stats. Requires
+	// KeepUnit.
+	IPAccounting bool `codec:"ip_accounting"`
+	// IPAddressAllow and IPAddressDeny restrict the IP traffic of the machine's unit to and from the given
+	// addresses, CIDRs or "any", "localhost", "link-local" and "multicast" in the kernel. Allowed addresses
+	// win over denied ones. Requires KeepUnit.
+	IPAddressAllow []string `codec:"ip_address_allow"`
+	IPAddressDeny  []string `codec:"ip_address_deny"`
+	// NUMANode binds the machine's memory and CPUs to the given NUMA nodes, e.g. "0" or "0-1", via
+	// NUMAPolicy=bind, NUMAMask= and CPUAffinity=numa. Requires KeepUnit.
+	NUMANode string `codec:"numa_node"`
+	// Memory tunes the swap and huge pages of the machine's unit. Requires KeepUnit.
+	Memory Memory `codec:"memory"`
+	// PidsLimit is the max number of tasks in the machine's unit, set as TasksMax= once the machine is
+	// started. Defaults to default_pids_limit of the plugin config.
+	PidsLimit int `codec:"pids_limit"`
+	// IOLimit limits the bandwidth and I/O operations of the machine's unit per block device. Requires
+	// KeepUnit.
+	IOLimit []IOLimit `codec:"io_limit"`
+	// CgroupDelegate sets Delegate=yes on the machine's unit, so a systemd booted in the container or
+	// container runtimes inside can manage their own sub-cgroups. Transient units and the scopes nspawn
+	// creates without KeepUnit are always delegated, this pins it for systemd-nspawn@.service units whose
+	// defaults may be overridden on the host.
+	CgroupDelegate bool `codec:"cgroup_delegate"`
+	// Nesting allows running nspawn or podman inside the container, by adding CAP_NET_ADMIN, the
+	// @keyring and bpf system calls, binding /dev/fuse and /dev/net/tun, and delegating the cgroup.
+	// Nested containers with private users need a PrivateUsers range larger than 65536, e.g.
+	// "pick" is too small.
+	Nesting bool `codec:"nesting"`
+	// Register controls whether the machine is registered with systemd-machined, defaults to true.
+	// Machines not registered are invisible to machinectl.
+	Register bool `codec:"register"`
+	// KeepUnit controls whether nspawn uses the machine's unit instead of creating a new scope
+	// unit for the container, defaults to true.
+	KeepUnit bool `codec:"keep_unit"`
+
+	// Driver section, which will not be written into nspawn file.
+
+	// BootTimeout is the time to wait for the machine to become ready, the
+	// machine will be terminated and task failed if it's not ready in time.
+	// Defaults to 5m.
+	BootTimeout string `codec:"boot_timeout"`
+	// WaitForPorts is the time to wait for the TCP container ports of Port to accept connections once
+	// the machine is started, so the task only becomes running once its service is up. The task fails
+	// if they don't in time. Disabled if empty.
+	WaitForPorts string `codec:"wait_for_ports"`
+	// ExecUser overrides the user which commands run by ExecTask run as, defaults to User.
+	ExecUser string `codec:"exec_user"`
+	// MountTaskDirs binds the task's alloc, local and secrets dirs into the container at /alloc, /local
+	// and /secrets, defaults to true.
+	MountTaskDirs bool `codec:"mount_task_dirs"`
+	// ExposeRootfs exposes the container's root read-only in the task dir for debugging, so it can be
+	// browsed via `nomad alloc fs`. Requires Register.
+	ExposeRootfs bool `codec:"expose_rootfs"`
+	// Checkpoint dumps the container with CRIU into the alloc dir when the task is stopped, and
+	// restores it when the task is started again. Experimental, requires criu in plugin config,
+	// and doesn't support private networking.
+	Checkpoint bool `codec:"checkpoint"`
+	// DiskLimit caps the size of the machine's image, e.g. "10G", so writes fail instead of filling the
+	// host volume. Nomad v0.9 doesn't pass ephemeral_disk to drivers, so it should be set to the same size.
+	// Requires /var/lib/machines to be btrfs with quotas, raw images are grown to the size instead.
+	DiskLimit string `codec:"disk_limit"`
+	// TransientUnit runs the machine in a transient unit with all options passed on the command line,
+	// instead of systemd-nspawn@.service with an nspawn file, which skips writing to /etc and reloading
+	// systemd.
+	TransientUnit bool `codec:"transient_unit"`
+	// Class is the class of the machine, either "container" (default) run by nspawn, or "vm" for a
+	// lightweight virtual machine run by systemd-vmspawn, which boots the image with its own kernel.
+	// vm requires TransientUnit and systemd 256, and doesn't support options only applying to
+	// containers, see vmUnsupportedOptions. Commands can't be executed in VMs.
+	Class string `codec:"class"`
+	// VM configures the virtual machine if Class is "vm".
+	VM VM `codec:"vm"`
+	// ExtraArgs are passed to nspawn as is in transient units, e.g. ["--suppress-sync=yes"], to use flags
+	// the driver doesn't support yet. Only the flags in extraArgsAllowlist are accepted.
+	ExtraArgs []string `codec:"extra_args" ini:"-"`
+	// RootLocation is where the machine's root is placed, either "machines" (default) for
+	// /var/lib/machines, or "alloc" for the task's local dir, so the ephemeral_disk sticky and
+	// migrate options keep the container's changes. The root in the local dir is reused if it exists.
+	RootLocation string `codec:"root_location"`
+	// StopMode controls how the machine is stopped if the task has no kill_signal: "poweroff" asks
+	// systemd as the container's init for an orderly shutdown, "terminate" (default) terminates the
+	// machine via machined, and "kill" kills all its processes at once. poweroff requires Register.
+	StopMode string `codec:"stop_mode"`
+	// ExportJournal exports the container's journal into the alloc's logs dir as
+	// <task>.journal.export when the task is destroyed. Requires link_journal to be host or guest.
+	ExportJournal bool `codec:"export_journal"`
+	// Coredumps controls what happens with core dumps of the container's processes recorded by the
+	// host's systemd-coredump: "off" (default) ignores them, "event" emits a task event with the path
+	// of the dump, and "copy" copies the dump into the alloc's logs dir as well.
+	Coredumps string `codec:"coredumps"`
+	// CoredumpMaxSize is the maximum size of dumps copied into the alloc dir, defaults to "100M".
+	CoredumpMaxSize string `codec:"coredump_max_size"`
+	// PreStartHook is run on the host before the machine is started, a failure fails the task unless
+	// ignore_failure is set.
+	PreStartHook Hook `codec:"pre_start_hook"`
+	// PostStopHook is run on the host once the machine is destroyed, or failed to be created.
+	PostStopHook Hook `codec:"post_stop_hook"`
+
+	bootTimeout     time.Duration
+	waitForPorts    time.Duration
+	diskLimit       uint64
+	coredumpMaxSize uint64
+	// rootDirectory is the root of the machine placed in the alloc dir
+	rootDirectory string
+	// ports is resolved from Port
+	ports []portMapping
+	// settingsFile is the content of NspawnSettingsFile or of the image's
+	// settings if RespectImageSettings is set
+	settingsFile string
+}
+
+// userNameRegexp matches valid UNIX user names.
+var userNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// validate checks the task config and parses fields which need it.
+func (c *TaskConfig) validate() error {
+	if err := validateINIValues(c); err != nil {
+		return err
+	}
+	if err := c.validateArch(); err != nil {
+		return err
+	}
+	if err := c.validateImage(); err != nil {
+		return err
+	}
+	if err := c.validateImageBuild(); err != nil {
+		return err
+	}
+	if err := c.validateBootstrap(); err != nil {
+		return err
+	}
+	if err := validateSyscallFilter(c.SystemCallFilter); err != nil {
+		return err
+	}
+	if err := c.validatePersonality(); err != nil {
+		return err
+	}
+	if err := c.validateEnvFiles(); err != nil {
+		return err
+	}
+	if err := validateParameters(c.Parameters); err != nil {
+		return err
+	}
+	if c.KillSignal != "" {
+		sig, err := parseSignal(c.KillSignal)
+		if err != nil {
+			return fmt.Errorf("invalid kill_signal: %v", err)
+		}
+		c.KillSignal = signalName(sig)
+	}
+	for _, b := range c.Bind {
+		if err := b.validate(); err != nil {
+			return err
+		}
+	}
+	for _, u := range c.BindUser {
+		if !userNameRegexp.MatchString(u) {
+			return fmt.Errorf("invalid bind_user %q", u)
+		}
+	}
+	if len(c.BindUser) > 0 && (c.PrivateUsers == "" || c.PrivateUsers == "no") {
+		return fmt.Errorf("bind_user requires private_users to be enabled")
+	}
+	if c.ExecUser != "" && !userNameRegexp.MatchString(c.ExecUser) {
+		return fmt.Errorf("invalid exec_user %q", c.ExecUser)
+	}
+	if c.ExposeRootfs && !c.Register {
+		return fmt.Errorf("expose_rootfs requires register to be enabled")
+	}
+	if c.Slice != "" && !strings.HasSuffix(c.Slice, ".slice") {
+		return fmt.Errorf("invalid slice %q", c.Slice)
+	}
+	if err := c.validateVolatile(); err != nil {
+		return err
+	}
+	if err := c.validatePrivateUsersOwnership(); err != nil {
+		return err
+	}
+	if err := c.validateOverlays(); err != nil {
+		return err
+	}
+	if err := c.validateLinkSpecs(); err != nil {
+		return err
+	}
+	if err := c.validateNetworkInterfaces(); err != nil {
+		return err
+	}
+	if err := validateZone(c.Zone); err != nil {
+		return err
+	}
+	if err := c.validatePorts(); err != nil {
+		return err
+	}
+	if err := c.validateFirewall(); err != nil {
+		return err
+	}
+	if err := c.validateIPAccess(); err != nil {
+		return err
+	}
+	if err := c.validateNUMANode(); err != nil {
+		return err
+	}
+	if err := c.validateMemory(); err != nil {
+		return err
+	}
+	if c.PidsLimit < 0 {
+		return fmt.Errorf("invalid pids_limit %d", c.PidsLimit)
+	}
+	if err := c.validateIOLimits(); err != nil {
+		return err
+	}
+	if err := c.validateNesting(); err != nil {
+		return err
+	}
+	if err := c.validateCheckpoint(); err != nil {
+		return err
+	}
+	if err := c.validateCredentials(); err != nil {
+		return err
+	}
+	if err := c.validateDiskLimit(); err != nil {
+		return err
+	}
+	if err := c.validateRootLocation(); err != nil {
+		return err
+	}
+	if err := c.validateExtraArgs(); err != nil {
+		return err
+	}
+	if err := c.validateClass(); err != nil {
+		return err
+	}
+	if err := c.validateSettingsFile(); err != nil {
+		return err
+	}
+	if err := c.validateStopMode(); err != nil {
+		return err
+	}
+	if err := c.validateExportJournal(); err != nil {
+		return err
+	}
+	if err := c.validateCoredumps(); err != nil {
+		return err
+	}
+	if err := c.PreStartHook.validate(hookPreStart); err != nil {
+		return err
+	}
+	if err := c.PostStopHook.validate(hookPostStop); err != nil {
+		return err
+	}
+	if err := c.validateStaticAddress(); err != nil {
+		return err
+	}
+	if err := c.HostNetwork.validate(c); err != nil {
+		return err
+	}
+	if err := c.NetworkBandwidth.validate(c); err != nil {
+		return err
+	}
+	if err := c.DNS.validate(c); err != nil {
+		return err
+	}
+
+	c.bootTimeout = defaultBootTimeout
+	if c.BootTimeout != "" {
+		t, err := time.ParseDuration(c.BootTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid boot_timeout %q: %v", c.BootTimeout, err)
+		}
+		c.bootTimeout = t
+	}
+	return nil
 }
 
 // TaskState is the state which is encoded in the handle returned in
 // StartTask. This information is needed to rebuild the task state and handler
 // during recovery.
 type TaskState struct {
+	// Version is the version of the encoding, see taskStateVersion.
+	Version     int
 	TaskConfig  *drivers.TaskConfig
 	MachineName string
 	StartedAt   time.Time
+	// Unregistered is true if the machine is not registered with machined.
+	Unregistered bool
+	Hostname     string
+	MachineID    string
+	Zone         string
+	Ports        []portMapping
+	// UnitName is the unit of the machine if it's not the default one,
+	// e.g. the machine is restored from a checkpoint.
+	UnitName   string
+	Checkpoint bool
+	StopMode   string
+	// ExportJournal is true if the journal is exported on destroy.
+	ExportJournal   bool
+	Coredumps       string
+	CoredumpMaxSize uint64
+	PostStopHook    Hook
+	IPAccounting    bool
+	// DriverVersion is the version of the plugin which started the task.
+	DriverVersion string
+	// ImageDigest is the digest of the machine's image if it's pinned.
+	ImageDigest string
+	// NSpawnFile is the path of the machine's nspawn file, empty for
+	// transient units.
+	NSpawnFile string
+	// UIDShift and UIDRange are the user namespace mapping of the machine,
+	// both are 0 if it doesn't use user namespacing.
+	UIDShift uint32
+	UIDRange uint32
+	// PortForwarding is true if the driver created nftables rules
+	// forwarding the ports.
+	PortForwarding bool
+	// Firewall is true if the driver created the nftables rules of the
+	// task's firewall.
+	Firewall bool
 }
 
 // NewSystemdNSpawnDriver returns a new DriverPlugin implementation
 func NewSystemdNSpawnDriver(logger log.Logger) drivers.DriverPlugin {
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.Named(pluginName)
-	return &Driver{
+	d := &Driver{
 		eventer:        eventer.NewEventer(ctx, logger),
-		config:         &Config{},
+		config:         &Config{fingerprintInterval: defaultFingerprintInterval},
+		tasks:          newTaskStore(),
+		zones:          newZoneStore(),
+		ports:          newPortStore(),
+		transfers:      newTransferStore(),
+		subsystems:     newSubsystemRegistry(ctx),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
 	}
+	d.reloader = newReloader(d.reloadSystemd)
+	return d
 }
 
 // PluginInfo implements BasePlugin's PluginInfo.
@@ -316,80 +1160,848 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if config.GC.Interval != "" {
+		t, err := time.ParseDuration(config.GC.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid gc.interval %q: %v", config.GC.Interval, err)
+		}
+		config.GC.interval = t
+	}
+	if config.GC.CreationGrace != "" {
+		t, err := time.ParseDuration(config.GC.CreationGrace)
+		if err != nil {
+			return fmt.Errorf("invalid gc.creation_grace %q: %v", config.GC.CreationGrace, err)
+		}
+		config.GC.creationGrace = t
+	}
+
+	config.fingerprintInterval = defaultFingerprintInterval
+	if config.FingerprintInterval != "" {
+		t, err := time.ParseDuration(config.FingerprintInterval)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid fingerprint_interval %q", config.FingerprintInterval)
+		}
+		config.fingerprintInterval = t
+	}
+
+	if config.LivenessInterval != "" {
+		t, err := time.ParseDuration(config.LivenessInterval)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid liveness_interval %q", config.LivenessInterval)
+		}
+		config.livenessInterval = t
+	}
+
+	if config.MinFreeSpace != "" {
+		size, err := parseBytes(config.MinFreeSpace)
+		if err != nil || size == math.MaxUint64 {
+			return fmt.Errorf("invalid min_free_space %q", config.MinFreeSpace)
+		}
+		config.minFreeSpace = size
+	}
+
+	if config.MaxConcurrentPulls < 0 {
+		return fmt.Errorf("invalid max_concurrent_pulls %d", config.MaxConcurrentPulls)
+	}
+	d.transfers.SetLimit(config.MaxConcurrentPulls)
+
+	if config.MaxConcurrentStarts < 0 {
+		return fmt.Errorf("invalid max_concurrent_starts %d", config.MaxConcurrentStarts)
+	}
+	if config.MaxConcurrentStarts > 0 {
+		d.startSlots = make(chan struct{}, config.MaxConcurrentStarts)
+	} else {
+		d.startSlots = nil
+	}
+
+	if config.DefaultPidsLimit < 0 {
+		return fmt.Errorf("invalid default_pids_limit %d", config.DefaultPidsLimit)
+	}
+
+	if err := config.PreStartHook.validate(hookPreStart); err != nil {
+		return err
+	}
+	if err := config.PostStopHook.validate(hookPostStop); err != nil {
+		return err
+	}
+	if err := config.PeerCache.validate(); err != nil {
+		return err
+	}
+	for _, p := range config.PeerCache.Peers {
+		if strings.HasPrefix(strings.ToLower(p), "http://") {
+			d.logger.Warn("peer_cache peer uses plain http, which exposes the token", "peer", p)
+		}
+	}
+
+	for _, image := range config.PrepullImages {
+		ref, err := parseImageRef(image)
+		if err != nil {
+			return fmt.Errorf("invalid prepull_images: %v", err)
+		}
+		if ref.Digest == "" {
+			return fmt.Errorf("invalid prepull_images: %q is not pinned by digest", image)
+		}
+	}
+
+	d.configLock.Lock()
 	d.config = &config
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
 	}
+	d.configLock.Unlock()
+
+	if (config.GC.DanglingMachines || config.GC.DanglingNSpawnFiles) && config.GC.interval > 0 {
+		d.reconcilerOnce.Do(func() {
+			if err := d.subsystems.Go(d.ctx, "reconcile", d.reconcileDangling); err != nil {
+				d.logger.Warn("failed to start reconciler", "error", err)
+			}
+		})
+	}
+	if len(config.PrepullImages) > 0 {
+		d.prepullOnce.Do(func() {
+			err := d.subsystems.Go(d.ctx, "prepull", func(ctx context.Context) {
+				d.prepullImages(ctx, config.PrepullImages)
+			})
+			if err != nil {
+				d.logger.Warn("failed to prepull images", "error", err)
+			}
+		})
+	}
+	if config.PeerCache.Listen != "" {
+		d.peerCacheOnce.Do(func() {
+			err := d.subsystems.Go(d.ctx, "peer_cache", func(ctx context.Context) {
+				d.servePeerCache(ctx, config.PeerCache)
+			})
+			if err != nil {
+				d.logger.Warn("failed to serve image cache to peers", "error", err)
+			}
+		})
+	}
+	if config.livenessInterval > 0 {
+		d.livenessOnce.Do(func() {
+			if err := d.subsystems.Go(d.ctx, "liveness", d.probeMachines); err != nil {
+				d.logger.Warn("failed to start liveness prober", "error", err)
+			}
+		})
+	}
 
 	return nil
 }
 
 // Shutdown will shutdown current driver.
+//
+// It isn't part of the DriverPlugin interface, the plugin process is killed
+// instead, so it's only used internally and by tests. Machines keep running,
+// since a restarted driver recovers their tasks. Only the subsystems of the
+// driver are stopped, and Shutdown waits for them to exit, so none of them
+// is still talking to systemd once it returns.
 func (d *Driver) Shutdown(ctx context.Context) error {
-	panic("implement me")
+	d.signalShutdown()
+	return d.subsystems.Wait(ctx)
 }
 
 // TaskConfigSchema implements DriverPlugin's TaskConfigSchema.
 func (d *Driver) TaskConfigSchema() (*hclspec.Spec, error) {
-	panic("implement me")
+	return taskConfigSpec, nil
 }
 
 // Capabilities implements DriverPlugin's Capabilities.
 func (d *Driver) Capabilities() (*drivers.Capabilities, error) {
-	panic("implement me")
+	return capabilities, nil
 }
 
 // Fingerprint implements DriverPlugin's Fingerprint.
 func (d *Driver) Fingerprint(ctx context.Context) (<-chan *drivers.Fingerprint, error) {
-	panic("implement me")
+	ch := make(chan *drivers.Fingerprint)
+	err := d.subsystems.Go(ctx, "fingerprint", func(ctx context.Context) {
+		d.handleFingerprint(ctx, ch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (d *Driver) handleFingerprint(ctx context.Context, ch chan<- *drivers.Fingerprint) {
+	defer close(ch)
+
+	ticker := time.NewTimer(0)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ticker.Reset(d.loadConfig().fingerprintInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- d.buildFingerprint():
+		}
+	}
+}
+
+func (d *Driver) buildFingerprint() *drivers.Fingerprint {
+	if !d.loadConfig().Enabled {
+		return &drivers.Fingerprint{
+			Health:            drivers.HealthStateUndetected,
+			HealthDescription: "disabled",
+		}
+	}
+
+	if _, err := getConn(); err != nil {
+		return &drivers.Fingerprint{
+			Health:            drivers.HealthStateUnhealthy,
+			HealthDescription: fmt.Sprintf("unhealthy: failed to connect to %v", err),
+		}
+	}
+
+	attrs := map[string]*pstructs.Attribute{
+		"driver.systemd-nspawn": pstructs.NewBoolAttribute(true),
+	}
+	var problems []string
+	if version, err := getSystemdVersion(d.ctx); err != nil {
+		d.logger.Warn("failed to detect systemd version", "error", err)
+		problems = append(problems, fmt.Sprintf("systemd: %v", err))
+	} else {
+		d.versionLock.Lock()
+		d.version = version
+		d.versionLock.Unlock()
+		attrs["driver.systemd-nspawn.version"] = pstructs.NewIntAttribute(int64(version), "")
+		attrs["driver.systemd-nspawn.features"] = pstructs.NewStringAttribute(strings.Join(supportedFeatures(version), ","))
+	}
+	if personalities := supportedPersonalities(); len(personalities) > 0 {
+		attrs["driver.systemd-nspawn.personalities"] = pstructs.NewStringAttribute(strings.Join(personalities, ","))
+	}
+	verity, signatures := verityAttributes()
+	attrs["driver.systemd-nspawn.verity"] = pstructs.NewBoolAttribute(verity)
+	attrs["driver.systemd-nspawn.verity_signatures"] = pstructs.NewBoolAttribute(signatures)
+	attrs["driver.systemd-nspawn.mymachines"] = pstructs.NewBoolAttribute(mymachinesEnabled())
+	for k, v := range d.zoneAttributes() {
+		attrs[k] = v
+	}
+	for k, v := range dbusAttributes() {
+		attrs[k] = v
+	}
+	for k, v := range d.transferAttributes() {
+		attrs[k] = v
+	}
+	for k, v := range d.poolAttributes() {
+		attrs[k] = v
+	}
+	for k, v := range numaAttributes() {
+		attrs[k] = v
+	}
+	attrs["driver.systemd-nspawn.nesting"] = pstructs.NewBoolAttribute(nestingSupported())
+
+	problems = append(problems, checkHealth(d.ctx)...)
+	health := drivers.HealthStateHealthy
+	if len(problems) > 0 {
+		health = drivers.HealthStateUnhealthy
+	}
+	return &drivers.Fingerprint{
+		Attributes:        attrs,
+		Health:            health,
+		HealthDescription: healthDescription(problems),
+	}
+}
+
+// loadConfig returns the driver configuration. SetConfig replaces the config
+// instead of modifying it, so operations reading several options should load
+// it once to see them consistently.
+func (d *Driver) loadConfig() *Config {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
+// systemdVersion returns the major version of the host's systemd, or 0 if
+// it's not detected yet.
+func (d *Driver) systemdVersion() int {
+	d.versionLock.RLock()
+	defer d.versionLock.RUnlock()
+	return d.version
 }
 
 // RecoverTask implements DriverPlugin's RecoverTask.
 func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
-	panic("implement me")
+	if handle == nil {
+		return fmt.Errorf("handle cannot be nil")
+	}
+
+	if _, ok := d.tasks.Get(handle.Config.ID); ok {
+		return nil
+	}
+
+	taskState, err := decodeTaskState(handle)
+	if err != nil {
+		return fmt.Errorf("failed to decode task state from handle: %v", err)
+	}
+	if taskState.Version > taskStateVersion {
+		d.logger.Warn("task state is newer than the driver, recovering known fields only",
+			"machine", taskState.MachineName, "version", taskState.Version)
+	}
+
+	h := &taskHandle{
+		driver:          d,
+		logger:          d.logger.With("machine", taskState.MachineName),
+		machineName:     taskState.MachineName,
+		unitName:        unitName(taskState.MachineName),
+		doneCh:          make(chan struct{}),
+		taskConfig:      taskState.TaskConfig,
+		procState:       drivers.TaskStateRunning,
+		startedAt:       taskState.StartedAt,
+		exitResult:      &drivers.ExitResult{},
+		unregistered:    taskState.Unregistered,
+		hostname:        taskState.Hostname,
+		machineID:       taskState.MachineID,
+		zone:            taskState.Zone,
+		ports:           taskState.Ports,
+		checkpoint:      taskState.Checkpoint,
+		stopMode:        taskState.StopMode,
+		exportJournal:   taskState.ExportJournal,
+		coredumps:       taskState.Coredumps,
+		coredumpMaxSize: taskState.CoredumpMaxSize,
+		postStopHook:    taskState.PostStopHook,
+		ipAccounting:    taskState.IPAccounting,
+		imageDigest:     taskState.ImageDigest,
+		nspawnFile:      taskState.NSpawnFile,
+		uidShift:        taskState.UIDShift,
+		uidRange:        taskState.UIDRange,
+		portForwarding:  taskState.PortForwarding,
+		firewall:        taskState.Firewall,
+	}
+	if taskState.UnitName != "" {
+		h.unitName = taskState.UnitName
+	}
+	if taskState.DriverVersion != pluginInfo.PluginVersion {
+		h.logger.Info("recovering task started by another driver version", "version", taskState.DriverVersion)
+	}
+
+	if err := d.migrateNSpawnFile(h.machineName); err != nil {
+		d.logger.Warn("failed to migrate nspawn file", "machine", h.machineName, "error", err)
+	}
+
+	if err := d.startTaskSubsystems(h); err != nil {
+		return err
+	}
+
+	// The machine already publishes its ports, even if they collide.
+	if err := d.ports.Reserve(taskState.TaskConfig.ID, h.ports); err != nil {
+		h.logger.Warn("failed to reserve ports", "error", err)
+	}
+	d.acquireZone(h.zone)
+	d.tasks.Set(taskState.TaskConfig.ID, h)
+	return nil
+}
+
+// startTaskSubsystems starts watching the machine of the task, the watchers
+// are stopped once the task is destroyed.
+func (d *Driver) startTaskSubsystems(h *taskHandle) error {
+	h.ctx, h.cancel = context.WithCancel(d.ctx)
+	if err := d.subsystems.Go(h.ctx, "watch/"+h.machineName, h.run); err != nil {
+		h.cancel()
+		return err
+	}
+
+	if h.coredumps == coredumpsEvent || h.coredumps == coredumpsCopy {
+		if err := d.subsystems.Go(h.ctx, "coredumps/"+h.machineName, h.watchCoredumps); err != nil {
+			h.cancel()
+			return err
+		}
+	}
+
+	// machined doesn't know the addresses of unregistered machines.
+	if !h.unregistered {
+		if err := d.subsystems.Go(h.ctx, "addresses/"+h.machineName, h.watchAddresses); err != nil {
+			h.cancel()
+			return err
+		}
+	}
+	return nil
 }
 
 // StartTask implements DriverPlugin's StartTask.
 func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
-	panic("implement me")
+	if _, ok := d.tasks.Get(cfg.ID); ok {
+		return nil, nil, fmt.Errorf("task with ID %q already started", cfg.ID)
+	}
+
+	var taskConfig TaskConfig
+	if err := cfg.DecodeDriverConfig(&taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
+	}
+	if err := taskConfig.validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+
+	if taskConfig.Hostname == "" {
+		taskConfig.Hostname = defaultHostname(cfg)
+	}
+	if taskConfig.MachineID == "" {
+		taskConfig.MachineID = defaultMachineID(cfg)
+	}
+	if err := d.checkFeatures(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+	if err := loadEnvFiles(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to load env_file: %v", err)
+	}
+	if err := loadSettingsFile(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to load nspawn_settings_file: %v", err)
+	}
+	config := d.loadConfig()
+	if taskConfig.Checkpoint && !config.CRIU {
+		return nil, nil, fmt.Errorf("checkpoint requires criu to be enabled in plugin config")
+	}
+	if err := checkVMSpawn(&taskConfig); err != nil {
+		return nil, nil, err
+	}
+
+	defer d.trackStarting(machineName(cfg))()
+
+	release, err := d.acquireStartSlot(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	ports, err := resolvePorts(cfg, taskConfig.Port)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid driver config: %v", err)
+	}
+	if err := d.ports.Reserve(cfg.ID, ports); err != nil {
+		return nil, nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			d.ports.Release(cfg.ID)
+		}
+	}()
+	taskConfig.ports = ports
+	taskConfig.setupAddressEnv()
+
+	setupTaskDirs(cfg, &taskConfig)
+	setupNesting(&taskConfig)
+	if err := setupVM(cfg, &taskConfig); err != nil {
+		return nil, nil, err
+	}
+	setupTmpfsSizes(cfg, &taskConfig)
+	if err := setupOverlays(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to setup overlays: %v", err)
+	}
+	if err := d.setupStaticAddress(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to setup static address: %v", err)
+	}
+	if err := d.setupDNS(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to setup dns: %v", err)
+	}
+	if err := d.setupNetworkInterfaces(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to setup macvlan: %v", err)
+	}
+	if err := setupCredentials(cfg, &taskConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to setup credentials: %v", err)
+	}
+
+	if err := d.runHooks(cfg, hookPreStart, config.PreStartHook, taskConfig.PreStartHook); err != nil {
+		if err := d.RemoveMachine(machineName(cfg), machineTables{}); err != nil {
+			d.logger.Warn("failed to remove machine", "error", err)
+		}
+		return nil, nil, err
+	}
+
+	d.acquireZone(taskConfig.Zone)
+
+	var m *Machine
+	if taskConfig.Checkpoint {
+		m, err = d.restoreMachine(cfg)
+		if err != nil {
+			d.logger.Warn("failed to restore checkpoint, booting instead", "error", err)
+			m = nil
+		}
+	}
+	restored := m != nil
+
+	createdAt := time.Now()
+	if !restored {
+		m, err = d.CreateMachine(cfg, taskConfig)
+	}
+	if err != nil {
+		// CreateMachine stops the unit of machines which failed to boot.
+		d.cleanupFailedStart(cfg, taskConfig, nil, false)
+		if line := d.scrapeJournal(d.ctx, cfg, taskConfig.machineUnitName(machineName(cfg)), createdAt); line != "" {
+			return nil, nil, fmt.Errorf("failed to create machine: %v: %s", err, line)
+		}
+		return nil, nil, fmt.Errorf("failed to create machine: %v", err)
+	}
+
+	unregistered := !taskConfig.Register || restored
+	if err := d.setupHostNetwork(m, taskConfig.HostNetwork); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to setup host network: %v", err)
+	}
+
+	if err := d.setupBandwidth(m, taskConfig.NetworkBandwidth); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to setup network bandwidth: %v", err)
+	}
+
+	if err := d.setupPortForwarding(m, taskConfig); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to setup port forwarding: %v", err)
+	}
+
+	if err := d.setupFirewall(m, taskConfig); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to setup firewall: %v", err)
+	}
+
+	if err := d.waitForPorts(m, taskConfig); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to wait for ports: %v", err)
+	}
+
+	props := resourceProperties(cfg.Resources)
+	if limit := pidsLimit(taskConfig.PidsLimit, config.DefaultPidsLimit); limit > 0 {
+		props = append(props, uint64Property("TasksMax", uint64(limit)))
+	}
+	if len(props) > 0 {
+		err := callDBus(d.ctx, "SetUnitProperties", func(c *systemdConn) error {
+			return c.systemd.SetUnitProperties(m.Unit, true, props...)
+		})
+		if err != nil {
+			d.logger.Warn("failed to apply resources", "machine", m.Name, "error", err)
+		}
+	}
+	if err := d.setupHugeTLB(m.Unit, taskConfig.Memory.HugeTLB); err != nil {
+		d.logger.Warn("failed to apply hugetlb limits", "machine", m.Name, "error", err)
+	}
+
+	if taskConfig.ExposeRootfs {
+		if err := exposeRootfs(cfg, m); err != nil {
+			d.logger.Warn("failed to expose machine root", "machine", m.Name, "error", err)
+		}
+	}
+
+	var imageDigest string
+	if taskConfig.Image != "" {
+		if ref, err := parseImageRef(taskConfig.Image); err == nil {
+			imageDigest = ref.Digest
+		}
+	}
+	var nspawnFile string
+	if !taskConfig.TransientUnit {
+		nspawnFile = nspawnPath(d.nspawnDir(), m.Name)
+	}
+	var uidShift, uidRange uint32
+	if taskConfig.PrivateUsers != "" && taskConfig.PrivateUsers != "no" && m.Leader > 0 {
+		if uidShift, uidRange, err = readUIDShift(m.Leader); err != nil {
+			d.logger.Warn("failed to read machine uid shift", "machine", m.Name, "error", err)
+		}
+	}
+
+	h := &taskHandle{
+		driver:          d,
+		logger:          d.logger.With("machine", m.Name),
+		machineName:     m.Name,
+		unitName:        m.Unit,
+		doneCh:          make(chan struct{}),
+		taskConfig:      cfg,
+		procState:       drivers.TaskStateRunning,
+		startedAt:       time.Now().Round(time.Millisecond),
+		unregistered:    unregistered,
+		hostname:        taskConfig.Hostname,
+		machineID:       taskConfig.MachineID,
+		zone:            taskConfig.Zone,
+		ports:           taskConfig.ports,
+		checkpoint:      taskConfig.Checkpoint,
+		stopMode:        taskConfig.StopMode,
+		exportJournal:   taskConfig.ExportJournal,
+		coredumps:       taskConfig.Coredumps,
+		coredumpMaxSize: taskConfig.coredumpMaxSize,
+		postStopHook:    taskConfig.PostStopHook,
+		ipAccounting:    taskConfig.IPAccounting,
+		imageDigest:     imageDigest,
+		nspawnFile:      nspawnFile,
+		uidShift:        uidShift,
+		uidRange:        uidRange,
+		portForwarding:  taskConfig.nftablesPorts(),
+		firewall:        taskConfig.Firewall.enabled(),
+	}
+
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+
+	taskState := TaskState{
+		Version:         taskStateVersion,
+		TaskConfig:      cfg,
+		MachineName:     m.Name,
+		StartedAt:       h.startedAt,
+		Unregistered:    h.unregistered,
+		Hostname:        h.hostname,
+		MachineID:       h.machineID,
+		Zone:            h.zone,
+		Ports:           h.ports,
+		UnitName:        h.unitName,
+		Checkpoint:      h.checkpoint,
+		StopMode:        h.stopMode,
+		ExportJournal:   h.exportJournal,
+		Coredumps:       h.coredumps,
+		CoredumpMaxSize: h.coredumpMaxSize,
+		PostStopHook:    h.postStopHook,
+		IPAccounting:    h.ipAccounting,
+		DriverVersion:   pluginInfo.PluginVersion,
+		ImageDigest:     h.imageDigest,
+		NSpawnFile:      h.nspawnFile,
+		UIDShift:        h.uidShift,
+		UIDRange:        h.uidRange,
+		PortForwarding:  h.portForwarding,
+		Firewall:        h.firewall,
+	}
+	if err := handle.SetDriverState(&taskState); err != nil {
+		d.logger.Error("failed to set driver state", "error", err)
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
+	}
+
+	if err := d.startTaskSubsystems(h); err != nil {
+		d.cleanupFailedStart(cfg, taskConfig, m, unregistered)
+		return nil, nil, err
+	}
+
+	d.tasks.Set(cfg.ID, h)
+	started = true
+	return handle, d.buildDriverNetwork(m, taskConfig), nil
+}
+
+// cleanupFailedStart tears down a task which failed to start, like
+// DestroyTask does for started tasks. The machine is stopped, everything set
+// up for it is removed once it's gone and the post-stop hooks are run. m is
+// nil if the machine wasn't created, whose unit CreateMachine already stopped.
+func (d *Driver) cleanupFailedStart(cfg *drivers.TaskConfig, taskConfig TaskConfig, m *Machine, unregistered bool) {
+	name, unit := machineName(cfg), taskConfig.machineUnitName(machineName(cfg))
+	if m != nil {
+		name, unit = m.Name, m.Unit
+		var err error
+		if unregistered {
+			err = d.stopUnit(unit)
+		} else {
+			err = d.TerminateMachine(name)
+		}
+		if err != nil {
+			d.logger.Error("failed to terminate machine", "machine", name, "error", err)
+		}
+	}
+	if err := d.waitMachineStopped(name, unit, time.Now().Add(machineStopTimeout)); err != nil {
+		d.logger.Warn("failed to wait for machine to stop", "machine", name, "error", err)
+	}
+
+	if err := unexposeRootfs(cfg); err != nil {
+		d.logger.Error("failed to unmount machine root", "machine", name, "error", err)
+	}
+	tables := machineTables{portForwarding: taskConfig.nftablesPorts(), firewall: taskConfig.Firewall.enabled()}
+	if err := d.RemoveMachine(name, tables); err != nil {
+		d.logger.Warn("failed to remove machine", "machine", name, "error", err)
+	}
+	d.releaseZone(taskConfig.Zone)
+	if err := d.runHooks(cfg, hookPostStop, taskConfig.PostStopHook, d.loadConfig().PostStopHook); err != nil {
+		d.logger.Warn("failed to run hook", "error", err)
+	}
 }
 
 // WaitTask implements DriverPlugin's WaitTask.
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	ch := make(chan *drivers.ExitResult)
+	err := d.subsystems.Go(ctx, "wait/"+h.machineName, func(ctx context.Context) {
+		d.handleWait(ctx, h, ch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (d *Driver) handleWait(ctx context.Context, h *taskHandle, ch chan<- *drivers.ExitResult) {
+	defer close(ch)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-h.ctx.Done():
+		return
+	case <-h.doneCh:
+	}
+
+	h.stateLock.RLock()
+	result := h.exitResult.Copy()
+	h.stateLock.RUnlock()
+
+	select {
+	case <-ctx.Done():
+	case <-h.ctx.Done():
+	case ch <- result:
+	}
 }
 
 // StopTask implements DriverPlugin's StopTask.
 func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) error {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	if h.checkpoint && !h.unregistered && h.IsRunning() {
+		if err := h.dumpCheckpoint(); err != nil {
+			h.logger.Warn("failed to checkpoint machine, stopping it", "error", err)
+		} else {
+			select {
+			case <-h.doneCh:
+				return nil
+			case <-time.After(timeout):
+				h.logger.Warn("machine didn't exit after checkpoint, stopping it")
+			}
+		}
+	}
+
+	return h.shutdown(d.ctx, timeout, signal)
 }
 
 // DestroyTask implements DriverPlugin's DestroyTask.
 func (d *Driver) DestroyTask(taskID string, force bool) error {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	if h.IsRunning() && !force {
+		return fmt.Errorf("cannot destroy running task")
+	}
+
+	if h.IsRunning() {
+		if err := h.shutdown(d.ctx, 0, "SIGKILL"); err != nil {
+			h.logger.Error("failed to kill machine", "error", err)
+		}
+	}
+	if err := d.waitMachineStopped(h.machineName, h.unitName, time.Now().Add(machineStopTimeout)); err != nil {
+		h.logger.Warn("failed to wait for machine to stop", "error", err)
+	}
+
+	// Stop the subsystems of the task before its machine goes away.
+	h.cancel()
+
+	// The journal linked by guest is in the machine's image.
+	if h.exportJournal {
+		if err := exportJournal(d.ctx, h.taskConfig, h.machineID); err != nil {
+			h.logger.Warn("failed to export journal", "error", err)
+		}
+	}
+
+	if err := unexposeRootfs(h.taskConfig); err != nil {
+		h.logger.Error("failed to unmount machine root", "error", err)
+	}
+	if err := d.RemoveMachine(h.machineName, machineTables{portForwarding: h.portForwarding, firewall: h.firewall}); err != nil {
+		h.logger.Error("failed to remove machine", "error", err)
+	}
+
+	d.releaseZone(h.zone)
+	d.ports.Release(taskID)
+	d.tasks.Delete(taskID)
+	return d.runHooks(h.taskConfig, hookPostStop, h.postStopHook, d.loadConfig().PostStopHook)
 }
 
 // InspectTask implements DriverPlugin's InspectTask.
 func (d *Driver) InspectTask(taskID string) (*drivers.TaskStatus, error) {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	return h.TaskStatus(), nil
 }
 
 // TaskStats implements DriverPlugin's TaskStats.
 func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	ch := make(chan *drivers.TaskResourceUsage)
+	err := d.subsystems.Go(ctx, "stats/"+h.machineName, func(ctx context.Context) {
+		d.handleStats(ctx, h, interval, ch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
 }
 
 // TaskEvents implements DriverPlugin's TaskEvents.
 func (d *Driver) TaskEvents(ctx context.Context) (<-chan *drivers.TaskEvent, error) {
-	panic("implement me")
+	return d.eventer.TaskEvents(ctx)
 }
 
 // SignalTask implements DriverPlugin's SignalTask.
 func (d *Driver) SignalTask(taskID string, signal string) error {
-	panic("implement me")
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return drivers.ErrTaskNotFound
+	}
+
+	// "freeze" and "thaw" are not signals, they pause and resume the
+	// machine via its cgroup.
+	switch strings.ToLower(signal) {
+	case "freeze":
+		return h.freeze(true)
+	case "thaw":
+		return h.freeze(false)
+	}
+
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+	return h.kill("leader", sig)
 }
 
+// driverCommandPrefix prefixes the commands of ExecTask which are handled by the
+// driver instead of running inside the machine, so that they don't shadow the
+// binaries of the container, e.g. "nspawn:console" instead of "console".
+const driverCommandPrefix = "nspawn:"
+
 // ExecTask implements DriverPlugin's ExecTask.
 func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
-	panic("implement me")
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("error cmd must have at least one value")
+	}
+
+	h, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+	if !h.IsRunning() {
+		return nil, fmt.Errorf("task %s is not running", taskID)
+	}
+
+	// Commands handled by the driver instead of running inside the machine.
+	switch cmd[0] {
+	case resourcesCommand:
+		return h.execResources(cmd[1:])
+	case consoleCommand:
+		return h.execConsole(cmd[1:])
+	case imageExportCommand:
+		return h.execImageExport(cmd[1:], timeout)
+	case imageImportCommand:
+		return h.execImageImport(cmd[1:], timeout)
+	}
+
+	return h.exec(cmd, timeout)
 }
@@ -0,0 +1,51 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+)
+
+// checkSpec checks that every field of typ with a codec tag can be set via
+// the object spec, recursing into blocks.
+func checkSpec(t *testing.T, path string, typ reflect.Type, spec *hclspec.Spec) {
+	for spec.GetDefault() != nil {
+		spec = spec.GetDefault().GetPrimary()
+	}
+	switch {
+	case spec.GetBlockValue() != nil:
+		spec = spec.GetBlockValue().GetNested()
+	case spec.GetBlockList() != nil:
+		spec = spec.GetBlockList().GetNested()
+	}
+	attrs := spec.GetObject().GetAttributes()
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("codec")
+		if tag == "" {
+			continue
+		}
+		s, ok := attrs[tag]
+		if !ok {
+			t.Errorf("%s%s is missing in the spec", path, tag)
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		for s.GetDefault() != nil {
+			s = s.GetDefault().GetPrimary()
+		}
+		if ft.Kind() == reflect.Struct && s.GetAttr() == nil {
+			checkSpec(t, path+tag+".", ft, s)
+		}
+	}
+}
+
+func TestConfigSpec(t *testing.T) {
+	checkSpec(t, "", reflect.TypeOf(Config{}), configSpec)
+	checkSpec(t, "", reflect.TypeOf(TaskConfig{}), taskConfigSpec)
+}
@@ -0,0 +1,91 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// envKeyRegexp matches valid names of environment variables.
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (c *TaskConfig) validateEnvFiles() error {
+	for _, p := range c.EnvFile {
+		if p == "" || filepath.IsAbs(p) || strings.HasPrefix(filepath.Clean(p), "..") {
+			return fmt.Errorf("env_file %q must be a path in the task dir", p)
+		}
+	}
+	return nil
+}
+
+// parseEnvFile parses KEY=VALUE lines, skipping empty lines and comments.
+// Lines may start with "export", and values may be quoted.
+func parseEnvFile(r io.Reader) (map[string]string, error) {
+	env := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing =", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if !envKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid name %q", n, key)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	return env, s.Err()
+}
+
+// loadEnvFiles adds the variables of the task's env files to Environment,
+// without overriding the ones set in the task config.
+func loadEnvFiles(cfg *drivers.TaskConfig, c *TaskConfig) error {
+	if len(c.EnvFile) == 0 {
+		return nil
+	}
+
+	loaded := map[string]string{}
+	for _, p := range c.EnvFile {
+		f, err := os.Open(filepath.Join(cfg.TaskDir().Dir, p))
+		if err != nil {
+			return err
+		}
+		env, err := parseEnvFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		for k, v := range env {
+			loaded[k] = v
+		}
+	}
+	if err := validateINIValue(reflect.ValueOf(loaded), "env_file"); err != nil {
+		return err
+	}
+
+	if c.Environment == nil {
+		c.Environment = map[string]string{}
+	}
+	for k, v := range loaded {
+		if _, ok := c.Environment[k]; !ok {
+			c.Environment[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateEnvFiles(t *testing.T) {
+	c := TaskConfig{EnvFile: []string{"local/app.env", "secrets/db.env"}}
+	if err := c.validateEnvFiles(); err != nil {
+		t.Error(err)
+	}
+
+	for _, p := range []string{"", "/etc/environment", "../other/local/app.env", "local/../../app.env"} {
+		c := TaskConfig{EnvFile: []string{p}}
+		if err := c.validateEnvFiles(); err == nil {
+			t.Errorf("%q: expected error", p)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	env, err := parseEnvFile(strings.NewReader(`
+# database
+DB_HOST=db.service.consul
+export DB_USER = web
+DB_PASSWORD="p#ss word"
+EMPTY=
+QUOTE='"'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"DB_HOST":     "db.service.consul",
+		"DB_USER":     "web",
+		"DB_PASSWORD": "p#ss word",
+		"EMPTY":       "",
+		"QUOTE":       `"`,
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected %v, got %v", expected, env)
+	}
+
+	for _, s := range []string{"NO_VALUE\n", "1ABC=x\n", "A B=x\n"} {
+		if _, err := parseEnvFile(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	local := cfg.TaskDir().LocalDir
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"a.env": "A=1\nB=1\nC=1\n",
+		"b.env": "B=2\n",
+		"c.env": "C=\"x\\\"\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := TaskConfig{
+		EnvFile:     []string{"local/a.env", "local/b.env"},
+		Environment: map[string]string{"C": "task"},
+	}
+	if err := loadEnvFiles(cfg, &c); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"A": "1", "B": "2", "C": "task"}; !reflect.DeepEqual(c.Environment, expected) {
+		t.Errorf("expected %v, got %v", expected, c.Environment)
+	}
+
+	for _, files := range [][]string{{"local/missing.env"}, {"local/c.env"}} {
+		c := TaskConfig{EnvFile: files}
+		if err := loadEnvFiles(cfg, &c); err == nil {
+			t.Errorf("%v: expected error", files)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// execArgs returns the arguments of systemd-run to run cmd inside the
+// machine, with the environment and working directory of the task.
+func execArgs(machineName string, taskConfig TaskConfig, cmd []string) []string {
+	args := []string{"--machine=" + machineName, "--quiet", "--wait", "--pipe", "--collect"}
+
+	user := taskConfig.User
+	if taskConfig.ExecUser != "" {
+		user = taskConfig.ExecUser
+	}
+	if user != "" {
+		args = append(args, "--uid="+user)
+	}
+	if taskConfig.WorkingDirectory != "" {
+		args = append(args, "--working-directory="+taskConfig.WorkingDirectory)
+	}
+
+	keys := make([]string, 0, len(taskConfig.Environment))
+	for k := range taskConfig.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--setenv="+k+"="+taskConfig.Environment[k])
+	}
+
+	args = append(args, "--")
+	return append(args, cmd...)
+}
+
+// exec runs cmd inside the machine via systemd-run, and waits for it to exit.
+func (h *taskHandle) exec(cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	if h.unregistered {
+		return nil, fmt.Errorf("exec requires the machine to be registered")
+	}
+
+	var taskConfig TaskConfig
+	if err := h.taskConfig.DecodeDriverConfig(&taskConfig); err != nil {
+		return nil, fmt.Errorf("failed to decode driver config: %v", err)
+	}
+	if taskConfig.Class == classVM {
+		return nil, fmt.Errorf("exec is not supported by class vm")
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "systemd-run", execArgs(h.machineName, taskConfig, cmd)...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	result := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
+	err := c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			result.ExitResult.ExitCode = status.ExitStatus()
+			if status.Signaled() {
+				result.ExitResult.Signal = int(status.Signal())
+			}
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("exec in machine %s: %v", h.machineName, err)
+	}
+
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	return result, nil
+}
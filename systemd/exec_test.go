@@ -0,0 +1,32 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecArgs(t *testing.T) {
+	taskConfig := TaskConfig{
+		User:             "web",
+		WorkingDirectory: "/srv",
+		Environment:      map[string]string{"B": "2", "A": "1"},
+	}
+
+	expected := []string{
+		"--machine=nomad-web-1234", "--quiet", "--wait", "--pipe", "--collect",
+		"--uid=web", "--working-directory=/srv", "--setenv=A=1", "--setenv=B=2",
+		"--", "ls", "-l",
+	}
+	if args := execArgs("nomad-web-1234", taskConfig, []string{"ls", "-l"}); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	taskConfig = TaskConfig{User: "web", ExecUser: "root"}
+	expected = []string{
+		"--machine=nomad-web-1234", "--quiet", "--wait", "--pipe", "--collect",
+		"--uid=root", "--", "id",
+	}
+	if args := execArgs("nomad-web-1234", taskConfig, []string{"id"}); !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
@@ -0,0 +1,231 @@
+package systemd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// Commands of ExecTask which export and import cached images, so operators
+// can seed the cache of a node from another one without pulling from the
+// origin again, e.g.:
+//
+//	nomad alloc exec <alloc> nspawn:image-export
+//	nomad alloc fs <alloc> alloc/nomad-sha256-....raw > nomad-sha256-....raw
+//
+// and on the other node, with the file fetched into the task dir by an
+// artifact:
+//
+//	nomad alloc exec <alloc> nspawn:image-import local/nomad-sha256-....raw
+//
+// The commands must be enabled with the image_commands plugin option. Only
+// raw images pulled by digest can be imported, they are verified against the
+// digest in their name so tasks can't seed the cache of other jobs with
+// images of their own.
+const (
+	imageExportCommand = driverCommandPrefix + "image-export"
+	imageImportCommand = driverCommandPrefix + "image-import"
+)
+
+// imageArchiveSuffixes are the suffixes of exported images, by the verb of
+// machinectl importing them. machinectl picks the compression by the suffix.
+var imageArchiveSuffixes = []struct{ suffix, verb string }{
+	{".tar.xz", "import-tar"},
+	{".tar.gz", "import-tar"},
+	{".tar.bz2", "import-tar"},
+	{".tar.zst", "import-tar"},
+	{".tar", "import-tar"},
+	{".raw.xz", "import-raw"},
+	{".raw.gz", "import-raw"},
+	{".raw.bz2", "import-raw"},
+	{".raw.zst", "import-raw"},
+	{".raw", "import-raw"},
+}
+
+// isCachedImage returns whether the image is shared by machines, i.e. pulled
+// by digest or built, which are the only images which may be exported or
+// imported.
+func isCachedImage(name string) bool {
+	for _, prefix := range []string{imageCachePrefix, imageBuildPrefix} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) && !strings.HasSuffix(name, "-tmp") {
+			return true
+		}
+	}
+	return false
+}
+
+// imageArchive returns the name of the cached image in the exported file,
+// which is the file name without its suffix, and the verb of machinectl
+// importing it.
+func imageArchive(path string) (name, verb string, err error) {
+	base := filepath.Base(path)
+	for _, a := range imageArchiveSuffixes {
+		if !strings.HasSuffix(base, a.suffix) {
+			continue
+		}
+		name := strings.TrimSuffix(base, a.suffix)
+		if !isCachedImage(name) {
+			return "", "", fmt.Errorf("%s is not an exported image", base)
+		}
+		return name, a.verb, nil
+	}
+	return "", "", fmt.Errorf("%s is not a tarball or raw image", base)
+}
+
+// exportFile returns the file name and the verb of machinectl exporting the
+// image at path, raw images can't be exported as tarballs.
+func exportFile(name, path string) (file, verb string) {
+	if strings.HasSuffix(path, ".raw") {
+		return name + ".raw", "export-raw"
+	}
+	return name + ".tar", "export-tar"
+}
+
+// runMachinectl runs machinectl with the arguments.
+func runMachinectl(ctx context.Context, args ...string) error {
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "machinectl", args...)
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("machinectl: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// execImageExport runs the image-export command of ExecTask, which exports
+// the cached image of the machine, or the given one, into the alloc dir.
+func (h *taskHandle) execImageExport(args []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	result := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
+	fail := func(format string, a ...interface{}) (*drivers.ExecTaskResult, error) {
+		result.Stderr = []byte(fmt.Sprintf(format+"\n", a...))
+		result.ExitResult.ExitCode = 1
+		return result, nil
+	}
+
+	if !h.driver.loadConfig().ImageCommands {
+		return fail("%s is disabled, see the image_commands plugin option", imageExportCommand)
+	}
+
+	var name string
+	switch {
+	case len(args) > 1:
+		return fail("usage: %s [image]", imageExportCommand)
+	case len(args) == 1:
+		name = args[0]
+	case h.imageDigest != "":
+		name = (&imageRef{Digest: h.imageDigest}).cacheName()
+	default:
+		return fail("the image of the machine is not cached, it must be pinned by digest")
+	}
+	if !isCachedImage(name) {
+		return fail("%s is not a cached image", name)
+	}
+	if ok, err := imageExists(h.driver.ctx, name); err != nil {
+		return nil, err
+	} else if !ok {
+		return fail("image %s not found", name)
+	}
+	u, err := getImageUsage(h.driver.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	file, verb := exportFile(name, u.Path)
+
+	ctx := h.driver.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	path := filepath.Join(h.taskConfig.TaskDir().SharedAllocDir, file)
+	h.logger.Info("exporting image", "name", name, "path", path)
+	if err := runMachinectl(ctx, verb, name, path); err != nil {
+		os.Remove(path)
+		return fail("failed to export %s: %v", name, err)
+	}
+	result.Stdout = []byte(filepath.Join(allocdir.SharedAllocName, file) + "\n")
+	return result, nil
+}
+
+// execImageImport runs the image-import command of ExecTask, which imports
+// an exported image in the task dir into the cache once its digest is
+// verified, unless the image is cached already.
+func (h *taskHandle) execImageImport(args []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	result := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
+	fail := func(format string, a ...interface{}) (*drivers.ExecTaskResult, error) {
+		result.Stderr = []byte(fmt.Sprintf(format+"\n", a...))
+		result.ExitResult.ExitCode = 1
+		return result, nil
+	}
+
+	if !h.driver.loadConfig().ImageCommands {
+		return fail("%s is disabled, see the image_commands plugin option", imageImportCommand)
+	}
+	if len(args) != 1 {
+		return fail("usage: %s <path in task dir>", imageImportCommand)
+	}
+	p := args[0]
+	if filepath.IsAbs(p) || strings.HasPrefix(filepath.Clean(p), "..") {
+		return fail("%q must be a path in the task dir", p)
+	}
+	name, verb, err := imageArchive(p)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if verb != "import-raw" || !strings.HasPrefix(name, imageCachePrefix) {
+		return fail("only raw images pulled by digest can be imported, others can't be verified")
+	}
+
+	ctx := h.driver.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	h.driver.imageLock.Lock()
+	defer h.driver.imageLock.Unlock()
+
+	if ok, err := imageExists(ctx, name); err != nil {
+		return nil, err
+	} else if ok {
+		result.Stdout = []byte(fmt.Sprintf("%s is cached already\n", name))
+		return result, nil
+	}
+
+	// The image is imported under a temporary name and only renamed into the
+	// cache once its digest matches its name.
+	tmp := name + "-tmp"
+	if err := removeImage(ctx, tmp); err != nil {
+		return nil, fmt.Errorf("failed to remove stale import %s: %v", tmp, err)
+	}
+	path := filepath.Join(h.taskConfig.TaskDir().Dir, p)
+	h.logger.Info("importing image", "name", name, "path", path)
+	err = runMachinectl(ctx, verb, path, tmp)
+	if err == nil {
+		var digest string
+		if digest, err = imageDigest(tmp); err == nil && (&imageRef{Digest: digest}).cacheName() != name {
+			err = fmt.Errorf("image has digest %s", digest)
+		}
+	}
+	if err != nil {
+		if err := removeImage(h.driver.ctx, tmp); err != nil {
+			h.logger.Warn("failed to remove failed import", "name", tmp, "error", err)
+		}
+		return fail("failed to import %s: %v", name, err)
+	}
+	if err := renameImage(ctx, tmp, name); err != nil {
+		return nil, err
+	}
+	result.Stdout = []byte(name + "\n")
+	return result, nil
+}
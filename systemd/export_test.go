@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestIsCachedImage(t *testing.T) {
+	cases := map[string]bool{
+		imageCachePrefix + "0123456789abcdef":          true,
+		imageBuildPrefix + "0123456789abcdef":          true,
+		imageBuildPrefix + "0123456789abcdef" + "-tmp": false,
+		imageCachePrefix: false,
+		"nomad-web-1234": false,
+		"debian":         false,
+	}
+	for name, expected := range cases {
+		if isCachedImage(name) != expected {
+			t.Errorf("%s: expected %v", name, expected)
+		}
+	}
+}
+
+func TestImageArchive(t *testing.T) {
+	name := imageCachePrefix + "0123456789abcdef"
+	cases := []struct {
+		path string
+		verb string
+	}{
+		{"local/" + name + ".raw", "import-raw"},
+		{"local/" + name + ".raw.xz", "import-raw"},
+		{name + ".tar", "import-tar"},
+		{name + ".tar.gz", "import-tar"},
+	}
+	for _, c := range cases {
+		n, verb, err := imageArchive(c.path)
+		if err != nil || n != name || verb != c.verb {
+			t.Errorf("%s: expected %s %s, got %s %s: %v", c.path, name, c.verb, n, verb, err)
+		}
+	}
+
+	for _, p := range []string{"local/debian.raw", name + ".qcow2", name, imageBuildPrefix + "1-tmp.tar"} {
+		if _, _, err := imageArchive(p); err == nil {
+			t.Errorf("%s: expected error", p)
+		}
+	}
+}
+
+func TestExportFile(t *testing.T) {
+	name := imageCachePrefix + "0123456789abcdef"
+	if file, verb := exportFile(name, "/var/lib/machines/"+name+".raw"); file != name+".raw" || verb != "export-raw" {
+		t.Errorf("unexpected export of raw image: %s %s", file, verb)
+	}
+	if file, verb := exportFile(name, "/var/lib/machines/"+name); file != name+".tar" || verb != "export-tar" {
+		t.Errorf("unexpected export of directory image: %s %s", file, verb)
+	}
+}
+
+func TestExecImageCommandErrors(t *testing.T) {
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	h := &taskHandle{driver: d}
+	for _, exec := range []func([]string, time.Duration) (*drivers.ExecTaskResult, error){h.execImageExport, h.execImageImport} {
+		res, err := exec([]string{"local/" + imageCachePrefix + "1.raw"}, 0)
+		if err != nil || res.ExitResult.ExitCode != 1 || !strings.Contains(string(res.Stderr), "image_commands") {
+			t.Errorf("expected image commands to be disabled, got %+v: %v", res, err)
+		}
+	}
+
+	d.config.ImageCommands = true
+	for _, args := range [][]string{nil, {"a", "b"}, {"nomad-web-1234"}} {
+		res, err := h.execImageExport(args, 0)
+		if err != nil || res.ExitResult.ExitCode != 1 {
+			t.Errorf("%s %q: expected exit code 1, got %+v: %v", imageExportCommand, args, res, err)
+		}
+	}
+	for _, args := range [][]string{nil, {"/tmp/" + imageCachePrefix + "1.raw"}, {"../" + imageCachePrefix + "1.raw"}, {"local/debian.raw"}, {"local/" + imageCachePrefix + "1.tar"}, {"local/" + imageBuildPrefix + "1.raw"}} {
+		res, err := h.execImageImport(args, 0)
+		if err != nil || res.ExitResult.ExitCode != 1 {
+			t.Errorf("%s %q: expected exit code 1, got %+v: %v", imageImportCommand, args, res, err)
+		}
+		if !strings.HasSuffix(string(res.Stderr), "\n") {
+			t.Errorf("%s %q: expected error message, got %q", imageImportCommand, args, res.Stderr)
+		}
+	}
+}
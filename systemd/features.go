@@ -0,0 +1,186 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// nspawnFeature is an option of nspawn which is only supported since some
+// version of systemd.
+type nspawnFeature struct {
+	// name is the name of the feature, which is published as node attribute.
+	name string
+	// version is the first version of systemd supporting the feature.
+	version int
+	// used returns whether the task config uses the feature, nil if the
+	// feature is not an option of tasks.
+	used func(c *TaskConfig) bool
+	// drop removes the feature from the task config.
+	drop func(c *TaskConfig)
+}
+
+// bindOptionUsed returns whether any bind uses the option.
+func bindOptionUsed(c *TaskConfig, option string) bool {
+	for _, b := range c.Bind {
+		for _, o := range b.Options {
+			if o == option {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropBindOption removes the option from all binds.
+func dropBindOption(c *TaskConfig, option string) {
+	for i, b := range c.Bind {
+		var options []string
+		for _, o := range b.Options {
+			if o != option {
+				options = append(options, o)
+			}
+		}
+		c.Bind[i].Options = options
+	}
+}
+
+// nspawnFeatures contains the nspawn options which are not supported by all
+// systemd versions the driver runs on.
+var nspawnFeatures = []nspawnFeature{
+	{
+		name:    "bind-user",
+		version: 249,
+		used:    func(c *TaskConfig) bool { return len(c.BindUser) > 0 },
+		drop:    func(c *TaskConfig) { c.BindUser = nil },
+	},
+	{
+		name:    "idmap",
+		version: 250,
+		used:    func(c *TaskConfig) bool { return bindOptionUsed(c, "idmap") },
+		drop:    func(c *TaskConfig) { dropBindOption(c, "idmap") },
+	},
+	{
+		name:    "rootidmap",
+		version: 252,
+		used:    func(c *TaskConfig) bool { return bindOptionUsed(c, "rootidmap") },
+		drop:    func(c *TaskConfig) { dropBindOption(c, "rootidmap") },
+	},
+	{
+		name:    "owneridmap",
+		version: 254,
+		used:    func(c *TaskConfig) bool { return bindOptionUsed(c, "owneridmap") },
+		drop:    func(c *TaskConfig) { dropBindOption(c, "owneridmap") },
+	},
+	{
+		name:    "volatile-overlay",
+		version: 242,
+		used:    func(c *TaskConfig) bool { return c.Volatile == "overlay" },
+		drop:    func(c *TaskConfig) { c.Volatile = "" },
+	},
+	{
+		name:    "credentials",
+		version: 247,
+		used:    func(c *TaskConfig) bool { return len(c.Credential) > 0 },
+		drop:    func(c *TaskConfig) { c.Credential = nil },
+	},
+	{
+		name:    "extension-image",
+		version: 248,
+		used:    func(c *TaskConfig) bool { return len(c.ExtensionImages) > 0 },
+		drop:    func(c *TaskConfig) { c.ExtensionImages = nil },
+	},
+	{
+		name:    "private-users-ownership",
+		version: 249,
+		used:    func(c *TaskConfig) bool { return c.PrivateUsersOwnership != "" },
+		drop:    func(c *TaskConfig) { c.PrivateUsersOwnership = "" },
+	},
+	{
+		name:    "suppress-sync",
+		version: 250,
+		used:    func(c *TaskConfig) bool { return c.SuppressSync },
+		drop:    func(c *TaskConfig) { c.SuppressSync = false },
+	},
+	{
+		name:    "numa",
+		version: 248,
+		used:    func(c *TaskConfig) bool { return c.NUMANode != "" },
+		drop:    func(c *TaskConfig) { c.NUMANode = "" },
+	},
+	{
+		name:    "zswap",
+		version: 253,
+		used:    func(c *TaskConfig) bool { return c.Memory.ZSwapMax != "" },
+		drop:    func(c *TaskConfig) { c.Memory.ZSwapMax = "" },
+	},
+	{
+		name:    "vmspawn",
+		version: 256,
+	},
+	{
+		name:    "console-pipe",
+		version: 242,
+	},
+	{
+		name:    "freeze",
+		version: 246,
+	},
+}
+
+// supportedFeatures returns the names of nspawn features supported by the
+// systemd version.
+func supportedFeatures(version int) []string {
+	var names []string
+	for _, f := range nspawnFeatures {
+		if version >= f.version {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// checkFeatures checks the task config against the features supported by
+// the host's systemd.
+//
+// Unsupported options fail the task if strict_options is enabled, otherwise
+// they are dropped with a task event. Nothing is checked if the version is
+// unknown.
+func (d *Driver) checkFeatures(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	version := d.systemdVersion()
+	if version == 0 {
+		return nil
+	}
+	strict := d.loadConfig().StrictOptions
+
+	var unsupported []string
+	for _, f := range nspawnFeatures {
+		if version >= f.version || f.used == nil || !f.used(taskConfig) {
+			continue
+		}
+		unsupported = append(unsupported, f.name)
+		if !strict {
+			f.drop(taskConfig)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("options not supported by systemd %d: %s", version, strings.Join(unsupported, ", "))
+	if strict {
+		return fmt.Errorf("%s", msg)
+	}
+
+	d.logger.Warn("dropping unsupported options", "task", cfg.Name, "options", unsupported)
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		TaskName:  cfg.Name,
+		AllocID:   cfg.AllocID,
+		Timestamp: time.Now(),
+		Message:   "dropped " + msg,
+	})
+	return nil
+}
@@ -0,0 +1,41 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSupportedFeatures(t *testing.T) {
+	if features := supportedFeatures(239); len(features) != 0 {
+		t.Errorf("unexpected features %v", features)
+	}
+
+	expected := []string{"bind-user", "idmap", "volatile-overlay", "credentials", "extension-image", "private-users-ownership", "suppress-sync", "numa", "console-pipe", "freeze"}
+	if features := supportedFeatures(250); !reflect.DeepEqual(features, expected) {
+		t.Errorf("expected %v, got %v", expected, features)
+	}
+}
+
+func TestDropFeatures(t *testing.T) {
+	c := TaskConfig{
+		BindUser: []string{"deploy"},
+		Bind: []BindMount{
+			{Source: "/srv", Options: []string{"rbind", "owneridmap"}},
+		},
+	}
+
+	var used []string
+	for _, f := range nspawnFeatures {
+		if f.used != nil && f.used(&c) {
+			used = append(used, f.name)
+			f.drop(&c)
+		}
+	}
+
+	if expected := []string{"bind-user", "owneridmap"}; !reflect.DeepEqual(used, expected) {
+		t.Errorf("expected %v, got %v", expected, used)
+	}
+	if len(c.BindUser) != 0 || !reflect.DeepEqual(c.Bind[0].Options, []string{"rbind"}) {
+		t.Errorf("options not dropped: %+v", c)
+	}
+}
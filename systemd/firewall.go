@@ -0,0 +1,240 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Firewall restricts the traffic of the container to the allowed rules with
+// nftables on the host, without a CNI plugin. Everything else to and from
+// the container is dropped, except replies and traffic to published ports.
+//
+// The rules match the addresses of the container, so it requires private
+// networking and either register or address to be set. MACVLAN and IPVLAN
+// interfaces bypass the host's nftables and are not restricted.
+type Firewall struct {
+	// Allow are the rules of the traffic allowed, in the form
+	// "<in|out> [tcp|udp|icmp] [address or CIDR] [port or range]", e.g.
+	// "out udp 10.0.0.1 53", "out tcp 443" or "in tcp 192.168.0.0/16 22".
+	// Ports require tcp or udp.
+	Allow []string `codec:"allow"`
+}
+
+// enabled returns whether the firewall is enabled.
+func (f Firewall) enabled() bool {
+	return len(f.Allow) > 0
+}
+
+// firewallRule is a parsed rule of the firewall.
+type firewallRule struct {
+	Ingress  bool
+	Protocol string
+	Network  *net.IPNet
+	Ports    string
+}
+
+// parseFirewallRule parses a rule of the firewall.
+func parseFirewallRule(s string) (firewallRule, error) {
+	var r firewallRule
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return r, fmt.Errorf("invalid firewall rule %q", s)
+	}
+	switch fields[0] {
+	case "in":
+		r.Ingress = true
+	case "out":
+	default:
+		return r, fmt.Errorf("invalid firewall rule %q, must start with in or out", s)
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case f == "tcp" || f == "udp" || f == "icmp":
+			if r.Protocol != "" {
+				return r, fmt.Errorf("invalid firewall rule %q, protocol set more than once", s)
+			}
+			r.Protocol = f
+		case isPortNumber(f):
+			if r.Ports != "" {
+				return r, fmt.Errorf("invalid firewall rule %q, port set more than once", s)
+			}
+			if _, _, err := parsePortRange(f); err != nil {
+				return r, fmt.Errorf("invalid firewall rule %q: %v", s, err)
+			}
+			r.Ports = f
+		default:
+			if r.Network != nil {
+				return r, fmt.Errorf("invalid firewall rule %q, address set more than once", s)
+			}
+			network, err := parseNetwork(f)
+			if err != nil {
+				return r, fmt.Errorf("invalid firewall rule %q: %v", s, err)
+			}
+			r.Network = network
+		}
+	}
+	if r.Ports != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+		return r, fmt.Errorf("invalid firewall rule %q, port requires tcp or udp", s)
+	}
+	return r, nil
+}
+
+// parseNetwork parses an address or a CIDR.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (c *TaskConfig) validateFirewall() error {
+	if !c.Firewall.enabled() {
+		return nil
+	}
+	for _, s := range c.Firewall.Allow {
+		if _, err := parseFirewallRule(s); err != nil {
+			return err
+		}
+	}
+	if !c.privateNetwork() {
+		return fmt.Errorf("firewall requires private networking")
+	}
+	if !c.Register && len(c.Address) == 0 {
+		return fmt.Errorf("firewall requires register or address to be set")
+	}
+	return nil
+}
+
+// firewallTable returns the nftables table holding the firewall of the
+// machine, each machine has its own table so rules can be removed at once.
+func firewallTable(machineName string) string {
+	return "nomad_fw_" + portTableRegexp.ReplaceAllString(machineName, "_")
+}
+
+// ipFamily returns the nftables family matching ip.
+func ipFamily(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// firewallRules renders the nftables script restricting the traffic of the
+// container with the addresses ips to the rules.
+//
+// Traffic of the container jumps to the egress and ingress chains, which
+// accept the allowed traffic and drop the rest. Traffic to the host itself
+// passes the input and output hooks instead of forward.
+func firewallRules(table string, ips []net.IP, rules []firewallRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table inet %s\n", table)
+	fmt.Fprintf(&b, "flush table inet %s\n", table)
+	for _, hook := range []string{"forward", "input", "output"} {
+		fmt.Fprintf(&b, "add chain inet %s %s { type filter hook %s priority 0; }\n", table, hook, hook)
+	}
+	fmt.Fprintf(&b, "add chain inet %s egress\n", table)
+	fmt.Fprintf(&b, "add chain inet %s ingress\n", table)
+
+	for _, ip := range ips {
+		family := ipFamily(ip)
+		fmt.Fprintf(&b, "add rule inet %s forward %s saddr %s jump egress\n", table, family, ip)
+		fmt.Fprintf(&b, "add rule inet %s forward %s daddr %s jump ingress\n", table, family, ip)
+		fmt.Fprintf(&b, "add rule inet %s input %s saddr %s jump egress\n", table, family, ip)
+		fmt.Fprintf(&b, "add rule inet %s output %s daddr %s jump ingress\n", table, family, ip)
+	}
+
+	fmt.Fprintf(&b, "add rule inet %s egress ct state established,related accept\n", table)
+	fmt.Fprintf(&b, "add rule inet %s ingress ct state established,related accept\n", table)
+	// Published ports are forwarded via DNAT, by nspawn or the nftables
+	// port backend.
+	fmt.Fprintf(&b, "add rule inet %s ingress ct status dnat accept\n", table)
+	for _, r := range rules {
+		chain, dir := "egress", "daddr"
+		if r.Ingress {
+			chain, dir = "ingress", "saddr"
+		}
+
+		var match []string
+		if r.Network != nil {
+			match = append(match, fmt.Sprintf("%s %s %s", ipFamily(r.Network.IP), dir, r.Network))
+		}
+		switch {
+		case r.Ports != "":
+			match = append(match, fmt.Sprintf("%s dport %s", r.Protocol, r.Ports))
+		case r.Protocol == "icmp":
+			match = append(match, "meta l4proto { icmp, ipv6-icmp }")
+		case r.Protocol != "":
+			match = append(match, "meta l4proto "+r.Protocol)
+		}
+		match = append(match, "accept")
+		fmt.Fprintf(&b, "add rule inet %s %s %s\n", table, chain, strings.Join(match, " "))
+	}
+	fmt.Fprintf(&b, "add rule inet %s egress drop\n", table)
+	fmt.Fprintf(&b, "add rule inet %s ingress drop\n", table)
+	return b.String()
+}
+
+// firewallAddresses returns the addresses of the container, which are the
+// static addresses if any, or the addresses reported by machined once it has
+// one.
+func (d *Driver) firewallAddresses(m *Machine, taskConfig TaskConfig) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range taskConfig.Address {
+		if ip, _, err := net.ParseCIDR(addr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	if _, err := d.portAddress(m, taskConfig); err != nil {
+		return nil, err
+	}
+	addrs, err := d.GetMachineAddresses(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		if !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// setupFirewall restricts the traffic of the machine if it has a firewall.
+func (d *Driver) setupFirewall(m *Machine, taskConfig TaskConfig) error {
+	if !taskConfig.Firewall.enabled() {
+		return nil
+	}
+
+	rules := make([]firewallRule, 0, len(taskConfig.Firewall.Allow))
+	for _, s := range taskConfig.Firewall.Allow {
+		r, err := parseFirewallRule(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	ips, err := d.firewallAddresses(m, taskConfig)
+	if err != nil {
+		return err
+	}
+	return nft(firewallRules(firewallTable(m.Name), ips, rules))
+}
+
+// removeFirewall removes the firewall of the machine.
+func (d *Driver) removeFirewall(machineName string) error {
+	return deleteNFTTable(firewallTable(machineName))
+}
@@ -0,0 +1,87 @@
+package systemd
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseFirewallRule(t *testing.T) {
+	cases := []struct {
+		rule     string
+		expected string
+	}{
+		{"out tcp 443", "egress tcp dport 443 accept"},
+		{"out udp 10.0.0.1 53", "egress ip daddr 10.0.0.1/32 udp dport 53 accept"},
+		{"in tcp 192.168.0.0/16 8000-8010", "ingress ip saddr 192.168.0.0/16 tcp dport 8000-8010 accept"},
+		{"out fd00::/8", "egress ip6 daddr fd00::/8 accept"},
+		{"in icmp", "ingress meta l4proto { icmp, ipv6-icmp } accept"},
+		{"out udp", "egress meta l4proto udp accept"},
+	}
+	for _, c := range cases {
+		r, err := parseFirewallRule(c.rule)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.rule, err)
+			continue
+		}
+		script := firewallRules("t", nil, []firewallRule{r})
+		if !strings.Contains(script, "add rule inet t "+c.expected+"\n") {
+			t.Errorf("%q: missing rule %q in:\n%s", c.rule, c.expected, script)
+		}
+	}
+
+	for _, rule := range []string{
+		"",
+		"tcp 443",
+		"out tcp udp",
+		"out 443",
+		"out icmp 443",
+		"out tcp 70000",
+		"out tcp 80 443",
+		"out example.com",
+		"out 10.0.0.1 10.0.0.2",
+	} {
+		if _, err := parseFirewallRule(rule); err == nil {
+			t.Errorf("%q: expected error", rule)
+		}
+	}
+}
+
+func TestValidateFirewall(t *testing.T) {
+	c := TaskConfig{VirtualEthernet: true, Register: true, Firewall: Firewall{Allow: []string{"out tcp 443"}}}
+	if err := c.validateFirewall(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, c := range []TaskConfig{
+		{VirtualEthernet: true, Register: true, Firewall: Firewall{Allow: []string{"both tcp 443"}}},
+		{Register: true, Firewall: Firewall{Allow: []string{"out tcp 443"}}},
+		{VirtualEthernet: true, Firewall: Firewall{Allow: []string{"out tcp 443"}}},
+	} {
+		if err := c.validateFirewall(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	table := firewallTable("nomad-web-1234-abcd")
+	if table != "nomad_fw_nomad_web_1234_abcd" {
+		t.Fatalf("unexpected table %q", table)
+	}
+
+	script := firewallRules(table, []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}, nil)
+	for _, rule := range []string{
+		"add chain inet nomad_fw_nomad_web_1234_abcd forward { type filter hook forward priority 0; }",
+		"add rule inet nomad_fw_nomad_web_1234_abcd forward ip saddr 10.0.0.2 jump egress",
+		"add rule inet nomad_fw_nomad_web_1234_abcd output ip6 daddr fd00::2 jump ingress",
+		"add rule inet nomad_fw_nomad_web_1234_abcd ingress ct status dnat accept",
+	} {
+		if !strings.Contains(script, rule+"\n") {
+			t.Errorf("missing rule %q in:\n%s", rule, script)
+		}
+	}
+	if !strings.HasSuffix(script, "egress drop\nadd rule inet nomad_fw_nomad_web_1234_abcd ingress drop\n") {
+		t.Errorf("expected traffic to be dropped last in:\n%s", script)
+	}
+}
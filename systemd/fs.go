@@ -0,0 +1,156 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// rootfsDirName is the directory in the task dir where the container's root
+// is exposed, so it's browsable via `nomad alloc fs`.
+const rootfsDirName = "rootfs"
+
+// volatileModes contains all values allowed for Volatile.
+var volatileModes = map[string]bool{
+	"":        true,
+	"no":      true,
+	"yes":     true,
+	"state":   true,
+	"overlay": true,
+}
+
+// validateVolatile checks Volatile, and applies EphemeralRoot.
+func (c *TaskConfig) validateVolatile() error {
+	if !volatileModes[c.Volatile] {
+		return fmt.Errorf("invalid volatile %q", c.Volatile)
+	}
+
+	if !c.EphemeralRoot {
+		return nil
+	}
+	if c.Volatile != "" {
+		return fmt.Errorf("ephemeral_root conflicts with volatile %q", c.Volatile)
+	}
+	if c.ReadOnly {
+		return fmt.Errorf("ephemeral_root conflicts with read_only")
+	}
+	c.Volatile = "overlay"
+	return nil
+}
+
+// privateUsersOwnershipModes contains all values allowed for
+// PrivateUsersOwnership.
+var privateUsersOwnershipModes = map[string]bool{
+	"":      true,
+	"off":   true,
+	"chown": true,
+	"map":   true,
+	"auto":  true,
+}
+
+func (c *TaskConfig) validatePrivateUsersOwnership() error {
+	if !privateUsersOwnershipModes[c.PrivateUsersOwnership] {
+		return fmt.Errorf("invalid private_users_ownership %q", c.PrivateUsersOwnership)
+	}
+	if c.PrivateUsersOwnership != "" && c.PrivateUsersChown {
+		return fmt.Errorf("private_users_ownership conflicts with private_users_chown")
+	}
+	return nil
+}
+
+// tmpfsSizeRatio is the default size of tmpfs mounts relative to the task's
+// memory limit.
+const tmpfsSizeRatio = 0.5
+
+// setupTmpfsSizes limits the size of tmpfs mounts without size option to a
+// fraction of the task's memory limit.
+func setupTmpfsSizes(cfg *drivers.TaskConfig, taskConfig *TaskConfig) {
+	if cfg.Resources == nil || cfg.Resources.LinuxResources == nil {
+		return
+	}
+	limit := cfg.Resources.LinuxResources.MemoryLimitBytes
+	if limit <= 0 {
+		return
+	}
+	size := fmt.Sprintf("size=%d", int64(float64(limit)*tmpfsSizeRatio))
+
+	for i, v := range taskConfig.TemporaryFileSystem {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) == 1 {
+			taskConfig.TemporaryFileSystem[i] = v + ":" + size
+			continue
+		}
+
+		hasSize := false
+		for _, o := range strings.Split(parts[1], ",") {
+			if strings.HasPrefix(o, "size=") || strings.HasPrefix(o, "nr_blocks=") {
+				hasSize = true
+			}
+		}
+		if !hasSize {
+			taskConfig.TemporaryFileSystem[i] = v + "," + size
+		}
+	}
+}
+
+// setupTaskDirs binds the alloc, local and secrets dirs of the task into the
+// container at the same paths as other drivers do.
+func setupTaskDirs(cfg *drivers.TaskConfig, taskConfig *TaskConfig) {
+	if !taskConfig.MountTaskDirs {
+		return
+	}
+
+	taskDir := cfg.TaskDir()
+	taskConfig.Bind = append(taskConfig.Bind,
+		BindMount{Source: taskDir.SharedAllocDir, Target: allocdir.SharedAllocContainerPath},
+		BindMount{Source: taskDir.LocalDir, Target: allocdir.TaskLocalContainerPath},
+		BindMount{Source: taskDir.SecretsDir, Target: allocdir.TaskSecretsContainerPath},
+	)
+}
+
+// rootfsPath returns the path where the container's root is exposed.
+func rootfsPath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().Dir, rootfsDirName)
+}
+
+// exposeRootfs binds the root directory of the machine read-only into the
+// task dir.
+func exposeRootfs(cfg *drivers.TaskConfig, m *Machine) error {
+	if m.RootDirectory == "" {
+		return fmt.Errorf("machine %s has no root directory", m.Name)
+	}
+
+	target := rootfsPath(cfg)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(m.RootDirectory, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %v", m.RootDirectory, err)
+	}
+	err := syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+	if err != nil {
+		syscall.Unmount(target, syscall.MNT_DETACH)
+		return fmt.Errorf("remount %s read-only: %v", target, err)
+	}
+	return nil
+}
+
+// unexposeRootfs unmounts the container's root from the task dir if it's
+// exposed, which must be done before Nomad removes the task dir.
+func unexposeRootfs(cfg *drivers.TaskConfig) error {
+	target := rootfsPath(cfg)
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return nil
+	}
+
+	err := syscall.Unmount(target, syscall.MNT_DETACH)
+	if err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return os.Remove(target)
+}
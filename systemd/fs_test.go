@@ -0,0 +1,108 @@
+package systemd
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestSetupTaskDirs(t *testing.T) {
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: "/var/lib/nomad/alloc/1234"}
+
+	taskConfig := TaskConfig{MountTaskDirs: true}
+	setupTaskDirs(cfg, &taskConfig)
+
+	expected := []string{
+		"/var/lib/nomad/alloc/1234/alloc:/alloc",
+		"/var/lib/nomad/alloc/1234/web/local:/local",
+		"/var/lib/nomad/alloc/1234/web/secrets:/secrets",
+	}
+	if len(taskConfig.Bind) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, taskConfig.Bind)
+	}
+	for i, b := range taskConfig.Bind {
+		if b.String() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], b.String())
+		}
+	}
+
+	taskConfig = TaskConfig{}
+	setupTaskDirs(cfg, &taskConfig)
+	if len(taskConfig.Bind) != 0 {
+		t.Errorf("unexpected binds %v", taskConfig.Bind)
+	}
+}
+
+func TestValidateVolatile(t *testing.T) {
+	for _, v := range []string{"", "no", "yes", "state", "overlay"} {
+		c := TaskConfig{Volatile: v}
+		if err := c.validateVolatile(); err != nil {
+			t.Errorf("%q: unexpected error: %v", v, err)
+		}
+	}
+
+	c := TaskConfig{Volatile: "tmpfs"}
+	if err := c.validateVolatile(); err == nil {
+		t.Errorf("expected error for invalid volatile")
+	}
+
+	c = TaskConfig{EphemeralRoot: true}
+	if err := c.validateVolatile(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Volatile != "overlay" || c.ReadOnly {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	for _, c := range []TaskConfig{
+		{EphemeralRoot: true, Volatile: "yes"},
+		{EphemeralRoot: true, ReadOnly: true},
+	} {
+		if err := c.validateVolatile(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestValidatePrivateUsersOwnership(t *testing.T) {
+	for _, v := range []string{"", "off", "chown", "map", "auto"} {
+		c := TaskConfig{PrivateUsersOwnership: v}
+		if err := c.validatePrivateUsersOwnership(); err != nil {
+			t.Errorf("%q: unexpected error: %v", v, err)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{PrivateUsersOwnership: "idmap"},
+		{PrivateUsersOwnership: "map", PrivateUsersChown: true},
+	} {
+		if err := c.validatePrivateUsersOwnership(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestSetupTmpfsSizes(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		Resources: &drivers.Resources{
+			LinuxResources: &drivers.LinuxResources{MemoryLimitBytes: 256 << 20},
+		},
+	}
+	c := TaskConfig{
+		TemporaryFileSystem: []string{"/tmp", "/run:mode=755", "/var/tmp:size=1G", "/cache:nr_blocks=10"},
+	}
+	setupTmpfsSizes(cfg, &c)
+
+	expected := []string{"/tmp:size=134217728", "/run:mode=755,size=134217728", "/var/tmp:size=1G", "/cache:nr_blocks=10"}
+	for i, v := range c.TemporaryFileSystem {
+		if v != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], v)
+		}
+	}
+
+	c = TaskConfig{TemporaryFileSystem: []string{"/tmp"}}
+	setupTmpfsSizes(&drivers.TaskConfig{}, &c)
+	if c.TemporaryFileSystem[0] != "/tmp" {
+		t.Errorf("unexpected %q without memory limit", c.TemporaryFileSystem[0])
+	}
+}
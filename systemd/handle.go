@@ -0,0 +1,338 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// unitPollInterval is the interval between polls of the machine's unit
+	// state.
+	unitPollInterval = time.Second
+)
+
+// taskHandle is the handle of a running systemd-nspawn machine.
+type taskHandle struct {
+	driver *Driver
+	logger log.Logger
+
+	machineName string
+	unitName    string
+	// unregistered is true if the machine is not registered with machined,
+	// in which case the unit is used to control it.
+	unregistered bool
+	hostname     string
+	machineID    string
+	zone         string
+	ports        []portMapping
+	// checkpoint is true if the machine is dumped with CRIU when stopped
+	checkpoint bool
+	// stopMode is how the machine is stopped without a signal
+	stopMode string
+	// exportJournal is true if the journal is exported on destroy
+	exportJournal bool
+	// coredumps is what happens with core dumps of the machine's processes,
+	// which are copied up to coredumpMaxSize
+	coredumps       string
+	coredumpMaxSize uint64
+	// postStopHook is the task's hook run after the machine is destroyed
+	postStopHook Hook
+	// ipAccounting is true if the IP traffic of the unit is counted
+	ipAccounting bool
+	// imageDigest is the digest of the machine's image if it's pinned
+	imageDigest string
+	// nspawnFile is the path of the machine's nspawn file, if any
+	nspawnFile string
+	// uidShift and uidRange are the user namespace mapping of the machine
+	uidShift uint32
+	uidRange uint32
+	// portForwarding is true if the ports are forwarded by nftables rules
+	portForwarding bool
+	// firewall is true if the traffic of the machine is restricted by
+	// nftables rules
+	firewall bool
+
+	// doneCh is closed once the machine has exited
+	doneCh chan struct{}
+
+	// ctx is cancelled once the task is destroyed or the driver is shut
+	// down, all subsystems of the task are stopped with it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stateLock syncs access to all fields below
+	stateLock sync.RWMutex
+
+	taskConfig *drivers.TaskConfig
+	osRelease  map[string]string
+	procState  drivers.TaskState
+	frozen     bool
+	// stopping is set once the machine is being stopped on purpose
+	stopping    bool
+	startedAt   time.Time
+	completedAt time.Time
+	exitResult  *drivers.ExitResult
+}
+
+// TaskStatus returns the current status of the task.
+func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
+	var diskUsage string
+	if u, err := getImageUsage(h.driver.ctx, h.machineName); err == nil && u.Usage != unknownSize {
+		diskUsage = strconv.FormatUint(u.Usage, 10)
+	}
+
+	osRelease := h.getOSRelease()
+
+	var addrs []string
+	if !h.unregistered && h.IsRunning() {
+		ips, err := h.driver.GetMachineAddresses(h.machineName)
+		if err != nil {
+			h.logger.Warn("failed to get machine addresses", "error", err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+	}
+
+	var uidShift string
+	if h.uidRange > 0 {
+		uidShift = fmt.Sprintf("%d:%d", h.uidShift, h.uidRange)
+	}
+
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+
+	status := &drivers.TaskStatus{
+		ID:          h.taskConfig.ID,
+		Name:        h.taskConfig.Name,
+		State:       h.procState,
+		StartedAt:   h.startedAt,
+		CompletedAt: h.completedAt,
+		ExitResult:  h.exitResult,
+		DriverAttributes: map[string]string{
+			"machine_name":   h.machineName,
+			"unit_name":      h.unitName,
+			"hostname":       h.hostname,
+			"machine_id":     h.machineID,
+			"addresses":      strings.Join(addrs, ","),
+			"dns_name":       h.dnsName(),
+			"disk_usage":     diskUsage,
+			"frozen":         strconv.FormatBool(h.frozen),
+			"os_pretty_name": osRelease["PRETTY_NAME"],
+			"os_version_id":  osRelease["VERSION_ID"],
+			"image_digest":   h.imageDigest,
+			"nspawn_file":    h.nspawnFile,
+			"uid_shift":      uidShift,
+		},
+	}
+	for k, v := range debugCommands(h.machineName, h.unregistered) {
+		status.DriverAttributes[k] = v
+	}
+	return status
+}
+
+// getOSRelease returns the os-release of the machine, which is only read
+// once because it doesn't change while the machine is running.
+//
+// nil will be returned if the machine is not registered with machined.
+func (h *taskHandle) getOSRelease() map[string]string {
+	h.stateLock.RLock()
+	osRelease := h.osRelease
+	h.stateLock.RUnlock()
+	if osRelease != nil || h.unregistered || !h.IsRunning() {
+		return osRelease
+	}
+
+	osRelease, err := h.driver.GetMachineOSRelease(h.machineName)
+	if err != nil {
+		h.logger.Warn("failed to get machine os-release", "error", err)
+		return nil
+	}
+
+	h.stateLock.Lock()
+	h.osRelease = osRelease
+	h.stateLock.Unlock()
+	return osRelease
+}
+
+// IsRunning returns whether the machine is still running.
+func (h *taskHandle) IsRunning() bool {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.procState == drivers.TaskStateRunning
+}
+
+// run polls the machine's unit until it exits.
+func (h *taskHandle) run(ctx context.Context) {
+	h.stateLock.Lock()
+	if h.exitResult == nil {
+		h.exitResult = &drivers.ExitResult{}
+	}
+	h.stateLock.Unlock()
+
+	ticker := time.NewTicker(unitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.doneCh:
+			return
+		case <-ticker.C:
+		}
+
+		state, status, err := h.driver.getUnitState(h.unitName)
+		if err != nil {
+			h.logger.Warn("failed to get machine unit state", "unit", h.unitName, "error", err)
+			continue
+		}
+
+		switch state {
+		case "active", "activating", "deactivating", "reloading":
+			continue
+		}
+
+		var line, result string
+		if state == "failed" {
+			line = h.driver.scrapeJournal(ctx, h.taskConfig, h.unitName, h.startedAt)
+			var err error
+			if result, err = h.driver.getUnitResult(h.unitName); err != nil {
+				h.logger.Warn("failed to get machine unit result", "unit", h.unitName, "error", err)
+			}
+		}
+		reason := describeUnitResult(result)
+
+		var exitErr error
+		switch {
+		case reason != "" && line != "":
+			exitErr = fmt.Errorf("machine unit %s failed (%s): %s", h.unitName, reason, line)
+		case reason != "":
+			exitErr = fmt.Errorf("machine unit %s failed (%s)", h.unitName, reason)
+		case line != "":
+			exitErr = fmt.Errorf("machine unit %s failed: %s", h.unitName, line)
+		case state == "failed" && status == 0:
+			exitErr = fmt.Errorf("machine unit %s failed", h.unitName)
+		}
+		h.setExited(status, result == "oom-kill", exitErr)
+		return
+	}
+}
+
+// setExited marks the machine as exited with the result, and closes doneCh.
+// It returns false if the machine already exited.
+func (h *taskHandle) setExited(status int, oomKilled bool, err error) bool {
+	h.stateLock.Lock()
+	if h.procState == drivers.TaskStateExited {
+		h.stateLock.Unlock()
+		return false
+	}
+	if h.exitResult == nil {
+		h.exitResult = &drivers.ExitResult{}
+	}
+	h.procState = drivers.TaskStateExited
+	h.exitResult.ExitCode = status
+	h.exitResult.OOMKilled = oomKilled
+	h.exitResult.Err = err
+	h.completedAt = time.Now()
+	h.stateLock.Unlock()
+
+	close(h.doneCh)
+	return true
+}
+
+// shutdown stops the machine, and kills it if it doesn't exit within the
+// timeout.
+//
+// If signal is empty, the machine is stopped according to its stop_mode.
+func (h *taskHandle) shutdown(ctx context.Context, timeout time.Duration, signal string) error {
+	if !h.IsRunning() {
+		return nil
+	}
+
+	// Frozen processes can't handle the stop signal.
+	h.stateLock.Lock()
+	h.stopping = true
+	frozen := h.frozen
+	h.stateLock.Unlock()
+	if frozen {
+		if err := h.freeze(false); err != nil {
+			h.logger.Warn("failed to thaw machine", "error", err)
+		}
+	}
+
+	if signal == "" {
+		if err := h.stop(); err != nil {
+			return err
+		}
+	} else {
+		sig, err := parseSignal(signal)
+		if err != nil {
+			return err
+		}
+		if err := h.kill("leader", sig); err != nil {
+			return fmt.Errorf("signal machine %s: %v", h.machineName, err)
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-h.doneCh:
+		return nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	h.logger.Warn("machine didn't exit in time, killing", "machine", h.machineName, "timeout", timeout)
+	if err := h.kill("all", syscall.SIGKILL); err != nil {
+		return fmt.Errorf("kill machine %s: %v", h.machineName, err)
+	}
+	return nil
+}
+
+// terminate terminates the machine.
+func (h *taskHandle) terminate() error {
+	if h.unregistered {
+		return h.driver.stopUnit(h.unitName)
+	}
+	return h.driver.TerminateMachine(h.machineName)
+}
+
+// kill sends signal to the machine.
+//
+// Signals will be sent to all processes of the unit if the machine is not
+// registered with machined.
+func (h *taskHandle) kill(who string, sig syscall.Signal) error {
+	if h.unregistered {
+		return callDBus(h.driver.ctx, "KillUnit", func(c *systemdConn) error {
+			c.systemd.KillUnit(h.unitName, int32(sig))
+			return nil
+		})
+	}
+	return h.driver.KillMachine(h.machineName, who, sig)
+}
+
+// freeze freezes or thaws all processes of the machine.
+func (h *taskHandle) freeze(freeze bool) error {
+	if !h.IsRunning() {
+		return fmt.Errorf("machine %s is not running", h.machineName)
+	}
+	if err := freezeUnit(h.driver.ctx, h.unitName, freeze); err != nil {
+		return err
+	}
+
+	h.stateLock.Lock()
+	h.frozen = freeze
+	h.stateLock.Unlock()
+	return nil
+}
@@ -0,0 +1,52 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// healthCheck checks a service the driver depends on.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthChecks are run on every fingerprint, besides detecting the version
+// of systemd. machined and importd are started on demand, so calling them
+// also tells whether they could be activated.
+var healthChecks = []healthCheck{
+	{"machined", func(ctx context.Context) error {
+		return callDBus(ctx, "ListMachines", func(c *systemdConn) error {
+			_, err := c.machined.ListMachines()
+			return err
+		})
+	}},
+	{"importd", func(ctx context.Context) error {
+		return callDBus(ctx, "ListTransfers", func(c *systemdConn) error {
+			_, err := c.importd.ListTransfers()
+			return err
+		})
+	}},
+}
+
+// checkHealth runs all health checks, and returns a description of every
+// failed one.
+func checkHealth(ctx context.Context) []string {
+	var problems []string
+	for _, c := range healthChecks {
+		if err := c.check(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+	return problems
+}
+
+// healthDescription returns the HealthDescription of the fingerprint with the
+// problems found.
+func healthDescription(problems []string) string {
+	if len(problems) == 0 {
+		return "healthy"
+	}
+	return "unhealthy: " + strings.Join(problems, "; ")
+}
@@ -0,0 +1,27 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckHealth(t *testing.T) {
+	defer func(checks []healthCheck) { healthChecks = checks }(healthChecks)
+	healthChecks = []healthCheck{
+		{"machined", func(context.Context) error { return nil }},
+		{"importd", func(context.Context) error { return errors.New("activation timed out") }},
+	}
+
+	problems := checkHealth(context.Background())
+	if expected := []string{"importd: activation timed out"}; !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected %v, got %v", expected, problems)
+	}
+	if d := healthDescription(problems); d != "unhealthy: importd: activation timed out" {
+		t.Errorf("unexpected description %q", d)
+	}
+	if d := healthDescription(nil); d != "healthy" {
+		t.Errorf("unexpected description %q", d)
+	}
+}
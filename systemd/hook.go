@@ -0,0 +1,139 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+)
+
+// defaultHookTimeout is the time a hook may run if it has no timeout.
+const defaultHookTimeout = time.Minute
+
+// Stages of hooks.
+const (
+	hookPreStart = "pre_start_hook"
+	hookPostStop = "post_stop_hook"
+)
+
+// Hook is a command run on the host before the machine is started or after
+// it's stopped, e.g. to set up ZFS datasets or firewall rules.
+//
+// The command gets the machine name and the task's dirs in its environment.
+type Hook struct {
+	// Command is the command and its arguments.
+	Command []string `codec:"command" ini:"-"`
+	// Timeout is the time the command may run before it's killed and
+	// considered failed, defaults to 1m.
+	Timeout string `codec:"timeout" ini:"-"`
+	// IgnoreFailure is set to true to only emit a task event if the command
+	// fails, instead of failing the task start or destroy.
+	IgnoreFailure bool `codec:"ignore_failure"`
+}
+
+// hookSpec returns the hcl specification of the hook block.
+func hookSpec(name string) *hclspec.Spec {
+	return hclspec.NewBlock(name, false, hclspec.NewObject(map[string]*hclspec.Spec{
+		"command":        hclspec.NewAttr("command", "list(string)", true),
+		"timeout":        hclspec.NewAttr("timeout", "string", false),
+		"ignore_failure": hclspec.NewAttr("ignore_failure", "bool", false),
+	}))
+}
+
+func (h Hook) validate(name string) error {
+	if len(h.Command) == 0 {
+		if h.Timeout != "" || h.IgnoreFailure {
+			return fmt.Errorf("%s requires command", name)
+		}
+		return nil
+	}
+	if h.Command[0] == "" {
+		return fmt.Errorf("invalid %s command %q", name, h.Command)
+	}
+	if h.Timeout != "" {
+		t, err := time.ParseDuration(h.Timeout)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid %s timeout %q", name, h.Timeout)
+		}
+	}
+	return nil
+}
+
+// timeout returns the time the hook may run.
+func (h Hook) timeout() time.Duration {
+	if t, err := time.ParseDuration(h.Timeout); err == nil && t > 0 {
+		return t
+	}
+	return defaultHookTimeout
+}
+
+// hookEnv returns the environment of hooks of the task.
+func hookEnv(cfg *drivers.TaskConfig, stage string) []string {
+	dir := cfg.TaskDir()
+	return append(os.Environ(),
+		"NSPAWN_HOOK="+stage,
+		"NSPAWN_MACHINE_NAME="+machineName(cfg),
+		"NOMAD_ALLOC_ID="+cfg.AllocID,
+		"NOMAD_TASK_NAME="+cfg.Name,
+		"NOMAD_ALLOC_DIR="+dir.SharedAllocDir,
+		"NOMAD_TASK_DIR="+dir.LocalDir,
+		"NOMAD_SECRETS_DIR="+dir.SecretsDir,
+	)
+}
+
+// runHook runs the hook and returns its error with the last line of output.
+func runHook(ctx context.Context, hook Hook, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, hook.timeout())
+	defer cancel()
+
+	c := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	c.Env = env
+	out, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", hook.timeout())
+	}
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			return fmt.Errorf("%v: %s", err, last)
+		}
+		return err
+	}
+	return nil
+}
+
+// runHooks runs the hooks of the stage in order, skipping unset ones.
+//
+// Failures of hooks with ignore_failure are emitted as task events, the
+// first other failure stops and is returned.
+func (d *Driver) runHooks(cfg *drivers.TaskConfig, stage string, hooks ...Hook) error {
+	env := hookEnv(cfg, stage)
+	for _, hook := range hooks {
+		if len(hook.Command) == 0 {
+			continue
+		}
+
+		err := runHook(d.ctx, hook, env)
+		if err == nil {
+			continue
+		}
+		if !hook.IgnoreFailure {
+			return fmt.Errorf("%s %q failed: %v", stage, hook.Command[0], err)
+		}
+
+		d.logger.Warn("hook failed", "stage", stage, "command", hook.Command[0], "error", err)
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			TaskName:  cfg.Name,
+			AllocID:   cfg.AllocID,
+			Timestamp: time.Now(),
+			Message:   fmt.Sprintf("%s %q failed: %v", stage, hook.Command[0], err),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package systemd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestHookValidate(t *testing.T) {
+	for _, h := range []Hook{
+		{},
+		{Command: []string{"/usr/local/bin/setup-dataset"}},
+		{Command: []string{"zfs", "create", "tank/web"}, Timeout: "10s", IgnoreFailure: true},
+	} {
+		if err := h.validate(hookPreStart); err != nil {
+			t.Errorf("%+v: unexpected error: %v", h, err)
+		}
+	}
+
+	for _, h := range []Hook{
+		{Timeout: "10s"},
+		{Command: []string{""}},
+		{Command: []string{"true"}, Timeout: "soon"},
+		{Command: []string{"true"}, Timeout: "-1s"},
+	} {
+		if err := h.validate(hookPreStart); err == nil {
+			t.Errorf("%+v: expected error", h)
+		}
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	cfg := &drivers.TaskConfig{Name: "web", AllocID: "1234", AllocDir: "/var/nomad/alloc/1234"}
+	env := hookEnv(cfg, hookPreStart)
+
+	hook := Hook{Command: []string{"sh", "-c", `test "$NSPAWN_MACHINE_NAME" = nomad-web-1234 && test "$NSPAWN_HOOK" = pre_start_hook`}}
+	if err := runHook(context.Background(), hook, env); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	hook = Hook{Command: []string{"sh", "-c", "echo starting; echo dataset exists >&2; exit 2"}}
+	if err := runHook(context.Background(), hook, env); err == nil || !strings.HasSuffix(err.Error(), ": dataset exists") {
+		t.Errorf("expected error with output, got %v", err)
+	}
+
+	hook = Hook{Command: []string{"sleep", "10"}, Timeout: "50ms"}
+	start := time.Now()
+	if err := runHook(context.Background(), hook, env); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("hook wasn't killed after its timeout")
+	}
+}
+
+func TestRunHooksIgnoreFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	events, err := d.TaskEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &drivers.TaskConfig{ID: "1", Name: "web", AllocID: "1234"}
+	ignored := Hook{Command: []string{"false"}, IgnoreFailure: true}
+	if err := d.runHooks(cfg, hookPostStop, Hook{}, ignored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if !strings.HasPrefix(ev.Message, `post_stop_hook "false" failed`) {
+			t.Errorf("unexpected event %q", ev.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected event")
+	}
+
+	if err := d.runHooks(cfg, hookPostStop, Hook{Command: []string{"false"}}, ignored); err == nil {
+		t.Error("expected error")
+	}
+}
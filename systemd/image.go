@@ -0,0 +1,204 @@
+package systemd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// rootHashRegexp matches the root hash of verity protected images.
+var rootHashRegexp = regexp.MustCompile(`^([0-9a-fA-F]{2}){32,}$`)
+
+// validateImage checks the image options, either image or disk_image must be
+// set.
+func (c *TaskConfig) validateImage() error {
+	sources := 0
+	for _, set := range []bool{c.Image != "", c.DiskImage != "", c.Bootstrap.Distro != "", c.ImageBuild.Tool == imageBuildMkosi} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of image, disk_image, bootstrap and image_build with tool %q must be set", imageBuildMkosi)
+	}
+
+	if c.Image != "" {
+		if _, err := parseImageRef(c.Image); err != nil {
+			return err
+		}
+	}
+
+	for name, p := range map[string]string{"disk_image": c.DiskImage, "verity": c.Verity} {
+		if p == "" {
+			continue
+		}
+		if err := validatePathArg(name, p); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.ExtensionImages {
+		if err := validatePathArg("extension_images", p); err != nil {
+			return err
+		}
+	}
+
+	if c.RootHash != "" {
+		if c.DiskImage == "" {
+			return fmt.Errorf("root_hash requires disk_image to be set")
+		}
+		if !rootHashRegexp.MatchString(c.RootHash) {
+			return fmt.Errorf("invalid root_hash %q", c.RootHash)
+		}
+	}
+	if c.Verity != "" && c.RootHash == "" {
+		return fmt.Errorf("verity requires root_hash to be set")
+	}
+	if c.RootHashSignature != "" {
+		if c.RootHash == "" {
+			return fmt.Errorf("root_hash_signature requires root_hash to be set")
+		}
+		if !strings.HasPrefix(c.RootHashSignature, "base64:") && !filepath.IsAbs(c.RootHashSignature) {
+			return fmt.Errorf("root_hash_signature must be an absolute path or start with \"base64:\"")
+		}
+		if strings.ContainsAny(c.RootHashSignature, " \t\"'\\") {
+			return fmt.Errorf("root_hash_signature must not contain whitespace, quotes or backslashes")
+		}
+	}
+	return nil
+}
+
+// imageDigestRegexp matches the digest of image references.
+var imageDigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// imageRef is a parsed image reference, which takes the form
+// "[transport:]url[@sha256:digest]".
+type imageRef struct {
+	// Transport is how importd pulls the image, either "raw" or "tar".
+	Transport string
+	// URL is the URL of the image.
+	URL string
+	// Name is the name of the image, which is the file name of URL without
+	// image and compression extensions.
+	Name string
+	// Digest pins the version of the image, which is the sha256 of the raw
+	// image once decompressed. Raw images are verified against it after
+	// pulling, tar images can't be verified and are trusted to match it.
+	Digest string
+}
+
+// imageExtensions are the extensions stripped from image names, in the order
+// they are removed.
+var imageExtensions = []string{".xz", ".gz", ".bz2", ".zst", ".raw", ".tar", ".qcow2"}
+
+// parseImageRef parses the image reference, the transport defaults to "raw".
+func parseImageRef(image string) (*imageRef, error) {
+	ref := &imageRef{Transport: "raw", URL: image}
+	for _, t := range []string{"raw", "tar"} {
+		if strings.HasPrefix(ref.URL, t+":") {
+			ref.Transport, ref.URL = t, strings.TrimPrefix(ref.URL, t+":")
+			break
+		}
+	}
+	if i := strings.LastIndex(ref.URL, "@"); i >= 0 && strings.HasPrefix(ref.URL[i+1:], "sha256:") {
+		ref.URL, ref.Digest = ref.URL[:i], ref.URL[i+1:]
+		if !imageDigestRegexp.MatchString(ref.Digest) {
+			return nil, fmt.Errorf("invalid image digest %q", ref.Digest)
+		}
+	}
+
+	u, err := url.Parse(ref.URL)
+	if err != nil {
+		if e, ok := err.(*url.Error); ok {
+			err = e.Err
+		}
+		return nil, fmt.Errorf("invalid image url %q: %v", redactURL(ref.URL), err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+		return nil, fmt.Errorf("image url %q must be http, https or file", redactURL(ref.URL))
+	}
+	ref.Name = path.Base(u.Path)
+	for _, ext := range imageExtensions {
+		ref.Name = strings.TrimSuffix(ref.Name, ext)
+	}
+	if ref.Name == "" || ref.Name == "/" {
+		return nil, fmt.Errorf("image url %q has no file name", redactURL(ref.URL))
+	}
+	return ref, nil
+}
+
+// imageCachePrefix is the prefix of images pulled by digest, which are
+// shared by all machines using the same digest.
+const imageCachePrefix = "nomad-sha256-"
+
+// cacheName returns the local name of the image pulled by digest, which is
+// empty if the reference is not pinned.
+func (r *imageRef) cacheName() string {
+	if r.Digest == "" {
+		return ""
+	}
+	// Image names are limited to 64 characters.
+	return imageCachePrefix + strings.TrimPrefix(r.Digest, "sha256:")[:32]
+}
+
+// machinesPool is where machined keeps images, which are pulled and cloned
+// into it.
+var machinesPool = "/var/lib/machines"
+
+// imageDigest returns the digest of the raw image of the pool.
+func imageDigest(name string) (string, error) {
+	f, err := os.Open(filepath.Join(machinesPool, name+".raw"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyImageDigest checks that the raw image of the pool has the digest.
+func verifyImageDigest(name, digest string) error {
+	got, err := imageDigest(name)
+	if err != nil {
+		return err
+	}
+	if got != digest {
+		return fmt.Errorf("image %s has digest %s, expected %s", name, got, digest)
+	}
+	return nil
+}
+
+// validatePathArg checks that the path of an option could be passed to nspawn
+// on the command line.
+func validatePathArg(name, p string) error {
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("%s %q must be an absolute path", name, p)
+	}
+	if strings.ContainsAny(p, " \t\"'\\") {
+		return fmt.Errorf("%s %q must not contain whitespace, quotes or backslashes", name, p)
+	}
+	return nil
+}
+
+// dmVerityModule is where the kernel exposes the dm-verity module.
+var dmVerityModule = "/sys/module/dm_verity"
+
+// verityAttributes returns whether the kernel supports dm-verity, and
+// whether it supports verifying signed root hashes.
+func verityAttributes() (supported, signatures bool) {
+	if _, err := os.Stat(dmVerityModule); err != nil {
+		return false, false
+	}
+	_, err := os.Stat(filepath.Join(dmVerityModule, "parameters", "require_signatures"))
+	return true, err == nil
+}
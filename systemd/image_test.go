@@ -0,0 +1,148 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateImage(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+
+	for _, c := range []TaskConfig{
+		{Image: "https://example.com/image.raw.xz"},
+		{DiskImage: "/srv/images/web.raw"},
+		{DiskImage: "/srv/images/web.raw", RootHash: hash},
+		{DiskImage: "/srv/images/web.raw", RootHash: hash, Verity: "/srv/images/web.verity"},
+		{DiskImage: "/srv/images/web.raw", RootHash: hash, RootHashSignature: "/srv/images/web.p7s"},
+		{DiskImage: "/srv/images/web.raw", RootHash: hash, RootHashSignature: "base64:MIIB"},
+		{Image: "https://example.com/image.raw.xz", ExtensionImages: []string{"/srv/sysext/agent.raw"}},
+	} {
+		if err := c.validateImage(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{},
+		{Image: "https://example.com/image.raw.xz", DiskImage: "/srv/images/web.raw"},
+		{DiskImage: "web.raw"},
+		{DiskImage: "/srv/my image.raw"},
+		{Image: "https://example.com/image.raw.xz", RootHash: hash},
+		{DiskImage: "/srv/images/web.raw", RootHash: "abc"},
+		{DiskImage: "/srv/images/web.raw", Verity: "/srv/images/web.verity"},
+		{DiskImage: "/srv/images/web.raw", RootHashSignature: "/srv/images/web.p7s"},
+		{DiskImage: "/srv/images/web.raw", RootHash: hash, RootHashSignature: "web.p7s"},
+		{Image: "https://example.com/image.raw.xz", ExtensionImages: []string{"agent.raw"}},
+		{Image: "https://example.com/image.raw.xz", ExtensionImages: []string{"/srv/sysext/my agent.raw"}},
+	} {
+		if err := c.validateImage(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestVerityAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dm_verity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := dmVerityModule
+	defer func() { dmVerityModule = old }()
+
+	dmVerityModule = filepath.Join(dir, "missing")
+	if verity, signatures := verityAttributes(); verity || signatures {
+		t.Errorf("expected no verity support")
+	}
+
+	dmVerityModule = dir
+	if verity, signatures := verityAttributes(); !verity || signatures {
+		t.Errorf("expected verity support without signatures")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "parameters"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "parameters", "require_signatures"), []byte("N\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if verity, signatures := verityAttributes(); !verity || !signatures {
+		t.Errorf("expected verity support with signatures")
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0123456789abcdef", 4)
+
+	for image, expected := range map[string]imageRef{
+		"https://example.com/images/web.raw.xz": {
+			Transport: "raw", URL: "https://example.com/images/web.raw.xz", Name: "web",
+		},
+		"tar:https://example.com/web-1.2.tar.gz@" + digest: {
+			Transport: "tar", URL: "https://example.com/web-1.2.tar.gz", Name: "web-1.2", Digest: digest,
+		},
+		"raw:https://user@example.com/web.raw": {
+			Transport: "raw", URL: "https://user@example.com/web.raw", Name: "web",
+		},
+	} {
+		ref, err := parseImageRef(image)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", image, err)
+			continue
+		}
+		if *ref != expected {
+			t.Errorf("%s: expected %+v, got %+v", image, expected, *ref)
+		}
+	}
+
+	for _, image := range []string{
+		"web",
+		"ftp://example.com/web.raw",
+		"https://example.com/",
+		"https://example.com/web.raw@sha256:abc",
+	} {
+		if _, err := parseImageRef(image); err == nil {
+			t.Errorf("%s: expected error", image)
+		}
+	}
+}
+
+func TestImageRefCacheName(t *testing.T) {
+	ref := imageRef{URL: "https://example.com/web.raw"}
+	if name := ref.cacheName(); name != "" {
+		t.Errorf("expected no cache name, got %q", name)
+	}
+
+	ref.Digest = "sha256:" + strings.Repeat("0123456789abcdef", 4)
+	if name := ref.cacheName(); name != "nomad-sha256-0123456789abcdef0123456789abcdef" {
+		t.Errorf("unexpected cache name %q", name)
+	}
+}
+
+func TestVerifyImageDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "machines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { machinesPool = p }(machinesPool)
+	machinesPool = dir
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "web.raw"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if err := verifyImageDigest("web", digest); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verifyImageDigest("web", "sha256:"+strings.Repeat("0", 64)); err == nil {
+		t.Error("expected error for mismatching digest")
+	}
+	if err := verifyImageDigest("missing", digest); err == nil {
+		t.Error("expected error for missing image")
+	}
+}
@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// secretINIPaths are the options whose values are not included in errors,
+// since they may contain secrets.
+var secretINIPaths = map[string]bool{
+	"environment": true,
+	"env_file":    true,
+}
+
+// validateINIValues checks all strings in the exported fields of v, so they
+// can't break out of their line in the generated unit files: control
+// characters like newlines would start a new setting or section, and a
+// trailing backslash would continue the setting on the next line.
+//
+// Fields tagged with `ini:"-"` are never written into unit files and skipped.
+func validateINIValues(v interface{}) error {
+	return validateINIValue(reflect.ValueOf(v), "")
+}
+
+func validateINIValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return validateINIValue(v.Elem(), path)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("ini") == "-" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("codec"); tag != "" {
+				name = tag
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := validateINIValue(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateINIValue(v.Index(i), path); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if err := validateINIValue(k, path); err != nil {
+				return err
+			}
+			if err := validateINIValue(v.MapIndex(k), path); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		s := v.String()
+		quoted := fmt.Sprintf("%q", s)
+		if secretINIPaths[path] {
+			quoted = redactedValue
+		}
+		if strings.IndexFunc(s, isControl) >= 0 {
+			return fmt.Errorf("invalid %s %s: contains control characters", path, quoted)
+		}
+		if strings.HasSuffix(s, `\`) {
+			return fmt.Errorf("invalid %s %s: ends with backslash", path, quoted)
+		}
+	}
+	return nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,171 @@
+//go:build integration
+// +build integration
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// The integration tests run machines on the host, so they need root and a
+// running systemd with machined and importd. They are only built with the
+// integration tag:
+//
+//	NSPAWN_TEST_IMAGE=https://example.com/image.raw.xz \
+//		go test -tags integration -run TestIntegration -v ./systemd
+//
+// NSPAWN_TEST_IMAGE is the url of a bootable image with /bin/true, raw
+// images are recommended as they are pulled the fastest.
+
+// integrationTimeout is the time every step of the tests may take, pulls
+// included.
+const integrationTimeout = 5 * time.Minute
+
+// integrationDriver returns a configured driver, skipping the test if the
+// host can't run machines.
+func integrationDriver(t *testing.T) (*Driver, string) {
+	image := os.Getenv("NSPAWN_TEST_IMAGE")
+	if image == "" {
+		t.Skip("NSPAWN_TEST_IMAGE is not set")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests must run as root")
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		t.Skip("systemd is not running")
+	}
+
+	logger := log.New(&log.LoggerOptions{Name: "integration", Level: log.Debug})
+	d := NewSystemdNSpawnDriver(logger).(*Driver)
+	var config []byte
+	if err := base.MsgPackEncode(&config, Config{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetConfig(&base.Config{PluginConfig: config}); err != nil {
+		t.Fatal(err)
+	}
+	return d, image
+}
+
+// integrationTask returns the config of a task of a new alloc, and a func
+// removing the alloc dir.
+func integrationTask(t *testing.T, image string) (*drivers.TaskConfig, func()) {
+	taskConfig, err := DecodeTaskConfig([]byte(fmt.Sprintf(`{"image": %q, "boot": true}`, image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "nspawn-integration-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocDir := allocdir.NewAllocDir(log.NewNullLogger(), dir)
+	if err := allocDir.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocDir.NewTaskDir("web").Build(false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	id := fmt.Sprintf("%08x", time.Now().UnixNano())[:8]
+	cfg := &drivers.TaskConfig{
+		ID:       id + "-web",
+		Name:     "web",
+		AllocID:  id + "-0000-0000-0000-000000000000",
+		AllocDir: dir,
+		Resources: &drivers.Resources{
+			LinuxResources: &drivers.LinuxResources{MemoryLimitBytes: 256 << 20, CPUShares: 512},
+		},
+	}
+	if err := cfg.EncodeConcreteDriverConfig(taskConfig); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, func() { allocDir.Destroy() }
+}
+
+// TestIntegrationLifecycle pulls the image and runs a machine through the
+// whole life of a task.
+func TestIntegrationLifecycle(t *testing.T) {
+	d, image := integrationDriver(t)
+	defer d.Shutdown(context.Background())
+
+	cfg, cleanup := integrationTask(t, image)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), integrationTimeout)
+	defer cancel()
+
+	handle, _, err := d.StartTask(cfg)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer d.DestroyTask(cfg.ID, true)
+	if handle.State != drivers.TaskStateRunning {
+		t.Errorf("expected running handle, got %q", handle.State)
+	}
+
+	waitCh, err := d.WaitTask(ctx, cfg.ID)
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	status, err := d.InspectTask(cfg.ID)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if status.State != drivers.TaskStateRunning {
+		t.Errorf("expected running task, got %q", status.State)
+	}
+
+	statsCh, err := d.TaskStats(ctx, cfg.ID, time.Second)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	select {
+	case usage := <-statsCh:
+		if usage == nil || usage.ResourceUsage == nil || usage.ResourceUsage.MemoryStats == nil {
+			t.Errorf("unexpected stats %+v", usage)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for stats")
+	}
+
+	res, err := d.ExecTask(cfg.ID, []string{"/bin/true"}, time.Minute)
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if res.ExitResult.ExitCode != 0 {
+		t.Errorf("expected exec to succeed, got exit code %d: %s", res.ExitResult.ExitCode, res.Stderr)
+	}
+
+	if err := d.StopTask(cfg.ID, time.Minute, "SIGTERM"); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-waitCh:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the machine to exit")
+	}
+
+	if err := d.DestroyTask(cfg.ID, false); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	if _, err := d.InspectTask(cfg.ID); err != drivers.ErrTaskNotFound {
+		t.Errorf("expected destroyed task to be gone, got %v", err)
+	}
+	for _, dir := range nspawnDirs() {
+		if _, err := os.Stat(nspawnPath(dir, machineName(cfg))); !os.IsNotExist(err) {
+			t.Errorf("expected nspawn file in %s to be removed", dir)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// Types of network interfaces.
+const (
+	networkInterfaceMove    = "interface"
+	networkInterfaceMACVLAN = "macvlan"
+	networkInterfaceIPVLAN  = "ipvlan"
+)
+
+// pinnedMACAddress is the mac of network interfaces whose MAC address is
+// derived by pinnedMAC.
+const pinnedMACAddress = "pinned"
+
+// linkNameRegexp matches valid interface names.
+var linkNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// NetworkInterface is a network interface of the container, either a host
+// interface moved into it, or a MACVLAN or IPVLAN interface on top of one.
+type NetworkInterface struct {
+	// Type is one of "interface", "macvlan" and "ipvlan".
+	Type string `codec:"type"`
+	// HostInterface is the interface on the host which is moved into the
+	// container, or the parent of the MACVLAN or IPVLAN interface.
+	HostInterface string `codec:"host_interface"`
+	// Name is the name of the interface in the container, defaults to
+	// HostInterface prefixed with "mv-" for MACVLAN and "iv-" for IPVLAN
+	// interfaces like nspawn does, or HostInterface itself.
+	Name string `codec:"name"`
+	// MAC is the MAC address of the interface, or "pinned" to derive it
+	// from the job, task and alloc index like pin_mac does. Not supported by
+	// IPVLAN interfaces, which share the address of their parent.
+	MAC string `codec:"mac"`
+}
+
+// linkName returns the name of the interface in the container.
+func (n NetworkInterface) linkName() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	var name string
+	switch n.Type {
+	case networkInterfaceMACVLAN:
+		name = "mv-" + n.HostInterface
+	case networkInterfaceIPVLAN:
+		name = "iv-" + n.HostInterface
+	default:
+		return n.HostInterface
+	}
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// linkSpec returns the interface in nspawn's "interface[:name]" form.
+func (n NetworkInterface) linkSpec() string {
+	if n.Name == "" {
+		return n.HostInterface
+	}
+	return n.HostInterface + ":" + n.Name
+}
+
+// address returns the MAC address of the interface, nil if it's assigned by
+// the kernel or nspawn.
+func (n NetworkInterface) address(cfg *drivers.TaskConfig) (net.HardwareAddr, error) {
+	switch n.MAC {
+	case "":
+		return nil, nil
+	case pinnedMACAddress:
+		return pinnedMAC(cfg, n.HostInterface), nil
+	default:
+		return net.ParseMAC(n.MAC)
+	}
+}
+
+func (n NetworkInterface) validate() error {
+	switch n.Type {
+	case networkInterfaceMove, networkInterfaceMACVLAN, networkInterfaceIPVLAN:
+	default:
+		return fmt.Errorf("invalid network_interface type %q", n.Type)
+	}
+	if !linkNameRegexp.MatchString(n.HostInterface) {
+		return fmt.Errorf("invalid network_interface host_interface %q", n.HostInterface)
+	}
+	if n.Name != "" && !linkNameRegexp.MatchString(n.Name) {
+		return fmt.Errorf("invalid network_interface name %q", n.Name)
+	}
+
+	if n.MAC != "" && n.MAC != pinnedMACAddress {
+		mac, err := net.ParseMAC(n.MAC)
+		if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+			return fmt.Errorf("invalid network_interface mac %q, must be a unicast MAC address", n.MAC)
+		}
+	}
+	if n.MAC != "" && n.Type == networkInterfaceIPVLAN {
+		return fmt.Errorf("network_interface mac is not supported with type %q", n.Type)
+	}
+	return nil
+}
+
+// validateNetworkInterfaces checks the network_interface blocks, which must
+// use distinct host interfaces and names in the container.
+func (c *TaskConfig) validateNetworkInterfaces() error {
+	hosts := map[string]bool{}
+	names := map[string]bool{}
+	for _, n := range c.NetworkInterface {
+		if err := n.validate(); err != nil {
+			return err
+		}
+		// Interfaces moved into the container can't be used by others.
+		if n.Type == networkInterfaceMove {
+			if hosts[n.HostInterface] {
+				return fmt.Errorf("network_interface host_interface %q is used more than once", n.HostInterface)
+			}
+			hosts[n.HostInterface] = true
+		}
+		if names[n.linkName()] {
+			return fmt.Errorf("network_interface name %q is used more than once", n.linkName())
+		}
+		names[n.linkName()] = true
+	}
+	return nil
+}
+
+// setupNetworkInterfaces converts the network_interface blocks and pinned
+// MACVLAN interfaces into nspawn's Interface=, MACVLAN= and IPVLAN= settings.
+//
+// Interfaces with a MAC address are created on the host with the address,
+// or have their address set if they are moved, and moved into the container
+// via Interface= instead of letting nspawn create them. The interfaces
+// created are destroyed together with the container's network namespace.
+func (d *Driver) setupNetworkInterfaces(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	ifaces := taskConfig.NetworkInterface
+	if taskConfig.PinMAC {
+		for _, spec := range taskConfig.MACVLAN {
+			parent, name := splitLinkSpec(spec, "mv-")
+			ifaces = append(ifaces, NetworkInterface{
+				Type:          networkInterfaceMACVLAN,
+				HostInterface: parent,
+				Name:          name,
+				MAC:           pinnedMACAddress,
+			})
+		}
+		taskConfig.MACVLAN = nil
+	}
+
+	prefix := pinnedLinkPrefix(machineName(cfg))
+	for i, n := range ifaces {
+		mac, err := n.address(cfg)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case n.Type == networkInterfaceMACVLAN && mac != nil:
+			link := fmt.Sprintf("%s%d", prefix, i)
+			out, err := exec.Command("ip", "link", "add", "link", n.HostInterface, "name", link,
+				"address", mac.String(), "type", "macvlan", "mode", "bridge").CombinedOutput()
+			if err != nil {
+				d.removePinnedMACVLAN(machineName(cfg))
+				return fmt.Errorf("create macvlan on %s: %v: %s", n.HostInterface, err, strings.TrimSpace(string(out)))
+			}
+			taskConfig.Interface = append(taskConfig.Interface, link+":"+n.linkName())
+		case n.Type == networkInterfaceMove && mac != nil:
+			out, err := exec.Command("ip", "link", "set", "dev", n.HostInterface, "address", mac.String()).CombinedOutput()
+			if err != nil {
+				d.removePinnedMACVLAN(machineName(cfg))
+				return fmt.Errorf("set address of %s: %v: %s", n.HostInterface, err, strings.TrimSpace(string(out)))
+			}
+			taskConfig.Interface = append(taskConfig.Interface, n.linkSpec())
+		case n.Type == networkInterfaceMove:
+			taskConfig.Interface = append(taskConfig.Interface, n.linkSpec())
+		case n.Type == networkInterfaceMACVLAN:
+			taskConfig.MACVLAN = append(taskConfig.MACVLAN, n.linkSpec())
+		default:
+			taskConfig.IPVLAN = append(taskConfig.IPVLAN, n.linkSpec())
+		}
+	}
+	taskConfig.NetworkInterface = nil
+	return nil
+}
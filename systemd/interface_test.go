@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateNetworkInterfaces(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{NetworkInterface: []NetworkInterface{{Type: "interface", HostInterface: "eth1"}}},
+		{NetworkInterface: []NetworkInterface{
+			{Type: "macvlan", HostInterface: "eth0", Name: "lan", MAC: "pinned"},
+			{Type: "macvlan", HostInterface: "eth0", Name: "lan2", MAC: "02:00:00:00:00:01"},
+			{Type: "ipvlan", HostInterface: "eth0"},
+		}},
+	} {
+		if err := c.validateNetworkInterfaces(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, n := range [][]NetworkInterface{
+		{{Type: "veth", HostInterface: "eth0"}},
+		{{Type: "macvlan"}},
+		{{Type: "macvlan", HostInterface: "eth0:lan"}},
+		{{Type: "macvlan", HostInterface: "eth0", Name: "averyveryverylongname"}},
+		{{Type: "macvlan", HostInterface: "eth0", MAC: "random"}},
+		{{Type: "macvlan", HostInterface: "eth0", MAC: "01:00:5e:00:00:01"}},
+		{{Type: "ipvlan", HostInterface: "eth0", MAC: "pinned"}},
+		{{Type: "interface", HostInterface: "eth1"}, {Type: "interface", HostInterface: "eth1", Name: "lan"}},
+		{{Type: "macvlan", HostInterface: "eth0"}, {Type: "macvlan", HostInterface: "eth0"}},
+	} {
+		c := TaskConfig{NetworkInterface: n}
+		if err := c.validateNetworkInterfaces(); err == nil {
+			t.Errorf("%+v: expected error", n)
+		}
+	}
+}
+
+func TestNetworkInterfaceLinkName(t *testing.T) {
+	cases := []struct {
+		iface NetworkInterface
+		name  string
+	}{
+		{NetworkInterface{Type: "interface", HostInterface: "eth1"}, "eth1"},
+		{NetworkInterface{Type: "macvlan", HostInterface: "eth0"}, "mv-eth0"},
+		{NetworkInterface{Type: "ipvlan", HostInterface: "enp0s31f6abcdef"}, "iv-enp0s31f6abc"},
+		{NetworkInterface{Type: "ipvlan", HostInterface: "eth0", Name: "wan"}, "wan"},
+	}
+	for _, c := range cases {
+		if name := c.iface.linkName(); name != c.name {
+			t.Errorf("%+v: expected %s, got %s", c.iface, c.name, name)
+		}
+	}
+}
+
+func TestSetupNetworkInterfaces(t *testing.T) {
+	d := &Driver{}
+	cfg := &drivers.TaskConfig{ID: "1234/web/abcd", Name: "web", AllocID: "1234"}
+	c := &TaskConfig{
+		Interface: []string{"dummy0"},
+		NetworkInterface: []NetworkInterface{
+			{Type: "interface", HostInterface: "eth1", Name: "lan"},
+			{Type: "macvlan", HostInterface: "eth0"},
+			{Type: "ipvlan", HostInterface: "eth0", Name: "wan"},
+		},
+	}
+	if err := d.setupNetworkInterfaces(cfg, c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(c.Interface, []string{"dummy0", "eth1:lan"}) {
+		t.Errorf("unexpected interface %v", c.Interface)
+	}
+	if !reflect.DeepEqual(c.MACVLAN, []string{"eth0"}) {
+		t.Errorf("unexpected macvlan %v", c.MACVLAN)
+	}
+	if !reflect.DeepEqual(c.IPVLAN, []string{"eth0:wan"}) {
+		t.Errorf("unexpected ipvlan %v", c.IPVLAN)
+	}
+	if c.NetworkInterface != nil {
+		t.Errorf("expected network_interface to be converted")
+	}
+}
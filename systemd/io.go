@@ -0,0 +1,111 @@
+package systemd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// IOLimit limits the I/O of the machine on a block device, so disk heavy
+// containers can't starve co-located workloads. Requires cgroup v2.
+type IOLimit struct {
+	// Device is the block device, e.g. "/dev/nvme0n1", or a path on the file
+	// system whose backing device is limited, e.g. "/var/lib/machines".
+	Device string `codec:"device"`
+	// ReadBPS and WriteBPS limit the bandwidth in bytes per second, e.g.
+	// "50M".
+	ReadBPS  string `codec:"read_bps"`
+	WriteBPS string `codec:"write_bps"`
+	// ReadIOPS and WriteIOPS limit the I/O operations per second.
+	ReadIOPS  int `codec:"read_iops"`
+	WriteIOPS int `codec:"write_iops"`
+}
+
+// ioDeviceLimit is an item of the IO*Max unit properties, which have the
+// D-Bus signature a(st).
+type ioDeviceLimit struct {
+	Path  string
+	Limit uint64
+}
+
+func (l IOLimit) validate() error {
+	if !filepath.IsAbs(l.Device) || strings.ContainsAny(l.Device, " \t") {
+		return fmt.Errorf("invalid io_limit device %q", l.Device)
+	}
+	for name, v := range map[string]string{"read_bps": l.ReadBPS, "write_bps": l.WriteBPS} {
+		if v == "" {
+			continue
+		}
+		if n, err := parseBytes(v); err != nil || n == 0 {
+			return fmt.Errorf("invalid io_limit %s %q", name, v)
+		}
+	}
+	if l.ReadIOPS < 0 || l.WriteIOPS < 0 {
+		return fmt.Errorf("invalid io_limit iops, must not be negative")
+	}
+	if l.ReadBPS == "" && l.WriteBPS == "" && l.ReadIOPS == 0 && l.WriteIOPS == 0 {
+		return fmt.Errorf("io_limit of %s requires a limit", l.Device)
+	}
+	return nil
+}
+
+func (c *TaskConfig) validateIOLimits() error {
+	devices := map[string]bool{}
+	for _, l := range c.IOLimit {
+		if err := l.validate(); err != nil {
+			return err
+		}
+		if devices[l.Device] {
+			return fmt.Errorf("io_limit device %q is used more than once", l.Device)
+		}
+		devices[l.Device] = true
+	}
+	// Without keep_unit the container runs in its own scope, which the
+	// properties of the machine's unit don't apply to.
+	if len(c.IOLimit) > 0 && !c.KeepUnit {
+		return fmt.Errorf("io_limit requires keep_unit to be enabled")
+	}
+	return nil
+}
+
+// ioLimitProperties returns the I/O limit properties of the machine's
+// transient unit.
+func ioLimitProperties(c TaskConfig) ([]dbus.Property, error) {
+	limits := map[string][]ioDeviceLimit{}
+	add := func(name, device string, v uint64) {
+		if v > 0 {
+			limits[name] = append(limits[name], ioDeviceLimit{Path: device, Limit: v})
+		}
+	}
+	for _, l := range c.IOLimit {
+		for name, v := range map[string]string{"IOReadBandwidthMax": l.ReadBPS, "IOWriteBandwidthMax": l.WriteBPS} {
+			if v == "" {
+				continue
+			}
+			n, err := parseBytes(v)
+			if err != nil {
+				return nil, err
+			}
+			add(name, l.Device, n)
+		}
+		add("IOReadIOPSMax", l.Device, uint64(l.ReadIOPS))
+		add("IOWriteIOPSMax", l.Device, uint64(l.WriteIOPS))
+	}
+
+	var props []dbus.Property
+	for _, name := range []string{"IOReadBandwidthMax", "IOWriteBandwidthMax", "IOReadIOPSMax", "IOWriteIOPSMax"} {
+		if len(limits[name]) > 0 {
+			props = append(props, dbus.Property{Name: name, Value: godbus.MakeVariant(limits[name])})
+		}
+	}
+	return props, nil
+}
+
+// String formats the limit like in unit files.
+func (l ioDeviceLimit) String() string {
+	return l.Path + " " + strconv.FormatUint(l.Limit, 10)
+}
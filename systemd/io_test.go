@@ -0,0 +1,56 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateIOLimits(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", ReadBPS: "10M", WriteIOPS: 100}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", ReadIOPS: 100}, {Device: "/dev/sdb", WriteBPS: "1G"}}},
+	} {
+		if err := c.validateIOLimits(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "sda", ReadIOPS: 100}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/my disk", ReadIOPS: 100}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda"}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", ReadBPS: "fast"}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", WriteBPS: "0"}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", WriteIOPS: -1}}},
+		{KeepUnit: true, IOLimit: []IOLimit{{Device: "/dev/sda", ReadIOPS: 1}, {Device: "/dev/sda", WriteIOPS: 1}}},
+		{IOLimit: []IOLimit{{Device: "/dev/sda", ReadIOPS: 100}}},
+	} {
+		if err := c.validateIOLimits(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestIOLimitProperties(t *testing.T) {
+	props, err := ioLimitProperties(TaskConfig{IOLimit: []IOLimit{
+		{Device: "/dev/sda", ReadBPS: "10M", WriteIOPS: 100},
+		{Device: "/dev/sdb", ReadBPS: "1K"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range props {
+		got = append(got, p.Name+"="+formatProperty(p, nil))
+	}
+	expected := []string{
+		"IOReadBandwidthMax=/dev/sda 10485760, /dev/sdb 1024",
+		"IOWriteIOPSMax=/dev/sda 100",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if sig := props[0].Value.Signature().String(); sig != "a(st)" {
+		t.Errorf("unexpected signature %s", sig)
+	}
+}
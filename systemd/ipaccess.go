@@ -0,0 +1,147 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+	"github.com/hashicorp/nomad/plugins/device"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// ipAddressNames are the symbolic names systemd accepts in IPAddressAllow=
+// and IPAddressDeny=, by the prefixes they stand for.
+var ipAddressNames = map[string][]string{
+	"any":        {"0.0.0.0/0", "::/0"},
+	"localhost":  {"127.0.0.0/8", "::1/128"},
+	"link-local": {"169.254.0.0/16", "fe80::/64"},
+	"multicast":  {"224.0.0.0/4", "ff00::/8"},
+}
+
+// ipAccountingCounters are the unit properties collected if IP accounting is
+// enabled, by the names of the interface counters.
+var ipAccountingCounters = map[string]string{
+	"rx_bytes":   "IPIngressBytes",
+	"tx_bytes":   "IPEgressBytes",
+	"rx_packets": "IPIngressPackets",
+	"tx_packets": "IPEgressPackets",
+}
+
+// ipAddressPrefix is an item of the IPAddressAllow and IPAddressDeny unit
+// properties, which have the D-Bus signature a(iayu).
+type ipAddressPrefix struct {
+	Family int32
+	Addr   []byte
+	Prefix uint32
+}
+
+// String formats the prefix like in unit files.
+func (p ipAddressPrefix) String() string {
+	return fmt.Sprintf("%s/%d", net.IP(p.Addr), p.Prefix)
+}
+
+// parseIPAddressPrefixes parses the address list into prefixes, which are
+// either a symbolic name, an address or a CIDR.
+func parseIPAddressPrefixes(list []string) ([]ipAddressPrefix, error) {
+	var prefixes []ipAddressPrefix
+	for _, v := range list {
+		cidrs, ok := ipAddressNames[v]
+		if !ok {
+			cidrs = []string{v}
+		}
+		for _, cidr := range cidrs {
+			network, err := parseNetwork(cidr)
+			if err != nil {
+				return nil, err
+			}
+			ones, _ := network.Mask.Size()
+			p := ipAddressPrefix{Family: 2, Addr: network.IP.To4(), Prefix: uint32(ones)}
+			if p.Addr == nil {
+				p = ipAddressPrefix{Family: 10, Addr: network.IP.To16(), Prefix: uint32(ones)}
+			}
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, nil
+}
+
+func (c *TaskConfig) validateIPAccess() error {
+	if !c.IPAccounting && len(c.IPAddressAllow) == 0 && len(c.IPAddressDeny) == 0 {
+		return nil
+	}
+	if _, err := parseIPAddressPrefixes(c.IPAddressAllow); err != nil {
+		return fmt.Errorf("invalid ip_address_allow: %v", err)
+	}
+	if _, err := parseIPAddressPrefixes(c.IPAddressDeny); err != nil {
+		return fmt.Errorf("invalid ip_address_deny: %v", err)
+	}
+	// Without keep_unit the container runs in its own scope, which the
+	// properties of the machine's unit don't apply to.
+	if !c.KeepUnit {
+		return fmt.Errorf("ip_accounting, ip_address_allow and ip_address_deny require keep_unit to be enabled")
+	}
+	return nil
+}
+
+// ipAccessProperties returns the IP accounting and filtering properties of
+// the machine's transient unit.
+func ipAccessProperties(c TaskConfig) ([]dbus.Property, error) {
+	var props []dbus.Property
+	if c.IPAccounting {
+		props = append(props, dbus.Property{Name: "IPAccounting", Value: godbus.MakeVariant(true)})
+	}
+	for _, p := range []struct {
+		name string
+		list []string
+	}{
+		{"IPAddressAllow", c.IPAddressAllow},
+		{"IPAddressDeny", c.IPAddressDeny},
+	} {
+		if len(p.list) == 0 {
+			continue
+		}
+		prefixes, err := parseIPAddressPrefixes(p.list)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, dbus.Property{Name: p.name, Value: godbus.MakeVariant(prefixes)})
+	}
+	return props, nil
+}
+
+// ipAccountingStats returns the IP traffic of the machine's unit counted by
+// systemd, nil unless IP accounting is enabled.
+func (h *taskHandle) ipAccountingStats(at time.Time) *device.DeviceGroupStats {
+	if !h.ipAccounting {
+		return nil
+	}
+
+	attrs := map[string]*pstructs.StatValue{}
+	for counter, property := range ipAccountingCounters {
+		v, err := h.driver.getUnitUint64(h.unitName, property)
+		if err != nil {
+			h.logger.Debug("failed to get ip accounting counter", "property", property, "error", err)
+			return nil
+		}
+		n := int64(v)
+		unit := "packets"
+		if counter == "rx_bytes" || counter == "tx_bytes" {
+			unit = "bytes"
+		}
+		attrs[counter] = &pstructs.StatValue{IntNumeratorVal: &n, Unit: unit}
+	}
+	return &device.DeviceGroupStats{
+		Vendor: pluginName,
+		Type:   "network",
+		Name:   "ip_accounting",
+		InstanceStats: map[string]*device.DeviceStats{
+			h.unitName: {
+				Summary:   attrs["rx_bytes"],
+				Stats:     &pstructs.StatObject{Attributes: attrs},
+				Timestamp: at,
+			},
+		},
+	}
+}
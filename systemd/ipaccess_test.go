@@ -0,0 +1,67 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIPAddressPrefixes(t *testing.T) {
+	prefixes, err := parseIPAddressPrefixes([]string{"10.0.0.1", "fd00::/8", "localhost"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	expected := []string{"10.0.0.1/32", "fd00::/8", "127.0.0.0/8", "::1/128"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if prefixes[0].Family != 2 || len(prefixes[0].Addr) != 4 || prefixes[1].Family != 10 || len(prefixes[1].Addr) != 16 {
+		t.Errorf("unexpected families %+v", prefixes)
+	}
+
+	if _, err := parseIPAddressPrefixes([]string{"example.com"}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestValidateIPAccess(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{KeepUnit: true, IPAccounting: true},
+		{KeepUnit: true, IPAddressAllow: []string{"10.0.0.0/8"}, IPAddressDeny: []string{"any"}},
+	} {
+		if err := c.validateIPAccess(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{IPAccounting: true},
+		{KeepUnit: true, IPAddressAllow: []string{"10.0.0.0/33"}},
+		{KeepUnit: true, IPAddressDeny: []string{"everything"}},
+	} {
+		if err := c.validateIPAccess(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestIPAccessProperties(t *testing.T) {
+	props, err := ipAccessProperties(TaskConfig{IPAccounting: true, IPAddressDeny: []string{"any"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range props {
+		got = append(got, p.Name+"="+formatProperty(p, nil))
+	}
+	expected := []string{"IPAccounting=yes", "IPAddressDeny=0.0.0.0/0 ::/0"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if sig := props[1].Value.Signature().String(); sig != "a(iayu)" {
+		t.Errorf("unexpected signature %s", sig)
+	}
+}
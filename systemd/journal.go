@@ -0,0 +1,189 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// journalErrors returns the error lines logged by the unit since the given
+// time.
+func journalErrors(ctx context.Context, unit string, since time.Time) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "journalctl",
+		"--unit", unit,
+		"--priority", "err",
+		"--since", fmt.Sprintf("@%d", since.Unix()),
+		"--output", "cat",
+		"--no-pager",
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+// scrapeJournal returns the first error line of the unit logged since the
+// given time, and emits it as a task event.
+//
+// An empty string will be returned if journal scraping is disabled or no
+// error could be found.
+func (d *Driver) scrapeJournal(ctx context.Context, cfg *drivers.TaskConfig, unit string, since time.Time) string {
+	if !d.loadConfig().ScrapeJournal {
+		return ""
+	}
+
+	lines, err := journalErrors(ctx, unit, since)
+	if err != nil {
+		d.logger.Warn("failed to scrape journal", "unit", unit, "error", err)
+		return ""
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		TaskName:  cfg.Name,
+		AllocID:   cfg.AllocID,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("systemd-nspawn error: %s", lines[0]),
+		Annotations: map[string]string{
+			"unit": unit,
+		},
+	})
+	return lines[0]
+}
+
+// consoleCommand is the command of ExecTask which prints the console output
+// of the machine, e.g. "nspawn:console 100".
+//
+// nspawn runs with a read-only console when started by the unit, so the
+// output of the container's console, including getty and init messages, is
+// in the journal of the unit.
+const consoleCommand = driverCommandPrefix + "console"
+
+// defaultConsoleLines is the number of console lines printed by default.
+const defaultConsoleLines = 200
+
+// consoleArgs returns the arguments of journalctl to print the last lines of
+// console output of the unit since the given time.
+func consoleArgs(unit string, lines int, since time.Time) []string {
+	return []string{
+		"--unit", unit,
+		"--since", fmt.Sprintf("@%d", since.Unix()),
+		"--lines", strconv.Itoa(lines),
+		"--output", "cat",
+		"--no-pager",
+	}
+}
+
+// execConsole runs the console command of ExecTask.
+func (h *taskHandle) execConsole(args []string) (*drivers.ExecTaskResult, error) {
+	result := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
+
+	lines := defaultConsoleLines
+	if len(args) > 1 {
+		result.Stderr = []byte(fmt.Sprintf("usage: %s [lines]\n", consoleCommand))
+		result.ExitResult.ExitCode = 1
+		return result, nil
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			result.Stderr = []byte(fmt.Sprintf("invalid lines %q\n", args[0]))
+			result.ExitResult.ExitCode = 1
+			return result, nil
+		}
+		lines = n
+	}
+
+	h.stateLock.RLock()
+	since := h.startedAt
+	h.stateLock.RUnlock()
+
+	var stdout, stderr bytes.Buffer
+	c := exec.Command("journalctl", consoleArgs(h.unitName, lines, since)...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+		result.ExitResult.ExitCode = 1
+	}
+
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	return result, nil
+}
+
+// journalDir is the directory of persistent journals, containers linking
+// their journal have theirs in a subdirectory named after their machine ID.
+var journalDir = "/var/log/journal"
+
+// validateExportJournal checks the journal of the container is visible to the
+// host, so it can be exported.
+func (c *TaskConfig) validateExportJournal() error {
+	if !c.ExportJournal {
+		return nil
+	}
+	switch c.LinkJournal {
+	case "host", "try-host", "guest", "try-guest", "auto":
+		return nil
+	}
+	return fmt.Errorf("export_journal requires link_journal to be host or guest")
+}
+
+// journalExportPath returns the path the journal of the task is exported to
+// in the alloc's log dir.
+func journalExportPath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().LogDir, cfg.Name+".journal.export")
+}
+
+// exportJournal exports the journal linked by the machine into the alloc's
+// log dir, so it outlives the machine for post-mortem debugging. The export
+// can be turned into a journal file with systemd-journal-remote.
+//
+// Nothing is exported if the machine has no linked journal.
+func exportJournal(ctx context.Context, cfg *drivers.TaskConfig, machineID string) error {
+	dir := filepath.Join(journalDir, machineID)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	path := journalExportPath(cfg)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "journalctl", "--directory", dir, "--output", "export", "--no-pager")
+	c.Stdout = f
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("journalctl: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
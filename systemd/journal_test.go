@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestConsoleArgs(t *testing.T) {
+	expected := []string{
+		"--unit", "systemd-nspawn@nomad-web-1234.service",
+		"--since", "@1560000000",
+		"--lines", "50",
+		"--output", "cat",
+		"--no-pager",
+	}
+	args := consoleArgs("systemd-nspawn@nomad-web-1234.service", 50, time.Unix(1560000000, 0))
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
+
+func TestExecConsoleUsage(t *testing.T) {
+	h := &taskHandle{}
+	for _, args := range [][]string{{"1", "2"}, {"x"}, {"0"}} {
+		result, err := h.execConsole(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExitResult.ExitCode != 1 || len(result.Stderr) == 0 {
+			t.Errorf("%v: expected usage error, got %+v", args, result)
+		}
+	}
+}
+
+func TestValidateExportJournal(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{ExportJournal: true, LinkJournal: "host"},
+		{ExportJournal: true, LinkJournal: "try-guest"},
+	} {
+		if err := c.validateExportJournal(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{ExportJournal: true},
+		{ExportJournal: true, LinkJournal: "no"},
+	} {
+		if err := c.validateExportJournal(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestExportJournalNotLinked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := journalDir
+	journalDir = filepath.Join(dir, "journal")
+	defer func() { journalDir = saved }()
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	if err := os.MkdirAll(cfg.TaskDir().LogDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exportJournal(context.Background(), cfg, defaultMachineID(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalExportPath(cfg)); !os.IsNotExist(err) {
+		t.Errorf("expected no export, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// pidAlive returns whether the process exists.
+var pidAlive = func(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// probeMachines periodically checks that the machines of all running tasks
+// still exist, so tasks don't run forever if their machine vanished without
+// the unit's exit being noticed, e.g. while systemd was not connected.
+func (d *Driver) probeMachines(ctx context.Context) {
+	ticker := time.NewTicker(d.loadConfig().livenessInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, h := range d.tasks.List() {
+			if err := h.probe(); err != nil {
+				h.logger.Warn("liveness probe failed", "machine", h.machineName, "error", err)
+			}
+		}
+	}
+}
+
+// probe checks that the machine is registered and its leader alive, and
+// marks the task as exited otherwise.
+//
+// Unregistered machines are not probed, their unit is watched by run.
+func (h *taskHandle) probe() error {
+	h.stateLock.RLock()
+	skip := h.unregistered || h.stopping || h.procState != drivers.TaskStateRunning
+	h.stateLock.RUnlock()
+	if skip {
+		return nil
+	}
+
+	var vanished error
+	m, err := h.driver.GetMachine(h.machineName)
+	switch {
+	case isNoSuchMachine(err):
+		vanished = fmt.Errorf("machine %s vanished", h.machineName)
+	case err != nil:
+		return err
+	case m.Leader > 0 && !pidAlive(m.Leader):
+		vanished = fmt.Errorf("leader %d of machine %s vanished", m.Leader, h.machineName)
+	default:
+		return nil
+	}
+
+	if h.setExited(0, false, vanished) {
+		h.logger.Warn("machine vanished, marking task as exited", "machine", h.machineName, "error", vanished)
+	}
+	return nil
+}
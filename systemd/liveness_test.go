@@ -0,0 +1,60 @@
+package systemd
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	godbus "github.com/godbus/dbus"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestIsNoSuchMachine(t *testing.T) {
+	if !isNoSuchMachine(godbus.Error{Name: "org.freedesktop.machine1.NoSuchMachine"}) {
+		t.Error("expected NoSuchMachine to match")
+	}
+	for _, err := range []error{nil, errors.New("no such machine"), godbus.Error{Name: "org.freedesktop.DBus.Error.NoReply"}} {
+		if isNoSuchMachine(err) {
+			t.Errorf("%v: unexpected match", err)
+		}
+	}
+}
+
+func TestPIDAlive(t *testing.T) {
+	if !pidAlive(os.Getpid()) {
+		t.Error("expected own pid to be alive")
+	}
+}
+
+func TestSetExited(t *testing.T) {
+	h := &taskHandle{procState: drivers.TaskStateRunning, doneCh: make(chan struct{})}
+
+	if !h.setExited(0, false, errors.New("machine vanished")) {
+		t.Fatal("expected first exit to be recorded")
+	}
+	if h.setExited(1, true, nil) {
+		t.Error("expected second exit to be ignored")
+	}
+
+	select {
+	case <-h.doneCh:
+	default:
+		t.Error("expected doneCh to be closed")
+	}
+	if h.procState != drivers.TaskStateExited || h.exitResult.ExitCode != 0 || h.exitResult.Err == nil {
+		t.Errorf("unexpected exit result %+v", h.exitResult)
+	}
+}
+
+func TestProbeSkipsStopping(t *testing.T) {
+	for _, h := range []*taskHandle{
+		{procState: drivers.TaskStateRunning, stopping: true},
+		{procState: drivers.TaskStateRunning, unregistered: true},
+		{procState: drivers.TaskStateExited},
+	} {
+		// The handle has no driver, so probing it would panic.
+		if err := h.probe(); err != nil {
+			t.Error(err)
+		}
+	}
+}
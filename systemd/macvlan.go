@@ -0,0 +1,87 @@
+package systemd
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// linkSpecRegexp matches interface entries in the "interface[:name]" form.
+var linkSpecRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}(:[a-zA-Z0-9_.-]{1,15})?$`)
+
+// validateLinkSpecs checks MACVLAN, IPVLAN and Interface entries.
+func (c *TaskConfig) validateLinkSpecs() error {
+	for _, list := range [][]string{c.Interface, c.MACVLAN, c.IPVLAN} {
+		for _, v := range list {
+			if !linkSpecRegexp.MatchString(v) {
+				return fmt.Errorf("invalid interface %q", v)
+			}
+		}
+	}
+	if c.PinMAC && len(c.MACVLAN) == 0 {
+		return fmt.Errorf("pin_mac requires macvlan to be set")
+	}
+	return nil
+}
+
+// splitLinkSpec splits "interface[:name]" into the host interface and the
+// name inside the container, which defaults to the given prefix followed by
+// the host interface like nspawn does.
+func splitLinkSpec(spec, prefix string) (string, string) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	name := prefix + parts[0]
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return parts[0], name
+}
+
+// pinnedLinkPrefix returns the prefix of host-side names of the pinned
+// MACVLAN interfaces of the machine.
+func pinnedLinkPrefix(machineName string) string {
+	sum := md5.Sum([]byte(machineName))
+	return "nm" + hex.EncodeToString(sum[:])[:10]
+}
+
+// pinnedMAC returns a locally administered unicast MAC address derived from
+// the job, task group, task and alloc index of the task, which are kept
+// when the alloc is rescheduled, unlike the alloc ID nspawn derives its MAC
+// addresses from via the machine name.
+func pinnedMAC(cfg *drivers.TaskConfig, parent string) net.HardwareAddr {
+	sum := md5.Sum([]byte(strings.Join([]string{
+		cfg.JobName, cfg.TaskGroupName, cfg.Name, cfg.Env["NOMAD_ALLOC_INDEX"], parent,
+	}, "/")))
+
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] &^ 0x01) | 0x02
+	return mac
+}
+
+// removePinnedMACVLAN removes the MACVLAN interfaces created on the host by
+// setupNetworkInterfaces which are left, e.g. if the machine failed to start.
+func (d *Driver) removePinnedMACVLAN(machineName string) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	prefix := pinnedLinkPrefix(machineName)
+	for _, iface := range ifaces {
+		if !strings.HasPrefix(iface.Name, prefix) {
+			continue
+		}
+		if out, err := exec.Command("ip", "link", "del", iface.Name).CombinedOutput(); err != nil {
+			return fmt.Errorf("remove macvlan %s: %v: %s", iface.Name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package systemd
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestSplitLinkSpec(t *testing.T) {
+	cases := []struct {
+		spec, parent, name string
+	}{
+		{"eth0", "eth0", "mv-eth0"},
+		{"eth0:lan", "eth0", "lan"},
+		{"enp0s31f6abcdef", "enp0s31f6abcdef", "mv-enp0s31f6abc"},
+	}
+	for _, c := range cases {
+		parent, name := splitLinkSpec(c.spec, "mv-")
+		if parent != c.parent || name != c.name {
+			t.Errorf("%q: expected %s, %s, got %s, %s", c.spec, c.parent, c.name, parent, name)
+		}
+	}
+}
+
+func TestValidateLinkSpecs(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{MACVLAN: []string{"eth0", "eth1:lan"}},
+		{IPVLAN: []string{"eth0:wan"}, Interface: []string{"dummy0"}},
+		{MACVLAN: []string{"eth0"}, PinMAC: true},
+	} {
+		if err := c.validateLinkSpecs(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{MACVLAN: []string{"eth0:"}},
+		{IPVLAN: []string{"eth0:a:b"}},
+		{Interface: []string{"averyveryverylongname"}},
+		{PinMAC: true},
+	} {
+		if err := c.validateLinkSpecs(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestPinnedMAC(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		JobName:       "web",
+		TaskGroupName: "web",
+		Name:          "nginx",
+		AllocID:       "1234",
+		Env:           map[string]string{"NOMAD_ALLOC_INDEX": "0"},
+	}
+
+	mac := pinnedMAC(cfg, "eth0")
+	if mac[0]&0x01 != 0 || mac[0]&0x02 == 0 {
+		t.Errorf("expected locally administered unicast address, got %s", mac)
+	}
+
+	cfg.AllocID = "5678"
+	if pinnedMAC(cfg, "eth0").String() != mac.String() {
+		t.Errorf("expected same address for rescheduled alloc")
+	}
+	if pinnedMAC(cfg, "eth1").String() == mac.String() {
+		t.Errorf("expected different address for different parent")
+	}
+}
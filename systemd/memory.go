@@ -0,0 +1,152 @@
+package systemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// cgroupRoot is where the unified cgroup hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// hugePageSizeRegexp matches huge page sizes as named by the hugetlb
+// controller, e.g. "2MB" or "1GB".
+var hugePageSizeRegexp = regexp.MustCompile(`^[0-9]+[KMG]B$`)
+
+// Memory tunes the memory of the machine's unit beyond the memory limit
+// Nomad sets, e.g. for databases and JVMs.
+type Memory struct {
+	// SwapMax limits the swap used by the machine, e.g. "1G", or "0" to
+	// disable swapping. Sets MemorySwapMax=.
+	SwapMax string `codec:"swap_max"`
+	// ZSwapMax limits the memory used by zswap for the machine. Sets
+	// MemoryZSwapMax=, which requires systemd 253.
+	ZSwapMax string `codec:"zswap_max"`
+	// HugeTLB limits the huge pages used by the machine by page size, e.g.
+	// {"2MB" = "1G"}. systemd doesn't manage the hugetlb controller, so the
+	// limits are written into the unit's cgroup once the machine is started,
+	// which requires cgroup v2.
+	HugeTLB map[string]string `codec:"hugetlb"`
+}
+
+// enabled returns whether the memory is tuned.
+func (m Memory) enabled() bool {
+	return m.SwapMax != "" || m.ZSwapMax != "" || len(m.HugeTLB) > 0
+}
+
+func (c *TaskConfig) validateMemory() error {
+	m := c.Memory
+	if !m.enabled() {
+		return nil
+	}
+	for name, v := range map[string]string{"swap_max": m.SwapMax, "zswap_max": m.ZSwapMax} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseBytes(v); err != nil {
+			return fmt.Errorf("invalid memory %s %q", name, v)
+		}
+	}
+	for size, limit := range m.HugeTLB {
+		if !hugePageSizeRegexp.MatchString(size) {
+			return fmt.Errorf("invalid memory hugetlb page size %q", size)
+		}
+		if _, err := parseBytes(limit); err != nil {
+			return fmt.Errorf("invalid memory hugetlb limit %q", limit)
+		}
+	}
+	// Without keep_unit the container runs in its own scope, which the
+	// properties of the machine's unit don't apply to.
+	if !c.KeepUnit {
+		return fmt.Errorf("memory requires keep_unit to be enabled")
+	}
+	return nil
+}
+
+// memoryProperties returns the swap properties of the machine's transient
+// unit.
+func memoryProperties(c TaskConfig) ([]dbus.Property, error) {
+	var props []dbus.Property
+	for _, p := range []struct{ name, value string }{
+		{"MemorySwapMax", c.Memory.SwapMax},
+		{"MemoryZSwapMax", c.Memory.ZSwapMax},
+	} {
+		if p.value == "" {
+			continue
+		}
+		v, err := parseBytes(p.value)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, uint64Property(p.name, v))
+	}
+	return props, nil
+}
+
+// enableController enables the controller for the cgroup, by enabling it in
+// the subtree of every ancestor starting at the root.
+func enableController(cgroup, controller string) error {
+	dirs := []string{cgroupRoot}
+	if parent := strings.Trim(filepath.Dir(cgroup), "/"); parent != "" {
+		for _, part := range strings.Split(parent, "/") {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], part))
+		}
+	}
+	for _, dir := range dirs {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			return fmt.Errorf("enable %s in %s: %v", controller, dir, err)
+		}
+	}
+	return nil
+}
+
+// setupHugeTLB writes the huge page limits into the cgroup of the unit.
+func (d *Driver) setupHugeTLB(unit string, limits map[string]string) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	var p *dbus.Property
+	err := callDBus(d.ctx, "GetServiceProperty", func(c *systemdConn) (err error) {
+		p, err = c.systemd.GetServiceProperty(unit, "ControlGroup")
+		return
+	})
+	if err != nil {
+		return err
+	}
+	cgroup, ok := p.Value.Value().(string)
+	if !ok || cgroup == "" {
+		return fmt.Errorf("unit %s has no cgroup", unit)
+	}
+	if err := enableController(cgroup, "hugetlb"); err != nil {
+		return err
+	}
+
+	sizes := make([]string, 0, len(limits))
+	for size := range limits {
+		sizes = append(sizes, size)
+	}
+	sort.Strings(sizes)
+	for _, size := range sizes {
+		v, err := parseBytes(limits[size])
+		if err != nil {
+			return err
+		}
+		limit := strconv.FormatUint(v, 10)
+		if v == math.MaxUint64 {
+			limit = "max"
+		}
+		path := filepath.Join(cgroupRoot, cgroup, "hugetlb."+size+".max")
+		if err := ioutil.WriteFile(path, []byte(limit), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
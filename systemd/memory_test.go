@@ -0,0 +1,72 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateMemory(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{KeepUnit: true, Memory: Memory{SwapMax: "0", ZSwapMax: "1G"}},
+		{KeepUnit: true, Memory: Memory{HugeTLB: map[string]string{"2MB": "512M", "1GB": "infinity"}}},
+	} {
+		if err := c.validateMemory(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{KeepUnit: true, Memory: Memory{SwapMax: "lots"}},
+		{KeepUnit: true, Memory: Memory{HugeTLB: map[string]string{"2M": "512M"}}},
+		{KeepUnit: true, Memory: Memory{HugeTLB: map[string]string{"2MB": "-1"}}},
+		{Memory: Memory{SwapMax: "1G"}},
+	} {
+		if err := c.validateMemory(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestMemoryProperties(t *testing.T) {
+	props, err := memoryProperties(TaskConfig{Memory: Memory{SwapMax: "1G", ZSwapMax: "0"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range props {
+		got = append(got, p.Name+"="+p.Value.String())
+	}
+	expected := []string{"MemorySwapMax=@t 1073741824", "MemoryZSwapMax=@t 0"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestEnableController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { cgroupRoot = path }(cgroupRoot)
+	cgroupRoot = dir
+
+	if err := os.MkdirAll(filepath.Join(dir, "machine.slice", "systemd-nspawn@web.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := enableController("/machine.slice/systemd-nspawn@web.service", "hugetlb"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{"cgroup.subtree_control", "machine.slice/cgroup.subtree_control"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil || string(b) != "+hugetlb" {
+			t.Errorf("%s: expected +hugetlb, got %q, %v", path, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "machine.slice", "systemd-nspawn@web.service", "cgroup.subtree_control")); err == nil {
+		t.Errorf("unexpected subtree_control in the unit's cgroup")
+	}
+}
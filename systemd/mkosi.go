@@ -0,0 +1,138 @@
+package systemd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mkosiBinary is the mkosi binary on the host.
+var mkosiBinary = "mkosi"
+
+// mkosiConfigName is the name of the config file mkosi reads from its
+// directory.
+const mkosiConfigName = "mkosi.conf"
+
+// mkosiOutputDirs are the directories mkosi may create next to its config,
+// which are not part of the recipe.
+var mkosiOutputDirs = map[string]bool{
+	"mkosi.builddir":  true,
+	"mkosi.cache":     true,
+	"mkosi.output":    true,
+	"mkosi.workspace": true,
+}
+
+func (c *TaskConfig) validateMkosiBuild() error {
+	b := c.ImageBuild
+	if b.Config == "" {
+		return fmt.Errorf("image_build tool %q requires config", imageBuildMkosi)
+	}
+	if filepath.IsAbs(b.Config) || strings.HasPrefix(filepath.Clean(b.Config), "..") {
+		return fmt.Errorf("image_build config %q must be a path in the task dir", b.Config)
+	}
+	if len(b.Commands) > 0 {
+		return fmt.Errorf("image_build commands are not supported with tool %q", imageBuildMkosi)
+	}
+	return nil
+}
+
+// mkosiConfigDir returns the directory mkosi runs in for the config, which
+// is either the directory or the mkosi.conf in it.
+func mkosiConfigDir(config string) (string, error) {
+	fi, err := os.Stat(config)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return config, nil
+	}
+	if filepath.Base(config) != mkosiConfigName {
+		return "", fmt.Errorf("image_build config %q must be named %s", filepath.Base(config), mkosiConfigName)
+	}
+	return filepath.Dir(config), nil
+}
+
+// hashMkosiConfig returns the hash of all files mkosi reads from the
+// directory, e.g. mkosi.conf, mkosi.extra and build scripts, except its
+// outputs.
+func hashMkosiConfig(dir string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", imageBuildMkosi)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && mkosiOutputDirs[rel] {
+			return filepath.SkipDir
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", filepath.ToSlash(rel), fi.Mode())
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+			fmt.Fprint(h, "\x00")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mkosiArgs returns the arguments of mkosi building the config in dir as a
+// directory image named output in the machines pool.
+func mkosiArgs(dir, output string) []string {
+	return []string{
+		"--directory=" + dir,
+		"--format=directory",
+		"--output-dir=" + machinesPool,
+		"--output=" + output,
+		"--force",
+		"build",
+	}
+}
+
+// buildMkosiImage builds the image from the mkosi config in dir unless it's
+// cached already, and returns its local name.
+func (d *Driver) buildMkosiImage(dir string, build ImageBuild) (string, error) {
+	sum, err := hashMkosiConfig(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash image_build config: %v", err)
+	}
+	// Image names are limited to 64 characters.
+	name := imageBuildPrefix + sum[:32]
+
+	return name, d.buildCachedImage(name, func(tmp string) error {
+		if err := d.checkFreeSpace(0); err != nil {
+			return err
+		}
+		d.logger.Info("building image with mkosi", "config", dir, "name", name)
+		hook := Hook{Command: append([]string{mkosiBinary}, mkosiArgs(dir, tmp)...), Timeout: build.timeout().String()}
+		if err := runHook(d.ctx, hook, os.Environ()); err != nil {
+			return fmt.Errorf("mkosi failed: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateMkosiBuild(t *testing.T) {
+	mkosi := func(config string) ImageBuild { return ImageBuild{Tool: imageBuildMkosi, Config: config} }
+	cases := []struct {
+		c     TaskConfig
+		valid bool
+	}{
+		{TaskConfig{ImageBuild: mkosi("local/mkosi.conf")}, true},
+		{TaskConfig{ImageBuild: mkosi("local")}, true},
+		{TaskConfig{ImageBuild: mkosi("")}, false},
+		{TaskConfig{ImageBuild: mkosi("/etc/mkosi.conf")}, false},
+		{TaskConfig{ImageBuild: mkosi("../mkosi.conf")}, false},
+		{TaskConfig{ImageBuild: ImageBuild{Tool: imageBuildMkosi, Config: "local", Commands: []string{"true"}}}, false},
+		{TaskConfig{ImageBuild: mkosi("local"), Image: "https://example.com/web.raw"}, false},
+		{TaskConfig{ImageBuild: mkosi("local"), DiskImage: "/srv/web.raw"}, false},
+		{TaskConfig{ImageBuild: mkosi("local"), RootLocation: rootLocationAlloc}, false},
+		{TaskConfig{ImageBuild: ImageBuild{Tool: "docker", Config: "local"}}, false},
+		{TaskConfig{Image: "https://example.com/web.raw", ImageBuild: ImageBuild{Config: "local"}}, false},
+	}
+	for _, c := range cases {
+		err := c.c.validateImage()
+		if err == nil {
+			err = c.c.validateImageBuild()
+		}
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.c.ImageBuild, c.valid, err)
+		}
+	}
+}
+
+func TestMkosiConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkosi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{mkosiConfigName, "other.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("[Distribution]\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{dir, filepath.Join(dir, mkosiConfigName)} {
+		if d, err := mkosiConfigDir(p); err != nil || d != dir {
+			t.Errorf("%s: expected %s, got %s: %v", p, dir, d, err)
+		}
+	}
+	for _, p := range []string{filepath.Join(dir, "other.conf"), filepath.Join(dir, "missing")} {
+		if _, err := mkosiConfigDir(p); err == nil {
+			t.Errorf("%s: expected error", p)
+		}
+	}
+}
+
+func TestHashMkosiConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkosi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func() string {
+		h, err := hashMkosiConfig(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write(mkosiConfigName, "[Distribution]\nDistribution=debian\n")
+	write("mkosi.extra/etc/motd", "hello\n")
+	h := hash()
+	if hash() != h {
+		t.Error("expected the same hash for the same config")
+	}
+
+	write("mkosi.cache/debian/pkg.deb", "cached")
+	write("mkosi.output/image", "built")
+	if hash() != h {
+		t.Error("expected outputs of mkosi not to change the hash")
+	}
+
+	write("mkosi.extra/etc/motd", "bye\n")
+	if hash() == h {
+		t.Error("expected changed files to change the hash")
+	}
+}
+
+func TestMkosiArgs(t *testing.T) {
+	args := mkosiArgs("/alloc/web/local", "nomad-build-1-tmp")
+	expected := []string{
+		"--directory=/alloc/web/local",
+		"--format=directory",
+		"--output-dir=" + machinesPool,
+		"--output=nomad-build-1-tmp",
+		"--force",
+		"build",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
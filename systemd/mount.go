@@ -0,0 +1,70 @@
+package systemd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// bindOptions contains all supported bind mount options.
+//
+// ref: https://www.freedesktop.org/software/systemd/man/systemd-nspawn.html#--bind=
+var bindOptions = map[string]struct{}{
+	"rbind":      {},
+	"norbind":    {},
+	"idmap":      {},
+	"noidmap":    {},
+	"rootidmap":  {},
+	"owneridmap": {},
+}
+
+// BindMount is a bind mount from the host into the container.
+type BindMount struct {
+	// Source is the path on the host.
+	Source string `codec:"source"`
+	// Target is the path in the container, defaults to Source.
+	Target string `codec:"target"`
+	// Options takes a list of mount options, like "norbind" or "rootidmap".
+	Options []string `codec:"options"`
+	// ReadOnly is set to true to create a read-only bind mount.
+	ReadOnly bool `codec:"read_only"`
+}
+
+// validate checks the bind mount.
+func (b BindMount) validate() error {
+	if !filepath.IsAbs(b.Source) {
+		return fmt.Errorf("bind source %q must be an absolute path", b.Source)
+	}
+	if b.Target != "" && !filepath.IsAbs(b.Target) {
+		return fmt.Errorf("bind target %q must be an absolute path", b.Target)
+	}
+	for _, v := range b.Options {
+		if _, ok := bindOptions[v]; !ok {
+			return fmt.Errorf("invalid bind option %q", v)
+		}
+	}
+	return nil
+}
+
+// String returns the bind mount in nspawn's "source:target:options" format.
+func (b BindMount) String() string {
+	s := escapeColon(b.Source)
+	if b.Target == "" && len(b.Options) == 0 {
+		return s
+	}
+
+	target := b.Target
+	if target == "" {
+		target = b.Source
+	}
+	s += ":" + escapeColon(target)
+	if len(b.Options) > 0 {
+		s += ":" + strings.Join(b.Options, ",")
+	}
+	return s
+}
+
+// escapeColon escapes colons in path, which are used as separators by nspawn.
+func escapeColon(path string) string {
+	return strings.Replace(path, ":", `\:`, -1)
+}
@@ -0,0 +1,32 @@
+package systemd
+
+import (
+	"testing"
+)
+
+func TestBindMount(t *testing.T) {
+	cases := []struct {
+		bind     BindMount
+		valid    bool
+		expected string
+	}{
+		{BindMount{Source: "/srv"}, true, "/srv"},
+		{BindMount{Source: "/srv", Target: "/data"}, true, "/srv:/data"},
+		{BindMount{Source: "/srv", Options: []string{"norbind", "rootidmap"}}, true, "/srv:/srv:norbind,rootidmap"},
+		{BindMount{Source: "/a:b", Target: "/c"}, true, `/a\:b:/c`},
+		{BindMount{Source: "srv"}, false, ""},
+		{BindMount{Source: "/srv", Target: "data"}, false, ""},
+		{BindMount{Source: "/srv", Options: []string{"ro"}}, false, ""},
+	}
+
+	for _, c := range cases {
+		err := c.bind.validate()
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got error %v", c.bind, c.valid, err)
+			continue
+		}
+		if c.valid && c.bind.String() != c.expected {
+			t.Errorf("%+v: expected %q, got %q", c.bind, c.expected, c.bind.String())
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package systemd
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// nsswitchPath is the path of the host's name service switch configuration.
+var nsswitchPath = "/etc/nsswitch.conf"
+
+// mymachinesEnabled returns whether the host resolves names of registered
+// machines via nss-mymachines.
+func mymachinesEnabled() bool {
+	f, err := os.Open(nsswitchPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if !strings.HasPrefix(line, "hosts:") {
+			continue
+		}
+		for _, source := range strings.Fields(strings.TrimPrefix(line, "hosts:")) {
+			if source == "mymachines" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dnsName returns the name the host resolves to the machine's addresses via
+// nss-mymachines, which is the machine name if it is registered.
+//
+// DriverNetwork has no field for host names, so it is published as a driver
+// attribute of the task instead.
+func (h *taskHandle) dnsName() string {
+	if h.unregistered {
+		return ""
+	}
+	return h.machineName
+}
@@ -0,0 +1,40 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMymachinesEnabled(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsswitch.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	old := nsswitchPath
+	defer func() { nsswitchPath = old }()
+	nsswitchPath = f.Name()
+
+	for content, expected := range map[string]bool{
+		"hosts: files dns\n":                                 false,
+		"# hosts: mymachines\nhosts: files dns\n":            false,
+		"passwd: files mymachines\nhosts: files dns\n":       false,
+		"hosts:  mymachines resolve [!UNAVAIL=return] dns\n": true,
+		"hosts: files mymachines # containers\n":             true,
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if enabled := mymachinesEnabled(); enabled != expected {
+			t.Errorf("%q: expected %v, got %v", content, expected, enabled)
+		}
+	}
+
+	nsswitchPath = f.Name() + ".missing"
+	if mymachinesEnabled() {
+		t.Error("expected false for missing nsswitch.conf")
+	}
+}
@@ -0,0 +1,97 @@
+package systemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procSys is where the kernel exposes its sysctls.
+var procSys = "/proc/sys"
+
+// nestingCapabilities are the capabilities nested nspawn and podman need
+// beyond nspawn's defaults, to set up the network of nested containers.
+var nestingCapabilities = []string{"CAP_NET_ADMIN"}
+
+// nestingSyscalls are allowed in addition to nspawn's system call filter,
+// for the keyrings of nested runtimes and the BPF programs cgroup v2 uses
+// for device access.
+var nestingSyscalls = []string{"@keyring", "bpf"}
+
+// nestingDevices are bound into the container if they exist on the host,
+// for fuse-overlayfs and the user mode networking of rootless podman.
+var nestingDevices = []string{"/dev/fuse", "/dev/net/tun"}
+
+func (c *TaskConfig) validateNesting() error {
+	if !c.Nesting {
+		return nil
+	}
+	for _, capability := range nestingCapabilities {
+		for _, v := range c.DropCapability {
+			if v == capability {
+				return fmt.Errorf("nesting requires %s, which is dropped", capability)
+			}
+		}
+	}
+	for _, syscall := range nestingSyscalls {
+		for _, v := range c.SystemCallFilter {
+			if v == "~"+syscall {
+				return fmt.Errorf("nesting requires system call %s, which is denied", syscall)
+			}
+		}
+	}
+	return nil
+}
+
+// appendMissing appends the values to the list unless they are in it.
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// setupNesting adds the capabilities, system calls and devices nested
+// containers need if nesting is enabled. nspawn adds allowed system calls to
+// its default filter, so the others stay allowed.
+func setupNesting(taskConfig *TaskConfig) {
+	if !taskConfig.Nesting {
+		return
+	}
+
+	taskConfig.Capability = appendMissing(taskConfig.Capability, nestingCapabilities...)
+	taskConfig.SystemCallFilter = appendMissing(taskConfig.SystemCallFilter, nestingSyscalls...)
+	for _, dev := range nestingDevices {
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		taskConfig.Bind = append(taskConfig.Bind, BindMount{Source: dev, Target: dev})
+	}
+}
+
+// nestingSupported returns whether the host supports containers nested in
+// machines, which requires user namespaces and the unified cgroup hierarchy
+// nspawn delegates to the container.
+func nestingSupported() bool {
+	b, err := ioutil.ReadFile(filepath.Join(procSys, "user", "max_user_namespaces"))
+	if err != nil {
+		return false
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err != nil || n == 0 {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
@@ -0,0 +1,106 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateNesting(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{DropCapability: []string{"CAP_NET_ADMIN"}},
+		{Nesting: true, DropCapability: []string{"CAP_SYS_MODULE"}, SystemCallFilter: []string{"~@swap"}},
+	} {
+		if err := c.validateNesting(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{Nesting: true, DropCapability: []string{"CAP_NET_ADMIN"}},
+		{Nesting: true, SystemCallFilter: []string{"~@keyring"}},
+		{Nesting: true, SystemCallFilter: []string{"~bpf"}},
+	} {
+		if err := c.validateNesting(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestSetupNesting(t *testing.T) {
+	taskConfig := TaskConfig{}
+	setupNesting(&taskConfig)
+	if !reflect.DeepEqual(taskConfig, TaskConfig{}) {
+		t.Errorf("unexpected config %+v", taskConfig)
+	}
+
+	dir, err := ioutil.TempDir("", "nesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(devices []string) { nestingDevices = devices }(nestingDevices)
+	fuse := filepath.Join(dir, "fuse")
+	if err := ioutil.WriteFile(fuse, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	nestingDevices = []string{fuse, filepath.Join(dir, "tun")}
+
+	taskConfig = TaskConfig{
+		Nesting:          true,
+		Capability:       []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"},
+		SystemCallFilter: []string{"~@swap"},
+	}
+	setupNesting(&taskConfig)
+	if expected := []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"}; !reflect.DeepEqual(taskConfig.Capability, expected) {
+		t.Errorf("expected capabilities %v, got %v", expected, taskConfig.Capability)
+	}
+	if expected := []string{"~@swap", "@keyring", "bpf"}; !reflect.DeepEqual(taskConfig.SystemCallFilter, expected) {
+		t.Errorf("expected system call filter %v, got %v", expected, taskConfig.SystemCallFilter)
+	}
+	if expected := []BindMount{{Source: fuse, Target: fuse}}; !reflect.DeepEqual(taskConfig.Bind, expected) {
+		t.Errorf("expected binds %v, got %v", expected, taskConfig.Bind)
+	}
+}
+
+func TestNestingSupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { procSys = path }(procSys)
+	defer func(path string) { cgroupRoot = path }(cgroupRoot)
+	procSys = filepath.Join(dir, "sys")
+	cgroupRoot = filepath.Join(dir, "cgroup")
+
+	if nestingSupported() {
+		t.Error("expected nesting to be unsupported without user namespaces")
+	}
+	for _, p := range []string{filepath.Join(procSys, "user"), cgroupRoot} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	namespaces := filepath.Join(procSys, "user", "max_user_namespaces")
+	if err := ioutil.WriteFile(namespaces, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if nestingSupported() {
+		t.Error("expected nesting to be unsupported with user namespaces disabled")
+	}
+	if err := ioutil.WriteFile(namespaces, []byte("63432\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if nestingSupported() {
+		t.Error("expected nesting to be unsupported without cgroup v2")
+	}
+	if err := ioutil.WriteFile(filepath.Join(cgroupRoot, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !nestingSupported() {
+		t.Error("expected nesting to be supported")
+	}
+}
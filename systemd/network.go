@@ -0,0 +1,311 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// containerNetworkPath is the path of the networkd config for host0 inside
+// the container, which overrides the default DHCP one shipped by systemd.
+const containerNetworkPath = "/etc/systemd/network/80-container-host0.network"
+
+// containerNetworkTemplate is the networkd config of container's host0
+// interface.
+const containerNetworkTemplate = nspawnFileMarker + `
+[Match]
+Virtualization=container
+Name=host0
+
+[Network]
+{{- range $_, $v := .Address }}
+Address={{$v}}
+{{- end }}
+{{- if .Gateway }}
+Gateway={{ .Gateway }}
+{{- end }}
+`
+
+var containerNetworkTmpl = template.Must(template.New("network").Parse(containerNetworkTemplate))
+
+// validateStaticAddress checks the static address and gateway.
+func (c *TaskConfig) validateStaticAddress() error {
+	for _, v := range c.Address {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("invalid address %q: %v", v, err)
+		}
+	}
+	if c.Gateway != "" && net.ParseIP(c.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %q", c.Gateway)
+	}
+	if c.Gateway != "" && len(c.Address) == 0 {
+		return fmt.Errorf("gateway requires address to be set")
+	}
+	if len(c.Address) > 0 && !c.VirtualEthernet && c.Bridge == "" && c.Zone == "" {
+		return fmt.Errorf("address requires virtual_ethernet, bridge or zone to be set")
+	}
+	return nil
+}
+
+// setupStaticAddress writes the networkd config for container's host0 into
+// the task dir, and binds it into the container.
+func (d *Driver) setupStaticAddress(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	if len(taskConfig.Address) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(cfg.TaskDir().Dir, "host0.network")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := containerNetworkTmpl.Execute(f, taskConfig); err != nil {
+		return err
+	}
+
+	taskConfig.Bind = append(taskConfig.Bind, BindMount{
+		Source:   path,
+		Target:   containerNetworkPath,
+		ReadOnly: true,
+	})
+	return nil
+}
+
+// hostNetworkDir is the directory which contains networkd configs for
+// host-side veth interfaces.
+const hostNetworkDir = "/run/systemd/network"
+
+// HostNetwork is the configuration of the host-side veth interface, which
+// will be managed by systemd-networkd on the host.
+type HostNetwork struct {
+	// Address takes a list of addresses in CIDR notation for the host-side interface.
+	Address []string `codec:"address"`
+	// Masquerade is set to true to masquerade packets from the container.
+	Masquerade bool `codec:"masquerade"`
+	// DHCPServer is set to true to run a DHCP server on the host-side interface,
+	// which hands out addresses to the container.
+	DHCPServer bool `codec:"dhcp_server"`
+	// IPv6Prefix is the IPv6 prefix announced to the container via router advertisement,
+	// masquerade will also be applied to IPv6 (NAT66) if it's set.
+	IPv6Prefix string `codec:"ipv6_prefix"`
+}
+
+// enabled returns whether host network config should be generated.
+func (n HostNetwork) enabled() bool {
+	return len(n.Address) > 0 || n.Masquerade || n.DHCPServer || n.IPv6Prefix != ""
+}
+
+// validate checks the host network config.
+func (n HostNetwork) validate(c *TaskConfig) error {
+	if !n.enabled() {
+		return nil
+	}
+	if !c.VirtualEthernet || c.Bridge != "" || c.Zone != "" {
+		return fmt.Errorf("host_network requires virtual_ethernet without bridge or zone")
+	}
+	if !c.Register {
+		return fmt.Errorf("host_network requires the machine to be registered")
+	}
+	for _, v := range n.Address {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("invalid host_network address %q: %v", v, err)
+		}
+	}
+	if n.DHCPServer && len(n.Address) == 0 {
+		return fmt.Errorf("host_network dhcp_server requires address to be set")
+	}
+	if n.IPv6Prefix != "" {
+		ip, _, err := net.ParseCIDR(n.IPv6Prefix)
+		if err != nil || ip.To4() != nil {
+			return fmt.Errorf("invalid host_network ipv6_prefix %q", n.IPv6Prefix)
+		}
+	}
+	return nil
+}
+
+// hostNetworkTemplate is the networkd config of the host-side veth interface.
+const hostNetworkTemplate = nspawnFileMarker + `
+[Match]
+Name={{ .Interface }}
+Driver=veth
+
+[Network]
+{{- range $_, $v := .Address }}
+Address={{$v}}
+{{- end }}
+{{- if .Masquerade }}
+IPMasquerade={{if .IPv6Prefix}}both{{else}}yes{{end}}
+{{- end }}
+{{- if .DHCPServer }}
+DHCPServer=yes
+{{- end }}
+{{- if .IPv6Prefix }}
+IPv6SendRA=yes
+
+[IPv6Prefix]
+Prefix={{ .IPv6Prefix }}
+{{- end }}
+`
+
+var hostNetworkTmpl = template.Must(template.New("host-network").Parse(hostNetworkTemplate))
+
+// hostNetworkPath returns the path of the networkd config for the machine's
+// host-side veth interface.
+func hostNetworkPath(machineName string) string {
+	return filepath.Join(hostNetworkDir, "70-"+machineName+".network")
+}
+
+// setupHostNetwork writes the networkd config for the machine's host-side
+// veth interface, and makes networkd apply it.
+//
+// machined reports the host-side interfaces of the machine, which is used to
+// find the veth name instead of guessing how nspawn shortens it.
+func (d *Driver) setupHostNetwork(m *Machine, n HostNetwork) error {
+	if !n.enabled() {
+		return nil
+	}
+	if len(m.NetworkInterfaces) == 0 {
+		return fmt.Errorf("machine %s has no network interface", m.Name)
+	}
+
+	iface, err := net.InterfaceByIndex(m.NetworkInterfaces[0])
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(hostNetworkDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(hostNetworkPath(m.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = hostNetworkTmpl.Execute(f, struct {
+		HostNetwork
+		Interface string
+	}{n, iface.Name})
+	if err != nil {
+		return err
+	}
+
+	if err := exec.Command("networkctl", "reload").Run(); err != nil {
+		return fmt.Errorf("reload networkd: %v", err)
+	}
+	return exec.Command("networkctl", "reconfigure", iface.Name).Run()
+}
+
+// removeHostNetwork removes the networkd config for the machine's host-side
+// veth interface if exists.
+func (d *Driver) removeHostNetwork(machineName string) error {
+	err := os.Remove(hostNetworkPath(machineName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return exec.Command("networkctl", "reload").Run()
+}
+
+// preferredAddress returns the address to advertise from the given
+// addresses, IPv4 is preferred over IPv6 and link local addresses are
+// ignored.
+func preferredAddress(ips []net.IP) net.IP {
+	var v6 net.IP
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip
+		}
+		if v6 == nil {
+			v6 = ip
+		}
+	}
+	return v6
+}
+
+// staticAddress returns the preferred static address of the container.
+func (c *TaskConfig) staticAddress() net.IP {
+	var ips []net.IP
+	for _, addr := range c.Address {
+		if ip, _, err := net.ParseCIDR(addr); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return preferredAddress(ips)
+}
+
+// setupAddressEnv injects the static address of the container into its
+// environment as NOMAD_IP_<label> and NOMAD_ADDR_<label> of every published
+// port label, so they point to the container instead of the host.
+//
+// Addresses assigned by DHCP are unknown until the container has booted, and
+// only available via DriverNetwork.
+func (c *TaskConfig) setupAddressEnv() {
+	ip := c.staticAddress()
+	if ip == nil {
+		return
+	}
+
+	if c.Environment == nil {
+		c.Environment = map[string]string{}
+	}
+	for _, p := range c.ports {
+		if p.Label == "" {
+			continue
+		}
+		c.Environment["NOMAD_IP_"+p.Label] = ip.String()
+		c.Environment["NOMAD_ADDR_"+p.Label] = net.JoinHostPort(ip.String(), strconv.Itoa(p.Container))
+	}
+}
+
+// buildDriverNetwork returns the network of the machine, or nil if the
+// machine doesn't use private networking or has no address yet.
+func (d *Driver) buildDriverNetwork(m *Machine, taskConfig TaskConfig) *drivers.DriverNetwork {
+	if !taskConfig.privateNetwork() {
+		return nil
+	}
+
+	ip := taskConfig.staticAddress()
+	if ip == nil && taskConfig.Register {
+		ips, err := d.GetMachineAddresses(m.Name)
+		if err != nil {
+			d.logger.Warn("failed to get machine addresses", "machine", m.Name, "error", err)
+		}
+		ip = preferredAddress(ips)
+	}
+	if ip == nil {
+		return nil
+	}
+
+	portMap := map[string]int{}
+	for _, p := range taskConfig.ports {
+		if p.Label != "" {
+			portMap[p.Label] = p.Container
+		}
+	}
+	return &drivers.DriverNetwork{
+		PortMap:       portMap,
+		IP:            ip.String(),
+		AutoAdvertise: true,
+	}
+}
+
+// privateNetwork returns whether the container runs in its own network namespace.
+func (c *TaskConfig) privateNetwork() bool {
+	return c.Private || c.VirtualEthernet || len(c.VirtualEthernetExtra) > 0 ||
+		len(c.Interface) > 0 || len(c.MACVLAN) > 0 || len(c.IPVLAN) > 0 || len(c.NetworkInterface) > 0 ||
+		c.Bridge != "" || c.Zone != ""
+}
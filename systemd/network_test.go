@@ -0,0 +1,162 @@
+package systemd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestContainerNetworkTemplate(t *testing.T) {
+	data := TaskConfig{
+		Address: []string{"10.0.0.2/24", "fd00::2/64"},
+		Gateway: "10.0.0.1",
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := containerNetworkTmpl.Execute(buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# Generated by nomad-driver-systemd-nspawn, DO NOT EDIT.
+[Match]
+Virtualization=container
+Name=host0
+
+[Network]
+Address=10.0.0.2/24
+Address=fd00::2/64
+Gateway=10.0.0.1
+`
+	if buf.String() != expected {
+		t.Errorf("network generated wrongly: %s", buf.String())
+	}
+}
+
+func TestValidateStaticAddress(t *testing.T) {
+	cases := []struct {
+		config TaskConfig
+		valid  bool
+	}{
+		{TaskConfig{}, true},
+		{TaskConfig{Bridge: "br0", Address: []string{"10.0.0.2/24"}, Gateway: "10.0.0.1"}, true},
+		{TaskConfig{Bridge: "br0", Address: []string{"10.0.0.2"}}, false},
+		{TaskConfig{Bridge: "br0", Address: []string{"10.0.0.2/24"}, Gateway: "gw"}, false},
+		{TaskConfig{Bridge: "br0", Gateway: "10.0.0.1"}, false},
+		{TaskConfig{Address: []string{"10.0.0.2/24"}}, false},
+	}
+
+	for _, c := range cases {
+		err := c.config.validateStaticAddress()
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got error %v", c.config, c.valid, err)
+		}
+	}
+}
+
+func TestHostNetworkTemplate(t *testing.T) {
+	data := struct {
+		HostNetwork
+		Interface string
+	}{
+		HostNetwork{Address: []string{"10.1.0.1/28"}, Masquerade: true, DHCPServer: true},
+		"ve-nomad-web",
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := hostNetworkTmpl.Execute(buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# Generated by nomad-driver-systemd-nspawn, DO NOT EDIT.
+[Match]
+Name=ve-nomad-web
+Driver=veth
+
+[Network]
+Address=10.1.0.1/28
+IPMasquerade=yes
+DHCPServer=yes
+`
+	if buf.String() != expected {
+		t.Errorf("host network generated wrongly: %s", buf.String())
+	}
+}
+
+func TestHostNetworkTemplateIPv6(t *testing.T) {
+	data := struct {
+		HostNetwork
+		Interface string
+	}{
+		HostNetwork{Address: []string{"10.1.0.1/28", "fd00:1::1/64"}, Masquerade: true, IPv6Prefix: "fd00:1::/64"},
+		"ve-nomad-web",
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := hostNetworkTmpl.Execute(buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# Generated by nomad-driver-systemd-nspawn, DO NOT EDIT.
+[Match]
+Name=ve-nomad-web
+Driver=veth
+
+[Network]
+Address=10.1.0.1/28
+Address=fd00:1::1/64
+IPMasquerade=both
+IPv6SendRA=yes
+
+[IPv6Prefix]
+Prefix=fd00:1::/64
+`
+	if buf.String() != expected {
+		t.Errorf("host network generated wrongly: %s", buf.String())
+	}
+}
+
+func TestPreferredAddress(t *testing.T) {
+	cases := []struct {
+		ips      []string
+		expected string
+	}{
+		{[]string{"fe80::1", "fd00::2", "10.0.0.2"}, "10.0.0.2"},
+		{[]string{"fe80::1", "fd00::2"}, "fd00::2"},
+		{[]string{"127.0.0.1", "fe80::1"}, "<nil>"},
+		{nil, "<nil>"},
+	}
+
+	for _, c := range cases {
+		var ips []net.IP
+		for _, v := range c.ips {
+			ips = append(ips, net.ParseIP(v))
+		}
+		if got := preferredAddress(ips).String(); got != c.expected {
+			t.Errorf("%v: expected %s, got %s", c.ips, c.expected, got)
+		}
+	}
+}
+
+func TestSetupAddressEnv(t *testing.T) {
+	c := TaskConfig{
+		Address: []string{"fd00::2/64", "10.0.0.2/24"},
+		ports: []portMapping{
+			{Protocol: "tcp", Host: 23456, Container: 80, Label: "http"},
+			{Protocol: "tcp", Host: 8080, Container: 8080},
+		},
+	}
+	c.setupAddressEnv()
+
+	expected := map[string]string{
+		"NOMAD_IP_http":   "10.0.0.2",
+		"NOMAD_ADDR_http": "10.0.0.2:80",
+	}
+	if len(c.Environment) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, c.Environment)
+	}
+	for k, v := range expected {
+		if c.Environment[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, c.Environment[k])
+		}
+	}
+}
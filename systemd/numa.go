@@ -0,0 +1,87 @@
+package systemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// sysNodes is where the kernel exposes the NUMA topology.
+var sysNodes = "/sys/devices/system/node"
+
+// numaPolicyBind is MPOL_BIND, the NUMAPolicy allocating memory only from
+// the nodes in NUMAMask.
+const numaPolicyBind int32 = 2
+
+func (c *TaskConfig) validateNUMANode() error {
+	if c.NUMANode == "" {
+		return nil
+	}
+	if _, err := parseCPUSet(c.NUMANode); err != nil {
+		return fmt.Errorf("invalid numa_node %q", c.NUMANode)
+	}
+	// Without keep_unit the container runs in its own scope, which the
+	// properties of the machine's unit don't apply to.
+	if !c.KeepUnit {
+		return fmt.Errorf("numa_node requires keep_unit to be enabled")
+	}
+	return nil
+}
+
+// numaProperties returns the properties of the machine's transient unit
+// binding it to the NUMA nodes.
+func numaProperties(c TaskConfig) ([]dbus.Property, error) {
+	if c.NUMANode == "" {
+		return nil, nil
+	}
+	mask, err := parseCPUSet(c.NUMANode)
+	if err != nil {
+		return nil, err
+	}
+	return []dbus.Property{
+		{Name: "NUMAPolicy", Value: godbus.MakeVariant(numaPolicyBind)},
+		{Name: "NUMAMask", Value: godbus.MakeVariant(mask)},
+		{Name: "CPUAffinityFromNUMA", Value: godbus.MakeVariant(true)},
+	}, nil
+}
+
+// numaAttributes returns the NUMA topology of the host as node attributes,
+// i.e. the online nodes and the CPUs of each, so jobs can be constrained to
+// nodes with enough NUMA nodes for numa_node.
+func numaAttributes() map[string]*pstructs.Attribute {
+	b, err := ioutil.ReadFile(filepath.Join(sysNodes, "online"))
+	if err != nil {
+		return nil
+	}
+	online := strings.TrimSpace(string(b))
+	mask, err := parseCPUSet(online)
+	if err != nil {
+		return nil
+	}
+
+	attrs := map[string]*pstructs.Attribute{
+		"driver.systemd-nspawn.numa.online": pstructs.NewStringAttribute(online),
+	}
+	var count int64
+	for i, bits := range mask {
+		for j := 0; j < 8; j++ {
+			if bits&(1<<uint(j)) == 0 {
+				continue
+			}
+			count++
+			node := fmt.Sprintf("node%d", i*8+j)
+			b, err := ioutil.ReadFile(filepath.Join(sysNodes, node, "cpulist"))
+			if err != nil {
+				continue
+			}
+			attrs["driver.systemd-nspawn.numa."+node+".cpus"] = pstructs.NewStringAttribute(strings.TrimSpace(string(b)))
+		}
+	}
+	attrs["driver.systemd-nspawn.numa.nodes"] = pstructs.NewIntAttribute(count, "")
+	return attrs
+}
@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateNUMANode(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{KeepUnit: true, NUMANode: "0"},
+		{KeepUnit: true, NUMANode: "0-1,3"},
+	} {
+		if err := c.validateNUMANode(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{KeepUnit: true, NUMANode: "first"},
+		{KeepUnit: true, NUMANode: "1-0"},
+		{NUMANode: "0"},
+	} {
+		if err := c.validateNUMANode(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestNUMAProperties(t *testing.T) {
+	props, err := numaProperties(TaskConfig{NUMANode: "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, p := range props {
+		got = append(got, p.Name+"="+p.Value.String())
+	}
+	expected := []string{"NUMAPolicy=2", "NUMAMask=@ay [0x2]", "CPUAffinityFromNUMA=true"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestNUMAAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "numa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { sysNodes = path }(sysNodes)
+	sysNodes = dir
+
+	if attrs := numaAttributes(); attrs != nil {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+
+	files := map[string]string{
+		"online":        "0-1\n",
+		"node0/cpulist": "0-3\n",
+		"node1/cpulist": "4-7\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attrs := numaAttributes()
+	for k, v := range map[string]string{
+		"driver.systemd-nspawn.numa.online":     "0-1",
+		"driver.systemd-nspawn.numa.nodes":      "2",
+		"driver.systemd-nspawn.numa.node1.cpus": "4-7",
+	} {
+		if attrs[k] == nil || attrs[k].GoString() != v {
+			t.Errorf("expected %s=%s, got %v", k, v, attrs[k])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/ugorji/go/codec"
+)
+
+// DecodeTaskConfig decodes the driver config of a task in JSON, as found in
+// the Config of tasks in `nomad job run -output`, and applies the defaults
+// of the task config schema.
+//
+// It's used to check task configs outside of Nomad, so variables like
+// ${NOMAD_TASK_DIR} are not interpolated.
+func DecodeTaskConfig(data []byte) (*TaskConfig, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if err := applySpec(raw, taskConfigSpec.GetObject().GetAttributes()); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var c TaskConfig
+	if err := codec.NewDecoderBytes(b, &codec.JsonHandle{}).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode driver config: %v", err)
+	}
+	return &c, nil
+}
+
+// applySpec checks the options against the schema, and sets the defaults of
+// unset ones. Blocks, which Nomad outputs as lists, are unwrapped.
+func applySpec(raw map[string]interface{}, attrs map[string]*hclspec.Spec) error {
+	for name := range raw {
+		if _, ok := attrs[name]; !ok {
+			return fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := attrs[name]
+		v, set := raw[name]
+		if d := spec.GetDefault(); d != nil {
+			spec = d.GetPrimary()
+			if !set {
+				if err := json.Unmarshal([]byte(d.GetDefault().GetLiteral().GetValue()), &v); err != nil {
+					return fmt.Errorf("invalid default of %s: %v", name, err)
+				}
+				raw[name], set = v, true
+			}
+		}
+		if !set {
+			if a := spec.GetAttr(); a != nil && a.GetRequired() {
+				return fmt.Errorf("missing required option %q", name)
+			}
+			continue
+		}
+		if spec.GetBlockValue() != nil {
+			if l, ok := v.([]interface{}); ok && len(l) == 1 {
+				raw[name] = l[0]
+			}
+		}
+	}
+	return nil
+}
+
+// Rendered is what the driver generates for a task config.
+type Rendered struct {
+	// Unit is the name of the machine's unit.
+	Unit string
+	// NSpawnFile and DropIn are the nspawn file and the drop-in of
+	// systemd-nspawn@.service, empty for transient units.
+	NSpawnFile string
+	DropIn     string
+	// Args is the command line of nspawn in transient units.
+	Args []string
+	// Properties are the properties of the transient unit as "Name=value".
+	Properties []string
+}
+
+// Render validates the task config and returns what the driver would
+// generate for it.
+//
+// Environment and credential values are masked, and defaults which depend on
+// the allocation, like the hostname, are left empty.
+func Render(c *TaskConfig, machineName string) (*Rendered, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	redacted := redactTaskConfig(*c)
+	r := &Rendered{Unit: unitName(machineName)}
+
+	if c.TransientUnit {
+		args, err := transientArgs(machineName, redacted)
+		if err != nil {
+			return nil, err
+		}
+		props, err := transientProperties(machineName, redacted)
+		if err != nil {
+			return nil, err
+		}
+		r.Args = args
+		for _, p := range props {
+			r.Properties = append(r.Properties, p.Name+"="+formatProperty(p, args))
+		}
+		return r, nil
+	}
+
+	content, err := renderNspawnFile(redacted)
+	if err != nil {
+		return nil, err
+	}
+	r.NSpawnFile = content
+	if redacted.needsDropIn() {
+		var buf bytes.Buffer
+		if err := dropInTmpl.Execute(&buf, redacted); err != nil {
+			return nil, err
+		}
+		r.DropIn = buf.String()
+	}
+	return r, nil
+}
+
+// formatProperty formats the value of the unit property like in unit files.
+// ExecStart, whose value is unexported, is formatted from the command line.
+func formatProperty(p dbus.Property, args []string) string {
+	if p.Name == "ExecStart" {
+		return strings.Join(args, " ")
+	}
+	switch v := p.Value.Value().(type) {
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	case []ipAddressPrefix:
+		items := make([]string, 0, len(v))
+		for _, p := range v {
+			items = append(items, p.String())
+		}
+		return strings.Join(items, " ")
+	case []ioDeviceLimit:
+		items := make([]string, 0, len(v))
+		for _, l := range v {
+			items = append(items, l.String())
+		}
+		return strings.Join(items, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,83 @@
+package systemd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTaskConfig(t *testing.T) {
+	c, err := DecodeTaskConfig([]byte(`{
+		"image": "https://example.com/web.raw",
+		"boot": true,
+		"environment": {"LANG": "C.UTF-8"},
+		"bind": [{"source": "/srv/data", "target": "/data"}],
+		"pre_start_hook": [{"command": ["/usr/local/bin/prepare"], "timeout": "10s"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Image != "https://example.com/web.raw" || !c.Boot || c.Environment["LANG"] != "C.UTF-8" {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if len(c.Bind) != 1 || c.Bind[0].Target != "/data" {
+		t.Errorf("unexpected binds %+v", c.Bind)
+	}
+	if c.PreStartHook.Timeout != "10s" || len(c.PreStartHook.Command) != 1 {
+		t.Errorf("unexpected hook %+v", c.PreStartHook)
+	}
+	// Defaults of the schema.
+	if !c.Register || !c.KeepUnit || c.BootTimeout != "5m" || c.StopMode != stopModeTerminate {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+
+	for _, s := range []string{`{"imag": "https://example.com/web.raw"}`, `[]`, `{"boot": "maybe"}`} {
+		if _, err := DecodeTaskConfig([]byte(s)); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	c, err := DecodeTaskConfig([]byte(`{"image": "https://example.com/web.raw", "environment": {"TOKEN": "s3cret"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Render(c, "nomad-task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Unit != "systemd-nspawn@nomad-task.service" || r.Args != nil || r.Properties != nil {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if !strings.Contains(r.NSpawnFile, "Environment=TOKEN="+redactedValue) {
+		t.Errorf("unexpected nspawn file:\n%s", r.NSpawnFile)
+	}
+
+	c, err = DecodeTaskConfig([]byte(`{"image": "https://example.com/web.raw", "transient_unit": true, "slice": "web.slice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = Render(c, "nomad-task"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Args) == 0 || r.Args[0] != nspawnBinary || r.NSpawnFile != "" {
+		t.Errorf("unexpected command line %v", r.Args)
+	}
+	expected := []string{
+		"Description=Container nomad-task",
+		"ExecStart=" + strings.Join(r.Args, " "),
+		"Type=notify",
+		"Slice=web.slice",
+		"KillMode=mixed",
+		"Delegate=yes",
+	}
+	if !reflect.DeepEqual(r.Properties, expected) {
+		t.Errorf("expected properties %q, got %q", expected, r.Properties)
+	}
+
+	c.Image = ""
+	if _, err := Render(c, "nomad-task"); err == nil {
+		t.Error("expected error for invalid config")
+	}
+}
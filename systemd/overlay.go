@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// overlayAutoUpper is the marker of an overlay's upper dir, which will be
+// replaced by a dir inside the task's local dir, so the writes are cleaned
+// up with the alloc.
+const overlayAutoUpper = "auto"
+
+// validateOverlays checks the overlays, only writable overlays with lower
+// dirs can have an automatic upper dir.
+func (c *TaskConfig) validateOverlays() error {
+	for _, o := range c.Overlay {
+		if len(o) < 2 {
+			return fmt.Errorf("invalid overlay %q: requires at least an upper dir and a target", o)
+		}
+		for i, p := range o {
+			if p == overlayAutoUpper && (i != len(o)-2 || len(o) < 3) {
+				return fmt.Errorf("invalid overlay %q: %q is only allowed as upper dir with lower dirs", o, overlayAutoUpper)
+			}
+		}
+	}
+	for _, o := range c.OverlayReadOnly {
+		if len(o) < 2 {
+			return fmt.Errorf("invalid overlay_read_only %q: requires at least a lower dir and a target", o)
+		}
+		for _, p := range o {
+			if p == overlayAutoUpper {
+				return fmt.Errorf("invalid overlay_read_only %q: %q is not allowed", o, overlayAutoUpper)
+			}
+		}
+	}
+	return nil
+}
+
+// setupOverlays creates the automatic upper dirs of overlays inside the
+// task's local dir.
+func setupOverlays(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	for i, o := range taskConfig.Overlay {
+		upper := len(o) - 2
+		if upper < 0 || o[upper] != overlayAutoUpper {
+			continue
+		}
+
+		dir := filepath.Join(cfg.TaskDir().LocalDir, "overlay", strconv.Itoa(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		overlay := make([]string, len(o))
+		copy(overlay, o)
+		overlay[upper] = dir
+		taskConfig.Overlay[i] = overlay
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateOverlays(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{Overlay: [][]string{{"/srv/lower", "auto", "/opt"}}},
+		{Overlay: [][]string{{"/a", "/b", "/srv/upper", "/opt"}}},
+		{OverlayReadOnly: [][]string{{"/a", "/opt"}}},
+	} {
+		if err := c.validateOverlays(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{Overlay: [][]string{{"/opt"}}},
+		{Overlay: [][]string{{"auto", "/opt"}}},
+		{Overlay: [][]string{{"auto", "/srv/upper", "/opt"}}},
+		{OverlayReadOnly: [][]string{{"/a", "auto", "/opt"}}},
+	} {
+		if err := c.validateOverlays(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestSetupOverlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	original := []string{"/srv/lower", "auto", "/opt"}
+	c := TaskConfig{
+		Overlay: [][]string{{"/srv/upper", "/data"}, original},
+	}
+	if err := setupOverlays(cfg, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	upper := filepath.Join(dir, "web", "local", "overlay", "1")
+	expected := [][]string{{"/srv/upper", "/data"}, {"/srv/lower", upper, "/opt"}}
+	if !reflect.DeepEqual(c.Overlay, expected) {
+		t.Errorf("expected %v, got %v", expected, c.Overlay)
+	}
+	if fi, err := os.Stat(upper); err != nil || !fi.IsDir() {
+		t.Errorf("upper dir not created: %v", err)
+	}
+	if original[1] != "auto" {
+		t.Errorf("original overlay modified")
+	}
+}
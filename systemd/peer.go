@@ -0,0 +1,155 @@
+package systemd
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// peerImagesPath is the path under which the peer cache serves images by
+// digest, e.g. /v1/images/sha256:...
+const peerImagesPath = "/v1/images/"
+
+// peerProbeTimeout is the time a peer may take to answer whether it has an
+// image.
+var peerProbeTimeout = 2 * time.Second
+
+// PeerCacheConfig shares the image cache between nodes, so images pinned by
+// digest are pulled from the WAN once per cluster instead of once per node.
+//
+// Only raw images can be served to peers, others are always pulled from
+// their origin.
+type PeerCacheConfig struct {
+	// Listen is the address the cache is served to peers on, e.g. ":7346".
+	// Serving is disabled if empty.
+	Listen string `codec:"listen"`
+	// Token authenticates peers, it must be the same on all nodes.
+	Token string `codec:"token"`
+	// Peers are the URLs of the caches of other nodes, e.g.
+	// "https://10.0.0.2:7346", which are asked in random order for images
+	// before pulling them from their origin. Images pulled from peers are
+	// verified against their digest like images pulled from their origin.
+	//
+	// importd can't set headers, so the token is sent in the query string,
+	// which importd logs and plain http exposes on the wire. Peers should be
+	// served over https, e.g. behind a TLS terminating proxy, http peers are
+	// warned about.
+	Peers []string `codec:"peers"`
+}
+
+func (c PeerCacheConfig) validate() error {
+	if c.Listen == "" && len(c.Peers) == 0 {
+		return nil
+	}
+	if c.Token == "" {
+		return fmt.Errorf("peer_cache requires token")
+	}
+	for _, p := range c.Peers {
+		u, err := url.Parse(p)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid peer_cache peer %q", p)
+		}
+	}
+	return nil
+}
+
+// peerAuthorized returns whether the request carries the token, either as
+// bearer token or in the token query parameter, which is used by importd as
+// it can't set headers.
+func peerAuthorized(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		got = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// peerCacheHandler serves the raw images of the cache by digest.
+func peerCacheHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !peerAuthorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		digest := strings.TrimPrefix(r.URL.Path, peerImagesPath)
+		if !strings.HasPrefix(r.URL.Path, peerImagesPath) || !imageDigestRegexp.MatchString(digest) {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(filepath.Join(machinesPool, (&imageRef{Digest: digest}).cacheName()+".raw"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	}
+}
+
+// servePeerCache serves the image cache to peers until ctx is done.
+func (d *Driver) servePeerCache(ctx context.Context, config PeerCacheConfig) {
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           peerCacheHandler(config.Token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	d.logger.Info("serving image cache to peers", "address", config.Listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		d.logger.Error("failed to serve image cache to peers", "error", err)
+	}
+}
+
+// peerImageURL returns the URL of the image on the peer.
+func peerImageURL(peer, digest, token string) string {
+	return strings.TrimSuffix(peer, "/") + peerImagesPath + digest + "?token=" + url.QueryEscape(token)
+}
+
+// findPeerImage returns the reference of the image on a peer of config which
+// has it cached, nil if none has.
+func (d *Driver) findPeerImage(ref *imageRef, config PeerCacheConfig) *imageRef {
+	if len(config.Peers) == 0 || ref.Transport != "raw" {
+		return nil
+	}
+
+	for _, i := range rand.Perm(len(config.Peers)) {
+		u := peerImageURL(config.Peers[i], ref.Digest, config.Token)
+		req, err := http.NewRequest(http.MethodHead, u, nil)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(d.ctx, peerProbeTimeout)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		cancel()
+		if err != nil {
+			d.logger.Debug("failed to ask peer for image", "peer", config.Peers[i], "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return &imageRef{Transport: "raw", URL: u, Name: ref.Name, Digest: ref.Digest}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+func TestPeerCacheConfig(t *testing.T) {
+	cases := []struct {
+		c     PeerCacheConfig
+		valid bool
+	}{
+		{PeerCacheConfig{}, true},
+		{PeerCacheConfig{Listen: ":7346", Token: "secret"}, true},
+		{PeerCacheConfig{Token: "secret", Peers: []string{"http://10.0.0.2:7346", "https://cache.example.com"}}, true},
+		{PeerCacheConfig{Listen: ":7346"}, false},
+		{PeerCacheConfig{Token: "secret", Peers: []string{"10.0.0.2:7346"}}, false},
+		{PeerCacheConfig{Token: "secret", Peers: []string{"ftp://10.0.0.2"}}, false},
+	}
+	for _, c := range cases {
+		if err := c.c.validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.c, c.valid, err)
+		}
+	}
+}
+
+func TestPeerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "machines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(pool string) { machinesPool = pool }(machinesPool)
+	machinesPool = dir
+
+	cached := "sha256:" + strings.Repeat("0123456789abcdef", 4)
+	missing := "sha256:" + strings.Repeat("fedcba9876543210", 4)
+	name := (&imageRef{Digest: cached}).cacheName()
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".raw"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(peerCacheHandler("secret"))
+	defer srv.Close()
+
+	cases := []struct {
+		method, url string
+		header      string
+		status      int
+	}{
+		{"GET", peerImageURL(srv.URL, cached, "secret"), "", http.StatusOK},
+		{"HEAD", peerImageURL(srv.URL, cached, "secret"), "", http.StatusOK},
+		{"GET", srv.URL + peerImagesPath + cached, "Bearer secret", http.StatusOK},
+		{"GET", peerImageURL(srv.URL, cached, "wrong"), "", http.StatusUnauthorized},
+		{"GET", srv.URL + peerImagesPath + cached, "", http.StatusUnauthorized},
+		{"GET", peerImageURL(srv.URL, missing, "secret"), "", http.StatusNotFound},
+		{"GET", peerImageURL(srv.URL, "../../etc/passwd", "secret"), "", http.StatusNotFound},
+		{"DELETE", peerImageURL(srv.URL, cached, "secret"), "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: expected status %d, got %d", c.method, c.url, c.status, resp.StatusCode)
+		}
+		if c.method == "GET" && c.status == http.StatusOK && string(body) != "image" {
+			t.Errorf("%s %s: unexpected body %q", c.method, c.url, body)
+		}
+	}
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	config := PeerCacheConfig{Token: "secret", Peers: []string{"http://127.0.0.1:1", srv.URL}}
+	ref := &imageRef{Transport: "raw", URL: "https://example.com/web.raw", Name: "web", Digest: cached}
+	peer := d.findPeerImage(ref, config)
+	if peer == nil || peer.URL != peerImageURL(srv.URL, cached, "secret") || peer.Digest != cached {
+		t.Errorf("expected image on peer, got %+v", peer)
+	}
+
+	ref.Digest = missing
+	if peer := d.findPeerImage(ref, config); peer != nil {
+		t.Errorf("expected no peer with missing image, got %+v", peer)
+	}
+	ref.Digest, ref.Transport = cached, "tar"
+	if peer := d.findPeerImage(ref, config); peer != nil {
+		t.Errorf("expected tar images not to be pulled from peers, got %+v", peer)
+	}
+}
@@ -0,0 +1,448 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// portBackendNSpawn publishes ports via nspawn's Port= setting.
+	portBackendNSpawn = "nspawn"
+	// portBackendNFTables publishes ports via DNAT rules in nftables, which
+	// also works with bridges and interfaces not managed by nspawn.
+	portBackendNFTables = "nftables"
+
+	// maxPortRange is the max number of ports in a single port block.
+	maxPortRange = 1024
+)
+
+// PortMapping is a port of the container published on the host.
+type PortMapping struct {
+	// Protocol is either "tcp" (default) or "udp".
+	Protocol string `codec:"protocol"`
+	// Host is the host port, which takes a port number, a range like
+	// "8000-8010", or the label of a port allocated by Nomad.
+	Host string `codec:"host"`
+	// Container is the container port, which takes a port number or a range
+	// of the same size as Host. Defaults to the host port.
+	Container string `codec:"container"`
+	// HostInterface restricts the port to traffic coming in on the named
+	// host interface, e.g. "eth0". It takes an interface name, not a Nomad
+	// host network, which Nomad 0.9 doesn't expose to drivers. Only supported
+	// by the nftables port backend.
+	HostInterface string `codec:"host_interface"`
+}
+
+// validate checks the port block, labels are resolved in resolvePorts.
+func (p PortMapping) validate() error {
+	switch p.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("invalid port protocol %q", p.Protocol)
+	}
+	if p.Host == "" {
+		return fmt.Errorf("port host is required")
+	}
+	if isPortNumber(p.Host) {
+		if _, _, err := parsePortRange(p.Host); err != nil {
+			return fmt.Errorf("invalid port host %q: %v", p.Host, err)
+		}
+	}
+	if p.Container != "" {
+		if _, _, err := parsePortRange(p.Container); err != nil {
+			return fmt.Errorf("invalid port container %q: %v", p.Container, err)
+		}
+	}
+	return nil
+}
+
+// portMapping is a resolved mapping of a single port.
+type portMapping struct {
+	Protocol  string
+	Host      int
+	Container int
+	Interface string
+	// Label is the label of the Nomad port, if the host port is a label.
+	Label string
+}
+
+// String returns the port in nspawn's format, "protocol:host:container".
+func (p portMapping) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Protocol, p.Host, p.Container)
+}
+
+// portNumberRegexp matches port numbers and ranges, anything else is
+// treated as a port label.
+var portNumberRegexp = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+func isPortNumber(s string) bool {
+	return portNumberRegexp.MatchString(s)
+}
+
+// parsePortRange parses a port number or a range like "8000-8010".
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := parsePortNumber(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	hi := lo
+	if len(parts) == 2 {
+		hi, err = parsePortNumber(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("invalid range")
+	}
+	if hi-lo+1 > maxPortRange {
+		return 0, 0, fmt.Errorf("range larger than %d ports", maxPortRange)
+	}
+	return lo, hi, nil
+}
+
+func parsePortNumber(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("port %d out of range", n)
+	}
+	return n, nil
+}
+
+// validatePorts checks the ports and the port backend.
+func (c *TaskConfig) validatePorts() error {
+	for _, p := range c.Port {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if p.HostInterface != "" && c.PortBackend != portBackendNFTables {
+			return fmt.Errorf("port host_interface requires port_backend %q", portBackendNFTables)
+		}
+	}
+
+	switch c.PortBackend {
+	case "", portBackendNSpawn:
+	case portBackendNFTables:
+		if len(c.Port) > 0 && !c.Register && len(c.Address) == 0 {
+			return fmt.Errorf("port_backend %q requires register or address to be set", c.PortBackend)
+		}
+	default:
+		return fmt.Errorf("invalid port_backend %q", c.PortBackend)
+	}
+
+	if c.WaitForPorts != "" {
+		t, err := time.ParseDuration(c.WaitForPorts)
+		if err != nil || t <= 0 {
+			return fmt.Errorf("invalid wait_for_ports %q", c.WaitForPorts)
+		}
+		if len(c.Port) == 0 {
+			return fmt.Errorf("wait_for_ports requires port")
+		}
+		c.waitForPorts = t
+	}
+	return nil
+}
+
+// nomadPorts returns all ports allocated by Nomad for the task by label.
+func nomadPorts(cfg *drivers.TaskConfig) map[string]int {
+	ports := map[string]int{}
+	if cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return ports
+	}
+	for _, n := range cfg.Resources.NomadResources.Networks {
+		for _, p := range n.ReservedPorts {
+			ports[p.Label] = p.Value
+		}
+		for _, p := range n.DynamicPorts {
+			ports[p.Label] = p.Value
+		}
+	}
+	return ports
+}
+
+// resolvePorts resolves port labels and expands port ranges into mappings of
+// single ports.
+func resolvePorts(cfg *drivers.TaskConfig, ports []PortMapping) ([]portMapping, error) {
+	labels := nomadPorts(cfg)
+
+	var mappings []portMapping
+	for _, p := range ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+
+		var hostLo, hostHi int
+		var label string
+		if isPortNumber(p.Host) {
+			var err error
+			hostLo, hostHi, err = parsePortRange(p.Host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port host %q: %v", p.Host, err)
+			}
+		} else {
+			n, ok := labels[p.Host]
+			if !ok {
+				return nil, fmt.Errorf("port label %q is not allocated to the task", p.Host)
+			}
+			hostLo, hostHi = n, n
+			label = p.Host
+		}
+
+		containerLo, containerHi := hostLo, hostHi
+		if p.Container != "" {
+			var err error
+			containerLo, containerHi, err = parsePortRange(p.Container)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port container %q: %v", p.Container, err)
+			}
+		}
+		if containerHi-containerLo != hostHi-hostLo {
+			return nil, fmt.Errorf("port host %q and container %q have different sizes", p.Host, p.Container)
+		}
+
+		for i := 0; i <= hostHi-hostLo; i++ {
+			mappings = append(mappings, portMapping{
+				Protocol:  protocol,
+				Host:      hostLo + i,
+				Container: containerLo + i,
+				Interface: p.HostInterface,
+				Label:     label,
+			})
+		}
+	}
+
+	if err := checkPortCollisions(mappings, nil); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// checkPortCollisions returns an error if any host port in ports is
+// published twice, or already published by others.
+func checkPortCollisions(ports []portMapping, others []portMapping) error {
+	type key struct {
+		protocol string
+		port     int
+	}
+
+	used := map[key]bool{}
+	for _, p := range others {
+		used[key{p.Protocol, p.Host}] = true
+	}
+	for _, p := range ports {
+		k := key{p.Protocol, p.Host}
+		if used[k] {
+			return fmt.Errorf("host port %s/%d is already published", p.Protocol, p.Host)
+		}
+		used[k] = true
+	}
+	return nil
+}
+
+// portStore tracks the host ports published by every task. Ports are
+// reserved before the machine is started, so tasks started concurrently
+// can't publish the same port.
+type portStore struct {
+	ports map[string][]portMapping
+	lock  sync.Mutex
+}
+
+func newPortStore() *portStore {
+	return &portStore{ports: map[string][]portMapping{}}
+}
+
+// Reserve reserves the ports for the task, and returns an error if they
+// collide with the ports of other tasks.
+func (ps *portStore) Reserve(taskID string, ports []portMapping) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	var others []portMapping
+	for id, p := range ps.ports {
+		if id != taskID {
+			others = append(others, p...)
+		}
+	}
+	if err := checkPortCollisions(ports, others); err != nil {
+		return err
+	}
+	if len(ports) > 0 {
+		ps.ports[taskID] = ports
+	}
+	return nil
+}
+
+// Release releases the ports of the task.
+func (ps *portStore) Release(taskID string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	delete(ps.ports, taskID)
+}
+
+// PortSettings returns the Port= settings of the nspawn file, ports
+// published via nftables are not included.
+func (c TaskConfig) PortSettings() []string {
+	if c.PortBackend == portBackendNFTables {
+		return nil
+	}
+	settings := make([]string, 0, len(c.ports))
+	for _, p := range c.ports {
+		settings = append(settings, p.String())
+	}
+	return settings
+}
+
+// nftablesPorts returns whether ports are published via nftables.
+func (c *TaskConfig) nftablesPorts() bool {
+	return c.PortBackend == portBackendNFTables && len(c.ports) > 0
+}
+
+// portTableRegexp matches all characters not allowed in nftables table names.
+var portTableRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// portTable returns the nftables table holding the port forwarding rules of
+// the machine, each machine has its own table so rules can be removed at once.
+func portTable(machineName string) string {
+	return "nomad_ports_" + portTableRegexp.ReplaceAllString(machineName, "_")
+}
+
+// portRules renders the nftables script which forwards the ports to ip.
+func portRules(table string, ip net.IP, ports []portMapping) string {
+	family, dest := "ip", ip.String()
+	if ip.To4() == nil {
+		family, dest = "ip6", "["+dest+"]"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table inet %s\n", table)
+	fmt.Fprintf(&b, "flush table inet %s\n", table)
+	fmt.Fprintf(&b, "add chain inet %s prerouting { type nat hook prerouting priority -100; }\n", table)
+	fmt.Fprintf(&b, "add chain inet %s output { type nat hook output priority -100; }\n", table)
+	for _, p := range ports {
+		if p.Interface != "" {
+			// Locally generated traffic has no input interface.
+			fmt.Fprintf(&b, "add rule inet %s prerouting iifname %q %s dport %d dnat %s to %s:%d\n",
+				table, p.Interface, p.Protocol, p.Host, family, dest, p.Container)
+			continue
+		}
+		for _, chain := range []string{"prerouting", "output"} {
+			fmt.Fprintf(&b, "add rule inet %s %s fib daddr type local %s dport %d dnat %s to %s:%d\n",
+				table, chain, p.Protocol, p.Host, family, dest, p.Container)
+		}
+	}
+	return b.String()
+}
+
+// portAddress returns the address to forward ports to, which is the static
+// address if any, or the address reported by machined once available.
+func (d *Driver) portAddress(m *Machine, taskConfig TaskConfig) (net.IP, error) {
+	if ip := taskConfig.staticAddress(); ip != nil {
+		return ip, nil
+	}
+
+	deadline := time.Now().Add(taskConfig.bootTimeout)
+	for {
+		ips, err := d.GetMachineAddresses(m.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ip := preferredAddress(ips); ip != nil {
+			return ip, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("machine %s has no address", m.Name)
+		}
+		time.Sleep(unitPollInterval)
+	}
+}
+
+// setupPortForwarding publishes the ports of the machine via nftables.
+func (d *Driver) setupPortForwarding(m *Machine, taskConfig TaskConfig) error {
+	if !taskConfig.nftablesPorts() {
+		return nil
+	}
+
+	ip, err := d.portAddress(m, taskConfig)
+	if err != nil {
+		return err
+	}
+	return nft(portRules(portTable(m.Name), ip, taskConfig.ports))
+}
+
+// removePortForwarding removes the port forwarding rules of the machine.
+func (d *Driver) removePortForwarding(machineName string) error {
+	return deleteNFTTable(portTable(machineName))
+}
+
+// portProbeInterval is the time between probes of ports which don't accept
+// connections yet.
+var portProbeInterval = time.Second
+
+// probeAddresses returns the addresses of the TCP container ports to probe,
+// UDP ports can't be probed without knowing the protocol.
+func probeAddresses(ip net.IP, ports []portMapping) []string {
+	var addrs []string
+	seen := map[int]bool{}
+	for _, p := range ports {
+		if p.Protocol != "tcp" || seen[p.Container] {
+			continue
+		}
+		seen[p.Container] = true
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(p.Container)))
+	}
+	return addrs
+}
+
+// waitForPorts waits until the TCP container ports accept connections if
+// wait_for_ports is set, and fails once it elapsed.
+func (d *Driver) waitForPorts(m *Machine, taskConfig TaskConfig) error {
+	if taskConfig.waitForPorts == 0 {
+		return nil
+	}
+
+	ip := net.IPv4(127, 0, 0, 1)
+	if taskConfig.privateNetwork() {
+		var err error
+		if ip, err = d.portAddress(m, taskConfig); err != nil {
+			return err
+		}
+	}
+
+	pending := probeAddresses(ip, taskConfig.ports)
+	d.logger.Debug("waiting for ports", "machine", m.Name, "addresses", pending)
+	deadline := time.Now().Add(taskConfig.waitForPorts)
+	for {
+		var closed []string
+		for _, addr := range pending {
+			conn, err := net.DialTimeout("tcp", addr, portProbeInterval)
+			if err != nil {
+				closed = append(closed, addr)
+				continue
+			}
+			conn.Close()
+		}
+		if pending = closed; len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not listening after %s", strings.Join(pending, ", "), taskConfig.waitForPorts)
+		}
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(portProbeInterval):
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package systemd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestResolvePorts(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Networks: []*structs.NetworkResource{{
+					ReservedPorts: []structs.Port{{Label: "dns", Value: 53}},
+					DynamicPorts:  []structs.Port{{Label: "http", Value: 23456}},
+				}},
+			},
+		},
+	}
+
+	cases := []struct {
+		input    []PortMapping
+		expected []portMapping
+		err      bool
+	}{
+		{
+			[]PortMapping{{Host: "8080", Container: "80"}},
+			[]portMapping{{"tcp", 8080, 80, "", ""}},
+			false,
+		},
+		{
+			[]PortMapping{{Protocol: "udp", Host: "dns"}, {Host: "http", Container: "80", HostInterface: "eth0"}},
+			[]portMapping{{"udp", 53, 53, "", "dns"}, {"tcp", 23456, 80, "eth0", "http"}},
+			false,
+		},
+		{
+			[]PortMapping{{Host: "8000-8002", Container: "9000-9002"}},
+			[]portMapping{{"tcp", 8000, 9000, "", ""}, {"tcp", 8001, 9001, "", ""}, {"tcp", 8002, 9002, "", ""}},
+			false,
+		},
+		{[]PortMapping{{Host: "8000-8002", Container: "9000"}}, nil, true},
+		{[]PortMapping{{Host: "unknown"}}, nil, true},
+		{[]PortMapping{{Host: "80"}, {Host: "79-81"}}, nil, true},
+	}
+
+	for _, c := range cases {
+		ports, err := resolvePorts(cfg, c.input)
+		if c.err {
+			if err == nil {
+				t.Errorf("%+v: expected error", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(ports, c.expected) {
+			t.Errorf("%+v: expected %+v, got %+v", c.input, c.expected, ports)
+		}
+	}
+}
+
+func TestPortMappingValidate(t *testing.T) {
+	for _, p := range []PortMapping{
+		{Host: "80"},
+		{Protocol: "udp", Host: "http", Container: "53"},
+		{Host: "8000-8010"},
+	} {
+		if err := p.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", p, err)
+		}
+	}
+	for _, p := range []PortMapping{
+		{},
+		{Protocol: "sctp", Host: "80"},
+		{Host: "0"},
+		{Host: "70000"},
+		{Host: "90-80"},
+		{Host: "1-2000"},
+		{Host: "80", Container: "http"},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v: expected error", p)
+		}
+	}
+}
+
+func TestCheckPortCollisions(t *testing.T) {
+	others := []portMapping{{"tcp", 80, 80, "", ""}}
+	if err := checkPortCollisions([]portMapping{{"udp", 80, 80, "", ""}}, others); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := checkPortCollisions([]portMapping{{"tcp", 80, 8080, "", ""}}, others); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestPortStore(t *testing.T) {
+	ps := newPortStore()
+	web := []portMapping{{Protocol: "tcp", Host: 8080, Container: 80}}
+	if err := ps.Reserve("web", web); err != nil {
+		t.Fatal(err)
+	}
+	// Reserving again replaces the task's own ports.
+	if err := ps.Reserve("web", web); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ps.Reserve("api", []portMapping{{Protocol: "tcp", Host: 8080, Container: 8080}}); err == nil {
+		t.Error("expected error for reserved port")
+	}
+
+	ps.Release("web")
+	if err := ps.Reserve("api", []portMapping{{Protocol: "tcp", Host: 8080, Container: 8080}}); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+}
+
+func TestPortRules(t *testing.T) {
+	table := portTable("nomad-web-1234-abcd")
+	if table != "nomad_ports_nomad_web_1234_abcd" {
+		t.Fatalf("unexpected table %q", table)
+	}
+
+	script := portRules(table, net.ParseIP("10.0.0.2"), []portMapping{
+		{"tcp", 8080, 80, "", ""},
+		{"udp", 53, 53, "eth0", ""},
+	})
+	for _, rule := range []string{
+		"add rule inet nomad_ports_nomad_web_1234_abcd prerouting fib daddr type local tcp dport 8080 dnat ip to 10.0.0.2:80",
+		"add rule inet nomad_ports_nomad_web_1234_abcd output fib daddr type local tcp dport 8080 dnat ip to 10.0.0.2:80",
+		`add rule inet nomad_ports_nomad_web_1234_abcd prerouting iifname "eth0" udp dport 53 dnat ip to 10.0.0.2:53`,
+	} {
+		if !strings.Contains(script, rule) {
+			t.Errorf("missing rule %q in:\n%s", rule, script)
+		}
+	}
+	if strings.Contains(script, "output iifname") {
+		t.Errorf("unexpected output rule with host_interface in:\n%s", script)
+	}
+
+	script = portRules(table, net.ParseIP("fd00::2"), []portMapping{{"tcp", 80, 80, "", ""}})
+	if !strings.Contains(script, "dnat ip6 to [fd00::2]:80") {
+		t.Errorf("missing ipv6 rule in:\n%s", script)
+	}
+}
+
+func TestValidateWaitForPorts(t *testing.T) {
+	c := TaskConfig{Port: []PortMapping{{Host: "80"}}, WaitForPorts: "30s"}
+	if err := c.validatePorts(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.waitForPorts != 30*time.Second {
+		t.Errorf("unexpected wait_for_ports %s", c.waitForPorts)
+	}
+
+	for _, c := range []TaskConfig{
+		{Port: []PortMapping{{Host: "80"}}, WaitForPorts: "soon"},
+		{Port: []PortMapping{{Host: "80"}}, WaitForPorts: "-1s"},
+		{WaitForPorts: "30s"},
+	} {
+		if err := c.validatePorts(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestProbeAddresses(t *testing.T) {
+	addrs := probeAddresses(net.ParseIP("fd00::2"), []portMapping{
+		{"tcp", 8080, 80, "", ""},
+		{"udp", 53, 53, "", ""},
+		{"tcp", 8081, 80, "eth0", ""},
+		{"tcp", 8443, 443, "", ""},
+	})
+	expected := []string{"[fd00::2]:80", "[fd00::2]:443"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected %v, got %v", expected, addrs)
+	}
+}
+
+func TestWaitForPorts(t *testing.T) {
+	defer func(d time.Duration) { portProbeInterval = d }(portProbeInterval)
+	portProbeInterval = 10 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	m := &Machine{Name: "test"}
+	c := TaskConfig{
+		ports:        []portMapping{{"tcp", port, port, "", ""}},
+		waitForPorts: 100 * time.Millisecond,
+	}
+	if err := d.waitForPorts(m, c); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	l.Close()
+	if err := d.waitForPorts(m, c); err == nil || !strings.Contains(err.Error(), "not listening") {
+		t.Errorf("expected error, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package systemd
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reconcileDangling periodically removes machines and nspawn files which are
+// created by this driver but not tracked by any task, for example tasks which
+// were lost while the Nomad client was down.
+func (d *Driver) reconcileDangling(ctx context.Context) {
+	timer := time.NewTimer(d.loadConfig().GC.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		gc := d.loadConfig().GC
+		if gc.DanglingMachines {
+			if err := d.removeDanglingMachines(); err != nil {
+				d.logger.Warn("failed to remove dangling machines", "error", err)
+			}
+		}
+		if gc.DanglingNSpawnFiles {
+			if err := d.removeDanglingNSpawnFiles(); err != nil {
+				d.logger.Warn("failed to remove dangling nspawn files", "error", err)
+			}
+		}
+		timer.Reset(gc.interval)
+	}
+}
+
+// removeDanglingMachines terminates and removes all untracked machines.
+//
+// Machines being started are skipped however long their start takes. They
+// are listed before the tasks, since a machine stops being started only once
+// its task is tracked.
+func (d *Driver) removeDanglingMachines() error {
+	gc := d.loadConfig().GC
+	tracked := d.startingMachines()
+	for _, h := range d.tasks.List() {
+		tracked[h.machineName] = struct{}{}
+	}
+
+	names, err := d.ListMachines()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, ok := tracked[name]; ok {
+			continue
+		}
+
+		m, err := d.GetMachine(name)
+		if err != nil {
+			d.logger.Warn("failed to get dangling machine", "machine", name, "error", err)
+			continue
+		}
+		if time.Since(m.Timestamp) < gc.creationGrace {
+			continue
+		}
+
+		if gc.DryRun {
+			d.logger.Info("found dangling machine", "machine", name, "dry_run", true)
+			continue
+		}
+
+		d.logger.Info("removing dangling machine", "machine", name)
+		if err := d.TerminateMachine(name); err != nil {
+			d.logger.Warn("failed to terminate dangling machine", "machine", name, "error", err)
+			continue
+		}
+		// The image can't be removed while the machine still runs.
+		if err := d.waitMachineStopped(name, m.Unit, time.Now().Add(machineStopTimeout)); err != nil {
+			d.logger.Warn("failed to wait for dangling machine to stop", "machine", name, "error", err)
+			continue
+		}
+		if err := d.RemoveMachine(name, allMachineTables); err != nil {
+			d.logger.Warn("failed to remove dangling machine", "machine", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// removeDanglingNSpawnFiles removes nspawn files generated by this driver
+// whose machines no longer exist.
+func (d *Driver) removeDanglingNSpawnFiles() error {
+	alive := d.startingMachines()
+	for _, h := range d.tasks.List() {
+		alive[h.machineName] = struct{}{}
+	}
+
+	names, err := d.ListMachines()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		alive[name] = struct{}{}
+	}
+
+	for _, dir := range nspawnDirs() {
+		d.removeDanglingNSpawnFilesIn(dir, alive)
+	}
+
+	return nil
+}
+
+// removeDanglingNSpawnFilesIn removes dangling nspawn files in dir, alive
+// contains the names of machines which still exist.
+func (d *Driver) removeDanglingNSpawnFilesIn(dir string, alive map[string]struct{}) {
+	gc := d.loadConfig().GC
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		d.logger.Warn("failed to read nspawn dir", "dir", dir, "error", err)
+		return
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), machineNamePrefix) ||
+			filepath.Ext(fi.Name()) != ".nspawn" {
+			continue
+		}
+
+		name := strings.TrimSuffix(fi.Name(), ".nspawn")
+		if _, ok := alive[name]; ok {
+			continue
+		}
+		if time.Since(fi.ModTime()) < gc.creationGrace {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		generated, err := isGeneratedNSpawnFile(path)
+		if err != nil {
+			d.logger.Warn("failed to read nspawn file", "path", path, "error", err)
+			continue
+		}
+		if !generated {
+			continue
+		}
+
+		if gc.DryRun {
+			d.logger.Info("found dangling nspawn file", "path", path, "dry_run", true)
+			continue
+		}
+
+		d.logger.Info("removing dangling nspawn file", "path", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			d.logger.Warn("failed to remove dangling nspawn file", "path", path, "error", err)
+		}
+	}
+}
+
+// isGeneratedNSpawnFile checks whether the nspawn file is generated by this
+// driver.
+func isGeneratedNSpawnFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return false, s.Err()
+	}
+	return s.Text() == nspawnFileMarker, nil
+}
@@ -0,0 +1,40 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsGeneratedNSpawnFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nspawn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		content  string
+		expected bool
+	}{
+		"generated": {nspawnFileMarker + "\n[Exec]\n", true},
+		"manual":    {"[Exec]\nBoot=on\n", false},
+		"empty":     {"", false},
+	}
+
+	for name, c := range cases {
+		path := filepath.Join(dir, name+".nspawn")
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := isGeneratedNSpawnFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if got != c.expected {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"bytes"
+	"net/url"
+)
+
+// redactedValue replaces secrets in logs, task events and debug output.
+const redactedValue = "<redacted>"
+
+// redactURL removes the password and the query values of the URL, which
+// often carry auth tokens. URLs which don't parse are redacted completely.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedValue
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{"xxxxx"}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactTaskConfig returns a copy of the task config whose environment
+// values, credential values and image URL are redacted.
+func redactTaskConfig(c TaskConfig) TaskConfig {
+	if c.Environment != nil {
+		env := make(map[string]string, len(c.Environment))
+		for k := range c.Environment {
+			env[k] = redactedValue
+		}
+		c.Environment = env
+	}
+	if c.Credential != nil {
+		creds := make([]Credential, len(c.Credential))
+		for i, cred := range c.Credential {
+			if cred.Value != "" {
+				cred.Value = redactedValue
+			}
+			creds[i] = cred
+		}
+		c.Credential = creds
+	}
+	if c.Image != "" {
+		c.Image = redactURL(c.Image)
+	}
+	c.settingsFile = redactSettingsFile(c.settingsFile)
+	return c
+}
+
+// logGeneratedFiles logs how the machine is configured with secrets masked,
+// which is enabled by log_generated_files.
+func (d *Driver) logGeneratedFiles(machineName string, taskConfig TaskConfig) {
+	redacted := redactTaskConfig(taskConfig)
+	if taskConfig.TransientUnit {
+		args, err := transientArgs(machineName, redacted)
+		if err != nil {
+			d.logger.Warn("failed to render transient unit", "machine", machineName, "error", err)
+			return
+		}
+		d.logger.Info("generated transient unit", "machine", machineName, "args", args)
+		return
+	}
+
+	nspawnFile, err := renderNspawnFile(redacted)
+	if err != nil {
+		d.logger.Warn("failed to render nspawn file", "machine", machineName, "error", err)
+		return
+	}
+	var dropIn bytes.Buffer
+	if taskConfig.needsDropIn() {
+		if err := dropInTmpl.Execute(&dropIn, redacted); err != nil {
+			d.logger.Warn("failed to render unit drop-in", "machine", machineName, "error", err)
+			return
+		}
+	}
+	d.logger.Info("generated nspawn file", "machine", machineName, "nspawn_file", nspawnFile, "drop_in", dropIn.String())
+}
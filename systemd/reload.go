@@ -0,0 +1,77 @@
+package systemd
+
+import (
+	"sync"
+	"time"
+)
+
+// reloadInterval is the minimum interval between two reloads of systemd.
+const reloadInterval = 500 * time.Millisecond
+
+// reloadCall is a pending reload of systemd.
+type reloadCall struct {
+	done chan struct{}
+	err  error
+}
+
+// reloader coalesces reloads of systemd, so starting many tasks at once
+// doesn't trigger a reload for each of them.
+//
+// Callers requesting a reload while one is pending share it, and reloads are
+// at least reloadInterval apart.
+type reloader struct {
+	reload func() error
+
+	// lock syncs access to pending
+	lock    sync.Mutex
+	pending *reloadCall
+
+	// runLock serializes reloads, and syncs access to last
+	runLock sync.Mutex
+	last    time.Time
+}
+
+func newReloader(reload func() error) *reloader {
+	return &reloader{reload: reload}
+}
+
+// reloadSystemd makes systemd reload all unit files.
+func (d *Driver) reloadSystemd() error {
+	return callDBus(d.ctx, "Reload", func(c *systemdConn) error {
+		return c.systemd.Reload()
+	})
+}
+
+// Reload reloads systemd, and returns once a reload started after the call
+// has finished.
+func (r *reloader) Reload() error {
+	r.lock.Lock()
+	c := r.pending
+	if c == nil {
+		c = &reloadCall{done: make(chan struct{})}
+		r.pending = c
+		go r.run(c)
+	}
+	r.lock.Unlock()
+
+	<-c.done
+	return c.err
+}
+
+func (r *reloader) run(c *reloadCall) {
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+
+	if wait := reloadInterval - time.Since(r.last); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	// Later callers need another reload to see their changes.
+	r.lock.Lock()
+	r.pending = nil
+	r.lock.Unlock()
+
+	c.err = r.reload()
+	r.last = time.Now()
+	close(c.done)
+}
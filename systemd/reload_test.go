@@ -0,0 +1,47 @@
+package systemd
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReloaderCoalesces(t *testing.T) {
+	var reloads int32
+	block := make(chan struct{})
+	r := newReloader(func() error {
+		if atomic.AddInt32(&reloads, 1) == 1 {
+			<-block
+		}
+		return nil
+	})
+
+	// The first reload is blocked, all later calls should share one reload.
+	first := make(chan error)
+	go func() { first <- r.Reload() }()
+	for atomic.LoadInt32(&reloads) == 0 {
+		runtime.Gosched()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	close(block)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&reloads); n != 2 {
+		t.Errorf("expected 2 reloads, got %d", n)
+	}
+}
@@ -0,0 +1,242 @@
+package systemd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// resourcesCommand is the command of ExecTask which updates the resource
+// limits of the running machine, e.g. "nspawn:resources memory_max=1G". The
+// limits can only be lowered down from the resources Nomad allocated to the
+// task, so tasks can't grow past what the scheduler placed.
+const resourcesCommand = driverCommandPrefix + "resources"
+
+// resourceProperties returns the unit properties which apply the resources
+// Nomad allocated to the task.
+func resourceProperties(res *drivers.Resources) []dbus.Property {
+	if res == nil || res.LinuxResources == nil {
+		return nil
+	}
+
+	var props []dbus.Property
+	if res.LinuxResources.MemoryLimitBytes > 0 {
+		props = append(props, uint64Property("MemoryMax", uint64(res.LinuxResources.MemoryLimitBytes)))
+	}
+	if res.LinuxResources.CPUShares > 0 {
+		props = append(props, uint64Property("CPUWeight", cpuWeight(res.LinuxResources.CPUShares)))
+	}
+	// The cores reserved by Nomad, which are enforced by the cpuset
+	// controller of cgroup v2 and ignored on cgroup v1.
+	if mask, err := parseCPUSet(res.LinuxResources.CpusetCPUs); err == nil && len(mask) > 0 {
+		props = append(props, dbus.Property{Name: "AllowedCPUs", Value: godbus.MakeVariant(mask)})
+	}
+	return props
+}
+
+// maxCPUSetIndex is the highest CPU or NUMA node index accepted in cpusets.
+const maxCPUSetIndex = 8191
+
+// parseCPUSet parses a cpuset like "0-3,8" into the bitmask systemd takes
+// for AllowedCPUs, where bit i of byte i/8 is set if CPU i is in the set.
+func parseCPUSet(s string) ([]byte, error) {
+	var mask []byte
+	if s == "" {
+		return mask, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		lo, err := strconv.Atoi(parts[0])
+		if err != nil || lo < 0 || lo > maxCPUSetIndex {
+			return nil, fmt.Errorf("invalid cpuset %q", s)
+		}
+		hi := lo
+		if len(parts) == 2 {
+			hi, err = strconv.Atoi(parts[1])
+			if err != nil || hi < lo || hi > maxCPUSetIndex {
+				return nil, fmt.Errorf("invalid cpuset %q", s)
+			}
+		}
+		for i := lo; i <= hi; i++ {
+			for len(mask) <= i/8 {
+				mask = append(mask, 0)
+			}
+			mask[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mask, nil
+}
+
+// pidsLimit returns the max number of tasks of the machine, which is the
+// task's limit if set or the plugin's default, 0 if unlimited.
+func pidsLimit(limit, defaultLimit int) int {
+	if limit > 0 {
+		return limit
+	}
+	return defaultLimit
+}
+
+// cpuWeight converts cgroup v1 CPU shares into CPUWeight, like systemd does.
+func cpuWeight(shares int64) uint64 {
+	w := uint64(shares) * 100 / 1024
+	if w < 1 {
+		return 1
+	}
+	if w > 10000 {
+		return 10000
+	}
+	return w
+}
+
+func uint64Property(name string, v uint64) dbus.Property {
+	return dbus.Property{Name: name, Value: godbus.MakeVariant(v)}
+}
+
+// parseResourceArgs parses "key=value" arguments of the resources command
+// into unit properties, rejecting limits above the allocated resources res.
+func parseResourceArgs(args []string, res *drivers.Resources) ([]dbus.Property, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: %s memory_max=<bytes> memory_high=<bytes> cpu_quota=<percent> cpu_weight=<weight>", resourcesCommand)
+	}
+
+	var memoryLimit, weightLimit uint64
+	if res != nil && res.LinuxResources != nil {
+		if res.LinuxResources.MemoryLimitBytes > 0 {
+			memoryLimit = uint64(res.LinuxResources.MemoryLimitBytes)
+		}
+		if res.LinuxResources.CPUShares > 0 {
+			weightLimit = cpuWeight(res.LinuxResources.CPUShares)
+		}
+	}
+
+	var props []dbus.Property
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid argument %q", arg)
+		}
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "memory_max", "memory_high":
+			v, err := parseBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			if memoryLimit > 0 && v > memoryLimit {
+				return nil, fmt.Errorf("%s %q exceeds the allocated memory of %d bytes", key, value, memoryLimit)
+			}
+			name := "MemoryMax"
+			if key == "memory_high" {
+				name = "MemoryHigh"
+			}
+			props = append(props, uint64Property(name, v))
+		case "cpu_quota":
+			// Nomad doesn't set a quota, so any quota only lowers the
+			// allocated resources and infinity restores them.
+			v, err := parseCPUQuota(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			props = append(props, uint64Property("CPUQuotaPerSecUSec", v))
+		case "cpu_weight":
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || v < 1 || v > 10000 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if weightLimit > 0 && v > weightLimit {
+				return nil, fmt.Errorf("%s %q exceeds the allocated weight of %d", key, value, weightLimit)
+			}
+			props = append(props, uint64Property("CPUWeight", v))
+		default:
+			return nil, fmt.Errorf("unknown resource %q", key)
+		}
+	}
+	return props, nil
+}
+
+// parseBytes parses sizes like systemd does, with base 1024 suffixes K, M,
+// G and T, or "infinity".
+func parseBytes(s string) (uint64, error) {
+	if s == "infinity" {
+		return math.MaxUint64, nil
+	}
+
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("size out of range")
+	}
+	return v * multiplier, nil
+}
+
+// parseCPUQuota parses a CPU quota in percent into CPUQuotaPerSecUSec,
+// "infinity" removes the quota.
+func parseCPUQuota(s string) (uint64, error) {
+	if s == "infinity" {
+		return math.MaxUint64, nil
+	}
+	if !strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("quota must be in percent")
+	}
+	v, err := strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("invalid quota")
+	}
+	return v * 10000, nil
+}
+
+// setResources applies the unit properties to the running machine without
+// restarting it, they are lost once the machine exits.
+func (h *taskHandle) setResources(props []dbus.Property) error {
+	if len(props) == 0 {
+		return nil
+	}
+	return callDBus(h.driver.ctx, "SetUnitProperties", func(c *systemdConn) error {
+		return c.systemd.SetUnitProperties(h.unitName, true, props...)
+	})
+}
+
+// execResources runs the resources command of ExecTask.
+func (h *taskHandle) execResources(args []string) (*drivers.ExecTaskResult, error) {
+	result := &drivers.ExecTaskResult{ExitResult: &drivers.ExitResult{}}
+
+	props, err := parseResourceArgs(args, h.taskConfig.Resources)
+	if err == nil {
+		err = h.setResources(props)
+	}
+	if err != nil {
+		result.Stderr = []byte(err.Error() + "\n")
+		result.ExitResult.ExitCode = 1
+		return result, nil
+	}
+
+	for _, p := range props {
+		result.Stdout = append(result.Stdout, fmt.Sprintf("%s=%v\n", p.Name, p.Value.Value())...)
+	}
+	return result, nil
+}
@@ -0,0 +1,137 @@
+package systemd
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestParseResourceArgs(t *testing.T) {
+	props, err := parseResourceArgs([]string{"memory_max=1G", "memory_high=512M", "cpu_quota=150%", "cpu_weight=200"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uint64{
+		"MemoryMax":          1 << 30,
+		"MemoryHigh":         512 << 20,
+		"CPUQuotaPerSecUSec": 1500000,
+		"CPUWeight":          200,
+	}
+	if len(props) != len(expected) {
+		t.Fatalf("expected %d properties, got %d", len(expected), len(props))
+	}
+	for _, p := range props {
+		if v := p.Value.Value().(uint64); v != expected[p.Name] {
+			t.Errorf("%s: expected %d, got %d", p.Name, expected[p.Name], v)
+		}
+	}
+
+	props, err = parseResourceArgs([]string{"memory_max=infinity"}, nil)
+	if err != nil || props[0].Value.Value().(uint64) != math.MaxUint64 {
+		t.Errorf("unexpected result for infinity: %v, %v", props, err)
+	}
+
+	res := &drivers.Resources{
+		LinuxResources: &drivers.LinuxResources{
+			MemoryLimitBytes: 1 << 30,
+			CPUShares:        1024,
+		},
+	}
+	if _, err := parseResourceArgs([]string{"memory_max=512M", "memory_high=1G", "cpu_weight=100", "cpu_quota=50%"}, res); err != nil {
+		t.Errorf("unexpected error lowering limits: %v", err)
+	}
+	for _, args := range [][]string{
+		{"memory_max=infinity"},
+		{"memory_high=2G"},
+		{"cpu_weight=101"},
+	} {
+		if _, err := parseResourceArgs(args, res); err == nil {
+			t.Errorf("%v: expected error raising limits", args)
+		}
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"memory_max"},
+		{"memory_max=1X"},
+		{"cpu_quota=50"},
+		{"cpu_weight=0"},
+		{"swap=1G"},
+		{"memory_max=17179869184G"},
+	} {
+		if _, err := parseResourceArgs(args, nil); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestResourceProperties(t *testing.T) {
+	res := &drivers.Resources{
+		LinuxResources: &drivers.LinuxResources{
+			MemoryLimitBytes: 256 << 20,
+			CPUShares:        2048,
+			CpusetCPUs:       "2-3",
+		},
+	}
+
+	props := resourceProperties(res)
+	if len(props) != 3 {
+		t.Fatalf("expected 3 properties, got %d", len(props))
+	}
+	if props[0].Name != "MemoryMax" || props[0].Value.Value().(uint64) != 256<<20 {
+		t.Errorf("unexpected %v", props[0])
+	}
+	if props[1].Name != "CPUWeight" || props[1].Value.Value().(uint64) != 200 {
+		t.Errorf("unexpected %v", props[1])
+	}
+	if props[2].Name != "AllowedCPUs" || !reflect.DeepEqual(props[2].Value.Value(), []byte{0x0c}) {
+		t.Errorf("unexpected %v", props[2])
+	}
+
+	if props := resourceProperties(nil); len(props) != 0 {
+		t.Errorf("unexpected %v", props)
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []byte
+	}{
+		{"", nil},
+		{"0", []byte{0x01}},
+		{"0-3,8", []byte{0x0f, 0x01}},
+		{"9, 1", []byte{0x02, 0x02}},
+	}
+	for _, c := range cases {
+		mask, err := parseCPUSet(c.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(mask, c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.input, c.expected, mask)
+		}
+	}
+
+	for _, s := range []string{"a", "3-1", "-1", "1-", "0-100000", "1,,2"} {
+		if _, err := parseCPUSet(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestPidsLimit(t *testing.T) {
+	if limit := pidsLimit(0, 16384); limit != 16384 {
+		t.Errorf("expected default limit, got %d", limit)
+	}
+	if limit := pidsLimit(100, 16384); limit != 100 {
+		t.Errorf("expected task limit, got %d", limit)
+	}
+	if limit := pidsLimit(0, 0); limit != 0 {
+		t.Errorf("expected no limit, got %d", limit)
+	}
+}
@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"fmt"
+)
+
+// unitResult describes a Result of a failed unit.
+type unitResult struct {
+	// Origin is where the problem most likely is: "image" for problems of
+	// the container, "host" for problems of the host and "task" for limits
+	// set by the task.
+	Origin      string
+	Description string
+}
+
+// unitResults are the Results of failed service units, except exit-code
+// which is reported by the exit code.
+var unitResults = map[string]unitResult{
+	"protocol":        {"image", "the container's init didn't notify readiness"},
+	"core-dump":       {"image", "the container's init dumped core"},
+	"signal":          {"image", "the container's init was killed by a signal"},
+	"watchdog":        {"image", "the container's init stopped sending watchdog keep-alives"},
+	"timeout":         {"host", "the machine didn't start or stop in time"},
+	"resources":       {"host", "systemd couldn't set up the unit, e.g. its mounts, namespaces or image"},
+	"start-limit-hit": {"host", "the unit was started too often"},
+	"oom-kill":        {"task", "the machine ran out of memory"},
+}
+
+// describeUnitResult returns a description of the unit Result, and an empty
+// string if it's not a failure or already reported otherwise.
+func describeUnitResult(result string) string {
+	r, ok := unitResults[result]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s, %s problem: %s", result, r.Origin, r.Description)
+}
+
+// getUnitResult returns the Result of the machine's unit, which explains why
+// it failed.
+func (d *Driver) getUnitResult(unit string) (string, error) {
+	var result string
+	err := callDBus(d.ctx, "GetServiceProperty", func(c *systemdConn) error {
+		p, err := c.systemd.GetServiceProperty(unit, "Result")
+		if err != nil {
+			return err
+		}
+		result, _ = p.Value.Value().(string)
+		return nil
+	})
+	return result, err
+}
+
+// unitFailure returns the description of the Result of the failed unit, or
+// an empty string if it's unknown.
+func (d *Driver) unitFailure(unit string) string {
+	result, err := d.getUnitResult(unit)
+	if err != nil {
+		d.logger.Warn("failed to get unit result", "unit", unit, "error", err)
+		return ""
+	}
+	return describeUnitResult(result)
+}
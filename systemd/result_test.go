@@ -0,0 +1,19 @@
+package systemd
+
+import "testing"
+
+func TestDescribeUnitResult(t *testing.T) {
+	cases := map[string]string{
+		"protocol":        "protocol, image problem: the container's init didn't notify readiness",
+		"start-limit-hit": "start-limit-hit, host problem: the unit was started too often",
+		"oom-kill":        "oom-kill, task problem: the machine ran out of memory",
+		"exit-code":       "",
+		"success":         "",
+		"":                "",
+	}
+	for result, expected := range cases {
+		if got := describeUnitResult(result); got != expected {
+			t.Errorf("%q: expected %q, got %q", result, expected, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// nspawnSections are the sections of nspawn files, in the order they are
+// generated.
+var nspawnSections = []string{"Exec", "Files", "Network"}
+
+// settingsFileControlled are the settings the driver keeps generating if the
+// task ships its own nspawn file, since they carry what Nomad allocated.
+var settingsFileControlled = map[string]bool{
+	"Environment":  true,
+	"Hostname":     true,
+	"MachineID":    true,
+	"Bind":         true,
+	"BindReadOnly": true,
+	"Port":         true,
+}
+
+// parseNspawnSettings parses the content of an nspawn file into the lines
+// of each section, skipping empty lines and comments.
+func parseNspawnSettings(content string) (map[string][]string, error) {
+	sections := map[string][]string{}
+	section := ""
+	s := bufio.NewScanner(strings.NewReader(content))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			if !contains(nspawnSections, section) {
+				return nil, fmt.Errorf("line %d: unknown section %q", n, line)
+			}
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: setting outside of a section", n)
+		}
+		if strings.IndexByte(line, '=') <= 0 {
+			return nil, fmt.Errorf("line %d: missing =", n)
+		}
+		sections[section] = append(sections[section], line)
+	}
+	return sections, s.Err()
+}
+
+// contains returns whether the list contains the value.
+func contains(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// nonDefaultSettings returns the settings of the generated nspawn file which
+// differ from the file generated for an empty task config, by section.
+func nonDefaultSettings(c TaskConfig) (map[string][]string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, c); err != nil {
+		return nil, err
+	}
+	settings, err := parseNspawnSettings(buf.String())
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err := tmpl.Execute(&buf, TaskConfig{}); err != nil {
+		return nil, err
+	}
+	defaults, err := parseNspawnSettings(buf.String())
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string][]string{}
+	for section, lines := range settings {
+		for _, line := range lines {
+			if !contains(defaults[section], line) {
+				changed[section] = append(changed[section], line)
+			}
+		}
+	}
+	return changed, nil
+}
+
+func (c *TaskConfig) validateSettingsFile() error {
+	p := c.NspawnSettingsFile
+	if p == "" {
+		return nil
+	}
+	if filepath.IsAbs(p) || strings.HasPrefix(filepath.Clean(p), "..") {
+		return fmt.Errorf("nspawn_settings_file %q must be a path in the task dir", p)
+	}
+	if c.Class == classVM {
+		return fmt.Errorf("nspawn_settings_file is not supported by class vm")
+	}
+	if c.RespectImageSettings {
+		return fmt.Errorf("nspawn_settings_file can't be combined with respect_image_settings")
+	}
+
+	// Options of the job would be mixed with the file in unexpected ways, so
+	// only the ones the driver controls may be set.
+	settings, err := nonDefaultSettings(*c)
+	if err != nil {
+		return err
+	}
+	conflicts := map[string]bool{}
+	for _, lines := range settings {
+		for _, line := range lines {
+			key := line[:strings.IndexByte(line, '=')]
+			if !settingsFileControlled[key] {
+				conflicts[key] = true
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		keys := make([]string, 0, len(conflicts))
+		for k := range conflicts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("nspawn_settings_file can't be combined with options setting %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// imageSettingsPath returns where nspawn looks for the settings shipped with
+// the machine's image, which is next to the image.
+func imageSettingsPath(machineName string, c TaskConfig) string {
+	switch {
+	case c.DiskImage != "":
+		return strings.TrimSuffix(c.DiskImage, filepath.Ext(c.DiskImage)) + ".nspawn"
+	case c.rootDirectory != "":
+		return c.rootDirectory + ".nspawn"
+	}
+	return filepath.Join(machinesPool, machineName+".nspawn")
+}
+
+// loadImageSettings reads the settings shipped with the machine's image if
+// respect_image_settings is enabled, and returns whether the image ships
+// settings.
+//
+// nspawn ignores them if the driver's nspawn file exists or settings are
+// disabled, and only applies some of them otherwise since they are
+// untrusted. Instead, they are merged into the driver's nspawn file like
+// nspawn_settings_file, so the task config wins.
+func loadImageSettings(machineName string, c *TaskConfig) (bool, error) {
+	if c.NspawnSettingsFile != "" || c.Class == classVM {
+		return false, nil
+	}
+	p := imageSettingsPath(machineName, *c)
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil || !c.RespectImageSettings {
+		return true, err
+	}
+	if _, err := parseNspawnSettings(string(b)); err != nil {
+		return true, fmt.Errorf("%s: %v", p, err)
+	}
+	c.settingsFile = string(b)
+	return true, nil
+}
+
+// loadSettingsFile reads the task's nspawn settings file from the task dir.
+func loadSettingsFile(cfg *drivers.TaskConfig, c *TaskConfig) error {
+	if c.NspawnSettingsFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().Dir, c.NspawnSettingsFile))
+	if err != nil {
+		return err
+	}
+	if _, err := parseNspawnSettings(string(b)); err != nil {
+		return fmt.Errorf("%s: %v", c.NspawnSettingsFile, err)
+	}
+	c.settingsFile = string(b)
+	return nil
+}
+
+// renderNspawnFile renders the nspawn file of the machine.
+//
+// If the task ships its own settings file or respects the image's, the
+// settings the driver generates which differ from the defaults are added to
+// its sections. Since nspawn takes the last value of single settings and
+// appends to lists, the task config wins over the file, and its binds and
+// ports are added to the file's.
+func renderNspawnFile(c TaskConfig) (string, error) {
+	if c.settingsFile == "" {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, c); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	file, err := parseNspawnSettings(c.settingsFile)
+	if err != nil {
+		return "", err
+	}
+	settings, err := nonDefaultSettings(c)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(nspawnFileMarker + "\n")
+	for i, section := range nspawnSections {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("[" + section + "]\n")
+		for _, line := range append(file[section], settings[section]...) {
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.String(), nil
+}
+
+// redactSettingsFile returns the settings file with the values of its
+// environment variables redacted.
+func redactSettingsFile(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "Environment=") {
+			continue
+		}
+		v := strings.TrimPrefix(trimmed, "Environment=")
+		if j := strings.IndexByte(v, '='); j >= 0 {
+			lines[i] = "Environment=" + v[:j+1] + redactedValue
+		}
+	}
+	return strings.Join(lines, "\n")
+}
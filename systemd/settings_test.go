@@ -0,0 +1,187 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const testSettingsFile = `# custom
+[Exec]
+Boot=yes
+Environment=TOKEN=secret
+Capability=CAP_NET_ADMIN
+
+[Files]
+BindReadOnly=/srv/static
+`
+
+func TestParseNspawnSettings(t *testing.T) {
+	sections, err := parseNspawnSettings(testSettingsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections["Exec"]) != 3 || len(sections["Files"]) != 1 || len(sections["Network"]) != 0 {
+		t.Errorf("unexpected sections %v", sections)
+	}
+
+	for _, content := range []string{
+		"Boot=yes\n",
+		"[Service]\nSlice=web.slice\n",
+		"[Exec]\nBoot\n",
+	} {
+		if _, err := parseNspawnSettings(content); err == nil {
+			t.Errorf("%q: expected error", content)
+		}
+	}
+}
+
+func TestValidateSettingsFile(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{NspawnSettingsFile: "local/custom.nspawn"},
+		{NspawnSettingsFile: "local/custom.nspawn", Hostname: "web", Environment: map[string]string{"A": "1"},
+			Bind: []BindMount{{Source: "/srv/data"}}},
+	} {
+		if err := c.validateSettingsFile(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{NspawnSettingsFile: "/etc/systemd/nspawn/web.nspawn"},
+		{NspawnSettingsFile: "../other/custom.nspawn"},
+		{NspawnSettingsFile: "local/custom.nspawn", Class: "vm"},
+		{NspawnSettingsFile: "local/custom.nspawn", RespectImageSettings: true},
+	} {
+		if err := c.validateSettingsFile(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+
+	c := TaskConfig{NspawnSettingsFile: "local/custom.nspawn", Boot: true, Capability: []string{"CAP_SYS_TIME"}}
+	err := c.validateSettingsFile()
+	if err == nil || !strings.Contains(err.Error(), "Boot, Capability") {
+		t.Errorf("expected conflicts with Boot and Capability, got %v", err)
+	}
+}
+
+func TestRenderNspawnFileWithSettingsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &drivers.TaskConfig{Name: "web", AllocDir: dir}
+	if err := os.MkdirAll(cfg.TaskDir().LocalDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cfg.TaskDir().LocalDir, "custom.nspawn"), []byte(testSettingsFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := TaskConfig{NspawnSettingsFile: "local/custom.nspawn"}
+	if err := loadSettingsFile(cfg, &c); err != nil {
+		t.Fatal(err)
+	}
+	c.Hostname = "web-0"
+	c.Bind = []BindMount{{Source: "/var/lib/nomad/alloc/1234/alloc", Target: "/alloc"}}
+	c.ports = []portMapping{{Protocol: "tcp", Host: 8080, Container: 80}}
+
+	content, err := renderNspawnFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nspawnFileMarker + `
+[Exec]
+Boot=yes
+Environment=TOKEN=secret
+Capability=CAP_NET_ADMIN
+Hostname=web-0
+
+[Files]
+BindReadOnly=/srv/static
+Bind=/var/lib/nomad/alloc/1234/alloc:/alloc
+
+[Network]
+Port=tcp:8080:80
+`
+	if content != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+
+	redacted, err := renderNspawnFile(redactTaskConfig(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(redacted, "secret") {
+		t.Errorf("environment not redacted:\n%s", redacted)
+	}
+
+	c.NspawnSettingsFile = "local/missing.nspawn"
+	if err := loadSettingsFile(cfg, &c); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestImageSettingsPath(t *testing.T) {
+	for _, c := range []struct {
+		config   TaskConfig
+		expected string
+	}{
+		{TaskConfig{}, "/var/lib/machines/nomad-web-1234.nspawn"},
+		{TaskConfig{DiskImage: "/srv/images/web.raw"}, "/srv/images/web.nspawn"},
+		{TaskConfig{rootDirectory: "/alloc/web/local/root"}, "/alloc/web/local/root.nspawn"},
+	} {
+		if p := imageSettingsPath("nomad-web-1234", c.config); p != c.expected {
+			t.Errorf("%+v: expected %s, got %s", c.config, c.expected, p)
+		}
+	}
+}
+
+func TestLoadImageSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := TaskConfig{DiskImage: filepath.Join(dir, "web.raw"), RespectImageSettings: true}
+	if shipped, err := loadImageSettings("nomad-web-1234", &c); err != nil || shipped {
+		t.Errorf("expected no image settings, got %v, %v", shipped, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "web.nspawn"), []byte(testSettingsFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ignored := TaskConfig{DiskImage: c.DiskImage}
+	if shipped, err := loadImageSettings("nomad-web-1234", &ignored); err != nil || !shipped {
+		t.Errorf("expected image settings, got %v, %v", shipped, err)
+	}
+	if ignored.settingsFile != "" {
+		t.Error("expected image settings to be ignored")
+	}
+
+	if shipped, err := loadImageSettings("nomad-web-1234", &c); err != nil || !shipped {
+		t.Fatalf("expected image settings, got %v, %v", shipped, err)
+	}
+	c.Capability = []string{"CAP_SYS_TIME"}
+	content, err := renderNspawnFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The task's capabilities are added after the image's.
+	if !strings.Contains(content, "Capability=CAP_NET_ADMIN\nCapability=CAP_SYS_TIME\n") {
+		t.Errorf("expected merged capabilities:\n%s", content)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "web.nspawn"), []byte("Boot=yes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadImageSettings("nomad-web-1234", &c); err == nil {
+		t.Error("expected error for invalid image settings")
+	}
+}
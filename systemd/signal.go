@@ -0,0 +1,108 @@
+package systemd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signals contains all signals that could be sent to a machine.
+var signals = map[string]syscall.Signal{
+	"SIGABRT":   syscall.SIGABRT,
+	"SIGALRM":   syscall.SIGALRM,
+	"SIGBUS":    syscall.SIGBUS,
+	"SIGCHLD":   syscall.SIGCHLD,
+	"SIGCONT":   syscall.SIGCONT,
+	"SIGFPE":    syscall.SIGFPE,
+	"SIGHUP":    syscall.SIGHUP,
+	"SIGILL":    syscall.SIGILL,
+	"SIGINT":    syscall.SIGINT,
+	"SIGIO":     syscall.SIGIO,
+	"SIGKILL":   syscall.SIGKILL,
+	"SIGPIPE":   syscall.SIGPIPE,
+	"SIGPROF":   syscall.SIGPROF,
+	"SIGPWR":    syscall.SIGPWR,
+	"SIGQUIT":   syscall.SIGQUIT,
+	"SIGSEGV":   syscall.SIGSEGV,
+	"SIGSTOP":   syscall.SIGSTOP,
+	"SIGSYS":    syscall.SIGSYS,
+	"SIGTERM":   syscall.SIGTERM,
+	"SIGTRAP":   syscall.SIGTRAP,
+	"SIGTSTP":   syscall.SIGTSTP,
+	"SIGTTIN":   syscall.SIGTTIN,
+	"SIGTTOU":   syscall.SIGTTOU,
+	"SIGURG":    syscall.SIGURG,
+	"SIGUSR1":   syscall.SIGUSR1,
+	"SIGUSR2":   syscall.SIGUSR2,
+	"SIGVTALRM": syscall.SIGVTALRM,
+	"SIGWINCH":  syscall.SIGWINCH,
+	"SIGXCPU":   syscall.SIGXCPU,
+	"SIGXFSZ":   syscall.SIGXFSZ,
+}
+
+// Real-time signals as seen by processes linked against glibc, which
+// reserves the first two for itself.
+const (
+	sigRTMIN = syscall.Signal(34)
+	sigRTMAX = syscall.Signal(64)
+)
+
+// parseSignal will parse a signal like "SIGTERM", "TERM", "SIGRTMIN+3" or
+// "15" into syscall.Signal.
+func parseSignal(name string) (syscall.Signal, error) {
+	s := strings.ToUpper(strings.TrimSpace(name))
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || syscall.Signal(n) > sigRTMAX {
+			return 0, fmt.Errorf("invalid signal: %s", name)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	if !strings.HasPrefix(s, "SIG") {
+		s = "SIG" + s
+	}
+	if sig, ok := signals[s]; ok {
+		return sig, nil
+	}
+
+	var base syscall.Signal
+	var offset string
+	switch {
+	case strings.HasPrefix(s, "SIGRTMIN"):
+		base, offset = sigRTMIN, strings.TrimPrefix(s, "SIGRTMIN")
+	case strings.HasPrefix(s, "SIGRTMAX"):
+		base, offset = sigRTMAX, strings.TrimPrefix(s, "SIGRTMAX")
+	default:
+		return 0, fmt.Errorf("invalid signal: %s", name)
+	}
+	if offset == "" {
+		return base, nil
+	}
+	n, err := strconv.Atoi(offset)
+	if err != nil || (offset[0] != '+' && offset[0] != '-') {
+		return 0, fmt.Errorf("invalid signal: %s", name)
+	}
+	sig := base + syscall.Signal(n)
+	if sig < sigRTMIN || sig > sigRTMAX {
+		return 0, fmt.Errorf("invalid signal: %s", name)
+	}
+	return sig, nil
+}
+
+// signalName returns the name of the signal, real-time signals are named
+// relative to SIGRTMIN.
+func signalName(sig syscall.Signal) string {
+	for name, v := range signals {
+		if v == sig {
+			return name
+		}
+	}
+	if sig == sigRTMIN {
+		return "SIGRTMIN"
+	}
+	if sig > sigRTMIN && sig <= sigRTMAX {
+		return fmt.Sprintf("SIGRTMIN+%d", sig-sigRTMIN)
+	}
+	return strconv.Itoa(int(sig))
+}
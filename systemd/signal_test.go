@@ -0,0 +1,53 @@
+package systemd
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected syscall.Signal
+	}{
+		{"SIGTERM", syscall.SIGTERM},
+		{"sigkill", syscall.SIGKILL},
+		{"HUP", syscall.SIGHUP},
+		{"15", syscall.SIGTERM},
+		{"SIGRTMIN", 34},
+		{"SIGRTMIN+3", 37},
+		{"RTMIN+3", 37},
+		{"SIGRTMAX", 64},
+		{"SIGRTMAX-1", 63},
+	}
+	for _, c := range cases {
+		sig, err := parseSignal(c.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.input, err)
+			continue
+		}
+		if sig != c.expected {
+			t.Errorf("%q: expected %d, got %d", c.input, c.expected, sig)
+		}
+	}
+
+	for _, input := range []string{"", "0", "65", "SIGFOO", "SIGRTMIN+31", "SIGRTMAX+1", "SIGRTMIN3", "SIGRTMIN+x"} {
+		if _, err := parseSignal(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestSignalName(t *testing.T) {
+	cases := map[syscall.Signal]string{
+		syscall.SIGTERM: "SIGTERM",
+		34:              "SIGRTMIN",
+		37:              "SIGRTMIN+3",
+		64:              "SIGRTMIN+30",
+	}
+	for sig, expected := range cases {
+		if name := signalName(sig); name != expected {
+			t.Errorf("%d: expected %q, got %q", sig, expected, name)
+		}
+	}
+}
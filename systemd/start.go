@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// acquireStartSlot waits until another machine could be started if
+// max_concurrent_starts is reached, and emits a task event while waiting.
+//
+// The returned function must be called once the machine has started.
+func (d *Driver) acquireStartSlot(cfg *drivers.TaskConfig) (func(), error) {
+	slots := d.startSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		TaskName:  cfg.Name,
+		AllocID:   cfg.AllocID,
+		Timestamp: time.Now(),
+		Message:   "waiting for start slot",
+	})
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-d.ctx.Done():
+		return nil, fmt.Errorf("driver is shutting down")
+	}
+}
+
+// trackStarting tracks the machine as being started until the returned
+// function is called, which must be after its task is tracked.
+func (d *Driver) trackStarting(name string) func() {
+	d.startingLock.Lock()
+	defer d.startingLock.Unlock()
+	if d.starting == nil {
+		d.starting = map[string]struct{}{}
+	}
+	d.starting[name] = struct{}{}
+
+	return func() {
+		d.startingLock.Lock()
+		defer d.startingLock.Unlock()
+		delete(d.starting, name)
+	}
+}
+
+// startingMachines returns the names of machines being started.
+func (d *Driver) startingMachines() map[string]struct{} {
+	d.startingLock.Lock()
+	defer d.startingLock.Unlock()
+	names := make(map[string]struct{}, len(d.starting))
+	for name := range d.starting {
+		names[name] = struct{}{}
+	}
+	return names
+}
@@ -0,0 +1,83 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestAcquireStartSlot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	d.startSlots = make(chan struct{}, 1)
+
+	events, err := d.TaskEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &drivers.TaskConfig{ID: "1", Name: "web", AllocID: "1234"}
+	release, err := d.acquireStartSlot(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := d.acquireStartSlot(cfg)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	select {
+	case ev := <-events:
+		if ev.Message != "waiting for start slot" {
+			t.Errorf("unexpected event %q", ev.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected event for queued start")
+	}
+
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("expected queued start to acquire the slot")
+	}
+
+	d.signalShutdown()
+	release, err = d.acquireStartSlot(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.acquireStartSlot(cfg); err == nil {
+		t.Error("expected error when the driver is shutting down")
+	}
+}
+
+func TestTrackStarting(t *testing.T) {
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+
+	done := d.trackStarting("nomad-web-1234")
+	d.trackStarting("nomad-db-1234")
+	starting := d.startingMachines()
+	if len(starting) != 2 {
+		t.Fatalf("expected 2 starting machines, got %v", starting)
+	}
+
+	done()
+	if _, ok := d.startingMachines()["nomad-web-1234"]; ok {
+		t.Error("expected machine to be untracked once started")
+	}
+	if _, ok := starting["nomad-web-1234"]; !ok {
+		t.Error("expected a copy of the starting machines")
+	}
+}
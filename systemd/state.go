@@ -0,0 +1,117 @@
+package systemd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// taskStore is the in-memory store of all tasks managed by the driver.
+type taskStore struct {
+	store map[string]*taskHandle
+	lock  sync.RWMutex
+}
+
+func newTaskStore() *taskStore {
+	return &taskStore{store: map[string]*taskHandle{}}
+}
+
+// Set stores the handle for the given task id.
+func (ts *taskStore) Set(id string, handle *taskHandle) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.store[id] = handle
+}
+
+// Get returns the handle of the given task id.
+func (ts *taskStore) Get(id string) (*taskHandle, bool) {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	t, ok := ts.store[id]
+	return t, ok
+}
+
+// Delete removes the handle of the given task id.
+func (ts *taskStore) Delete(id string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	delete(ts.store, id)
+}
+
+// List returns a snapshot of all handles in the store.
+func (ts *taskStore) List() []*taskHandle {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	handles := make([]*taskHandle, 0, len(ts.store))
+	for _, h := range ts.store {
+		handles = append(handles, h)
+	}
+	return handles
+}
+
+// taskStateVersion is the version of the TaskState encoding written by this
+// driver. Version 0 is the encoding before TaskState was versioned.
+const taskStateVersion = 1
+
+// taskStateV0 contains the fields of TaskState which every version has with
+// the same type, which are recovered if the state doesn't decode as a whole.
+type taskStateV0 struct {
+	TaskConfig   *drivers.TaskConfig
+	MachineName  string
+	StartedAt    time.Time
+	Unregistered bool
+	Hostname     string
+	MachineID    string
+	Zone         string
+	UnitName     string
+}
+
+// decodeTaskState decodes the task state of the handle, and migrates it to
+// the current version.
+//
+// States whose fields changed their type fall back to the fields of
+// taskStateV0, so running machines are recovered and can be stopped instead
+// of being orphaned.
+func decodeTaskState(handle *drivers.TaskHandle) (*TaskState, error) {
+	var state TaskState
+	if err := handle.GetDriverState(&state); err != nil {
+		var v0 taskStateV0
+		if err0 := handle.GetDriverState(&v0); err0 != nil || v0.MachineName == "" {
+			return nil, err
+		}
+		state = TaskState{
+			TaskConfig:   v0.TaskConfig,
+			MachineName:  v0.MachineName,
+			StartedAt:    v0.StartedAt,
+			Unregistered: v0.Unregistered,
+			Hostname:     v0.Hostname,
+			MachineID:    v0.MachineID,
+			Zone:         v0.Zone,
+			UnitName:     v0.UnitName,
+		}
+	}
+	if state.TaskConfig == nil {
+		state.TaskConfig = handle.Config
+	}
+	migrateTaskState(&state)
+	return &state, nil
+}
+
+// migrateTaskState migrates the state to the current version.
+func migrateTaskState(state *TaskState) {
+	if state.Version >= taskStateVersion {
+		return
+	}
+
+	// Version 0 left options added later empty, which are set to their
+	// defaults so they don't depend on how empty values are handled.
+	if state.StopMode == "" {
+		state.StopMode = stopModeTerminate
+	}
+	if state.Coredumps == "" {
+		state.Coredumps = coredumpsOff
+	}
+	state.Version = taskStateVersion
+}
@@ -0,0 +1,77 @@
+package systemd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestDecodeTaskState(t *testing.T) {
+	cfg := &drivers.TaskConfig{ID: "task", Name: "web"}
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+
+	state := TaskState{
+		Version:     taskStateVersion,
+		TaskConfig:  cfg,
+		MachineName: "nomad-web-1234",
+		StopMode:    stopModePoweroff,
+		Ports:       []portMapping{{Protocol: "tcp", Host: 8080, Container: 80}},
+
+		PortForwarding: true,
+		Firewall:       true,
+	}
+	if err := handle.SetDriverState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeTaskState(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.MachineName != state.MachineName || decoded.StopMode != stopModePoweroff || len(decoded.Ports) != 1 ||
+		!decoded.PortForwarding || !decoded.Firewall {
+		t.Errorf("unexpected state %+v", decoded)
+	}
+}
+
+func TestDecodeTaskStateV0(t *testing.T) {
+	cfg := &drivers.TaskConfig{ID: "task", Name: "web"}
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+
+	// Ports used to have another type, which doesn't decode anymore.
+	legacy := struct {
+		TaskConfig  *drivers.TaskConfig
+		MachineName string
+		StartedAt   time.Time
+		Zone        string
+		Ports       string
+	}{cfg, "nomad-web-1234", time.Now().Round(time.Millisecond), "web", "8080:80"}
+	if err := handle.SetDriverState(&legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := decodeTaskState(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != taskStateVersion {
+		t.Errorf("expected version %d, got %d", taskStateVersion, state.Version)
+	}
+	if state.MachineName != legacy.MachineName || state.Zone != "web" || !state.StartedAt.Equal(legacy.StartedAt) {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if state.StopMode != stopModeTerminate || state.Coredumps != coredumpsOff {
+		t.Errorf("defaults not migrated: %+v", state)
+	}
+}
+
+func TestDecodeTaskStateInvalid(t *testing.T) {
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.DriverState = []byte("invalid")
+	if _, err := decodeTaskState(handle); err == nil {
+		t.Error("expected error for invalid state")
+	}
+}
@@ -0,0 +1,235 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// sysClassNet is where the kernel exposes interface statistics.
+var sysClassNet = "/sys/class/net"
+
+// dirUsageInterval is the minimum interval between two walks of an image
+// whose usage machined can't determine.
+const dirUsageInterval = time.Minute
+
+// dirUsageCache is the last disk usage computed by walking the image.
+type dirUsageCache struct {
+	at    time.Time
+	usage uint64
+}
+
+// interfaceCounters are the counters collected for every interface.
+var interfaceCounters = []string{"rx_bytes", "tx_bytes", "rx_packets", "tx_packets", "rx_dropped", "tx_dropped"}
+
+// handleStats sends the resource usage of the machine every interval until
+// the context is done.
+func (d *Driver) handleStats(ctx context.Context, h *taskHandle, interval time.Duration, ch chan<- *drivers.TaskResourceUsage) {
+	defer close(ch)
+
+	var prevCPU uint64
+	var prevAt time.Time
+	var du dirUsageCache
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(interval)
+		}
+
+		now := time.Now()
+		usage := &cstructs.ResourceUsage{
+			MemoryStats: &cstructs.MemoryStats{},
+			CpuStats:    &cstructs.CpuStats{},
+		}
+
+		if v, err := d.getUnitUint64(h.unitName, "MemoryCurrent"); err == nil {
+			usage.MemoryStats.Usage = v
+			usage.MemoryStats.RSS = v
+			usage.MemoryStats.Measured = []string{"RSS", "Usage"}
+		}
+		if v, err := d.getUnitUint64(h.unitName, "CPUUsageNSec"); err == nil {
+			if !prevAt.IsZero() && v >= prevCPU {
+				usage.CpuStats.Percent = float64(v-prevCPU) / float64(now.Sub(prevAt)) * 100
+			}
+			usage.CpuStats.Measured = []string{"Percent"}
+			prevCPU, prevAt = v, now
+		}
+		if stats := h.networkStats(now); stats != nil {
+			usage.DeviceStats = append(usage.DeviceStats, stats)
+		}
+		if stats := h.ipAccountingStats(now); stats != nil {
+			usage.DeviceStats = append(usage.DeviceStats, stats)
+		}
+		if stats := h.diskStats(now, &du); stats != nil {
+			usage.DeviceStats = append(usage.DeviceStats, stats)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.ctx.Done():
+			return
+		case ch <- &cstructs.TaskResourceUsage{ResourceUsage: usage, Timestamp: now.UnixNano()}:
+		}
+	}
+}
+
+// getUnitUint64 returns a numeric property of the machine's unit, which is
+// reported as unset if accounting is disabled.
+func (d *Driver) getUnitUint64(unit, name string) (uint64, error) {
+	var p *dbus.Property
+	err := callDBus(d.ctx, "GetServiceProperty", func(c *systemdConn) (err error) {
+		p, err = c.systemd.GetServiceProperty(unit, name)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, ok := p.Value.Value().(uint64)
+	if !ok || v == ^uint64(0) {
+		return 0, errPropertyUnset
+	}
+	return v, nil
+}
+
+// networkStats returns the counters of the machine's interfaces.
+//
+// machined only knows the host side of virtual ethernet links, so the
+// counters are swapped to be seen from the container: bytes sent by the host
+// side are received by the container.
+func (h *taskHandle) networkStats(at time.Time) *device.DeviceGroupStats {
+	if h.unregistered {
+		return nil
+	}
+	m, err := h.driver.GetMachine(h.machineName)
+	if err != nil || len(m.NetworkInterfaces) == 0 {
+		return nil
+	}
+
+	stats := &device.DeviceGroupStats{
+		Vendor:        pluginName,
+		Type:          "network",
+		Name:          "interface",
+		InstanceStats: map[string]*device.DeviceStats{},
+	}
+	for _, idx := range m.NetworkInterfaces {
+		iface, err := net.InterfaceByIndex(int(idx))
+		if err != nil {
+			continue
+		}
+		attrs, err := readInterfaceCounters(iface.Name)
+		if err != nil {
+			h.logger.Debug("failed to read interface counters", "interface", iface.Name, "error", err)
+			continue
+		}
+		stats.InstanceStats[iface.Name] = &device.DeviceStats{
+			Summary:   attrs["rx_bytes"],
+			Stats:     &pstructs.StatObject{Attributes: attrs},
+			Timestamp: at,
+		}
+	}
+	return stats
+}
+
+// readInterfaceCounters reads the counters of the host-side interface, and
+// names them from the container's point of view.
+func readInterfaceCounters(name string) (map[string]*pstructs.StatValue, error) {
+	attrs := map[string]*pstructs.StatValue{}
+	for _, counter := range interfaceCounters {
+		b, err := ioutil.ReadFile(filepath.Join(sysClassNet, name, "statistics", counter))
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		unit := "packets"
+		if strings.HasSuffix(counter, "_bytes") {
+			unit = "bytes"
+		}
+		attrs[swapDirection(counter)] = &pstructs.StatValue{IntNumeratorVal: &v, Unit: unit}
+	}
+	return attrs, nil
+}
+
+// swapDirection swaps the rx and tx of the counter name.
+func swapDirection(counter string) string {
+	switch {
+	case strings.HasPrefix(counter, "rx_"):
+		return "tx_" + strings.TrimPrefix(counter, "rx_")
+	case strings.HasPrefix(counter, "tx_"):
+		return "rx_" + strings.TrimPrefix(counter, "tx_")
+	}
+	return counter
+}
+
+// diskStats returns the disk usage of the machine's image, which falls back
+// to walking the image if machined can't determine it. Disk images are not
+// managed by machined and have no stats.
+func (h *taskHandle) diskStats(at time.Time, du *dirUsageCache) *device.DeviceGroupStats {
+	u, err := getImageUsage(h.driver.ctx, h.machineName)
+	if err != nil {
+		return nil
+	}
+	if u.Usage == unknownSize && u.Path != "" {
+		if at.Sub(du.at) >= dirUsageInterval {
+			v, err := dirUsage(u.Path)
+			if err != nil {
+				h.logger.Debug("failed to compute image usage", "path", u.Path, "error", err)
+			} else {
+				du.at, du.usage = at, v
+			}
+		}
+		if !du.at.IsZero() {
+			u.Usage = du.usage
+		}
+	}
+
+	attrs := map[string]*pstructs.StatValue{}
+	for name, v := range map[string]uint64{
+		"usage":           u.Usage,
+		"usage_exclusive": u.UsageExclusive,
+		"limit":           u.Limit,
+	} {
+		if v == unknownSize {
+			continue
+		}
+		n := int64(v)
+		attrs[name] = &pstructs.StatValue{IntNumeratorVal: &n, Unit: "bytes"}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	return &device.DeviceGroupStats{
+		Vendor: pluginName,
+		Type:   "disk",
+		Name:   "image",
+		InstanceStats: map[string]*device.DeviceStats{
+			h.machineName: {
+				Summary:   attrs["usage"],
+				Stats:     &pstructs.StatObject{Attributes: attrs},
+				Timestamp: at,
+			},
+		},
+	}
+}
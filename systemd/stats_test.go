@@ -0,0 +1,57 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadInterfaceCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysclassnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := sysClassNet
+	sysClassNet = dir
+	defer func() { sysClassNet = old }()
+
+	statsDir := filepath.Join(dir, "ve-web", "statistics")
+	if err := os.MkdirAll(statsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"rx_bytes": "100\n", "tx_bytes": "200\n",
+		"rx_packets": "1\n", "tx_packets": "2\n",
+		"rx_dropped": "0\n", "tx_dropped": "3\n",
+	}
+	for k, v := range values {
+		if err := ioutil.WriteFile(filepath.Join(statsDir, k), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attrs, err := readInterfaceCounters("ve-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"rx_bytes": 200, "tx_bytes": 100,
+		"rx_packets": 2, "tx_packets": 1,
+		"rx_dropped": 3, "tx_dropped": 0,
+	}
+	for k, v := range expected {
+		if attrs[k] == nil || *attrs[k].IntNumeratorVal != v {
+			t.Errorf("%s: expected %d, got %v", k, v, attrs[k])
+		}
+	}
+	if attrs["rx_bytes"].Unit != "bytes" || attrs["rx_packets"].Unit != "packets" {
+		t.Errorf("unexpected units")
+	}
+
+	if _, err := readInterfaceCounters("missing"); err == nil {
+		t.Errorf("expected error for missing interface")
+	}
+}
@@ -0,0 +1,51 @@
+package systemd
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	// stopModePoweroff asks the container's init for an orderly shutdown.
+	stopModePoweroff = "poweroff"
+	// stopModeTerminate terminates the machine via machined, which makes
+	// nspawn send the KillSignal to the container's init.
+	stopModeTerminate = "terminate"
+	// stopModeKill kills all processes of the machine.
+	stopModeKill = "kill"
+)
+
+// sigPoweroff makes systemd as the container's init power off, like
+// `machinectl poweroff` does.
+const sigPoweroff = sigRTMIN + 4
+
+func (c *TaskConfig) validateStopMode() error {
+	switch c.StopMode {
+	case "", stopModePoweroff, stopModeTerminate, stopModeKill:
+	default:
+		return fmt.Errorf("invalid stop_mode %q", c.StopMode)
+	}
+	if c.StopMode == stopModePoweroff && !c.Register {
+		return fmt.Errorf("stop_mode %q requires register to be enabled", c.StopMode)
+	}
+	return nil
+}
+
+// stop stops the machine according to its stop mode.
+func (h *taskHandle) stop() error {
+	switch h.stopMode {
+	case stopModePoweroff:
+		if err := h.kill("leader", sigPoweroff); err != nil {
+			return fmt.Errorf("power off machine %s: %v", h.machineName, err)
+		}
+	case stopModeKill:
+		if err := h.kill("all", syscall.SIGKILL); err != nil {
+			return fmt.Errorf("kill machine %s: %v", h.machineName, err)
+		}
+	default:
+		if err := h.terminate(); err != nil {
+			return fmt.Errorf("terminate machine %s: %v", h.machineName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package systemd
+
+import (
+	"testing"
+)
+
+func TestValidateStopMode(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{StopMode: "terminate"},
+		{StopMode: "kill"},
+		{StopMode: "poweroff", Register: true},
+	} {
+		if err := c.validateStopMode(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+
+	for _, c := range []TaskConfig{
+		{StopMode: "halt", Register: true},
+		{StopMode: "poweroff"},
+	} {
+		if err := c.validateStopMode(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestSigPoweroff(t *testing.T) {
+	if name := signalName(sigPoweroff); name != "SIGRTMIN+4" {
+		t.Errorf("expected SIGRTMIN+4, got %s", name)
+	}
+}
@@ -0,0 +1,123 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// errShutdown is returned when a subsystem is started after the driver has
+// been shut down.
+var errShutdown = errors.New("driver is shutting down")
+
+// subsystemRegistry tracks the goroutines started by the driver, such as
+// stats collectors, task watchers and image pulls, so Shutdown can cancel
+// them and wait for them to exit before the driver goes away.
+//
+// Every subsystem runs with a context which is cancelled when either the
+// context it was started with or the registry's context is done.
+type subsystemRegistry struct {
+	ctx context.Context
+
+	// lock syncs access to running and stopped
+	lock    sync.Mutex
+	running map[string]int
+	stopped bool
+
+	wg sync.WaitGroup
+}
+
+func newSubsystemRegistry(ctx context.Context) *subsystemRegistry {
+	return &subsystemRegistry{
+		ctx:     ctx,
+		running: map[string]int{},
+	}
+}
+
+// Go runs fn as the named subsystem in a new goroutine.
+//
+// errShutdown will be returned without running fn if the registry is
+// stopped.
+func (r *subsystemRegistry) Go(ctx context.Context, name string, fn func(ctx context.Context)) error {
+	r.lock.Lock()
+	if r.stopped {
+		r.lock.Unlock()
+		return errShutdown
+	}
+	r.running[name]++
+	r.wg.Add(1)
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		defer r.done(name)
+
+		// Tie the subsystem to the registry as well.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-r.ctx.Done():
+				cancel()
+			case <-stop:
+			}
+		}()
+
+		fn(ctx)
+	}()
+	return nil
+}
+
+func (r *subsystemRegistry) done(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.running[name]--
+	if r.running[name] == 0 {
+		delete(r.running, name)
+	}
+}
+
+// Running returns the sorted names of all running subsystems, a name is
+// repeated for every instance of it.
+func (r *subsystemRegistry) Running() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var names []string
+	for name, n := range r.running {
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Wait stops the registry from starting new subsystems, and waits for the
+// running ones to exit.
+//
+// The registry's context must be cancelled before, otherwise Wait blocks
+// until all subsystems exit on their own or ctx is done.
+func (r *subsystemRegistry) Wait(ctx context.Context) error {
+	r.lock.Lock()
+	r.stopped = true
+	r.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("subsystems didn't exit: %v", r.Running())
+	}
+}
@@ -0,0 +1,136 @@
+package systemd
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// waitGoroutines waits for the number of goroutines to drop to n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("expected %d goroutines, got %d:\n%s", n, runtime.NumGoroutine(), buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubsystemRegistry(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newSubsystemRegistry(ctx)
+
+	taskCtx, cancelTask := context.WithCancel(context.Background())
+	for _, name := range []string{"stats/a", "stats/a", "watch/a"} {
+		if err := r.Go(taskCtx, name, func(ctx context.Context) { <-ctx.Done() }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Go(context.Background(), "reconcile", func(ctx context.Context) { <-ctx.Done() }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"reconcile", "stats/a", "stats/a", "watch/a"}
+	if running := r.Running(); !reflect.DeepEqual(running, expected) {
+		t.Errorf("expected %v, got %v", expected, running)
+	}
+
+	// Cancelling the task only stops its subsystems.
+	cancelTask()
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(r.Running(), []string{"reconcile"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected task subsystems to exit, got %v", r.Running())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if running := r.Running(); len(running) != 0 {
+		t.Errorf("expected no running subsystems, got %v", running)
+	}
+	if err := r.Go(context.Background(), "late", func(context.Context) {}); err != errShutdown {
+		t.Errorf("expected %v, got %v", errShutdown, err)
+	}
+
+	waitGoroutines(t, base)
+}
+
+func TestSubsystemRegistryWaitTimeout(t *testing.T) {
+	r := newSubsystemRegistry(context.Background())
+
+	release := make(chan struct{})
+	defer close(release)
+	if err := r.Go(context.Background(), "stuck", func(context.Context) { <-release }); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestShutdownNoLeak(t *testing.T) {
+	base := runtime.NumGoroutine()
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+
+	cfg := &drivers.TaskConfig{ID: "1", Name: "web", AllocID: "1234"}
+	h := &taskHandle{
+		driver:      d,
+		logger:      d.logger,
+		machineName: "nomad-web-1234",
+		unitName:    unitName("nomad-web-1234"),
+		doneCh:      make(chan struct{}),
+		taskConfig:  cfg,
+		procState:   drivers.TaskStateUnknown,
+	}
+	h.ctx, h.cancel = context.WithCancel(d.ctx)
+	d.tasks.Set(cfg.ID, h)
+
+	fingerprints, err := d.Fingerprint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fingerprints
+
+	results, err := d.WaitTask(context.Background(), cfg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consumers see closed channels instead of hanging forever.
+	for range fingerprints {
+	}
+	if _, ok := <-results; ok {
+		t.Error("expected closed wait channel")
+	}
+	if _, err := d.Fingerprint(context.Background()); err != errShutdown {
+		t.Errorf("expected %v, got %v", errShutdown, err)
+	}
+
+	waitGoroutines(t, base)
+}
@@ -0,0 +1,85 @@
+package systemd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// syscallGroups contains all system call groups supported by systemd.
+//
+// ref: https://www.freedesktop.org/software/systemd/man/systemd.exec.html#SystemCallFilter=
+var syscallGroups = map[string]struct{}{
+	"@aio":            {},
+	"@basic-io":       {},
+	"@chown":          {},
+	"@clock":          {},
+	"@cpu-emulation":  {},
+	"@debug":          {},
+	"@default":        {},
+	"@file-system":    {},
+	"@io-event":       {},
+	"@ipc":            {},
+	"@keyring":        {},
+	"@known":          {},
+	"@memlock":        {},
+	"@module":         {},
+	"@mount":          {},
+	"@network-io":     {},
+	"@obsolete":       {},
+	"@pkey":           {},
+	"@privileged":     {},
+	"@process":        {},
+	"@raw-io":         {},
+	"@reboot":         {},
+	"@resources":      {},
+	"@sandbox":        {},
+	"@setuid":         {},
+	"@signal":         {},
+	"@swap":           {},
+	"@sync":           {},
+	"@system-service": {},
+	"@timer":          {},
+}
+
+var syscallNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// validateSyscallFilter checks every entry of SystemCallFilter, which could be
+// a system call name or group, prefixed with "~" to deny it.
+func validateSyscallFilter(filter []string) error {
+	for _, v := range filter {
+		name := strings.TrimPrefix(v, "~")
+		if strings.HasPrefix(name, "@") {
+			if _, ok := syscallGroups[name]; !ok {
+				return fmt.Errorf("invalid system call group %q", v)
+			}
+			continue
+		}
+		if !syscallNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid system call %q", v)
+		}
+	}
+	return nil
+}
+
+// allowedSyscalls returns all system calls and groups to allow.
+func allowedSyscalls(filter []string) []string {
+	var s []string
+	for _, v := range filter {
+		if !strings.HasPrefix(v, "~") {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// deniedSyscalls returns all system calls and groups to deny, without the "~" prefix.
+func deniedSyscalls(filter []string) []string {
+	var s []string
+	for _, v := range filter {
+		if strings.HasPrefix(v, "~") {
+			s = append(s, strings.TrimPrefix(v, "~"))
+		}
+	}
+	return s
+}
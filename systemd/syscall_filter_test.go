@@ -0,0 +1,37 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateSyscallFilter(t *testing.T) {
+	cases := []struct {
+		filter []string
+		valid  bool
+	}{
+		{[]string{"@keyring", "~@obsolete", "ptrace", "~bpf"}, true},
+		{[]string{"@not-exist"}, false},
+		{[]string{"~@not-exist"}, false},
+		{[]string{"ptrace bpf"}, false},
+		{nil, true},
+	}
+
+	for _, c := range cases {
+		err := validateSyscallFilter(c.filter)
+		if (err == nil) != c.valid {
+			t.Errorf("%v: expected valid %v, got error %v", c.filter, c.valid, err)
+		}
+	}
+}
+
+func TestSplitSyscallFilter(t *testing.T) {
+	filter := []string{"@keyring", "~@obsolete", "ptrace", "~bpf"}
+
+	if got := allowedSyscalls(filter); !reflect.DeepEqual(got, []string{"@keyring", "ptrace"}) {
+		t.Errorf("unexpected allowed syscalls: %v", got)
+	}
+	if got := deniedSyscalls(filter); !reflect.DeepEqual(got, []string{"@obsolete", "bpf"}) {
+		t.Errorf("unexpected denied syscalls: %v", got)
+	}
+}
@@ -1,55 +1,60 @@
 package systemd
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/dbus"
 	"github.com/coreos/go-systemd/import1"
 	"github.com/coreos/go-systemd/machine1"
-	log "github.com/hashicorp/go-hclog"
+	godbus "github.com/godbus/dbus"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
-var (
-	dbusConn     *dbus.Conn
-	machinedConn *machine1.Conn
-	importdConn  *import1.Conn
-)
-
 // Machine Object in dbus.
 //
-// node /org/freedesktop/machine1/machine/fedora_2dtree {
-//  interface org.freedesktop.machine1.Machine {
-//    methods:
-//      Terminate();
-//      Kill(in  s who,
-//           in  s signal);
-//      GetAddresses(out a(iay) addresses);
-//      GetOSRelease(out a{ss} fields);
-//    signals:
-//    properties:
-//      readonly s Name = 'fedora-tree';
-//      readonly ay Id = [0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00];
-//      readonly t Timestamp = 1374193370484284;
-//      readonly t TimestampMonotonic = 128247251308;
-//      readonly s Service = 'nspawn';
-//      readonly s Unit = 'machine-fedora\\x2dtree.scope';
-//      readonly u Leader = 30046;
-//      readonly s Class = 'container';
-//      readonly s RootDirectory = '/home/lennart/fedora-tree';
-//      readonly ai NetworkInterfaces = [7];
-//      readonly s State = 'running';
-//  };
-//  interface org.freedesktop.DBus.Properties {
-//  };
-//  interface org.freedesktop.DBus.Peer {
-//  };
-//  interface org.freedesktop.DBus.Introspectable {
-//  };
-//};
+//	node /org/freedesktop/machine1/machine/fedora_2dtree {
+//	 interface org.freedesktop.machine1.Machine {
+//	   methods:
+//	     Terminate();
+//	     Kill(in  s who,
+//	          in  s signal);
+//	     GetAddresses(out a(iay) addresses);
+//	     GetOSRelease(out a{ss} fields);
+//	   signals:
+//	   properties:
+//	     readonly s Name = 'fedora-tree';
+//	     readonly ay Id = [0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00];
+//	     readonly t Timestamp = 1374193370484284;
+//	     readonly t TimestampMonotonic = 128247251308;
+//	     readonly s Service = 'nspawn';
+//	     readonly s Unit = 'machine-fedora\\x2dtree.scope';
+//	     readonly u Leader = 30046;
+//	     readonly s Class = 'container';
+//	     readonly s RootDirectory = '/home/lennart/fedora-tree';
+//	     readonly ai NetworkInterfaces = [7];
+//	     readonly s State = 'running';
+//	 };
+//	 interface org.freedesktop.DBus.Properties {
+//	 };
+//	 interface org.freedesktop.DBus.Peer {
+//	 };
+//	 interface org.freedesktop.DBus.Introspectable {
+//	 };
+//	};
 type Machine struct {
 	Name               string
 	ID                 []byte
@@ -77,98 +82,822 @@ const (
 	MachineClassVM        = "vm"
 )
 
-// CreateMachine will create a new systemd-nspawn machine.
-func (d *Driver) CreateMachine(cfg *drivers.TaskConfig, taskConfig TaskConfig) (m *Machine, err error) {
-	machineName := fmt.Sprintf("%s-%s", strings.Replace(cfg.Name, "/", "_", -1), cfg.AllocID)
+// machineNamePrefix is the prefix of all machines created by this driver.
+const machineNamePrefix = "nomad-"
+
+// maxMachineNameLength is the maximum length of machine names accepted by
+// machined.
+const maxMachineNameLength = 64
+
+// machineNameRegexp matches all characters of task names not allowed in
+// machine names.
+var machineNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// machineName returns the machine name for the given task, which is
+// distinct for every task of the alloc.
+//
+// Long task names are truncated and suffixed with a hash of the full name,
+// so tasks of the same group sharing a long prefix don't collide.
+func machineName(cfg *drivers.TaskConfig) string {
+	task := machineNameRegexp.ReplaceAllString(cfg.Name, "_")
+	name := fmt.Sprintf("%s%s-%s", machineNamePrefix, task, cfg.AllocID)
+	if len(name) <= maxMachineNameLength {
+		return name
+	}
+
+	sum := md5.Sum([]byte(cfg.Name))
+	suffix := fmt.Sprintf("-%s-%s", hex.EncodeToString(sum[:])[:8], cfg.AllocID)
+	return machineNamePrefix + task[:maxMachineNameLength-len(machineNamePrefix)-len(suffix)] + suffix
+}
+
+// hostnameRegexp matches all characters not allowed in hostname.
+var hostnameRegexp = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// defaultHostname returns the default hostname for the given task, which is
+// "<job>-<task>-<alloc-index>".
+func defaultHostname(cfg *drivers.TaskConfig) string {
+	name := fmt.Sprintf("%s-%s", cfg.JobName, cfg.Name)
+	if idx, ok := cfg.Env["NOMAD_ALLOC_INDEX"]; ok {
+		name += "-" + idx
+	}
+	return sanitizeHostname(name)
+}
 
-	trans, err := importdConn.PullRaw(taskConfig.Image, machineName, "no", false)
+// sanitizeHostname converts name into a valid hostname.
+func sanitizeHostname(name string) string {
+	name = hostnameRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.Trim(name, "-")
+}
+
+// defaultMachineID returns the machine ID derived from the alloc ID and task
+// name, so it's stable across restarts of the same task.
+func defaultMachineID(cfg *drivers.TaskConfig) string {
+	sum := md5.Sum([]byte(cfg.AllocID + "/" + cfg.Name))
+	return hex.EncodeToString(sum[:])
+}
+
+// unitName returns the systemd unit name which runs the machine.
+func unitName(machineName string) string {
+	return fmt.Sprintf("systemd-nspawn@%s.service", machineName)
+}
+
+// debugCommands returns the commands operators can run on the host to debug
+// the machine, by the name of their driver attribute.
+//
+// Unregistered machines are unknown to machinectl, so only their unit's
+// status is returned.
+func debugCommands(machineName string, unregistered bool) map[string]string {
+	if unregistered {
+		return map[string]string{
+			"status_command": "systemctl status " + unitName(machineName),
+		}
+	}
+	return map[string]string{
+		"status_command": "machinectl status " + machineName,
+		"shell_command":  "machinectl shell " + machineName,
+		"login_command":  "machinectl login " + machineName,
+	}
+}
+
+// Directories which contain nspawn files, files in /etc take precedence
+// over files in /run.
+var (
+	etcNSpawnDir = "/etc/systemd/nspawn"
+	runNSpawnDir = "/run/systemd/nspawn"
+)
+
+// nspawnDirs returns all directories the driver could place nspawn files in.
+func nspawnDirs() []string {
+	return []string{etcNSpawnDir, runNSpawnDir}
+}
+
+// nspawnPath returns the path of the nspawn file for the machine in dir.
+func nspawnPath(dir, machineName string) string {
+	return filepath.Join(dir, machineName+".nspawn")
+}
+
+// nspawnDir returns the directory the driver writes nspawn files to.
+func (d *Driver) nspawnDir() string {
+	if d.loadConfig().RuntimeNSpawnFiles {
+		return runNSpawnDir
+	}
+	return etcNSpawnDir
+}
+
+// migrateNSpawnFile moves the nspawn file of the machine written by a
+// previous configuration of the driver into the current directory. nspawn
+// reads it only on start, so running machines are not affected.
+func (d *Driver) migrateNSpawnFile(machineName string) error {
+	dst := nspawnPath(d.nspawnDir(), machineName)
+	for _, dir := range nspawnDirs() {
+		src := nspawnPath(dir, machineName)
+		if src == dst {
+			continue
+		}
+		generated, err := isGeneratedNSpawnFile(src)
+		if os.IsNotExist(err) || (err == nil && !generated) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+		d.logger.Info("migrated nspawn file", "from", src, "to", dst)
+	}
+	return nil
+}
+
+// prepareImage makes the image the image of machine, images pinned by digest
+// are cloned from the local cache and pulled only if missing.
+func (d *Driver) prepareImage(image, machineName string) error {
+	ref, err := parseImageRef(image)
 	if err != nil {
+		return err
+	}
+
+	if ref.Digest == "" {
+		return d.pullImage(ref, machineName)
+	}
+
+	// Clones are cheap on btrfs, but copied on other file systems.
+	if err := d.checkFreeSpace(0); err != nil {
+		return err
+	}
+
+	cached, err := d.cacheImage(ref)
+	if err != nil {
+		return err
+	}
+	return cloneImage(d.ctx, cached, machineName)
+}
+
+// cacheImage pulls the image pinned by digest unless it's cached already,
+// and returns its local name.
+func (d *Driver) cacheImage(ref *imageRef) (string, error) {
+	name := ref.cacheName()
+
+	d.imageLock.Lock()
+	defer d.imageLock.Unlock()
+
+	ok, err := imageExists(d.ctx, name)
+	if err != nil || ok {
+		return name, err
+	}
+	if peer := d.findPeerImage(ref, d.loadConfig().PeerCache); peer != nil {
+		d.logger.Info("pulling image from peer", "url", redactURL(peer.URL), "digest", ref.Digest, "name", name)
+		err := d.pullVerifiedImage(peer, name)
+		if err == nil {
+			return name, nil
+		}
+		d.logger.Warn("failed to pull image from peer, pulling from origin", "url", redactURL(peer.URL), "error", err)
+	}
+	d.logger.Info("pulling image", "url", redactURL(ref.URL), "digest", ref.Digest, "name", name)
+	return name, d.pullVerifiedImage(ref, name)
+}
+
+// pullVerifiedImage pulls the image pinned by digest under a temporary name,
+// which is renamed to name once the digest of raw images is verified, so
+// images which don't match their digest never enter the cache.
+func (d *Driver) pullVerifiedImage(ref *imageRef, name string) error {
+	tmp := name + "-tmp"
+	if err := removeImage(d.ctx, tmp); err != nil {
+		return fmt.Errorf("failed to remove stale pull %s: %v", tmp, err)
+	}
+	err := d.pullImage(ref, tmp)
+	if err == nil && ref.Transport == "raw" {
+		err = verifyImageDigest(tmp, ref.Digest)
+	}
+	if err != nil {
+		if err := removeImage(d.ctx, tmp); err != nil {
+			d.logger.Warn("failed to remove failed pull", "name", tmp, "error", err)
+		}
+		return err
+	}
+	return renameImage(d.ctx, tmp, name)
+}
+
+// prepullImages pulls the images into the cache, so the first tasks using
+// them don't have to wait for the pull.
+func (d *Driver) prepullImages(ctx context.Context, images []string) {
+	for _, image := range images {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		ref, err := parseImageRef(image)
+		if err == nil {
+			_, err = d.cacheImage(ref)
+		}
+		if err != nil {
+			d.logger.Error("failed to prepull image", "image", image, "error", err)
+		}
+	}
+}
+
+// pullImage will pull the image as the local image name via systemd-importd.
+//
+// Pulls wait for a slot if max_concurrent_pulls is reached.
+func (d *Driver) pullImage(ref *imageRef, name string) error {
+	if err := d.transfers.Acquire(d.ctx); err != nil {
+		return err
+	}
+	defer d.transfers.Release()
+
+	size := contentLength(ref.URL)
+	// The download size is a lower bound of the space the image takes, which
+	// is usually compressed.
+	var need uint64
+	if size > 0 {
+		need = uint64(size)
+	}
+	if err := d.checkFreeSpace(need); err != nil {
+		return err
+	}
+
+	var trans *import1.Transfer
+	err := callDBus(d.ctx, "Pull", func(c *systemdConn) (err error) {
+		pull := c.importd.PullRaw
+		if ref.Transport == "tar" {
+			pull = c.importd.PullTar
+		}
+		trans, err = pull(ref.URL, name, "no", false)
 		return
+	})
+	if err != nil {
+		return err
 	}
 
+	d.transfers.Add(trans.Id, size)
+	defer d.transfers.Delete(trans.Id)
+
 	// FIXME: So stupid, let's use signal instead.
 	for {
-		ts, err := importdConn.ListTransfers()
+		var ts []import1.TransferStatus
+		err := callDBus(d.ctx, "ListTransfers", func(c *systemdConn) (err error) {
+			ts, err = c.importd.ListTransfers()
+			return
+		})
 		if err != nil {
-			return nil, err
+			return err
 		}
 		found := false
 		for _, v := range ts {
 			if v.Id == trans.Id {
 				found = true
+				d.transfers.Update(v.Id, v.Progress)
+				d.logger.Debug("pulling image", "url", redactURL(ref.URL), "progress", v.Progress)
 				break
 			}
 		}
 		if !found {
-			break
+			return nil
+		}
+
+		select {
+		case <-d.ctx.Done():
+			err := callDBus(context.Background(), "CancelTransfer", func(c *systemdConn) error {
+				return c.importd.CancelTransfer(trans.Id)
+			})
+			if err != nil {
+				d.logger.Warn("failed to cancel transfer", "url", redactURL(ref.URL), "error", err)
+			}
+			return d.ctx.Err()
+		case <-time.After(transferPollInterval):
 		}
 	}
+}
 
-	// Create nspawn file.
-	f, err := os.Create("/etc/systemd/nspawn/" + machineName)
+// CreateMachine will create a new systemd-nspawn machine.
+func (d *Driver) CreateMachine(cfg *drivers.TaskConfig, taskConfig TaskConfig) (m *Machine, err error) {
+	machineName := machineName(cfg)
+
+	// Disk images are booted directly without pulling.
+	switch {
+	case taskConfig.RootLocation == rootLocationAlloc:
+		err = d.prepareAllocRoot(cfg, &taskConfig)
+	case taskConfig.Bootstrap.Distro != "":
+		err = d.prepareBootstrapImage(taskConfig.Bootstrap, machineName)
+	case taskConfig.ImageBuild.enabled():
+		err = d.prepareBuiltImage(cfg, taskConfig, machineName)
+	case taskConfig.DiskImage == "":
+		err = d.prepareImage(taskConfig.Image, machineName)
+	}
 	if err != nil {
-		d.logger.Error("Create nspawn file failed", "error", err)
 		return
 	}
+
+	shipped, err := loadImageSettings(machineName, &taskConfig)
+	if err != nil {
+		d.logger.Error("Load image settings failed", "error", err)
+		return nil, fmt.Errorf("failed to load image settings: %v", err)
+	}
+	if shipped && !taskConfig.RespectImageSettings {
+		d.logger.Info("ignoring nspawn settings shipped with image", "machine", machineName)
+		d.eventer.EmitEvent(&drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			TaskName:  cfg.Name,
+			AllocID:   cfg.AllocID,
+			Timestamp: time.Now(),
+			Message:   "ignored nspawn settings shipped with the image, set respect_image_settings to apply them",
+		})
+	}
+
+	if taskConfig.diskLimit > 0 {
+		err = setImageLimit(d.ctx, machineName, taskConfig.diskLimit)
+		if err != nil {
+			d.logger.Error("Set image limit failed", "error", err)
+			return nil, fmt.Errorf("failed to set disk limit: %v", err)
+		}
+	}
+
+	// Start machine along with image and nspawn file, or in a transient unit
+	// with all options on the command line.
+	//
+	// ch must not be closed here, because the job result could be sent after
+	// boot timeout.
+	unit := taskConfig.machineUnitName(machineName)
+	ch := make(chan string, 1)
+	if d.loadConfig().LogGeneratedFiles {
+		d.logGeneratedFiles(machineName, taskConfig)
+	}
+	if taskConfig.TransientUnit {
+		var props []dbus.Property
+		props, err = transientProperties(machineName, taskConfig)
+		if err != nil {
+			d.logger.Error("Generate transient unit failed", "error", err)
+			return
+		}
+		err = callDBus(d.ctx, "StartTransientUnit", func(c *systemdConn) error {
+			_, err := c.systemd.StartTransientUnit(unit, "fail", props, ch)
+			return err
+		})
+	} else {
+		err = d.writeMachineFiles(machineName, taskConfig)
+		if err != nil {
+			return
+		}
+		err = callDBus(d.ctx, "StartUnit", func(c *systemdConn) error {
+			_, err := c.systemd.StartUnit(unit, "replace", ch)
+			return err
+		})
+	}
+	if err != nil {
+		d.logger.Error("Create machine unit failed", "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(taskConfig.bootTimeout)
+	timer := time.NewTimer(taskConfig.bootTimeout)
+	defer timer.Stop()
+
+	select {
+	case job := <-ch:
+		if job != "done" {
+			d.logger.Error("Start machine unit failed", "result", job)
+			if reason := d.unitFailure(unit); reason != "" {
+				return nil, fmt.Errorf("start machine unit failed: %s (%s)", job, reason)
+			}
+			return nil, fmt.Errorf("start machine unit failed: %s", job)
+		}
+	case <-timer.C:
+		d.logger.Error("Machine boot timeout", "machine", machineName, "timeout", taskConfig.bootTimeout)
+		if err := d.stopUnit(unit); err != nil {
+			d.logger.Error("Stop machine unit failed", "error", err)
+		}
+		return nil, fmt.Errorf("machine didn't become ready within %s", taskConfig.bootTimeout)
+	}
+
+	// machined doesn't know the machine if it's not registered.
+	if !taskConfig.Register {
+		return &Machine{
+			Name:  machineName,
+			Unit:  unit,
+			Class: MachineClassContainer,
+			State: MachineStateRunning,
+		}, nil
+	}
+
+	// The start job is done once nspawn is forked, which is before the
+	// container registers itself with machined.
+	m, err = d.waitMachineRunning(machineName, unit, deadline)
+	if err != nil {
+		d.logger.Error("Machine registration failed", "machine", machineName, "error", err)
+		if err := d.stopUnit(unit); err != nil {
+			d.logger.Error("Stop machine unit failed", "error", err)
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeMachineFiles writes the nspawn file of the machine, and the drop-in
+// of its unit if needed.
+func (d *Driver) writeMachineFiles(machineName string, taskConfig TaskConfig) error {
+	dir := d.nspawnDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		d.logger.Error("Create nspawn dir failed", "error", err)
+		return err
+	}
+
+	// The nspawn file contains the environment, which may carry secrets.
+	f, err := os.OpenFile(nspawnPath(dir, machineName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		d.logger.Error("Create nspawn file failed", "error", err)
+		return err
+	}
 	defer f.Close()
 
-	err = tmpl.Execute(f, taskConfig)
+	content, err := renderNspawnFile(taskConfig)
 	if err != nil {
 		d.logger.Error("Generate nspawn file failed", "error", err)
+		return err
+	}
+	if _, err = f.WriteString(content); err != nil {
+		d.logger.Error("Write nspawn file failed", "error", err)
+		return err
+	}
+
+	// Create unit drop-in for options not supported by nspawn file.
+	if taskConfig.needsDropIn() {
+		err = d.writeUnitDropIn(machineName, taskConfig)
+		if err != nil {
+			d.logger.Error("Create unit drop-in failed", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// waitMachineRunning waits until machined reports the machine as running,
+// and fails early if its unit stops before that.
+func (d *Driver) waitMachineRunning(name, unit string, deadline time.Time) (*Machine, error) {
+	for {
+		m, err := d.GetMachine(name)
+		if err == nil && m.State == MachineStateRunning {
+			return m, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("machine is %s", m.State)
+		}
+
+		state, status, uerr := d.getUnitState(unit)
+		if uerr == nil && (state == "failed" || state == "inactive") {
+			return nil, fmt.Errorf("machine unit %s is %s with exit status %d before registering with machined", unit, state, status)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("machine %s didn't register with machined in time: %v", name, err)
+		}
+		time.Sleep(machinePollInterval)
+	}
+}
+
+// ListMachines will list all machines created by this driver.
+func (d *Driver) ListMachines() ([]string, error) {
+	var ms []machine1.MachineStatus
+	err := callDBus(d.ctx, "ListMachines", func(c *systemdConn) (err error) {
+		ms, err = c.machined.ListMachines()
 		return
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Start machine along with image and nspawn file.
-	ch := make(chan string)
-	defer close(ch)
-	_, err = dbusConn.StartUnit(
-		fmt.Sprintf("systemd-nspawn@%s.service", machineName), "replace", ch)
+	names := make([]string, 0, len(ms))
+	for _, m := range ms {
+		if strings.HasPrefix(m.Name, machineNamePrefix) {
+			names = append(names, m.Name)
+		}
+	}
+	return names, nil
+}
+
+// GetMachine will get a systemd-nspawn machine.
+func (d *Driver) GetMachine(name string) (m *Machine, err error) {
+	var props map[string]interface{}
+	err = callDBus(d.ctx, "DescribeMachine", func(c *systemdConn) (err error) {
+		props, err = c.machined.DescribeMachine(name)
+		return
+	})
 	if err != nil {
-		d.logger.Error("Create machine unit failed", "error", err)
 		return
 	}
 
-	job := <-ch
-	if job != "done" {
-		d.logger.Error("Start machine unit failed")
+	m = &Machine{}
+	m.Name, _ = props["Name"].(string)
+	m.ID, _ = props["Id"].([]byte)
+	if v, ok := props["Timestamp"].(uint64); ok {
+		m.Timestamp = time.Unix(0, int64(v)*int64(time.Microsecond))
 	}
-
+	if v, ok := props["TimestampMonotonic"].(uint64); ok {
+		m.TimestampMonotonic = time.Unix(0, int64(v)*int64(time.Microsecond))
+	}
+	m.Service, _ = props["Service"].(string)
+	m.Unit, _ = props["Unit"].(string)
+	if v, ok := props["Leader"].(uint32); ok {
+		m.Leader = int(v)
+	}
+	m.Class, _ = props["Class"].(string)
+	m.RootDirectory, _ = props["RootDirectory"].(string)
+	if v, ok := props["NetworkInterfaces"].([]int32); ok {
+		for _, i := range v {
+			m.NetworkInterfaces = append(m.NetworkInterfaces, int(i))
+		}
+	}
+	m.State, _ = props["State"].(string)
 	return
 }
 
-// GetMachine will get a new systemd-nspawn machine.
-func (d *Driver) GetMachine() {
-	panic("implement me")
+// GetMachineAddresses will get IP addresses of a systemd-nspawn machine.
+//
+// go-systemd's machine1 doesn't decode the addresses, so we call it directly.
+func (d *Driver) GetMachineAddresses(name string) ([]net.IP, error) {
+	var addrs []struct {
+		Family  int32
+		Address []byte
+	}
+	err := callDBus(d.ctx, "GetMachineAddresses", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.GetMachineAddresses", 0, name).Store(&addrs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, v := range addrs {
+		ips = append(ips, net.IP(v.Address))
+	}
+	return ips, nil
+}
+
+// GetMachineOSRelease will get the os-release fields of a systemd-nspawn
+// machine, like PRETTY_NAME and VERSION_ID.
+//
+// go-systemd's machine1 doesn't support GetMachineOSRelease, so we call it
+// directly.
+func (d *Driver) GetMachineOSRelease(name string) (map[string]string, error) {
+	var fields map[string]string
+	err := callDBus(d.ctx, "GetMachineOSRelease", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.GetMachineOSRelease", 0, name).Store(&fields)
+	})
+	return fields, err
+}
+
+// KillMachine will send a signal to processes of a systemd-nspawn machine.
+//
+// who could be "leader" or "all".
+func (d *Driver) KillMachine(name, who string, sig syscall.Signal) error {
+	return callDBus(d.ctx, "KillMachine", func(c *systemdConn) error {
+		return c.machined.KillMachine(name, who, sig)
+	})
 }
 
-// KillMachine will kill a new systemd-nspawn machine.
-func (d *Driver) KillMachine() {
-	panic("implement me")
+// TerminateMachine will terminate a systemd-nspawn machine.
+func (d *Driver) TerminateMachine(name string) error {
+	return callDBus(d.ctx, "TerminateMachine", func(c *systemdConn) error {
+		return c.machined.TerminateMachine(name)
+	})
 }
 
-// TerminateMachine will terminate a new systemd-nspawn machine.
-func (d *Driver) TerminateMachine() {
-	panic("implement me")
+// stopUnit will stop the unit without waiting for it.
+func (d *Driver) stopUnit(unit string) error {
+	return callDBus(d.ctx, "StopUnit", func(c *systemdConn) error {
+		_, err := c.systemd.StopUnit(unit, "replace", nil)
+		return err
+	})
 }
 
-func (d *Driver) getMachine() {
-	panic("implement me")
+// machineTables are the nftables tables the driver created for a machine,
+// which are only removed if it has them.
+type machineTables struct {
+	portForwarding bool
+	firewall       bool
 }
 
-func init() {
-	var err error
-	dbusConn, err = dbus.New()
+// allMachineTables are the tables of a machine whose task state is unknown.
+var allMachineTables = machineTables{portForwarding: true, firewall: true}
+
+// RemoveMachine will remove the nspawn file, unit drop-in, host network config, firewall and image of a stopped
+// systemd-nspawn machine. It goes on if a step fails, so the others aren't leaked, and returns all errors.
+func (d *Driver) RemoveMachine(name string, tables machineTables) error {
+	var mErr multierror.Error
+	for _, dir := range nspawnDirs() {
+		err := os.Remove(nspawnPath(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+
+	if err := d.removeUnitDropIn(name); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if err := d.removeHostNetwork(name); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if tables.portForwarding {
+		if err := d.removePortForwarding(name); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	if tables.firewall {
+		if err := d.removeFirewall(name); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	if err := d.removePinnedMACVLAN(name); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if err := removeCredentials(name); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	// Failed transient units are kept until they are reset.
+	err := callDBus(d.ctx, "ResetFailedUnit", func(c *systemdConn) error {
+		return c.systemd.ResetFailedUnit(transientUnitName(name))
+	})
+	if err != nil {
+		d.logger.Debug("failed to reset transient unit", "machine", name, "error", err)
+	}
+
+	if err := removeImage(d.ctx, name); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	return mErr.ErrorOrNil()
+}
+
+// imageExists returns whether machined knows the image.
+func imageExists(ctx context.Context, name string) (bool, error) {
+	var path godbus.ObjectPath
+	err := callDBus(ctx, "GetImage", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.GetImage", 0, name).Store(&path)
+	})
+	if e, ok := err.(godbus.Error); ok && e.Name == "org.freedesktop.machine1.NoSuchImage" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// cloneImage clones the image as the image of machine via systemd-machined,
+// which uses a snapshot if the storage supports it.
+func cloneImage(ctx context.Context, name, machineName string) error {
+	return callDBus(ctx, "CloneImage", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.CloneImage", 0, name, machineName, false).Err
+	})
+}
+
+// renameImage renames the image via systemd-machined.
+func renameImage(ctx context.Context, name, newName string) error {
+	return callDBus(ctx, "RenameImage", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.RenameImage", 0, name, newName).Err
+	})
+}
+
+// removeImage will remove the machine image via systemd-machined.
+//
+// go-systemd's machine1 doesn't support RemoveImage, so we call it directly.
+func removeImage(ctx context.Context, name string) error {
+	err := callDBus(ctx, "RemoveImage", func(c *systemdConn) error {
+		return c.machinedManager().
+			Call("org.freedesktop.machine1.Manager.RemoveImage", 0, name).Err
+	})
+	if e, ok := err.(godbus.Error); ok && e.Name == "org.freedesktop.machine1.NoSuchImage" {
+		// Machines booted from disk images have no image to remove.
+		return nil
+	}
+	return err
+}
+
+// freezeUnit will freeze or thaw all processes of the unit via its cgroup.
+//
+// go-systemd's dbus doesn't support FreezeUnit and ThawUnit, so we call them
+// directly.
+func freezeUnit(ctx context.Context, unit string, freeze bool) error {
+	method := "ThawUnit"
+	if freeze {
+		method = "FreezeUnit"
+	}
+	return callDBus(ctx, method, func(c *systemdConn) error {
+		return c.systemdManager().
+			Call("org.freedesktop.systemd1.Manager."+method, 0, unit).Err
+	})
+}
+
+// getSystemdVersion returns the major version of the host's systemd.
+//
+// go-systemd's dbus doesn't support manager properties, so we get it
+// directly.
+func getSystemdVersion(ctx context.Context) (int, error) {
+	var v godbus.Variant
+	err := callDBus(ctx, "GetVersion", func(c *systemdConn) (err error) {
+		v, err = c.systemdManager().GetProperty("org.freedesktop.systemd1.Manager.Version")
+		return
+	})
 	if err != nil {
-		log.Default().Error("systemd connected failed", err)
+		return 0, err
 	}
+	s, _ := v.Value().(string)
+	return parseSystemdVersion(s)
+}
 
-	machinedConn, err = machine1.New()
+// parseSystemdVersion parses the major version from versions like
+// "245.4-4ubuntu3" or "252".
+func parseSystemdVersion(s string) (int, error) {
+	s = strings.Trim(s, `"`)
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		s = s[:end]
+	}
+	return strconv.Atoi(s)
+}
+
+// errPropertyUnset is returned if the unit property is not available, e.g.
+// accounting is disabled.
+var errPropertyUnset = errors.New("property is unset")
+
+// getUnitState will get the active state and exit status of machine's unit.
+func (d *Driver) getUnitState(unit string) (state string, status int, err error) {
+	var p *dbus.Property
+	err = callDBus(d.ctx, "GetUnitProperty", func(c *systemdConn) (err error) {
+		p, err = c.systemd.GetUnitProperty(unit, "ActiveState")
+		return
+	})
 	if err != nil {
-		log.Default().Error("systemd-machined connected failed", err)
+		return
 	}
+	state, _ = p.Value.Value().(string)
 
-	importdConn, err = import1.New()
+	err = callDBus(d.ctx, "GetServiceProperty", func(c *systemdConn) (err error) {
+		p, err = c.systemd.GetServiceProperty(unit, "ExecMainStatus")
+		return
+	})
 	if err != nil {
-		log.Default().Error("systemd-importd connected failed", err)
+		return
+	}
+	if v, ok := p.Value.Value().(int32); ok {
+		status = int(v)
+	}
+	return
+}
+
+// machinePollInterval is the interval between polls of the machine while
+// waiting for its registration or for it to stop.
+const machinePollInterval = 200 * time.Millisecond
+
+// machineStopTimeout is the time to wait for a terminated machine to stop
+// before removing it.
+const machineStopTimeout = 30 * time.Second
+
+// isNoSuchMachine returns whether the error is returned by machined for
+// machines which don't exist.
+func isNoSuchMachine(err error) bool {
+	e, ok := err.(godbus.Error)
+	return ok && e.Name == "org.freedesktop.machine1.NoSuchMachine"
+}
+
+// waitMachineStopped waits until machined doesn't know the machine anymore
+// and its unit is stopped, so nothing of the machine is in use.
+func (d *Driver) waitMachineStopped(name, unit string, deadline time.Time) error {
+	for {
+		_, err := d.GetMachine(name)
+		if err == nil {
+			err = fmt.Errorf("machine is still registered")
+		} else if isNoSuchMachine(err) {
+			state, _, uerr := d.getUnitState(unit)
+			if uerr == nil && (state == "failed" || state == "inactive") {
+				return nil
+			}
+			err = uerr
+			if err == nil {
+				err = fmt.Errorf("machine unit %s is %s", unit, state)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine %s didn't stop in time: %v", name, err)
+		}
+		time.Sleep(machinePollInterval)
 	}
 }
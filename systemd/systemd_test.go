@@ -0,0 +1,216 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestDefaultHostname(t *testing.T) {
+	cases := []struct {
+		cfg      *drivers.TaskConfig
+		expected string
+	}{
+		{
+			&drivers.TaskConfig{
+				JobName: "web",
+				Name:    "nginx",
+				Env:     map[string]string{"NOMAD_ALLOC_INDEX": "2"},
+			},
+			"web-nginx-2",
+		},
+		{
+			&drivers.TaskConfig{JobName: "Batch_Job", Name: "task.one"},
+			"batch-job-task-one",
+		},
+		{
+			&drivers.TaskConfig{
+				JobName: "a-very-long-job-name-that-goes-on-and-on-and-on-forever",
+				Name:    "and-a-long-task-name",
+			},
+			"a-very-long-job-name-that-goes-on-and-on-and-on-forever-and-a-l",
+		},
+	}
+
+	for _, c := range cases {
+		if got := defaultHostname(c.cfg); got != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, got)
+		}
+	}
+}
+
+func TestDefaultMachineID(t *testing.T) {
+	cfg := &drivers.TaskConfig{AllocID: "9b0e2a4c-3f6d-4a58-8d0a-0c6f3c3f1a2b", Name: "web"}
+
+	id := defaultMachineID(cfg)
+	if len(id) != 32 {
+		t.Errorf("machine id %q should have 32 characters", id)
+	}
+	if id != defaultMachineID(cfg.Copy()) {
+		t.Error("machine id should be stable for the same task")
+	}
+
+	other := cfg.Copy()
+	other.Name = "db"
+	if id == defaultMachineID(other) {
+		t.Error("machine id should differ between tasks")
+	}
+}
+
+func TestParseSystemdVersion(t *testing.T) {
+	cases := map[string]int{
+		"245.4-4ubuntu3": 245,
+		`"252"`:          252,
+		"239":            239,
+		"254.5-1.fc39":   254,
+	}
+	for s, expected := range cases {
+		v, err := parseSystemdVersion(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%q: expected %d, got %d", s, expected, v)
+		}
+	}
+	if _, err := parseSystemdVersion("unknown"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestMachineName(t *testing.T) {
+	allocID := "9b0e2a4c-3f6d-4a58-8d0a-0c6f3c3f1a2b"
+
+	for name, expected := range map[string]string{
+		"web":      "nomad-web-" + allocID,
+		"web/http": "nomad-web_http-" + allocID,
+		"task.one": "nomad-task_one-" + allocID,
+	} {
+		if got := machineName(&drivers.TaskConfig{Name: name, AllocID: allocID}); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+
+	a := machineName(&drivers.TaskConfig{Name: "a-very-long-task-name-for-the-frontend", AllocID: allocID})
+	b := machineName(&drivers.TaskConfig{Name: "a-very-long-task-name-for-the-backend", AllocID: allocID})
+	if a == b {
+		t.Errorf("long task names collide: %q", a)
+	}
+	for _, name := range []string{a, b} {
+		if len(name) > maxMachineNameLength {
+			t.Errorf("machine name %q is too long", name)
+		}
+	}
+}
+
+// TestTaskGroup checks that tasks of the same group get distinct machines
+// and share the alloc dir.
+func TestDebugCommands(t *testing.T) {
+	expected := map[string]string{
+		"status_command": "machinectl status nomad-web-1234",
+		"shell_command":  "machinectl shell nomad-web-1234",
+		"login_command":  "machinectl login nomad-web-1234",
+	}
+	if c := debugCommands("nomad-web-1234", false); !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %v, got %v", expected, c)
+	}
+
+	expected = map[string]string{"status_command": "systemctl status systemd-nspawn@nomad-web-1234.service"}
+	if c := debugCommands("nomad-web-1234", true); !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %v, got %v", expected, c)
+	}
+}
+
+func TestTaskGroup(t *testing.T) {
+	allocDir := "/var/lib/nomad/alloc/9b0e2a4c-3f6d-4a58-8d0a-0c6f3c3f1a2b"
+	var cfgs []*drivers.TaskConfig
+	for _, name := range []string{"web", "sidecar", "log-shipper"} {
+		cfgs = append(cfgs, &drivers.TaskConfig{
+			ID:            "9b0e2a4c-3f6d-4a58-8d0a-0c6f3c3f1a2b/" + name,
+			JobName:       "app",
+			TaskGroupName: "app",
+			Name:          name,
+			AllocID:       "9b0e2a4c-3f6d-4a58-8d0a-0c6f3c3f1a2b",
+			AllocDir:      allocDir,
+			Env:           map[string]string{"NOMAD_ALLOC_INDEX": "0"},
+		})
+	}
+
+	seen := map[string]string{}
+	unique := func(kind, v string) {
+		if other, ok := seen[kind+v]; ok {
+			t.Errorf("%s %q is used by %s too", kind, v, other)
+		}
+		seen[kind+v] = kind
+	}
+
+	for _, cfg := range cfgs {
+		name := machineName(cfg)
+		unique("machine name", name)
+		unique("nspawn file", nspawnPath(runNSpawnDir, name))
+		unique("unit", unitName(name))
+		unique("drop-in", unitDropInDir(name))
+		unique("hostname", defaultHostname(cfg))
+		unique("machine id", defaultMachineID(cfg))
+		unique("credentials", credentialsPath(name))
+		unique("link prefix", pinnedLinkPrefix(name))
+		unique("mac", pinnedMAC(cfg, "eth0").String())
+
+		taskConfig := TaskConfig{MountTaskDirs: true}
+		setupTaskDirs(cfg, &taskConfig)
+		if src := taskConfig.Bind[0].Source; src != filepath.Join(allocDir, "alloc") {
+			t.Errorf("%s: expected shared alloc dir to be bound, got %s", cfg.Name, src)
+		}
+		unique("local dir", taskConfig.Bind[1].Source)
+	}
+}
+
+func TestMigrateNSpawnFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nspawn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldEtc, oldRun := etcNSpawnDir, runNSpawnDir
+	defer func() { etcNSpawnDir, runNSpawnDir = oldEtc, oldRun }()
+	etcNSpawnDir, runNSpawnDir = filepath.Join(dir, "etc"), filepath.Join(dir, "run")
+
+	if err := os.MkdirAll(etcNSpawnDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := nspawnFileMarker + "\n[Exec]\nBoot=on\n"
+	for name, c := range map[string]string{
+		"nomad-web-1234": content,
+		"nomad-own-1234": "[Exec]\nBoot=on\n",
+	} {
+		if err := ioutil.WriteFile(nspawnPath(etcNSpawnDir, name), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewSystemdNSpawnDriver(log.NewNullLogger()).(*Driver)
+	d.config.RuntimeNSpawnFiles = true
+	for _, name := range []string{"nomad-web-1234", "nomad-own-1234", "nomad-new-1234"} {
+		if err := d.migrateNSpawnFile(name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(nspawnPath(etcNSpawnDir, "nomad-web-1234")); !os.IsNotExist(err) {
+		t.Error("expected generated nspawn file to be moved out of /etc")
+	}
+	b, err := ioutil.ReadFile(nspawnPath(runNSpawnDir, "nomad-web-1234"))
+	if err != nil || string(b) != content {
+		t.Errorf("unexpected migrated nspawn file %q: %v", b, err)
+	}
+	if _, err := os.Stat(nspawnPath(etcNSpawnDir, "nomad-own-1234")); err != nil {
+		t.Error("expected nspawn file not generated by the driver to be kept")
+	}
+}
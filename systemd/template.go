@@ -1,19 +1,31 @@
 package systemd
 
 import (
+	"fmt"
 	"strings"
 	"text/template"
 )
 
 var funcMaps = template.FuncMap{
-	"join": strings.Join,
+	"join":            strings.Join,
+	"quoteParameters": quoteParameters,
+	"allowedSyscalls": allowedSyscalls,
+	"deniedSyscalls":  deniedSyscalls,
+	"escapeSpecifiers": func(s string) string {
+		return strings.Replace(s, "%", "%%", -1)
+	},
 }
 
-const nspawnTemplate = `[Exec]
+// nspawnFileMarker is the first line of all nspawn files generated by this
+// driver, which is used to find out dangling nspawn files.
+const nspawnFileMarker = "# Generated by nomad-driver-systemd-nspawn, DO NOT EDIT."
+
+const nspawnTemplate = nspawnFileMarker + `
+[Exec]
 Boot={{if .Boot}}on{{else}}off{{end}}
 Ephemeral={{if .Ephemeral}}on{{else}}off{{end}}
 ProcessTwo={{if .ProcessTwo}}on{{else}}off{{end}}
-Parameters={{join .Parameters ","}}
+Parameters={{quoteParameters .Parameters}}
 {{- range $k, $v := .Environment }}
 Environment={{$k}}={{$v}}
 {{- end }}
@@ -28,7 +40,12 @@ Personality={{ .Personality }}
 MachineID={{ .MachineID }}
 PrivateUsers={{ .PrivateUsers }}
 NotifyReady={{if .NotifyReady}}on{{else}}off{{end}}
-SystemCallFilter={{join .SystemCallFilter " "}}
+{{- with allowedSyscalls .SystemCallFilter }}
+SystemCallFilter={{join . " "}}
+{{- end }}
+{{- with deniedSyscalls .SystemCallFilter }}
+SystemCallFilter=~{{join . " "}}
+{{- end }}
 LimitCPU={{ .LimitCPU }}
 LimitFSIZE={{ .LimitFSIZE }}
 LimitDATA={{ .LimitDATA }}
@@ -51,15 +68,15 @@ Hostname={{ .Hostname }}
 ResolvConf={{ .ResolvConf }}
 Timezone={{ .Timezone }}
 LinkJournal={{ .LinkJournal }}
+{{- if .SuppressSync }}
+SuppressSync=on
+{{- end }}
 
 [Files]
 ReadOnly={{if .ReadOnly}}on{{else}}off{{end}}
 Volatile={{ .Volatile}}
 {{- range $_, $v := .Bind }}
-Bind={{$v}}
-{{- end }}
-{{- range $_, $v := .BindReadOnly }}
-BindReadOnly={{$v}}
+{{if $v.ReadOnly}}BindReadOnly{{else}}Bind{{end}}={{$v}}
 {{- end }}
 {{- range $_, $v := .TemporaryFileSystem }}
 TemporaryFileSystem={{$v}}
@@ -74,6 +91,12 @@ Overlay={{join $v ":"}}
 OverlayReadOnly={{join $v ":"}}
 {{- end }}
 PrivateUsersChown={{if .PrivateUsersChown}}on{{else}}off{{end}}
+{{- with .PrivateUsersOwnership }}
+PrivateUsersOwnership={{ . }}
+{{- end }}
+{{- range $_, $v := .BindUser }}
+BindUser={{$v}}
+{{- end }}
 
 [Network]
 Private={{if .Private}}on{{else}}off{{end}}
@@ -81,14 +104,107 @@ VirtualEthernet={{if .VirtualEthernet}}on{{else}}off{{end}}
 {{- range $_, $v := .VirtualEthernetExtra }}
 VirtualEthernetExtra={{$v}}
 {{- end }}
-Interface={{join .Parameters " "}}
+Interface={{join .Interface " "}}
 MACVLAN={{join .MACVLAN " "}}
 IPVLAN={{join .IPVLAN " "}}
 Bridge={{.Bridge}}
 Zone={{.Zone}}
-{{- range $_, $v := .Port }}
+{{- range $_, $v := .PortSettings }}
 Port={{$v}}
 {{- end }}
 `
 
 var tmpl = template.Must(template.New("nspawn").Funcs(funcMaps).Parse(nspawnTemplate))
+
+// dropInTemplate is the drop-in of machine's unit, which controls options
+// that are not supported by nspawn file.
+//
+// All other options are set by nspawn file, so we use --settings=override to
+// make sure nspawn file always wins.
+const dropInTemplate = nspawnFileMarker + `
+[Service]
+{{- if .Slice }}
+Slice={{ .Slice }}
+{{- end }}
+{{- if or .CgroupDelegate .Nesting }}
+Delegate=yes
+{{- end }}
+{{- if .Nesting }}
+DeviceAllow=/dev/fuse rwm
+{{- end }}
+{{- if .IPAccounting }}
+IPAccounting=yes
+{{- end }}
+{{- if .IPAddressAllow }}
+IPAddressAllow={{ join .IPAddressAllow " " }}
+{{- end }}
+{{- if .IPAddressDeny }}
+IPAddressDeny={{ join .IPAddressDeny " " }}
+{{- end }}
+{{- if .NUMANode }}
+NUMAPolicy=bind
+NUMAMask={{ .NUMANode }}
+CPUAffinity=numa
+{{- end }}
+{{- with .Memory.SwapMax }}
+MemorySwapMax={{ . }}
+{{- end }}
+{{- with .Memory.ZSwapMax }}
+MemoryZSwapMax={{ . }}
+{{- end }}
+{{- range $l := .IOLimit }}
+{{- with $l.ReadBPS }}
+IOReadBandwidthMax={{ escapeSpecifiers $l.Device }} {{ . }}
+{{- end }}
+{{- with $l.WriteBPS }}
+IOWriteBandwidthMax={{ escapeSpecifiers $l.Device }} {{ . }}
+{{- end }}
+{{- with $l.ReadIOPS }}
+IOReadIOPSMax={{ escapeSpecifiers $l.Device }} {{ . }}
+{{- end }}
+{{- with $l.WriteIOPS }}
+IOWriteIOPSMax={{ escapeSpecifiers $l.Device }} {{ . }}
+{{- end }}
+{{- end }}
+ExecStart=
+ExecStart=/usr/bin/systemd-nspawn --quiet --settings=override --machine=%i --register={{if .Register}}yes{{else}}no{{end}}{{if .KeepUnit}} --keep-unit{{end}}
+{{- with .DiskImage }} --image={{ escapeSpecifiers . }}{{ end }}
+{{- with .RootDirectory }} --directory={{ escapeSpecifiers . }}{{ end }}
+{{- with .RootHash }} --root-hash={{ . }}{{ end }}
+{{- with .Verity }} --verity-data={{ escapeSpecifiers . }}{{ end }}
+{{- with .RootHashSignature }} --root-hash-sig={{ escapeSpecifiers . }}{{ end }}
+{{- range .ExtensionImages }} --extension-image={{ escapeSpecifiers . }}{{ end }}
+{{- range .Credential }} --load-credential={{ .Name }}:{{ escapeSpecifiers .File }}{{ end }}
+`
+
+var dropInTmpl = template.Must(template.New("drop-in").Funcs(funcMaps).Parse(dropInTemplate))
+
+// quoteParameters joins the parameters for Parameters=, which nspawn splits
+// at whitespace. Parameters with whitespace or quotes, or empty ones, are
+// quoted with the quotes they don't contain. Backslashes are not escapes in
+// Parameters=, so they are kept as they are.
+func quoteParameters(params []string) string {
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		switch {
+		case p != "" && !strings.ContainsAny(p, ` "'`):
+			quoted[i] = p
+		case !strings.Contains(p, "'"):
+			quoted[i] = "'" + p + "'"
+		default:
+			quoted[i] = `"` + p + `"`
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// validateParameters checks that the parameters can be quoted for
+// Parameters=, which has no way to escape quotes.
+func validateParameters(params []string) error {
+	for _, p := range params {
+		if strings.Contains(p, "'") && strings.Contains(p, `"`) {
+			return fmt.Errorf("invalid parameter %q: contains both single and double quotes", p)
+		}
+	}
+	return nil
+}
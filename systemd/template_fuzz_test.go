@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package systemd
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzTemplate asserts that every task config which passes validation
+// renders into valid INI without injected sections or settings.
+func FuzzTemplate(f *testing.F) {
+	f.Add("web-0", "/srv", "LANG", "C.UTF-8", "quiet", "/srv/data")
+	f.Add("web\n[Files]", "/srv\\", "A\nB", "x", "a\rb", "/srv:/data")
+
+	f.Fuzz(func(t *testing.T, hostname, workdir, envKey, envValue, param, bindSource string) {
+		c := TaskConfig{
+			Image:            "https://example.com/image.raw.xz",
+			Hostname:         hostname,
+			WorkingDirectory: workdir,
+			Environment:      map[string]string{envKey: envValue},
+			Parameters:       []string{param},
+			Bind:             []BindMount{{Source: bindSource}},
+			Register:         true,
+			KeepUnit:         true,
+		}
+		if err := c.validate(); err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+		checkINI(t, buf.String())
+
+		buf.Reset()
+		if err := dropInTmpl.Execute(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+		checkINI(t, buf.String())
+	})
+}
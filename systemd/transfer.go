@@ -0,0 +1,187 @@
+package systemd
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/import1"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// transferPollInterval is the interval between polls of importd
+	// transfers.
+	transferPollInterval = time.Second
+
+	// contentLengthTimeout is the timeout of requesting the size of images.
+	contentLengthTimeout = 10 * time.Second
+)
+
+// transfer is an image pull started by the driver.
+type transfer struct {
+	// size is the size of the downloaded file, -1 if unknown.
+	size      int64
+	startedAt time.Time
+	// progress is the progress reported by importd between 0 and 1.
+	progress float64
+}
+
+// transferStore tracks the image pulls started by the driver, and limits
+// the number of concurrent pulls.
+type transferStore struct {
+	transfers map[uint32]*transfer
+	// slots holds a token for every pull in progress, nil if unlimited.
+	slots  chan struct{}
+	queued int
+	lock   sync.Mutex
+}
+
+func newTransferStore() *transferStore {
+	return &transferStore{transfers: map[uint32]*transfer{}}
+}
+
+// SetLimit limits the number of concurrent pulls, 0 means unlimited.
+//
+// It must be called before any pull is started.
+func (s *transferStore) SetLimit(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n > 0 {
+		s.slots = make(chan struct{}, n)
+	} else {
+		s.slots = nil
+	}
+}
+
+// Acquire waits until another pull could be started, or ctx is done.
+func (s *transferStore) Acquire(ctx context.Context) error {
+	s.lock.Lock()
+	slots := s.slots
+	s.queued++
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.queued--
+		s.lock.Unlock()
+	}()
+
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot of a finished pull.
+func (s *transferStore) Release() {
+	s.lock.Lock()
+	slots := s.slots
+	s.lock.Unlock()
+
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Queued returns the number of pulls waiting for a slot.
+func (s *transferStore) Queued() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queued
+}
+
+// Add tracks the transfer of the given id.
+func (s *transferStore) Add(id uint32, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.transfers[id] = &transfer{size: size, startedAt: time.Now()}
+}
+
+// Update sets the progress of the transfer of the given id.
+func (s *transferStore) Update(id uint32, progress float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.transfers[id]; ok {
+		t.progress = progress
+	}
+}
+
+// Delete stops tracking the transfer of the given id.
+func (s *transferStore) Delete(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.transfers, id)
+}
+
+// Rate returns the aggregate download rate in bytes per second, estimated
+// from the progress of transfers whose size is known.
+func (s *transferStore) Rate(now time.Time) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var rate float64
+	for _, t := range s.transfers {
+		elapsed := now.Sub(t.startedAt).Seconds()
+		if t.size < 0 || elapsed <= 0 {
+			continue
+		}
+		rate += t.progress * float64(t.size) / elapsed
+	}
+	return rate
+}
+
+// contentLength returns the size of the image at the URL, or -1 if unknown.
+func contentLength(rawurl string) int64 {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return -1
+	}
+	if u.Scheme == "file" {
+		fi, err := os.Stat(u.Path)
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+
+	client := &http.Client{Timeout: contentLengthTimeout}
+	resp, err := client.Head(rawurl)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// transferAttributes returns node attributes of the image pulls in
+// progress, so operators can see why tasks are slow to start.
+func (d *Driver) transferAttributes() map[string]*pstructs.Attribute {
+	var ts []import1.TransferStatus
+	err := callDBus(d.ctx, "ListTransfers", func(c *systemdConn) (err error) {
+		ts, err = c.importd.ListTransfers()
+		return
+	})
+	if err != nil {
+		d.logger.Warn("failed to list transfers", "error", err)
+		return nil
+	}
+
+	rate := d.transfers.Rate(time.Now())
+	return map[string]*pstructs.Attribute{
+		"driver.systemd-nspawn.transfers":     pstructs.NewIntAttribute(int64(len(ts)), ""),
+		"driver.systemd-nspawn.transfer_rate": pstructs.NewIntAttribute(int64(rate/1024), pstructs.UnitKiBPerS),
+		"driver.systemd-nspawn.queued_pulls":  pstructs.NewIntAttribute(int64(d.transfers.Queued()), ""),
+	}
+}
@@ -0,0 +1,100 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransferStoreRate(t *testing.T) {
+	ts := newTransferStore()
+	ts.Add(1, 10<<20)
+	ts.Add(2, -1)
+	ts.Update(1, 0.5)
+	ts.Update(2, 0.9)
+
+	now := time.Now()
+	ts.transfers[1].startedAt = now.Add(-5 * time.Second)
+	ts.transfers[2].startedAt = now.Add(-5 * time.Second)
+
+	if rate := ts.Rate(now); math.Abs(rate-1<<20) > 1 {
+		t.Errorf("expected 1MiB/s, got %f", rate)
+	}
+
+	ts.Delete(1)
+	if rate := ts.Rate(now); rate != 0 {
+		t.Errorf("expected no rate, got %f", rate)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/web.raw" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "1234")
+	}))
+	defer srv.Close()
+
+	if n := contentLength(srv.URL + "/web.raw"); n != 1234 {
+		t.Errorf("expected 1234, got %d", n)
+	}
+	if n := contentLength(srv.URL + "/missing.raw"); n != -1 {
+		t.Errorf("expected -1, got %d", n)
+	}
+
+	f, err := ioutil.TempFile("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, 42))
+	f.Close()
+
+	if n := contentLength("file://" + f.Name()); n != 42 {
+		t.Errorf("expected 42, got %d", n)
+	}
+}
+
+func TestTransferStoreLimit(t *testing.T) {
+	ts := newTransferStore()
+	ts.SetLimit(1)
+
+	if err := ts.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- ts.Acquire(context.Background())
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected the second pull to be queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := ts.Queued(); n != 1 {
+		t.Errorf("expected 1 queued pull, got %d", n)
+	}
+
+	ts.Release()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.Queued(); n != 0 {
+		t.Errorf("expected no queued pulls, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ts.Acquire(ctx); err == nil {
+		t.Error("expected error for canceled context")
+	}
+}
@@ -0,0 +1,261 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/dbus"
+	godbus "github.com/godbus/dbus"
+)
+
+// nspawnBinary is the path of systemd-nspawn.
+const nspawnBinary = "/usr/bin/systemd-nspawn"
+
+// transientUnitName returns the name of the transient unit which runs the
+// machine.
+func transientUnitName(machineName string) string {
+	return machineName + ".service"
+}
+
+// machineUnitName returns the name of the unit which runs the machine.
+func (c *TaskConfig) machineUnitName(machineName string) string {
+	if c.TransientUnit {
+		return transientUnitName(machineName)
+	}
+	return unitName(machineName)
+}
+
+// extraArgsAllowlist contains the nspawn flags accepted in extra_args. They
+// must not interfere with how the driver runs and tracks the machine, so e.g.
+// --machine, --register or networking flags are not allowed.
+var extraArgsAllowlist = map[string]bool{
+	"--suppress-sync":           true,
+	"--private-users-ownership": true,
+	"--console":                 true,
+	"--background":              true,
+}
+
+func (c *TaskConfig) validateExtraArgs() error {
+	if len(c.ExtraArgs) > 0 && !c.TransientUnit {
+		return fmt.Errorf("extra_args requires transient_unit to be enabled")
+	}
+	for _, arg := range c.ExtraArgs {
+		// Values must be passed as --flag=value, so every arg is a flag.
+		name := strings.SplitN(arg, "=", 2)[0]
+		if !extraArgsAllowlist[name] {
+			return fmt.Errorf("extra_args: flag %q is not allowed", arg)
+		}
+	}
+	return nil
+}
+
+// nspawnSwitches maps settings of nspawn files to command line switches.
+var nspawnSwitches = map[string]string{
+	"User":                  "--user",
+	"WorkingDirectory":      "--chdir",
+	"PivotRoot":             "--pivot-root",
+	"Environment":           "--setenv",
+	"KillSignal":            "--kill-signal",
+	"Personality":           "--personality",
+	"MachineID":             "--uuid",
+	"PrivateUsers":          "--private-users",
+	"SystemCallFilter":      "--system-call-filter",
+	"OOMScoreAdjust":        "--oom-score-adjust",
+	"CPUAffinity":           "--cpu-affinity",
+	"Hostname":              "--hostname",
+	"ResolvConf":            "--resolv-conf",
+	"Timezone":              "--timezone",
+	"LinkJournal":           "--link-journal",
+	"PrivateUsersOwnership": "--private-users-ownership",
+	"Volatile":              "--volatile",
+	"Bind":                  "--bind",
+	"BindReadOnly":          "--bind-ro",
+	"TemporaryFileSystem":   "--tmpfs",
+	"Inaccessible":          "--inaccessible",
+	"Overlay":               "--overlay",
+	"OverlayReadOnly":       "--overlay-ro",
+	"BindUser":              "--bind-user",
+	"VirtualEthernetExtra":  "--network-veth-extra",
+	"Bridge":                "--network-bridge",
+	"Zone":                  "--network-zone",
+	"Port":                  "--port",
+}
+
+// nspawnFlags maps boolean settings of nspawn files to command line switches
+// which are passed if the setting is on.
+var nspawnFlags = map[string]string{
+	"Boot":              "--boot",
+	"Ephemeral":         "--ephemeral",
+	"ProcessTwo":        "--as-pid2",
+	"NoNewPrivileges":   "--no-new-privileges=yes",
+	"NotifyReady":       "--notify-ready=yes",
+	"ReadOnly":          "--read-only",
+	"PrivateUsersChown": "--private-users-chown",
+	"SuppressSync":      "--suppress-sync=yes",
+	"Private":           "--private-network",
+	"VirtualEthernet":   "--network-veth",
+}
+
+// nspawnLists maps settings of nspawn files taking space separated lists to
+// command line switches, which take a comma separated list if join is set,
+// or are repeated for every item otherwise.
+var nspawnLists = map[string]struct {
+	name string
+	join bool
+}{
+	"Capability":     {"--capability", true},
+	"DropCapability": {"--drop-capability", true},
+	"Interface":      {"--network-interface", false},
+	"MACVLAN":        {"--network-macvlan", false},
+	"IPVLAN":         {"--network-ipvlan", false},
+}
+
+// nspawnArgs converts the rendered nspawn file into command line switches.
+//
+// Parameters are not converted, since they are split by spaces in nspawn
+// files.
+func nspawnArgs(settings string) ([]string, error) {
+	var args []string
+	s := bufio.NewScanner(strings.NewReader(settings))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid setting %q", line)
+		}
+		key, value := line[:i], line[i+1:]
+		if value == "" || key == "Parameters" {
+			continue
+		}
+
+		if name, ok := nspawnSwitches[key]; ok {
+			args = append(args, name+"="+value)
+			continue
+		}
+		if name, ok := nspawnFlags[key]; ok {
+			if value == "on" {
+				args = append(args, name)
+			}
+			continue
+		}
+		if l, ok := nspawnLists[key]; ok {
+			if l.join {
+				args = append(args, l.name+"="+strings.Join(strings.Fields(value), ","))
+				continue
+			}
+			for _, v := range strings.Fields(value) {
+				args = append(args, l.name+"="+v)
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "Limit") {
+			args = append(args, "--rlimit=RLIMIT_"+strings.TrimPrefix(key, "Limit")+"="+value)
+			continue
+		}
+		return nil, fmt.Errorf("setting %s has no command line switch", key)
+	}
+	return args, s.Err()
+}
+
+// transientArgs returns the command line of nspawn running the machine in a
+// transient unit, which includes all options of the nspawn file and the
+// drop-in. Settings files are ignored.
+func transientArgs(machineName string, taskConfig TaskConfig) ([]string, error) {
+	if taskConfig.Class == classVM {
+		return vmArgs(machineName, taskConfig), nil
+	}
+
+	content, err := renderNspawnFile(taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := nspawnArgs(content)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{nspawnBinary, "--quiet", "--settings=no", "--machine=" + machineName}
+	if taskConfig.Register {
+		args = append(args, "--register=yes")
+	} else {
+		args = append(args, "--register=no")
+	}
+	if taskConfig.KeepUnit {
+		args = append(args, "--keep-unit")
+	}
+	for _, v := range [][2]string{
+		{"--image", taskConfig.DiskImage},
+		{"--directory", taskConfig.rootDirectory},
+		{"--root-hash", taskConfig.RootHash},
+		{"--verity-data", taskConfig.Verity},
+		{"--root-hash-sig", taskConfig.RootHashSignature},
+	} {
+		if v[1] != "" {
+			args = append(args, v[0]+"="+v[1])
+		}
+	}
+	for _, v := range taskConfig.ExtensionImages {
+		args = append(args, "--extension-image="+v)
+	}
+	for _, c := range taskConfig.Credential {
+		args = append(args, "--load-credential="+c.Name+":"+c.File)
+	}
+	args = append(args, settings...)
+	args = append(args, taskConfig.ExtraArgs...)
+
+	if len(taskConfig.Parameters) > 0 {
+		args = append(args, "--")
+		args = append(args, taskConfig.Parameters...)
+	}
+	return args, nil
+}
+
+// transientProperties returns the properties of the transient unit, which
+// follow systemd-nspawn@.service.
+func transientProperties(machineName string, taskConfig TaskConfig) ([]dbus.Property, error) {
+	args, err := transientArgs(machineName, taskConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	slice := taskConfig.Slice
+	if slice == "" {
+		slice = "machine.slice"
+	}
+	description := "Container " + machineName
+	if taskConfig.Class == classVM {
+		description = "Virtual Machine " + machineName
+	}
+	props := []dbus.Property{
+		dbus.PropDescription(description),
+		dbus.PropExecStart(args, true),
+		dbus.PropType("notify"),
+		dbus.PropSlice(slice),
+		{Name: "KillMode", Value: godbus.MakeVariant("mixed")},
+		{Name: "Delegate", Value: godbus.MakeVariant(true)},
+	}
+	ipProps, err := ipAccessProperties(taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	numaProps, err := numaProperties(taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	memoryProps, err := memoryProperties(taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	ioProps, err := ioLimitProperties(taskConfig)
+	if err != nil {
+		return nil, err
+	}
+	props = append(props, ipProps...)
+	props = append(props, numaProps...)
+	props = append(props, memoryProps...)
+	return append(props, ioProps...), nil
+}
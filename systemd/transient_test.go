@@ -0,0 +1,115 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNSpawnArgs(t *testing.T) {
+	args, err := nspawnArgs(nspawnFileMarker + `
+[Exec]
+Boot=on
+Ephemeral=off
+Parameters=--log-level=debug
+User=
+Capability=CAP_NET_ADMIN CAP_SYS_TIME
+LimitNOFILE=1024
+
+[Files]
+BindReadOnly=/srv:/srv:norbind
+
+[Network]
+MACVLAN=eth0 eth1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"--boot",
+		"--capability=CAP_NET_ADMIN,CAP_SYS_TIME",
+		"--rlimit=RLIMIT_NOFILE=1024",
+		"--bind-ro=/srv:/srv:norbind",
+		"--network-macvlan=eth0",
+		"--network-macvlan=eth1",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	if _, err := nspawnArgs("[Exec]\nUnknownSetting=yes\n"); err == nil {
+		t.Error("expected error for unknown setting")
+	}
+}
+
+func TestTransientArgsGolden(t *testing.T) {
+	c := fullTaskConfig()
+	c.Parameters = []string{"--log-level", "debug info"}
+	c.ExtraArgs = []string{"--console=passive"}
+
+	args, err := transientArgs("nomad-web-1234", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] != nspawnBinary {
+		t.Errorf("unexpected binary %s", args[0])
+	}
+	if tail := args[len(args)-3:]; !reflect.DeepEqual(tail, []string{"--", "--log-level", "debug info"}) {
+		t.Errorf("parameters must be passed after all options, got %v", tail)
+	}
+
+	got := strings.Join(args, "\n") + "\n"
+	path := filepath.Join("testdata", "full.args")
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(expected) {
+		t.Errorf("generated command line differs from golden file, run go test -update to update it\ngot:\n%s", got)
+	}
+}
+
+func TestValidateExtraArgs(t *testing.T) {
+	c := TaskConfig{TransientUnit: true, ExtraArgs: []string{"--suppress-sync=yes", "--console=passive"}}
+	if err := c.validateExtraArgs(); err != nil {
+		t.Error(err)
+	}
+
+	for _, args := range [][]string{
+		{"--machine=other"},
+		{"--register=no"},
+		{"--console", "passive"},
+		{"-q"},
+	} {
+		c := TaskConfig{TransientUnit: true, ExtraArgs: args}
+		if err := c.validateExtraArgs(); err == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+
+	c = TaskConfig{ExtraArgs: []string{"--suppress-sync=yes"}}
+	if err := c.validateExtraArgs(); err == nil {
+		t.Error("expected error without transient_unit")
+	}
+}
+
+func TestMachineUnitName(t *testing.T) {
+	c := TaskConfig{}
+	if unit := c.machineUnitName("nomad-web-1234"); unit != "systemd-nspawn@nomad-web-1234.service" {
+		t.Errorf("unexpected unit %s", unit)
+	}
+	c.TransientUnit = true
+	if unit := c.machineUnitName("nomad-web-1234"); unit != "nomad-web-1234.service" {
+		t.Errorf("unexpected unit %s", unit)
+	}
+}
@@ -0,0 +1,56 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// unitDropInDir is the directory which contains drop-ins of machine's unit.
+//
+// Drop-ins are placed under /run so they will be cleaned up on reboot.
+func unitDropInDir(machineName string) string {
+	return filepath.Join("/run/systemd/system", unitName(machineName)+".d")
+}
+
+// needsDropIn returns whether the task uses options which are only supported
+// on nspawn's command line.
+func (c *TaskConfig) needsDropIn() bool {
+	return c.Slice != "" || !c.Register || !c.KeepUnit || c.DiskImage != "" || c.rootDirectory != "" ||
+		len(c.ExtensionImages) > 0 || len(c.Credential) > 0 || c.CgroupDelegate || c.IPAccounting ||
+		len(c.IPAddressAllow) > 0 || len(c.IPAddressDeny) > 0 || c.NUMANode != "" || c.Memory.SwapMax != "" ||
+		c.Memory.ZSwapMax != "" || len(c.IOLimit) > 0 || c.Nesting
+}
+
+// writeUnitDropIn writes the drop-in of machine's unit, and reloads systemd
+// to make it take effect.
+func (d *Driver) writeUnitDropIn(machineName string, taskConfig TaskConfig) error {
+	dir := unitDropInDir(machineName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "nomad.conf"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := dropInTmpl.Execute(f, taskConfig); err != nil {
+		return err
+	}
+
+	return d.reloader.Reload()
+}
+
+// removeUnitDropIn removes the drop-in of machine's unit if exists.
+func (d *Driver) removeUnitDropIn(machineName string) error {
+	dir := unitDropInDir(machineName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return d.reloader.Reload()
+}
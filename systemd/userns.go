@@ -0,0 +1,57 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procDir is where the kernel exposes processes.
+var procDir = "/proc"
+
+// fullUIDRange is the range of the initial user namespace, which maps all
+// UIDs to themselves.
+const fullUIDRange = 4294967295
+
+// parseUIDMap parses the uid_map of a process, and returns the host UID
+// which UID 0 of the namespace maps to and the size of the range. Both are 0
+// if the process runs in the initial user namespace.
+func parseUIDMap(r io.Reader) (shift, size uint32, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			return 0, 0, fmt.Errorf("invalid uid_map line %q", s.Text())
+		}
+		if fields[0] != "0" {
+			continue
+		}
+		shift64, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uid_map line %q", s.Text())
+		}
+		size64, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uid_map line %q", s.Text())
+		}
+		if shift64 == 0 && size64 == fullUIDRange {
+			return 0, 0, nil
+		}
+		return uint32(shift64), uint32(size64), nil
+	}
+	return 0, 0, s.Err()
+}
+
+// readUIDShift returns the user namespace mapping of the process.
+func readUIDShift(pid int) (shift, size uint32, err error) {
+	f, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "uid_map"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return parseUIDMap(f)
+}
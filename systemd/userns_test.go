@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseUIDMap(t *testing.T) {
+	cases := []struct {
+		uidMap      string
+		shift, size uint32
+	}{
+		{"         0          0 4294967295\n", 0, 0},
+		{"         0 1878392832      65536\n", 1878392832, 65536},
+		{"      1000       1000          1\n         0     100000       1000\n", 100000, 1000},
+		{"", 0, 0},
+	}
+	for _, c := range cases {
+		shift, size, err := parseUIDMap(strings.NewReader(c.uidMap))
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.uidMap, err)
+			continue
+		}
+		if shift != c.shift || size != c.size {
+			t.Errorf("%q: expected %d/%d, got %d/%d", c.uidMap, c.shift, c.size, shift, size)
+		}
+	}
+
+	if _, _, err := parseUIDMap(strings.NewReader("0 abc 65536\n")); err == nil {
+		t.Error("expected error for invalid uid_map")
+	}
+}
+
+func TestReadUIDShift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { procDir = d }(procDir)
+	procDir = dir
+
+	if err := os.MkdirAll(filepath.Join(dir, "42"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "42", "uid_map"), []byte("0 655360 65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shift, size, err := readUIDShift(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shift != 655360 || size != 65536 {
+		t.Errorf("unexpected mapping %d/%d", shift, size)
+	}
+	if _, _, err := readUIDShift(43); err == nil {
+		t.Error("expected error for missing process")
+	}
+}
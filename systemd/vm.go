@@ -0,0 +1,219 @@
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// vmspawnBinary is the path of systemd-vmspawn.
+const vmspawnBinary = "/usr/bin/systemd-vmspawn"
+
+// Classes of machines run by the driver.
+const (
+	classContainer = "container"
+	classVM        = "vm"
+)
+
+// vmMemoryOverhead is the memory left to qemu within the unit's memory
+// limit if the RAM of a VM defaults to the task's memory.
+const vmMemoryOverhead = 64 << 20
+
+// VM configures the virtual machine of tasks with class "vm".
+type VM struct {
+	// CPUs is the number of CPUs of the VM, defaults to 1.
+	CPUs int `codec:"cpus"`
+	// RAM is the memory of the VM, e.g. "2G". Defaults to the task's memory
+	// less vmMemoryOverhead for qemu.
+	RAM string `codec:"ram"`
+	// Linux boots the kernel directly instead of the image's boot loader.
+	Linux string `codec:"linux"`
+	// Initrd is the initrd of Linux.
+	Initrd string `codec:"initrd"`
+}
+
+// vmUnsupportedOptions are the options which only apply to containers, by
+// their names in the task config.
+var vmUnsupportedOptions = []struct {
+	name string
+	used func(c *TaskConfig) bool
+}{
+	{"root_hash", func(c *TaskConfig) bool { return c.RootHash != "" || c.Verity != "" || c.RootHashSignature != "" }},
+	{"extension_images", func(c *TaskConfig) bool { return len(c.ExtensionImages) > 0 }},
+	{"ephemeral", func(c *TaskConfig) bool { return c.Ephemeral }},
+	{"process_two", func(c *TaskConfig) bool { return c.ProcessTwo }},
+	{"environment", func(c *TaskConfig) bool { return len(c.Environment) > 0 || len(c.EnvFile) > 0 }},
+	{"user", func(c *TaskConfig) bool { return c.User != "" || c.WorkingDirectory != "" || c.PivotRoot != "" }},
+	{"capability", func(c *TaskConfig) bool { return len(c.Capability) > 0 || len(c.DropCapability) > 0 }},
+	{"no_new_privileges", func(c *TaskConfig) bool { return c.NoNewPrivileges }},
+	{"kill_signal", func(c *TaskConfig) bool { return c.KillSignal != "" }},
+	{"personality", func(c *TaskConfig) bool { return c.Personality != "" }},
+	{"private_users", func(c *TaskConfig) bool {
+		return c.PrivateUsers != "" || c.PrivateUsersChown || c.PrivateUsersOwnership != ""
+	}},
+	{"notify_ready", func(c *TaskConfig) bool { return c.NotifyReady }},
+	{"system_call_filter", func(c *TaskConfig) bool { return len(c.SystemCallFilter) > 0 }},
+	{"limit_*", func(c *TaskConfig) bool {
+		for _, v := range []string{c.LimitCPU, c.LimitFSIZE, c.LimitDATA, c.LimitSTACK, c.LimitCORE, c.LimitRSS,
+			c.LimitNOFILE, c.LimitAS, c.LimitNPROC, c.LimitMEMLOCK, c.LimitLOCKS, c.LimitSIGPENDING,
+			c.LimitMSGQUEUE, c.LimitNICE, c.LimitRTPRIO, c.LimitRTTIME} {
+			if v != "" {
+				return true
+			}
+		}
+		return false
+	}},
+	{"oom_score_adjust", func(c *TaskConfig) bool { return c.OOMScoreAdjust != 0 }},
+	{"cpu_affinity", func(c *TaskConfig) bool { return len(c.CPUAffinity) > 0 }},
+	{"hostname", func(c *TaskConfig) bool { return c.Hostname != "" }},
+	{"resolv_conf", func(c *TaskConfig) bool { return c.ResolvConf != "" || c.DNS.enabled() }},
+	{"timezone", func(c *TaskConfig) bool { return c.Timezone != "" }},
+	{"link_journal", func(c *TaskConfig) bool { return c.LinkJournal != "" || c.ExportJournal }},
+	{"suppress_sync", func(c *TaskConfig) bool { return c.SuppressSync }},
+	{"read_only", func(c *TaskConfig) bool { return c.ReadOnly || c.Volatile != "" || c.EphemeralRoot }},
+	{"temporary_file_system", func(c *TaskConfig) bool { return len(c.TemporaryFileSystem) > 0 || len(c.Inaccessible) > 0 }},
+	{"overlay", func(c *TaskConfig) bool { return len(c.Overlay) > 0 || len(c.OverlayReadOnly) > 0 }},
+	{"bind_user", func(c *TaskConfig) bool { return len(c.BindUser) > 0 }},
+	{"interface", func(c *TaskConfig) bool {
+		return len(c.Interface) > 0 || len(c.MACVLAN) > 0 || len(c.IPVLAN) > 0 || len(c.NetworkInterface) > 0 ||
+			len(c.VirtualEthernetExtra) > 0
+	}},
+	{"bridge", func(c *TaskConfig) bool { return c.Bridge != "" || c.Zone != "" }},
+	{"port", func(c *TaskConfig) bool { return len(c.Port) > 0 }},
+	{"address", func(c *TaskConfig) bool { return len(c.Address) > 0 || c.HostNetwork.enabled() }},
+	{"firewall", func(c *TaskConfig) bool { return len(c.Firewall.Allow) > 0 }},
+	{"network_bandwidth", func(c *TaskConfig) bool { return c.NetworkBandwidth.enabled() }},
+	{"nesting", func(c *TaskConfig) bool { return c.Nesting }},
+	{"expose_rootfs", func(c *TaskConfig) bool { return c.ExposeRootfs }},
+	{"checkpoint", func(c *TaskConfig) bool { return c.Checkpoint }},
+	{"extra_args", func(c *TaskConfig) bool { return len(c.ExtraArgs) > 0 }},
+	{"respect_image_settings", func(c *TaskConfig) bool { return c.RespectImageSettings }},
+	{"stop_mode", func(c *TaskConfig) bool { return c.StopMode == stopModePoweroff }},
+}
+
+func (c *TaskConfig) validateClass() error {
+	switch c.Class {
+	case "", classContainer:
+		if c.VM != (VM{}) {
+			return fmt.Errorf("vm requires class vm")
+		}
+		return nil
+	case classVM:
+	default:
+		return fmt.Errorf("invalid class %q, must be container or vm", c.Class)
+	}
+
+	// There is no unit template for vmspawn.
+	if !c.TransientUnit {
+		return fmt.Errorf("class vm requires transient_unit to be enabled")
+	}
+	for _, o := range vmUnsupportedOptions {
+		if o.used(c) {
+			return fmt.Errorf("%s is not supported by class vm", o.name)
+		}
+	}
+	for _, b := range c.Bind {
+		if len(b.Options) > 0 {
+			return fmt.Errorf("bind options are not supported by class vm")
+		}
+	}
+	if c.VM.CPUs < 0 {
+		return fmt.Errorf("invalid vm cpus %d", c.VM.CPUs)
+	}
+	if c.VM.RAM != "" {
+		if n, err := parseBytes(c.VM.RAM); err != nil || n == 0 {
+			return fmt.Errorf("invalid vm ram %q", c.VM.RAM)
+		}
+	}
+	for _, p := range []string{c.VM.Linux, c.VM.Initrd} {
+		if p != "" && !filepath.IsAbs(p) {
+			return fmt.Errorf("vm kernel %q must be an absolute path", p)
+		}
+	}
+	if c.VM.Initrd != "" && c.VM.Linux == "" {
+		return fmt.Errorf("vm initrd requires linux")
+	}
+	return nil
+}
+
+// checkVMSpawn checks that vmspawn is installed if the task is a VM, which
+// is packaged separately by most distributions.
+func checkVMSpawn(taskConfig *TaskConfig) error {
+	if taskConfig.Class != classVM {
+		return nil
+	}
+	if _, err := os.Stat(vmspawnBinary); err != nil {
+		return fmt.Errorf("class vm requires systemd-vmspawn: %v", err)
+	}
+	return nil
+}
+
+// setupVM defaults the RAM of the VM to the task's memory, leaving room for
+// qemu within the unit's memory limit.
+func setupVM(cfg *drivers.TaskConfig, taskConfig *TaskConfig) error {
+	if taskConfig.Class != classVM || taskConfig.VM.RAM != "" {
+		return nil
+	}
+	if cfg.Resources == nil || cfg.Resources.LinuxResources == nil || cfg.Resources.LinuxResources.MemoryLimitBytes == 0 {
+		return nil
+	}
+	ram := cfg.Resources.LinuxResources.MemoryLimitBytes - vmMemoryOverhead
+	if ram <= 0 {
+		return fmt.Errorf("class vm requires more than %d MB of memory", vmMemoryOverhead>>20)
+	}
+	taskConfig.VM.RAM = strconv.FormatInt(ram>>20, 10) + "M"
+	return nil
+}
+
+// vmArgs returns the command line of vmspawn running the machine as a VM in
+// a transient unit.
+func vmArgs(machineName string, taskConfig TaskConfig) []string {
+	args := []string{vmspawnBinary, "--quiet", "--machine=" + machineName}
+	if taskConfig.Register {
+		args = append(args, "--register=yes")
+	} else {
+		args = append(args, "--register=no")
+	}
+	if taskConfig.KeepUnit {
+		args = append(args, "--keep-unit")
+	}
+	for _, v := range [][2]string{
+		{"--image", taskConfig.DiskImage},
+		{"--directory", taskConfig.rootDirectory},
+		{"--uuid", taskConfig.MachineID},
+		{"--ram", taskConfig.VM.RAM},
+		{"--linux", taskConfig.VM.Linux},
+		{"--initrd", taskConfig.VM.Initrd},
+	} {
+		if v[1] != "" {
+			args = append(args, v[0]+"="+v[1])
+		}
+	}
+	if taskConfig.VM.CPUs > 0 {
+		args = append(args, "--cpus="+strconv.Itoa(taskConfig.VM.CPUs))
+	}
+	// The VM is attached to a tap device, like the veth of containers.
+	if taskConfig.VirtualEthernet {
+		args = append(args, "--network-tap")
+	}
+	for _, b := range taskConfig.Bind {
+		if b.ReadOnly {
+			args = append(args, "--bind-ro="+b.String())
+		} else {
+			args = append(args, "--bind="+b.String())
+		}
+	}
+	for _, c := range taskConfig.Credential {
+		args = append(args, "--load-credential="+c.Name+":"+c.File)
+	}
+
+	// Parameters are appended to the kernel command line.
+	if len(taskConfig.Parameters) > 0 {
+		args = append(args, "--")
+		args = append(args, taskConfig.Parameters...)
+	}
+	return args
+}
@@ -0,0 +1,92 @@
+package systemd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestValidateClass(t *testing.T) {
+	for _, c := range []TaskConfig{
+		{},
+		{Class: "container", Hostname: "web"},
+		{Class: "vm", TransientUnit: true},
+		{Class: "vm", TransientUnit: true, Bind: []BindMount{{Source: "/srv", ReadOnly: true}},
+			VM: VM{CPUs: 2, RAM: "2G", Linux: "/boot/vmlinuz", Initrd: "/boot/initrd"}},
+	} {
+		if err := c.validateClass(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		}
+	}
+	for _, c := range []TaskConfig{
+		{Class: "qemu"},
+		{VM: VM{CPUs: 2}},
+		{Class: "vm"},
+		{Class: "vm", TransientUnit: true, Capability: []string{"CAP_NET_ADMIN"}},
+		{Class: "vm", TransientUnit: true, Port: []PortMapping{{Host: "http", Container: "80"}}},
+		{Class: "vm", TransientUnit: true, Bind: []BindMount{{Source: "/srv", Options: []string{"idmap"}}}},
+		{Class: "vm", TransientUnit: true, VM: VM{CPUs: -1}},
+		{Class: "vm", TransientUnit: true, VM: VM{RAM: "lots"}},
+		{Class: "vm", TransientUnit: true, VM: VM{Linux: "vmlinuz"}},
+		{Class: "vm", TransientUnit: true, VM: VM{Initrd: "/boot/initrd"}},
+	} {
+		if err := c.validateClass(); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+}
+
+func TestSetupVM(t *testing.T) {
+	cfg := &drivers.TaskConfig{Resources: &drivers.Resources{
+		LinuxResources: &drivers.LinuxResources{MemoryLimitBytes: 1 << 30},
+	}}
+
+	taskConfig := TaskConfig{Class: "vm"}
+	if err := setupVM(cfg, &taskConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if taskConfig.VM.RAM != "960M" {
+		t.Errorf("expected ram 960M, got %q", taskConfig.VM.RAM)
+	}
+
+	taskConfig = TaskConfig{Class: "vm", VM: VM{RAM: "512M"}}
+	if err := setupVM(cfg, &taskConfig); err != nil || taskConfig.VM.RAM != "512M" {
+		t.Errorf("expected ram to be kept, got %q, %v", taskConfig.VM.RAM, err)
+	}
+
+	cfg.Resources.LinuxResources.MemoryLimitBytes = 32 << 20
+	taskConfig = TaskConfig{Class: "vm"}
+	if err := setupVM(cfg, &taskConfig); err == nil {
+		t.Error("expected error for too little memory")
+	}
+}
+
+func TestVMArgs(t *testing.T) {
+	taskConfig := TaskConfig{
+		Class:           "vm",
+		TransientUnit:   true,
+		Register:        true,
+		KeepUnit:        true,
+		DiskImage:       "/srv/images/web.raw",
+		MachineID:       "0123456789abcdef0123456789abcdef",
+		VirtualEthernet: true,
+		Bind:            []BindMount{{Source: "/srv/data", Target: "/data"}, {Source: "/etc/ssl", ReadOnly: true}},
+		Credential:      []Credential{{Name: "db.password", File: "/run/credentials/db.password"}},
+		Parameters:      []string{"console=ttyS0"},
+		VM:              VM{CPUs: 2, RAM: "960M"},
+	}
+	args, err := transientArgs("nomad-web-1234", taskConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"/usr/bin/systemd-vmspawn", "--quiet", "--machine=nomad-web-1234", "--register=yes", "--keep-unit",
+		"--image=/srv/images/web.raw", "--uuid=0123456789abcdef0123456789abcdef", "--ram=960M", "--cpus=2",
+		"--network-tap", "--bind=/srv/data:/data", "--bind-ro=/etc/ssl",
+		"--load-credential=db.password:/run/credentials/db.password", "--", "console=ttyS0",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+}
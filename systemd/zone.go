@@ -0,0 +1,167 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// zoneIsolationTable is the nftables table which isolates network zones
+// from each other.
+const zoneIsolationTable = "nomad_nspawn_zones"
+
+// zoneIsolationRules drops all traffic forwarded between zone bridges, traffic
+// inside a zone is bridged and not affected.
+var zoneIsolationRules = fmt.Sprintf(`add table inet %[1]s
+add chain inet %[1]s forward { type filter hook forward priority 0; }
+flush chain inet %[1]s forward
+add rule inet %[1]s forward iifname "vz-*" oifname "vz-*" iifname != oifname drop
+`, zoneIsolationTable)
+
+// zoneBridge returns the name of the bridge interface of zone.
+func zoneBridge(zone string) string {
+	return "vz-" + zone
+}
+
+// validateZone checks the zone name, which must fit in an interface name
+// after prefixed by "vz-".
+func validateZone(zone string) error {
+	if zone == "" {
+		return nil
+	}
+	if len(zoneBridge(zone)) > 15 || strings.ContainsAny(zone, "/: ") {
+		return fmt.Errorf("invalid zone %q", zone)
+	}
+	return nil
+}
+
+// zoneStore tracks the number of tasks in every network zone.
+type zoneStore struct {
+	refs map[string]int
+	lock sync.Mutex
+}
+
+func newZoneStore() *zoneStore {
+	return &zoneStore{refs: map[string]int{}}
+}
+
+// Acquire adds a task to the zone, and returns the number of zones in use.
+func (zs *zoneStore) Acquire(zone string) int {
+	zs.lock.Lock()
+	defer zs.lock.Unlock()
+	zs.refs[zone]++
+	return len(zs.refs)
+}
+
+// Release removes a task from the zone, and returns the number of zones in use.
+func (zs *zoneStore) Release(zone string) int {
+	zs.lock.Lock()
+	defer zs.lock.Unlock()
+	if zs.refs[zone] <= 1 {
+		delete(zs.refs, zone)
+	} else {
+		zs.refs[zone]--
+	}
+	return len(zs.refs)
+}
+
+// List returns a snapshot of the number of tasks in every zone.
+func (zs *zoneStore) List() map[string]int {
+	zs.lock.Lock()
+	defer zs.lock.Unlock()
+	refs := make(map[string]int, len(zs.refs))
+	for k, v := range zs.refs {
+		refs[k] = v
+	}
+	return refs
+}
+
+// acquireZone tracks a task joining the zone, and sets up the zone isolation
+// if it's enabled.
+func (d *Driver) acquireZone(zone string) {
+	if zone == "" {
+		return
+	}
+
+	d.zones.Acquire(zone)
+	if !d.loadConfig().ZoneIsolation {
+		return
+	}
+	if err := nft(zoneIsolationRules); err != nil {
+		d.logger.Warn("failed to setup zone isolation", "error", err)
+	}
+}
+
+// releaseZone tracks a task leaving the zone, and removes the zone isolation
+// if no zone is in use.
+func (d *Driver) releaseZone(zone string) {
+	if zone == "" {
+		return
+	}
+
+	if d.zones.Release(zone) > 0 || !d.loadConfig().ZoneIsolation {
+		return
+	}
+	if err := nft(fmt.Sprintf("delete table inet %s\n", zoneIsolationTable)); err != nil {
+		d.logger.Warn("failed to remove zone isolation", "error", err)
+	}
+}
+
+// zoneAttributes returns node attributes of zones in use.
+func (d *Driver) zoneAttributes() map[string]*pstructs.Attribute {
+	attrs := map[string]*pstructs.Attribute{}
+	for zone, n := range d.zones.List() {
+		prefix := "driver.systemd-nspawn.zone." + zone
+		attrs[prefix+".tasks"] = pstructs.NewIntAttribute(int64(n), "")
+
+		iface, err := net.InterfaceByName(zoneBridge(zone))
+		if err != nil {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		var subnets []string
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				subnets = append(subnets, ipnet.String())
+			}
+		}
+		sort.Strings(subnets)
+		attrs[prefix+".subnet"] = pstructs.NewStringAttribute(strings.Join(subnets, ","))
+	}
+	return attrs
+}
+
+// nft applies the nftables script.
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// deleteNFTTable deletes the nftables table. A table which doesn't exist or
+// a host without nft has nothing to delete.
+func deleteNFTTable(table string) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil
+	}
+	err := nft(fmt.Sprintf("delete table inet %s\n", table))
+	if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestZoneStore(t *testing.T) {
+	zs := newZoneStore()
+
+	if n := zs.Acquire("a"); n != 1 {
+		t.Fatalf("expected 1 zone, got %d", n)
+	}
+	zs.Acquire("a")
+	if n := zs.Acquire("b"); n != 2 {
+		t.Fatalf("expected 2 zones, got %d", n)
+	}
+	if refs := zs.List(); refs["a"] != 2 || refs["b"] != 1 {
+		t.Fatalf("unexpected refs: %v", refs)
+	}
+
+	if n := zs.Release("a"); n != 2 {
+		t.Fatalf("expected 2 zones, got %d", n)
+	}
+	zs.Release("a")
+	if n := zs.Release("b"); n != 0 {
+		t.Fatalf("expected 0 zones, got %d", n)
+	}
+}
+
+func TestValidateZone(t *testing.T) {
+	for _, zone := range []string{"", "web", "abcdefghijkl"} {
+		if err := validateZone(zone); err != nil {
+			t.Errorf("zone %q: unexpected error: %v", zone, err)
+		}
+	}
+	for _, zone := range []string{"abcdefghijklm", "a/b", "a b"} {
+		if err := validateZone(zone); err == nil {
+			t.Errorf("zone %q: expected error", zone)
+		}
+	}
+}
+
+func TestDeleteNFTTableWithoutNFT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	if err := deleteNFTTable(portTable("nomad-web-1234")); err != nil {
+		t.Errorf("expected nothing to delete without nft, got %v", err)
+	}
+}